@@ -0,0 +1,140 @@
+package decompile
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"ipsw/internal/decompile"
+)
+
+var addr2lineDir string
+
+func init() {
+	addr2lineCmd.Flags().StringVarP(&addr2lineDir, "output-dir", "o", "decompiled", "Output directory of decompile-project whose source maps addresses are looked up in")
+	Cmd.AddCommand(addr2lineCmd)
+}
+
+// addr2lineCmd maps between lines of generated .m files and addresses in the
+// binary using the .m.map files written next to them.
+var addr2lineCmd = &cobra.Command{
+	Use:   "addr2line <file.m:line | address>...",
+	Short: "Map decompiled source lines to binary addresses and back",
+	Long: `Map decompiled source lines to binary addresses and back.
+
+A <file.m>:<line> argument prints the method the line belongs to, its start
+address and the instructions matched to the line. An address argument, such as
+0x1a2b3c01c, prints the method containing it and the closest line of every .m
+file under --output-dir.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var maps map[string]*decompile.SourceMap
+		for _, arg := range args {
+			if addr, err := strconv.ParseUint(arg, 0, 64); err == nil {
+				if maps == nil {
+					var err error
+					if maps, err = loadSourceMaps(addr2lineDir); err != nil {
+						return err
+					}
+				}
+				lookupAddress(maps, decompile.Address(addr))
+				continue
+			}
+			if err := lookupLine(arg); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+// lookupLine prints what a <file.m>:<line> argument maps to.
+func lookupLine(arg string) error {
+	i := strings.LastIndexByte(arg, ':')
+	if i < 0 {
+		return fmt.Errorf("%q is neither an address nor <file.m>:<line>", arg)
+	}
+	file := arg[:i]
+	line, err := strconv.Atoi(arg[i+1:])
+	if err != nil || line < 1 {
+		return fmt.Errorf("invalid line number in %q", arg)
+	}
+	m, err := decompile.LoadSourceMap(file + decompile.SourceMapExt)
+	if err != nil {
+		return err
+	}
+	fn, addrs, ok := m.Line(line)
+	if !ok {
+		fmt.Printf("%s: not in a decompiled method\n", arg)
+		return nil
+	}
+	if fn.Address == 0 {
+		fmt.Printf("%s: %s in %s, address unknown\n", arg, fn.Symbol, fn.Image)
+		return nil
+	}
+	fmt.Printf("%s: %s in %s at %v\n", arg, fn.Symbol, fn.Image, fn.Address)
+	if len(addrs) == 0 {
+		fmt.Println("  no instructions matched to this line")
+		return nil
+	}
+	for _, addr := range addrs {
+		fmt.Printf("  %v\t%s+%#x\n", addr, fn.Symbol, uint64(addr-fn.Address))
+	}
+	return nil
+}
+
+// lookupAddress prints the methods and lines an address maps to.
+func lookupAddress(maps map[string]*decompile.SourceMap, addr decompile.Address) {
+	found := false
+	for _, file := range sortedFiles(maps) {
+		fn, line, ok := maps[file].Address(addr)
+		if !ok {
+			continue
+		}
+		found = true
+		fmt.Printf("%v: %s+%#x in %s\n  %s:%d\n", addr, fn.Symbol, uint64(addr-fn.Address), fn.Image, file, line)
+	}
+	if !found {
+		fmt.Printf("%v: not in a decompiled method\n", addr)
+	}
+}
+
+// loadSourceMaps reads every .m.map under dir, keyed by the path of its .m
+// file.
+func loadSourceMaps(dir string) (map[string]*decompile.SourceMap, error) {
+	maps := make(map[string]*decompile.SourceMap)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".m"+decompile.SourceMapExt) {
+			return nil
+		}
+		m, err := decompile.LoadSourceMap(path)
+		if err != nil {
+			return err
+		}
+		maps[strings.TrimSuffix(path, decompile.SourceMapExt)] = m
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read source maps in %s: %w", dir, err)
+	}
+	if len(maps) == 0 {
+		return nil, fmt.Errorf("no source maps found in %s", dir)
+	}
+	return maps, nil
+}
+
+func sortedFiles(maps map[string]*decompile.SourceMap) []string {
+	files := make([]string, 0, len(maps))
+	for file := range maps {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	return files
+}
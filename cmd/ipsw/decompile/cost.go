@@ -0,0 +1,68 @@
+package decompile
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"ipsw/internal/decompile"
+)
+
+var (
+	costDBPath string
+	costBy     []string
+)
+
+func init() {
+	costCmd.Flags().StringVar(&costDBPath, "db", "decompile.db", "Path to the SQLite database file")
+	costCmd.Flags().StringSliceVar(&costBy, "by", []string{decompile.CostByRun, decompile.CostByModel, decompile.CostByClass}, "Break spend down by run, model and/or class")
+	Cmd.AddCommand(costCmd)
+}
+
+// costCmd reports the token usage and spend recorded in a database.
+var costCmd = &cobra.Command{
+	Use:   "cost",
+	Short: "Report token usage and spend by run, model and class",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := decompile.OpenTaskStore(costDBPath)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		estimated := false
+		for i, by := range costBy {
+			report, err := store.CostReport(context.Background(), by)
+			if err != nil {
+				return err
+			}
+			if i > 0 {
+				fmt.Println()
+			}
+			tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+			fmt.Fprintf(tw, "%s\ttasks\tprompt tokens\tcompletion tokens\tcost (USD)\t\n", by)
+			var total decompile.CostRow
+			for _, r := range report {
+				mark := ""
+				if r.Estimated {
+					mark, estimated = "*", true
+				}
+				fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%.4f%s\t\n", r.Key, r.Tasks, r.PromptTokens, r.CompletionTokens, r.Cost, mark)
+				total.PromptTokens += r.PromptTokens
+				total.CompletionTokens += r.CompletionTokens
+				total.Cost += r.Cost
+			}
+			fmt.Fprintf(tw, "total\t\t%d\t%d\t%.4f\t\n", total.PromptTokens, total.CompletionTokens, total.Cost)
+			if err := tw.Flush(); err != nil {
+				return err
+			}
+		}
+		if estimated {
+			fmt.Println("\n* includes token counts estimated from text length; the provider did not report usage")
+		}
+		return nil
+	},
+}
@@ -0,0 +1,11 @@
+package decompile
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// Cmd groups the commands that work on an existing decompilation database.
+var Cmd = &cobra.Command{
+	Use:   "decompile",
+	Short: "Inspect the results of decompile-project runs",
+}
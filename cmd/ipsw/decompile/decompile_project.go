@@ -5,9 +5,10 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
-	"path/filepath"
+	"strings"
 	"sync"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -17,25 +18,102 @@ import (
 )
 
 var (
-	inputDir     string
-	outputDir    string
-	concurrency  int
-	batchSize    int
-	litellmURL   string
-	model        string
-	maxRetries   int
-	dbPath       string
+	inputDir    string
+	outputDir   string
+	concurrency int
+	batchSize   int
+	litellmURL  string
+	model       string
+	maxRetries  int
+	dbPath      string
+	rpmLimit    int
+	tpmLimit    int
+	maxInFlight int
+
+	breakerThreshold int
+	breakerCooldown  time.Duration
+
+	routeThresholds string
+	minQuality      float64
+	minFidelity     float64
+
+	ensembleModels   string
+	ensembleStrategy string
+	ensembleJudge    string
+	ensembleClasses  string
+
+	promptDir string
+
+	granularity     string
+	classMaxMethods int
+
+	validateMode  string
+	repairRounds  int
+	acceptInvalid bool
+
+	stream            bool
+	streamIdleTimeout time.Duration
+
+	pricesPath string
+	budget     float64
+
+	dryRun    bool
+	outputTPS float64
+
+	recordDir string
+	replayDir string
+
+	outputLayout string
+
+	baselinePath string
+
+	gitRepo   string
+	gitBranch string
+	gitAuthor string
+	build     string
 )
 
 func init() {
 	DecompileCmd.Flags().StringVarP(&inputDir, "input", "i", "", "Input directory containing assembly files")
 	DecompileCmd.Flags().StringVarP(&outputDir, "output-dir", "o", "decompiled", "Output directory for decompiled source files")
+	DecompileCmd.Flags().StringVar(&outputLayout, "layout", string(decompile.LayoutImage), "Output layout: \"image\" puts each image's files in <output>/<Image>/, \"framework\" adds Headers/ and Sources/ and an umbrella header per image, \"flat\" puts every file in <output>/")
 	DecompileCmd.Flags().IntVarP(&concurrency, "concurrency", "c", 4, "Number of concurrent workers")
 	DecompileCmd.Flags().IntVarP(&batchSize, "batch-size", "b", 10, "Number of tasks to process in a batch")
 	DecompileCmd.Flags().StringVar(&litellmURL, "litellm-url", "http://localhost:4000/v1/chat/completions", "LiteLLM API endpoint URL")
-	DecompileCmd.Flags().StringVar(&model, "model", "ollama/codellama", "AI model to use for decompilation")
+	DecompileCmd.Flags().StringVar(&model, "model", "ollama/codellama", "AI model to use for decompilation, or a fallback chain such as \"ollama/codellama -> gpt-4o-mini -> claude\"")
 	DecompileCmd.Flags().IntVar(&maxRetries, "max-retries", 3, "Maximum number of retries for a failed task")
 	DecompileCmd.Flags().StringVar(&dbPath, "db", "decompile.db", "Path to the SQLite database file")
+	DecompileCmd.Flags().IntVar(&rpmLimit, "rpm", 0, "Maximum AI requests per minute across all workers (0 = unlimited)")
+	DecompileCmd.Flags().IntVar(&tpmLimit, "tpm", 0, "Maximum estimated AI tokens per minute across all workers (0 = unlimited)")
+	DecompileCmd.Flags().IntVar(&maxInFlight, "max-in-flight", 0, "Maximum concurrent AI requests (0 = no limit)")
+	DecompileCmd.Flags().StringVar(&routeThresholds, "route-thresholds", "", "Comma-separated complexity thresholds that route larger methods to later models in the chain, e.g. \"40,200\"")
+	DecompileCmd.Flags().Float64Var(&minQuality, "min-quality", 0.5, "Quality score (0-1) below which a result is escalated to the next model in the chain")
+	DecompileCmd.Flags().Float64Var(&minFidelity, "min-fidelity", 0, "Fidelity score (0-1) between the calls and strings of the assembly and the result below which the result is escalated or retried, e.g. 0.5 (0 = disable)")
+	DecompileCmd.Flags().StringVar(&promptDir, "prompt-dir", "", "Directory with system.tmpl, user.tmpl, class.tmpl, repair.tmpl and examples.json overriding the built-in prompts; <dir>/<model>/ overrides per model")
+	DecompileCmd.Flags().StringVar(&ensembleModels, "ensemble", "", "Comma-separated models to decompile each method with in ensemble mode, e.g. \"gpt-4o,claude\"")
+	DecompileCmd.Flags().StringVar(&ensembleStrategy, "ensemble-strategy", decompile.EnsembleConsensus, "How to pick the ensemble result: syntax, consensus or judge")
+	DecompileCmd.Flags().StringVar(&ensembleJudge, "ensemble-judge", "", "Model that picks the best candidate when --ensemble-strategy=judge")
+	DecompileCmd.Flags().StringVar(&ensembleClasses, "ensemble-classes", "", "Comma-separated classes to decompile in ensemble mode (default: all classes)")
+	DecompileCmd.Flags().StringVar(&granularity, "granularity", "method", "Task granularity: \"method\" decompiles methods in batches, \"class\" decompiles small classes and clusters of related methods as one @implementation")
+	DecompileCmd.Flags().IntVar(&classMaxMethods, "class-max-methods", 12, "Largest class sent as one unit with --granularity=class; bigger classes are split into clusters of related methods")
+	DecompileCmd.Flags().StringVar(&validateMode, "validate", "", "Syntax-check results: builtin, clang (clang -fsyntax-only with stub headers) or auto (clang when installed); empty disables validation")
+	DecompileCmd.Flags().IntVar(&repairRounds, "repair-rounds", 2, "Repair prompts sent with the diagnostics for results that fail validation")
+	DecompileCmd.Flags().BoolVar(&acceptInvalid, "accept-invalid", false, "Keep results that still fail validation after the last repair round, marked invalid, instead of failing them")
+	DecompileCmd.Flags().BoolVar(&stream, "stream", false, "Request streamed (SSE) responses and store each method of a batch as soon as it arrives")
+	DecompileCmd.Flags().DurationVar(&streamIdleTimeout, "stream-idle-timeout", decompile.DefaultStreamIdleTimeout, "Abort a streamed response after this long without data")
+	DecompileCmd.Flags().StringVar(&pricesPath, "prices", "", "JSON file of model prices in USD per million tokens, e.g. {\"gpt-4o\": {\"prompt\": 2.5, \"completion\": 10}}; keys ending in * match model prefixes")
+	DecompileCmd.Flags().Float64Var(&budget, "budget", 0, "Stop the workers once this run has spent this many USD (0 = unlimited)")
+	DecompileCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Scan the input and print the expected requests, tokens, cost and time without calling any model or writing the database")
+	DecompileCmd.Flags().Float64Var(&outputTPS, "output-tps", 40, "Model output speed in tokens per second assumed by --dry-run time estimates")
+	DecompileCmd.Flags().StringVar(&recordDir, "record", "", "Save every AI request and response to this cassette directory")
+	DecompileCmd.Flags().StringVar(&replayDir, "replay", "", "Answer AI requests from this cassette directory instead of the network")
+	DecompileCmd.Flags().StringVar(&baselinePath, "baseline", "", "Database of a previous run, e.g. the last build; methods whose class, selector and normalized assembly match one of its completed methods reuse its result instead of being decompiled")
+	DecompileCmd.Flags().StringVar(&gitRepo, "git", "", "Also commit the assembled output to a branch of this git repository, created as a bare repository if missing")
+	DecompileCmd.Flags().StringVar(&gitBranch, "git-branch", decompile.DefaultGitBranch, "Branch of the --git repository to commit to; it must not be checked out")
+	DecompileCmd.Flags().StringVar(&gitAuthor, "git-author", "ipsw decompile <decompile@ipsw.local>", "Author and committer of --git commits, as \"Name <email>\"")
+	DecompileCmd.Flags().StringVar(&build, "build", "", "Firmware build being decompiled, e.g. \"21A5248v\", named in --git commit messages")
+	DecompileCmd.Flags().IntVar(&breakerThreshold, "breaker-threshold", 5, "Consecutive transport errors before pausing all workers (0 = disable circuit breaker)")
+	DecompileCmd.Flags().DurationVar(&breakerCooldown, "breaker-cooldown", 30*time.Second, "How long the circuit breaker stays open before probing the endpoint again")
 
 	DecompileCmd.MarkFlagRequired("input")
 }
@@ -45,15 +123,126 @@ var DecompileCmd = &cobra.Command{
 	Use:   "decompile-project",
 	Short: "Concurrently decompile a project using an AI model via LiteLLM",
 	RunE: func(cmd *cobra.Command, args []string) error {
+		models, err := decompile.ParseModelChain(model)
+		if err != nil {
+			return err
+		}
+		thresholds, err := decompile.ParseRouteThresholds(routeThresholds)
+		if err != nil {
+			return err
+		}
+		ensemble, err := decompile.ParseEnsembleConfig(ensembleModels, ensembleStrategy, ensembleJudge, ensembleClasses)
+		if err != nil {
+			return err
+		}
+		if granularity != "method" && granularity != "class" {
+			return fmt.Errorf("unknown granularity %q, want \"method\" or \"class\"", granularity)
+		}
+		if granularity == "class" && ensemble != nil {
+			// A unit is answered as one @implementation by a single model.
+			return fmt.Errorf("--ensemble cannot be used with --granularity=class")
+		}
+		layout, err := decompile.ParseLayout(outputLayout)
+		if err != nil {
+			return err
+		}
+		prompts, err := decompile.LoadPromptLibrary(promptDir)
+		if err != nil {
+			return fmt.Errorf("failed to load prompt templates: %w", err)
+		}
+		prices, err := decompile.LoadPriceTable(pricesPath)
+		if err != nil {
+			return err
+		}
+		if recordDir != "" && replayDir != "" {
+			return fmt.Errorf("--record and --replay cannot be used together")
+		}
+		var validator *decompile.Validator
+		if validateMode != "" {
+			validator, err = decompile.NewValidator(validateMode, repairRounds, acceptInvalid)
+			if err != nil {
+				return err
+			}
+			defer validator.Close()
+		}
+		var baseline *decompile.Baseline
+		if baselinePath != "" {
+			baseline, err = decompile.LoadBaseline(context.Background(), baselinePath)
+			if err != nil {
+				return err
+			}
+		}
+
 		fmt.Printf("Starting Odin Decompilation Engine...\n")
 		fmt.Printf("Configuration:\n")
 		fmt.Printf("  - Input Directory: %s\n", inputDir)
-		fmt.Printf("  - Output Directory: %s\n", outputDir)
+		fmt.Printf("  - Output Directory: %s (%s layout)\n", outputDir, layout)
 		fmt.Printf("  - Concurrency: %d\n", concurrency)
 		fmt.Printf("  - Batch Size: %d\n", batchSize)
+		fmt.Printf("  - Granularity: %s\n", granularity)
+		fmt.Printf("  - Models: %s\n", strings.Join(models, " -> "))
+		if ensemble != nil {
+			fmt.Printf("  - Ensemble: %s (%s)\n", strings.Join(ensemble.Models, ", "), ensemble.Strategy)
+		}
+		if validator != nil {
+			fmt.Printf("  - Validation: %s, up to %d repair rounds\n", validateMode, repairRounds)
+		}
+		if budget > 0 {
+			fmt.Printf("  - Budget: $%.2f\n", budget)
+		}
+		if baseline != nil {
+			fmt.Printf("  - Baseline: %s (%d results)\n", baselinePath, baseline.Len())
+		}
+		if recordDir != "" {
+			fmt.Printf("  - Recording to: %s\n", recordDir)
+		} else if replayDir != "" {
+			fmt.Printf("  - Replaying from: %s\n", replayDir)
+		}
 		fmt.Printf("  - Database Path: %s\n", dbPath)
 		fmt.Println("------------------------------------")
 
+		if dryRun {
+			// Nothing is sent to the models and the database is left untouched.
+			scan, err := scanProject(models, thresholds)
+			if err != nil {
+				return err
+			}
+			if baseline != nil {
+				changed := baseline.Filter(scan.tasks, scan.symbols)
+				fmt.Printf("Baseline covers %d of %d methods.\n", len(scan.tasks)-len(changed), len(scan.tasks))
+				scan.tasks = changed
+			}
+			est, err := decompile.EstimateRun(scan.tasks, scan.edges, scan.classes, scan.symbols, decompile.EstimateConfig{
+				Models:                models,
+				BatchSize:             batchSize,
+				Concurrency:           concurrency,
+				Ensemble:              ensemble,
+				Prompts:               prompts,
+				Prices:                prices,
+				RequestsPerMinute:     rpmLimit,
+				TokensPerMinute:       tpmLimit,
+				OutputTokensPerSecond: outputTPS,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to estimate run: %w", err)
+			}
+			printEstimate(est)
+			return nil
+		}
+
+		// Created after the dry run, which must not leave an empty cassette
+		// directory behind.
+		var cassette *decompile.Cassette
+		switch {
+		case recordDir != "":
+			cassette, err = decompile.NewCassette(recordDir, decompile.CassetteRecord)
+		case replayDir != "":
+			cassette, err = decompile.NewCassette(replayDir, decompile.CassetteReplay)
+		}
+		if err != nil {
+			return err
+		}
+
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
 
@@ -84,21 +273,81 @@ var DecompileCmd = &cobra.Command{
 
 		if total == 0 {
 			fmt.Println("First run detected. Scanning for tasks...")
-			// In a real scenario, we would scan inputDir. Here we use mock data.
-			tasks, err := createMockTasks()
+			scan, err := scanProject(models, thresholds)
 			if err != nil {
-				return fmt.Errorf("failed to create mock tasks: %w", err)
+				return err
 			}
+			tasks, edges := scan.tasks, scan.edges
+
 			if err := store.AddTasks(ctx, tasks); err != nil {
 				return fmt.Errorf("failed to add initial tasks: %w", err)
 			}
-			fmt.Printf("Added %d tasks to the database.\n", len(tasks))
+			if err := store.AddClasses(ctx, scan.classes); err != nil {
+				return fmt.Errorf("failed to add class metadata: %w", err)
+			}
+			if err := store.AddProtocols(ctx, scan.protocols); err != nil {
+				return fmt.Errorf("failed to add protocol metadata: %w", err)
+			}
+			for image, symbols := range scan.symbols {
+				if err := store.AddImageSymbols(ctx, image, symbols); err != nil {
+					return fmt.Errorf("failed to add image symbols: %w", err)
+				}
+			}
+			if err := store.AddCallEdges(ctx, edges); err != nil {
+				return fmt.Errorf("failed to add call graph: %w", err)
+			}
+			fmt.Printf("Added %d tasks and %d call edges to the database.\n", len(tasks), len(edges))
 		} else {
 			fmt.Println("Resuming previous session. Resetting in-flight tasks...")
 			if err := store.ResetInFlightTasks(); err != nil {
 				return fmt.Errorf("failed to reset in-flight tasks: %w", err)
 			}
 		}
+		if baseline != nil {
+			reused, err := decompile.ApplyBaseline(ctx, store, baseline)
+			if err != nil {
+				return fmt.Errorf("failed to apply baseline: %w", err)
+			}
+			fmt.Printf("Reused %d results from baseline %s.\n", reused, baselinePath)
+		}
+
+		runID, err := store.StartRun(ctx, budget)
+		if err != nil {
+			return err
+		}
+		runBudget := decompile.NewBudget(budget)
+
+		// All workers share one limiter so the pool as a whole stays within the provider's limits.
+		limiter := decompile.NewRateLimiter(decompile.RateLimitConfig{
+			RequestsPerMinute: rpmLimit,
+			TokensPerMinute:   tpmLimit,
+			MaxInFlight:       maxInFlight,
+		})
+		var breaker *decompile.CircuitBreaker
+		if breakerThreshold > 0 {
+			breaker = decompile.NewCircuitBreaker(breakerThreshold, breakerCooldown)
+		}
+		workerCfg := decompile.WorkerConfig{
+			LiteLLMURL:        litellmURL,
+			Models:            models,
+			MinQuality:        minQuality,
+			MinFidelity:       minFidelity,
+			BatchSize:         batchSize,
+			MaxRetries:        maxRetries,
+			Limiter:           limiter,
+			Breaker:           breaker,
+			Ensemble:          ensemble,
+			Prompts:           prompts,
+			Validator:         validator,
+			Stream:            stream,
+			StreamIdleTimeout: streamIdleTimeout,
+			Prices:            prices,
+			Budget:            runBudget,
+			RunID:             runID,
+		}
+		if cassette != nil {
+			workerCfg.Transport = cassette
+		}
 
 		// Start the worker pool
 		var wg sync.WaitGroup
@@ -109,7 +358,7 @@ var DecompileCmd = &cobra.Command{
 				defer wg.Done()
 				// The decompileWorker function now needs to be public to be accessible here
 				// I will adjust the worker.go file for that.
-				decompile.DecompileWorker(ctx, workerID, store, litellmURL, model, batchSize, maxRetries)
+				decompile.DecompileWorker(ctx, workerID, store, workerCfg)
 			}(i)
 		}
 
@@ -144,70 +393,266 @@ var DecompileCmd = &cobra.Command{
 			}
 		}()
 
-
 		wg.Wait()
+		if !bar.Completed() {
+			// Failed tasks, a spent budget or a shutdown leave the bar short.
+			bar.Abort(false)
+		}
 		p.Wait()
 
+		if runBudget.Exhausted() {
+			fmt.Printf("\nBudget of $%.2f reached ($%.4f spent); run again with a higher --budget to continue.\n", budget, runBudget.Spent())
+		}
+
 		fmt.Println("\nAll workers have finished. Assembling final files...")
-		if err := assembleFiles(store, outputDir); err != nil {
+		files, err := assembleFiles(store, outputDir, layout)
+		if err != nil {
 			return fmt.Errorf("failed to assemble files: %w", err)
 		}
+		if gitRepo != "" {
+			if err := commitFiles(store, files, runID); err != nil {
+				return fmt.Errorf("failed to commit output: %w", err)
+			}
+		}
 
 		fmt.Println("Decompilation process completed successfully.")
 		return nil
 	},
 }
 
+// projectScan is the result of scanning the input: the tasks, routed to
+// their model tiers and grouped into units, and the metadata stored with them.
+type projectScan struct {
+	tasks     []*decompile.Task
+	classes   []*decompile.ClassInfo
+	protocols []*decompile.ProtocolInfo
+	symbols   map[string]*decompile.ImageSymbols
+	edges     []decompile.CallEdge
+}
+
+// scanProject scans the input directory for tasks and prepares them for the
+// queue.
+func scanProject(models decompile.ModelChain, thresholds []int) (*projectScan, error) {
+	// In a real scenario, we would scan inputDir. Here we use mock data.
+	tasks, err := createMockTasks()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create mock tasks: %w", err)
+	}
+	decompile.RouteTasks(tasks, models, thresholds)
+	scan := &projectScan{
+		tasks:     tasks,
+		classes:   createMockClasses(),
+		protocols: createMockProtocols(),
+		symbols:   map[string]*decompile.ImageSymbols{mockImage: createMockSymbols()},
+	}
+
+	// Record who calls whom so callees are decompiled before their callers.
+	scan.edges = decompile.BuildCallGraph(tasks, scan.symbols, scan.classes)
+	if granularity == "class" {
+		decompile.AssignUnits(tasks, scan.edges, classMaxMethods)
+	}
+	return scan, nil
+}
+
+// printEstimate prints the outcome of a dry run.
+func printEstimate(est *decompile.Estimate) {
+	fmt.Printf("Dry run: %d methods in %d requests\n\n", est.Tasks, est.Requests)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "model\trequests\tmethods\tprompt tokens\tcompletion tokens\tcost (USD)\t\n")
+	var unpriced []string
+	for _, m := range est.Models {
+		cost := fmt.Sprintf("%.4f", m.Cost)
+		if !m.Priced {
+			cost = "?"
+			unpriced = append(unpriced, m.Model)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%s\t\n", m.Model, m.Requests, m.Methods, m.PromptTokens, m.CompletionTokens, cost)
+	}
+	fmt.Fprintf(tw, "total\t%d\t\t%d\t%d\t%.4f\t\n", est.Requests, est.PromptTokens, est.CompletionTokens, est.Cost)
+	tw.Flush()
+
+	fmt.Printf("\nEstimated time: %s at the current concurrency and rate limits\n", est.Duration.Round(time.Second))
+	if len(unpriced) > 0 {
+		fmt.Printf("No price for %s; pass --prices to include them in the cost\n", strings.Join(unpriced, ", "))
+	}
+	fmt.Println("Repair rounds, retries and escalations are not included.")
+}
+
+// mockImage is the image all mock tasks are scanned from.
+const mockImage = "/System/Library/PrivateFrameworks/CMCapture.framework/CMCapture"
+
 // createMockTasks simulates scanning the input directory and creating tasks.
 // Replace this with actual file scanning logic.
 func createMockTasks() ([]*decompile.Task, error) {
 	return []*decompile.Task{
-		{ClassName: "CMCapture", SymbolName: "-[CMCaptureController startCapture]", AssemblyCode: "asm for startCapture..."},
-		{ClassName: "CMCapture", SymbolName: "-[CMCaptureController stopCapture]", AssemblyCode: "asm for stopCapture..."},
-		{ClassName: "CMCapture", SymbolName: "-[CMCaptureController setZoom:]", AssemblyCode: "asm for setZoom..."},
-		{ClassName: "CMWhatever", SymbolName: "-[CMWhatever doSomething]", AssemblyCode: "asm for doSomething..."},
-		{ClassName: "CMWhatever", SymbolName: "-[CMWhatever doSomethingElse]", AssemblyCode: "asm for doSomethingElse..."},
+		{ClassName: "CMCapture", SymbolName: "-[CMCaptureController startCapture]", Image: mockImage, Address: 0x1a2b3c000, AssemblyCode: `0x1a2b3c000:  stp x20, x19, [sp, #-0x20]!
+0x1a2b3c004:  stp x29, x30, [sp, #0x10]
+0x1a2b3c008:  mov x19, x0
+0x1a2b3c00c:  ldr x0, [x0, #0x18]
+0x1a2b3c010:  adrp x8, 0x1f5c23000
+0x1a2b3c014:  ldr x1, [x8, #0x5c8]
+0x1a2b3c018:  bl _objc_msgSend
+0x1a2b3c01c:  mov w8, #0x1
+0x1a2b3c020:  strb w8, [x19, #0x10]
+0x1a2b3c024:  adrp x8, 0x1f5c24000
+0x1a2b3c028:  ldr x0, [x8, #0x100]
+0x1a2b3c02c:  adrp x2, 0x1e0000000
+0x1a2b3c030:  add x2, x2, #0x1a0
+0x1a2b3c034:  ldp x29, x30, [sp, #0x10]
+0x1a2b3c038:  ldp x20, x19, [sp], #0x20
+0x1a2b3c03c:  b _objc_msgSend$postNotificationName:object:`},
+		{ClassName: "CMCapture", SymbolName: "-[CMCaptureController stopCapture]", Image: mockImage, Address: 0x1a2b3c100, AssemblyCode: `0x1a2b3c100:  stp x20, x19, [sp, #-0x20]!
+0x1a2b3c104:  stp x29, x30, [sp, #0x10]
+0x1a2b3c108:  mov x19, x0
+0x1a2b3c10c:  adrp x8, 0x1f5c23000
+0x1a2b3c110:  ldr x1, [x8, #0x5d0]
+0x1a2b3c114:  fmov d0, #1.00000000
+0x1a2b3c118:  bl _objc_msgSend
+0x1a2b3c11c:  strb wzr, [x19, #0x10]
+0x1a2b3c120:  ldp x29, x30, [sp, #0x10]
+0x1a2b3c124:  ldp x20, x19, [sp], #0x20
+0x1a2b3c128:  ret`},
+		{ClassName: "CMCapture", SymbolName: "-[CMCaptureController setZoom:]", Image: mockImage, AssemblyCode: "asm for setZoom..."},
+		{ClassName: "CMWhatever", SymbolName: "-[CMWhatever doSomething]", Image: mockImage, AssemblyCode: "asm for doSomething..."},
+		{ClassName: "CMWhatever", SymbolName: "-[CMWhatever doSomethingElse]", Image: mockImage, AssemblyCode: "asm for doSomethingElse..."},
 	}, nil
 }
 
+// createMockSymbols simulates the selector, class and string references the
+// scanner resolves for an image. Replace this with the image's real
+// __objc_selrefs, __objc_classrefs, __cfstring and __cstring contents.
+func createMockSymbols() *decompile.ImageSymbols {
+	syms := decompile.NewImageSymbols()
+	syms.Selrefs[0x1f5c235c8] = "startRunning"
+	syms.Selrefs[0x1f5c235d0] = "setZoom:"
+	syms.Classrefs[0x1f5c24100] = "NSNotificationCenter"
+	syms.CFStrings[0x1e00001a0] = "capture.started"
+	return syms
+}
+
+// createMockClasses simulates the runtime metadata the scanner records for
+// each class, used to give the model context about ivars, properties and
+// method types. Replace this with metadata read from the input.
+func createMockClasses() []*decompile.ClassInfo {
+	return []*decompile.ClassInfo{
+		{
+			Name:       "CMCaptureController",
+			Image:      mockImage,
+			Superclass: "NSObject",
+			Protocols:  []string{"AVCaptureVideoDataOutputSampleBufferDelegate"},
+			Ivars: []decompile.IvarInfo{
+				{Name: "_running", Offset: 0x10, Type: "B"},
+				{Name: "_session", Offset: 0x18, Type: `@"AVCaptureSession"`},
+				{Name: "_zoomFactor", Offset: 0x20, Type: "d"},
+			},
+			Properties: []decompile.PropertyInfo{
+				{Name: "session", Attributes: `T@"AVCaptureSession",&,N,V_session`},
+				{Name: "running", Attributes: "TB,R,N,GisRunning,V_running"},
+			},
+			Methods: []decompile.MethodInfo{
+				{Selector: "startCapture", Types: "v16@0:8"},
+				{Selector: "stopCapture", Types: "v16@0:8"},
+				{Selector: "setZoom:", Types: "v24@0:8d16"},
+			},
+		},
+		{
+			Name:       "CMWhatever",
+			Image:      mockImage,
+			Superclass: "NSObject",
+			Protocols:  []string{"CMCaptureObserver"},
+			Methods: []decompile.MethodInfo{
+				{Selector: "doSomething", Types: "v16@0:8"},
+				{Selector: "doSomethingElse", Types: "B16@0:8"},
+			},
+		},
+	}
+}
+
+// createMockProtocols simulates the protocol metadata the scanner records.
+// Replace this with metadata read from the input.
+func createMockProtocols() []*decompile.ProtocolInfo {
+	return []*decompile.ProtocolInfo{
+		{
+			Name:      "CMCaptureObserver",
+			Image:     mockImage,
+			Protocols: []string{"NSObject"},
+			Methods: []decompile.MethodInfo{
+				{Selector: "captureControllerDidStart:", Types: `v24@0:8@"CMCaptureController"16`},
+			},
+			OptionalMethods: []decompile.MethodInfo{
+				{Selector: "captureController:didFailWithError:", Types: `v32@0:8@"CMCaptureController"16@"NSError"24`},
+			},
+		},
+	}
+}
+
 // assembleFiles reads all successful tasks from the database and writes them
-// into .m files, organized by class name.
-func assembleFiles(store *decompile.TaskStore, outputDir string) error {
+// into .m files, organized by class name, with their source maps, next to a
+// header for every scanned class and protocol, placed according to layout.
+// Running it again rewrites only the files whose content changed. It returns
+// the files it assembled.
+func assembleFiles(store *decompile.TaskStore, outputDir string, layout decompile.Layout) ([]decompile.OutputFile, error) {
 	tasks, err := store.GetAllCompletedTasks()
 	if err != nil {
-		return fmt.Errorf("could not fetch completed tasks: %w", err)
+		return nil, fmt.Errorf("could not fetch completed tasks: %w", err)
+	}
+	ctx := context.Background()
+	classes, err := store.GetAllClasses(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch class metadata: %w", err)
+	}
+	protocols, err := store.GetAllProtocols(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch protocol metadata: %w", err)
 	}
 
-	files := make(map[string]*os.File)
-	defer func() {
-		for _, f := range files {
-			f.Close()
-		}
-	}()
-
+	// The symbols resolve calls and literals for the source maps.
+	symbols := make(map[string]*decompile.ImageSymbols)
 	for _, task := range tasks {
-		if !task.DecompiledSource.Valid {
-			continue // Skip tasks with no decompiled source
+		if _, ok := symbols[task.Image]; ok || task.Image == "" {
+			continue
 		}
-
-		fileName := fmt.Sprintf("%s.m", task.ClassName)
-		filePath := filepath.Join(outputDir, fileName)
-
-		f, ok := files[filePath]
-		if !ok {
-			f, err = os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-			if err != nil {
-				return fmt.Errorf("failed to open file %s: %w", filePath, err)
-			}
-			files[filePath] = f
+		if symbols[task.Image], err = store.GetImageSymbols(ctx, task.Image); err != nil {
+			return nil, fmt.Errorf("could not fetch symbols of %s: %w", task.Image, err)
 		}
+	}
 
-		header := fmt.Sprintf("\n// Decompiled symbol: %s\n", task.SymbolName)
-		if _, err := f.WriteString(header + task.DecompiledSource.String + "\n"); err != nil {
-			return fmt.Errorf("failed to write to file %s: %w", filePath, err)
-		}
+	headers := decompile.RenderHeaders(classes, protocols, layout)
+	files := append(decompile.RenderSources(tasks, classes, symbols, layout), headers...)
+	stats, err := decompile.WriteOutput(outputDir, files)
+	if err != nil {
+		return nil, err
 	}
 
-	fmt.Printf("Successfully assembled %d tasks into .m files in %s\n", len(tasks), outputDir)
+	fmt.Printf("Assembled %d tasks into .m files and %d headers in %s: %d written, %d unchanged, %d stale removed\n",
+		len(tasks), len(headers), outputDir, stats.Written, stats.Unchanged, stats.Removed)
+	return files, nil
+}
+
+// commitFiles commits the assembled files to --git-branch of the --git
+// repository, with the build, models and task counts in the message.
+func commitFiles(store *decompile.TaskStore, files []decompile.OutputFile, runID int64) error {
+	var stats decompile.CommitStats
+	err := store.ForEachTask(context.Background(), false, func(task *decompile.Task) error {
+		stats.Add(task)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	id, committed, err := decompile.CommitOutput(gitRepo, files, decompile.GitCommit{
+		Branch:  gitBranch,
+		Author:  gitAuthor,
+		Time:    time.Now(),
+		Message: stats.Message(build, runID),
+	})
+	if err != nil {
+		return err
+	}
+	if !committed {
+		fmt.Printf("Output unchanged since commit %.12s on %s of %s; nothing to commit.\n", id, gitBranch, gitRepo)
+		return nil
+	}
+	fmt.Printf("Committed %d files to %s of %s as %.12s.\n", len(files), gitBranch, gitRepo, id)
 	return nil
-}
\ No newline at end of file
+}
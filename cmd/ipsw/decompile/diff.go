@@ -0,0 +1,66 @@
+package decompile
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"ipsw/internal/decompile"
+)
+
+var (
+	diffHTML  string
+	diffTitle string
+)
+
+func init() {
+	diffCmd.Flags().StringVar(&diffHTML, "html", "", "Directory to write the diff to as a static HTML page instead of printing it")
+	diffCmd.Flags().StringVar(&diffTitle, "title", "", "Title of the HTML page (default: the names of both runs)")
+	Cmd.AddCommand(diffCmd)
+}
+
+// diffCmd compares the decompiled methods of two runs.
+var diffCmd = &cobra.Command{
+	Use:   "diff <db-or-project-A> <db-or-project-B>",
+	Short: "Diff decompiled output between two builds",
+	Long: `Diff decompiled output between two builds.
+
+Each argument is a SQLite database, a decompile-project directory holding a
+decompile.db, or a .jsonl or .json file written by 'ipsw decompile export'.
+Methods are matched by image, class and selector. Methods whose assembly hashes are
+equal are skipped as unchanged; for the others a unified diff of the
+decompiled source is shown. Added and removed methods are listed.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := context.Background()
+		old, err := decompile.LoadRun(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		new, err := decompile.LoadRun(ctx, args[1])
+		if err != nil {
+			return err
+		}
+		d := decompile.DiffRuns(filepath.Clean(args[0]), old, filepath.Clean(args[1]), new)
+
+		if diffHTML == "" {
+			return d.WriteText(os.Stdout)
+		}
+		title := diffTitle
+		if title == "" {
+			title = d.Old + " → " + d.New
+		}
+		files, err := decompile.RenderHTMLDiff(title, d)
+		if err != nil {
+			return err
+		}
+		if _, err := decompile.WriteOutput(diffHTML, files); err != nil {
+			return err
+		}
+		fmt.Printf("Wrote diff of %d changed, %d added and %d removed methods to %s\n",
+			len(d.Changed), len(d.Added), len(d.Removed), filepath.Join(diffHTML, "index.html"))
+		return nil
+	},
+}
@@ -0,0 +1,88 @@
+package decompile
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+	"ipsw/internal/decompile"
+)
+
+var (
+	exportDBPath string
+	exportFormat string
+	exportOutput string
+	exportAll    bool
+)
+
+func init() {
+	exportCmd.Flags().StringVar(&exportDBPath, "db", "decompile.db", "Path to the SQLite database file")
+	exportCmd.Flags().StringVarP(&exportFormat, "format", "f", decompile.ExportJSONL, "Output format: jsonl or json")
+	exportCmd.Flags().StringVarP(&exportOutput, "output", "o", "-", "File to write the export to, - for stdout")
+	exportCmd.Flags().BoolVar(&exportAll, "all", false, "Export every task, not only completed ones")
+	Cmd.AddCommand(exportCmd)
+}
+
+// exportCmd streams the tasks of a database as JSON records.
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export decompiled methods as JSON Lines or JSON",
+	Long: `Export decompiled methods as JSON Lines or JSON.
+
+Each record is one method with its class, symbol, image, address, assembly
+hash, model, prompt version, source, validation status and timestamps. Tasks
+are streamed from the database, so exports of any size run in constant
+memory. Only completed methods are exported unless --all is given.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		store, err := decompile.OpenTaskStore(exportDBPath)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		var out io.Writer = os.Stdout
+		if exportOutput != "-" {
+			f, err := os.Create(exportOutput)
+			if err != nil {
+				return fmt.Errorf("failed to create export file: %w", err)
+			}
+			defer func() {
+				if cerr := f.Close(); err == nil {
+					err = cerr
+				}
+			}()
+			out = f
+		}
+		bw := bufio.NewWriter(out)
+		w, err := decompile.NewExportWriter(bw, exportFormat)
+		if err != nil {
+			return err
+		}
+		// The store allows one connection, so symbols are read before
+		// iterating over the tasks.
+		symbols, err := store.AllImageSymbols(context.Background())
+		if err != nil {
+			return err
+		}
+		err = store.ForEachTask(context.Background(), !exportAll, func(task *decompile.Task) error {
+			return w.Write(decompile.NewExportRecord(task, symbols[task.Image]))
+		})
+		if err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+		if exportOutput != "-" {
+			fmt.Fprintf(os.Stderr, "Exported %d methods to %s\n", w.Count(), exportOutput)
+		}
+		return nil
+	},
+}
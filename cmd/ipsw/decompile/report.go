@@ -0,0 +1,79 @@
+package decompile
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"ipsw/internal/decompile"
+)
+
+var (
+	reportDBPath string
+	reportHTML   string
+	reportTitle  string
+)
+
+func init() {
+	reportCmd.Flags().StringVar(&reportDBPath, "db", "decompile.db", "Path to the SQLite database file")
+	reportCmd.Flags().StringVar(&reportHTML, "html", "", "Directory to write the static HTML report to")
+	reportCmd.Flags().StringVar(&reportTitle, "title", "", "Title of the report (default: the database file name)")
+	reportCmd.MarkFlagRequired("html")
+	Cmd.AddCommand(reportCmd)
+}
+
+// reportCmd writes a browsable report of the tasks in a database.
+var reportCmd = &cobra.Command{
+	Use:   "report",
+	Short: "Write a static HTML report of a decompilation run",
+	Long: `Write a static HTML report of a decompilation run.
+
+The report has an index of classes with their progress and fidelity, a list of
+failed and missing methods with their errors, and a page per class showing
+each method's annotated assembly next to its decompiled source. It needs no
+server: open index.html or copy the directory anywhere.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := decompile.OpenTaskStore(reportDBPath)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		ctx := context.Background()
+		tasks, err := store.GetAllTasks(ctx)
+		if err != nil {
+			return err
+		}
+		classes, err := store.GetAllClasses(ctx)
+		if err != nil {
+			return err
+		}
+		symbols := make(map[string]*decompile.ImageSymbols)
+		for _, task := range tasks {
+			if _, ok := symbols[task.Image]; ok || task.Image == "" {
+				continue
+			}
+			if symbols[task.Image], err = store.GetImageSymbols(ctx, task.Image); err != nil {
+				return err
+			}
+		}
+
+		title := reportTitle
+		if title == "" {
+			title = filepath.Base(reportDBPath)
+		}
+		files, err := decompile.RenderHTMLReport(title, tasks, classes, symbols)
+		if err != nil {
+			return err
+		}
+		stats, err := decompile.WriteOutput(reportHTML, files)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Wrote report of %d tasks to %s: %d written, %d unchanged, %d stale removed\n",
+			len(tasks), filepath.Join(reportHTML, "index.html"), stats.Written, stats.Unchanged, stats.Removed)
+		return nil
+	},
+}
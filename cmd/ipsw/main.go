@@ -18,6 +18,7 @@ and includes advanced features like the Odin decompilation engine.`,
 func init() {
 	// Add the decompile-project command to the root command.
 	rootCmd.AddCommand(decompile.DecompileCmd)
+	rootCmd.AddCommand(decompile.Cmd)
 }
 
 func main() {
@@ -0,0 +1,475 @@
+package decompile
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ImageSymbols holds the addresses the annotation pass resolves for an image:
+// selector references (__objc_selrefs), class references (__objc_classrefs),
+// CFString literals (__cfstring), C strings (__cstring) and named functions.
+type ImageSymbols struct {
+	Selrefs   map[uint64]string
+	Classrefs map[uint64]string
+	CFStrings map[uint64]string
+	CStrings  map[uint64]string
+	Functions map[uint64]string
+}
+
+// Symbol kinds as stored in the image_symbols table.
+const (
+	SymbolSelref   = "selref"
+	SymbolClassref = "classref"
+	SymbolCFString = "cfstring"
+	SymbolCString  = "cstring"
+	SymbolFunction = "function"
+)
+
+// NewImageSymbols returns an empty symbol table.
+func NewImageSymbols() *ImageSymbols {
+	return &ImageSymbols{
+		Selrefs:   make(map[uint64]string),
+		Classrefs: make(map[uint64]string),
+		CFStrings: make(map[uint64]string),
+		CStrings:  make(map[uint64]string),
+		Functions: make(map[uint64]string),
+	}
+}
+
+// byKind returns the map holding symbols of the given kind.
+func (s *ImageSymbols) byKind(kind string) map[uint64]string {
+	switch kind {
+	case SymbolSelref:
+		return s.Selrefs
+	case SymbolClassref:
+		return s.Classrefs
+	case SymbolCFString:
+		return s.CFStrings
+	case SymbolCString:
+		return s.CStrings
+	case SymbolFunction:
+		return s.Functions
+	}
+	return nil
+}
+
+// regKind describes what the annotation pass knows about a register.
+type regKind int
+
+const (
+	regUnknown  regKind = iota
+	regAddress          // a plain address, e.g. the page loaded by adrp
+	regSelf             // self on entry to an instance method
+	regClass            // a class object loaded from a classref
+	regSelector         // a selector loaded from a selref
+	regString           // a CFString or C string literal
+)
+
+type regValue struct {
+	kind regKind
+	addr uint64
+	name string
+}
+
+// AsmCall is a call site found in a method's disassembly.
+type AsmCall struct {
+	Line int
+	// Function is the callee of a direct call, without the leading
+	// underscore, e.g. "objc_retain". It is empty for message sends.
+	Function string
+	// TargetAddress is the callee address of a "bl 0x..." call, if any.
+	TargetAddress uint64
+	// Selector, Receiver and ClassMessage describe a message send. Selector
+	// is empty if it could not be resolved, Receiver if the receiver's class
+	// is unknown.
+	Selector     string
+	Receiver     string
+	ClassMessage bool
+	Super        bool
+	Self         bool
+}
+
+// IsMessageSend reports whether the call is an objc_msgSend variant.
+func (c AsmCall) IsMessageSend() bool {
+	return c.Function == "" && c.TargetAddress == 0
+}
+
+// AsmString is a CFString or C-string literal loaded by the disassembly.
+type AsmString struct {
+	Line  int
+	Value string
+	CF    bool
+}
+
+// AsmAnalysis is the result of the static pass over a method's disassembly.
+type AsmAnalysis struct {
+	Lines []string
+	// Addresses maps line indexes to instruction addresses for listings
+	// that include them.
+	Addresses map[int]uint64
+	Calls     []AsmCall
+	Strings   []AsmString
+	notes     map[int]string
+	// unresolvedAddresses counts addresses computed with adr or adrp and
+	// add that the image's symbols don't name, any of which may be a string.
+	unresolvedAddresses int
+}
+
+func (a *AsmAnalysis) note(line int, text string) {
+	if text != "" {
+		a.notes[line] = text
+	}
+}
+
+// Annotated returns the listing with each note appended as a comment.
+func (a *AsmAnalysis) Annotated() string {
+	lines := make([]string, len(a.Lines))
+	for i, line := range a.Lines {
+		lines[i] = appendNote(line, a.notes[i])
+	}
+	return strings.Join(lines, "\n")
+}
+
+// AnnotateAssembly adds inline comments to ARM64 disassembly for the things a
+// model would otherwise have to guess: the selector and receiver of each
+// objc_msgSend call, class and selector loads, string literals, calls to
+// known functions and, given class metadata, ivar accesses relative to self.
+//
+//	bl _objc_msgSend           ; -[? setZoom:]
+//	add x2, x2, #0x1a0         ; @"capture.started"
+//	ldr x8, [x0, #0x18]        ; self->_session
+//
+// syms and class may be nil.
+func AnnotateAssembly(asm string, syms *ImageSymbols, class *ClassInfo, classMethod bool) string {
+	return AnalyzeAssembly(asm, syms, class, classMethod).Annotated()
+}
+
+// AnalyzeAssembly runs the static pass behind AnnotateAssembly and returns
+// the call sites and literals it resolved. Registers are tracked linearly
+// through the listing without following branches, which is enough for the
+// straight-line setup code before calls. syms and class may be nil.
+func AnalyzeAssembly(asm string, syms *ImageSymbols, class *ClassInfo, classMethod bool) *AsmAnalysis {
+	if syms == nil {
+		syms = NewImageSymbols()
+	}
+	regs := make(map[string]regValue)
+	if !classMethod && class != nil {
+		regs["x0"] = regValue{kind: regSelf, name: class.Name}
+	}
+
+	a := &AsmAnalysis{
+		Lines:     strings.Split(asm, "\n"),
+		Addresses: make(map[int]uint64),
+		notes:     make(map[int]string),
+	}
+	local := localTargets(a.Lines)
+	for i, line := range a.Lines {
+		if addr, ok := instructionAddress(line); ok {
+			a.Addresses[i] = addr
+		}
+		mnemonic, operands := splitInstruction(line)
+		if mnemonic == "" {
+			continue
+		}
+		ops := splitOperands(operands)
+
+		switch mnemonic {
+		case "adrp", "adr":
+			if len(ops) == 2 {
+				if addr, ok := parseImmediate(ops[1]); ok {
+					dst := regName(ops[0])
+					regs[dst] = regValue{kind: regAddress, addr: addr}
+					// adrp only yields a page, which is resolved by the following add or ldr.
+					if mnemonic == "adr" {
+						a.note(i, a.describeAddress(i, syms, addr, regs, dst))
+					}
+					continue
+				}
+			}
+		case "add":
+			if len(ops) == 3 {
+				base, ok := regs[regName(ops[1])]
+				imm, immOK := parseImmediate(ops[2])
+				if ok && immOK && base.kind == regAddress {
+					addr := base.addr + imm
+					dst := regName(ops[0])
+					regs[dst] = regValue{kind: regAddress, addr: addr}
+					a.note(i, a.describeAddress(i, syms, addr, regs, dst))
+					continue
+				}
+			}
+		case "ldr", "ldur", "ldrb", "ldrh", "ldrsb", "ldrsh", "ldrsw":
+			if len(ops) >= 2 {
+				baseReg, offset, ok := parseMemOperand(ops[1])
+				if ok {
+					base := regs[baseReg]
+					dst := regName(ops[0])
+					note := ""
+					switch base.kind {
+					case regAddress:
+						addr := base.addr + offset
+						if sel, ok := syms.Selrefs[addr]; ok {
+							regs[dst] = regValue{kind: regSelector, name: sel}
+							note = "@selector(" + sel + ")"
+						} else if cls, ok := syms.Classrefs[addr]; ok {
+							regs[dst] = regValue{kind: regClass, name: cls}
+							note = "[" + cls + " class]"
+						} else {
+							delete(regs, dst)
+						}
+						a.note(i, note)
+						continue
+					case regSelf:
+						if ivar, ok := class.IvarAt(offset); ok {
+							note = "self->" + ivar.Name
+						}
+						delete(regs, dst)
+						a.note(i, note)
+						continue
+					}
+				}
+			}
+		case "str", "stur", "strb", "strh":
+			// Stores don't change registers; note ivar writes through self.
+			if len(ops) >= 2 {
+				if baseReg, offset, ok := parseMemOperand(ops[1]); ok && regs[baseReg].kind == regSelf {
+					if ivar, ok := class.IvarAt(offset); ok {
+						a.note(i, "self->"+ivar.Name+" = ...")
+					}
+				}
+			}
+			continue
+		case "stp":
+			continue
+		case "ldp":
+			if len(ops) >= 2 {
+				delete(regs, regName(ops[0]))
+				delete(regs, regName(ops[1]))
+			}
+			continue
+		case "mov":
+			if len(ops) == 2 {
+				if src, ok := regs[regName(ops[1])]; ok {
+					regs[regName(ops[0])] = src
+				} else {
+					delete(regs, regName(ops[0]))
+				}
+				continue
+			}
+		case "bl", "b", "blr", "br":
+			// A plain b is a tail call only when it leaves the function;
+			// jumps to its own labels are loops and early exits.
+			if len(ops) == 1 && (mnemonic != "b" || local.tailCall(syms, ops[0])) {
+				if call, note, ok := resolveCall(syms, ops[0], regs); ok {
+					call.Line = i
+					a.Calls = append(a.Calls, call)
+					a.note(i, note)
+				}
+			}
+			if mnemonic == "bl" || mnemonic == "blr" {
+				// Caller-saved registers don't survive the call.
+				for r := 0; r <= 18; r++ {
+					delete(regs, fmt.Sprintf("x%d", r))
+				}
+			}
+			continue
+		}
+
+		// Any other instruction overwrites its first operand.
+		if len(ops) > 0 {
+			delete(regs, regName(ops[0]))
+		}
+	}
+	return a
+}
+
+// branchTargets describes the labels and address range of a listing, which
+// a b instruction can jump to without leaving the function.
+type branchTargets struct {
+	labels   map[string]bool
+	lo, hi   uint64
+	hasRange bool
+}
+
+func localTargets(lines []string) branchTargets {
+	t := branchTargets{labels: make(map[string]bool)}
+	for _, line := range lines {
+		if addr, ok := instructionAddress(line); ok {
+			if !t.hasRange || addr < t.lo {
+				t.lo = addr
+			}
+			t.hi = max(t.hi, addr)
+			t.hasRange = true
+		}
+		if fields := strings.Fields(line); len(fields) > 0 && strings.HasSuffix(fields[0], ":") && !strings.HasPrefix(fields[0], "0x") {
+			t.labels[strings.TrimSuffix(fields[0], ":")] = true
+		}
+	}
+	return t
+}
+
+// tailCall reports whether the target of a b instruction is a symbol or stub
+// outside the function: a known function address beyond the listing, or a
+// symbol name such as _objc_msgSend$start or sub_1a2b3c that isn't one of
+// the listing's labels.
+func (t branchTargets) tailCall(syms *ImageSymbols, target string) bool {
+	if addr, ok := parseImmediate(target); ok {
+		_, known := syms.Functions[addr]
+		return known && (!t.hasRange || addr < t.lo || addr > t.hi)
+	}
+	if t.labels[target] {
+		return false
+	}
+	return strings.HasPrefix(target, "_") || strings.HasPrefix(target, "sub_") || strings.HasPrefix(target, "j_")
+}
+
+// resolveCall describes a branch target. Message sends get their selector
+// and receiver, other calls the callee's name. Register branches and
+// unknown addresses yield ok=false.
+func resolveCall(syms *ImageSymbols, target string, regs map[string]regValue) (call AsmCall, note string, ok bool) {
+	if strings.HasPrefix(regName(target), "x") {
+		if _, err := strconv.Atoi(regName(target)[1:]); err == nil {
+			return AsmCall{}, "", false
+		}
+	}
+	name := strings.TrimPrefix(target, "_")
+	if addr, isAddr := parseImmediate(target); isAddr {
+		fn, known := syms.Functions[addr]
+		if !known {
+			return AsmCall{TargetAddress: addr}, "", true
+		}
+		name = strings.TrimPrefix(fn, "_")
+		if !strings.HasPrefix(name, "objc_msgSend") {
+			return AsmCall{Function: name, TargetAddress: addr}, fn, true
+		}
+	}
+
+	switch {
+	case strings.HasPrefix(name, "objc_msgSend$"):
+		// Selector stubs carry the selector in their name.
+		call.Selector = strings.TrimPrefix(name, "objc_msgSend$")
+	case name == "objc_msgSend" || name == "objc_msgSendSuper2":
+		if r := regs["x1"]; r.kind == regSelector {
+			call.Selector = r.name
+		}
+	default:
+		return AsmCall{Function: name}, "", true
+	}
+
+	sel := call.Selector
+	if sel == "" {
+		sel = "?"
+	}
+	receiver := regs["x0"]
+	switch {
+	case name == "objc_msgSendSuper2":
+		call.Super = true
+		return call, "[super " + sel + "]", true
+	case receiver.kind == regClass:
+		call.Receiver, call.ClassMessage = receiver.name, true
+		return call, "+[" + receiver.name + " " + sel + "]", true
+	case receiver.kind == regSelf:
+		call.Receiver, call.Self = receiver.name, true
+		return call, "-[" + receiver.name + " " + sel + "] (self)", true
+	}
+	return call, "-[? " + sel + "]", true
+}
+
+// describeAddress annotates an address that was just materialized into reg
+// if it points at a known literal, and records the literal in regs.
+func (a *AsmAnalysis) describeAddress(line int, syms *ImageSymbols, addr uint64, regs map[string]regValue, reg string) string {
+	if s, ok := syms.CFStrings[addr]; ok {
+		regs[reg] = regValue{kind: regString, addr: addr, name: s}
+		a.Strings = append(a.Strings, AsmString{Line: line, Value: s, CF: true})
+		return "@" + strconv.Quote(s)
+	}
+	if s, ok := syms.CStrings[addr]; ok {
+		regs[reg] = regValue{kind: regString, addr: addr, name: s}
+		a.Strings = append(a.Strings, AsmString{Line: line, Value: s})
+		return strconv.Quote(s)
+	}
+	if fn, ok := syms.Functions[addr]; ok {
+		return fn
+	}
+	a.unresolvedAddresses++
+	return ""
+}
+
+func appendNote(line, note string) string {
+	if note == "" {
+		return line
+	}
+	return strings.TrimRight(line, " \t") + " ; " + note
+}
+
+// splitOperands splits an operand list on commas outside brackets.
+func splitOperands(s string) []string {
+	var ops []string
+	depth, start := 0, 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ',':
+			if depth == 0 {
+				ops = append(ops, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	if rest := strings.TrimSpace(s[start:]); rest != "" {
+		ops = append(ops, rest)
+	}
+	return ops
+}
+
+// instructionAddress parses the address a listing line starts with, as in
+// "0x1a2b3c000:  mov x19, x0".
+func instructionAddress(line string) (uint64, bool) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], "0x") {
+		return 0, false
+	}
+	return parseImmediate(strings.TrimSuffix(fields[0], ":"))
+}
+
+// regName normalizes a register operand so w8 and x8 are tracked together.
+func regName(op string) string {
+	op = strings.ToLower(strings.TrimSpace(op))
+	if len(op) > 1 && op[0] == 'w' && op[1] >= '0' && op[1] <= '9' {
+		return "x" + op[1:]
+	}
+	return op
+}
+
+// parseImmediate parses "#0x18", "#24", "0x1f5c23000" or "24".
+func parseImmediate(op string) (uint64, bool) {
+	op = strings.TrimPrefix(strings.TrimSpace(op), "#")
+	if op == "" {
+		return 0, false
+	}
+	v, err := strconv.ParseUint(op, 0, 64)
+	return v, err == nil
+}
+
+// parseMemOperand parses "[x8, #0x5c8]", "[x8, #0x5c8]!" or "[x8]" into the
+// base register and immediate offset.
+func parseMemOperand(op string) (string, uint64, bool) {
+	op = strings.TrimSuffix(strings.TrimSpace(op), "!")
+	if !strings.HasPrefix(op, "[") || !strings.HasSuffix(op, "]") {
+		return "", 0, false
+	}
+	parts := strings.Split(op[1:len(op)-1], ",")
+	base := regName(parts[0])
+	if len(parts) == 1 {
+		return base, 0, true
+	}
+	if len(parts) != 2 {
+		return "", 0, false
+	}
+	offset, ok := parseImmediate(parts[1])
+	return base, offset, ok
+}
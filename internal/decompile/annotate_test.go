@@ -0,0 +1,96 @@
+package decompile
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAnnotateAssembly(t *testing.T) {
+	syms := NewImageSymbols()
+	syms.Selrefs[0x1f5c235c8] = "startRunning"
+	syms.Classrefs[0x1f5c24100] = "NSNotificationCenter"
+	syms.CFStrings[0x1e00001a0] = "capture.started"
+
+	class := &ClassInfo{
+		Name:  "CMCaptureController",
+		Ivars: []IvarInfo{{Name: "_running", Offset: 0x10, Type: "B"}, {Name: "_session", Offset: 0x18, Type: `@"AVCaptureSession"`}},
+	}
+
+	asm := `0x1000:  mov x19, x0
+0x1004:  ldr x0, [x0, #0x18]
+0x1008:  adrp x8, 0x1f5c23000
+0x100c:  ldr x1, [x8, #0x5c8]
+0x1010:  bl _objc_msgSend
+0x1014:  strb w8, [x19, #0x10]
+0x1018:  adrp x8, 0x1f5c24000
+0x101c:  ldr x0, [x8, #0x100]
+0x1020:  bl _objc_msgSend$defaultCenter
+0x1024:  adrp x2, 0x1e0000000
+0x1028:  add x2, x2, #0x1a0
+0x102c:  bl _objc_msgSend`
+
+	got := strings.Split(AnnotateAssembly(asm, syms, class, false), "\n")
+	want := map[int]string{
+		1:  "; self->_session",
+		3:  "; @selector(startRunning)",
+		4:  "; -[? startRunning]",
+		5:  "; self->_running = ...",
+		7:  "; [NSNotificationCenter class]",
+		8:  "; +[NSNotificationCenter defaultCenter]",
+		10: `; @"capture.started"`,
+		11: "; -[? ?]",
+	}
+	for line, suffix := range want {
+		if !strings.HasSuffix(got[line], suffix) {
+			t.Errorf("line %d = %q, want suffix %q", line, got[line], suffix)
+		}
+	}
+	if strings.Contains(got[0], ";") {
+		t.Errorf("line 0 should not be annotated: %q", got[0])
+	}
+}
+
+func TestBuildCallGraph(t *testing.T) {
+	syms := NewImageSymbols()
+	syms.Selrefs[0x2008] = "helper:"
+	syms.Selrefs[0x2010] = "reset"
+	syms.Classrefs[0x3000] = "B"
+	syms.Functions[0x5000] = "_objc_msgSend"
+
+	tasks := []*Task{
+		{SymbolName: "-[A foo]", Image: "img", AssemblyCode: `adrp x8, 0x2000
+ldr x1, [x8, #0x8]
+bl _objc_msgSend
+adrp x8, 0x3000
+ldr x0, [x8]
+bl _objc_msgSend$reset
+bl 0x4000
+bl _objc_msgSend$foo`},
+		{SymbolName: "-[A helper:]", Image: "img", AssemblyCode: `mov x0, x2
+adrp x8, 0x2000
+ldr x1, [x8, #0x10]
+bl 0x5000`},
+		{SymbolName: "+[B reset]", Image: "img", AssemblyCode: "ret"},
+		{SymbolName: "-[C reset]", Image: "img", AssemblyCode: "ret"},
+		{SymbolName: "_cleanup", Image: "img", Address: 0x4000, AssemblyCode: "ret"},
+		// The same class in another image must not capture img's calls.
+		{SymbolName: "-[A helper:]", Image: "other", AssemblyCode: "ret"},
+	}
+	classes := []*ClassInfo{{Name: "A", Image: "img"}}
+
+	got := BuildCallGraph(tasks, map[string]*ImageSymbols{"img": syms}, classes)
+	want := []CallEdge{
+		{Caller: "-[A foo]", Callee: "+[B reset]", CallerImage: "img", CalleeImage: "img"},
+		{Caller: "-[A foo]", Callee: "-[A helper:]", CallerImage: "img", CalleeImage: "img"},
+		{Caller: "-[A foo]", Callee: "_cleanup", CallerImage: "img", CalleeImage: "img"},
+		{Caller: "-[A helper:]", Callee: "-[C reset]", CallerImage: "img", CalleeImage: "img"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("BuildCallGraph = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("edge %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
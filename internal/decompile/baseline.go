@@ -0,0 +1,108 @@
+package decompile
+
+import (
+	"context"
+	"fmt"
+)
+
+// Baseline holds the accepted results of a previous run, such as the last
+// firmware build, keyed by method and normalized assembly.
+type Baseline struct {
+	results map[string]*Task
+}
+
+// LoadBaseline reads the completed tasks of a baseline database.
+func LoadBaseline(ctx context.Context, path string) (*Baseline, error) {
+	store, err := OpenTaskStore(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open baseline: %w", err)
+	}
+	defer store.Close()
+
+	symbols, err := store.AllImageSymbols(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read baseline: %w", err)
+	}
+	b := &Baseline{results: make(map[string]*Task)}
+	err = store.ForEachTask(ctx, true, func(task *Task) error {
+		if key := baselineKey(task, symbols[task.Image]); key != "" {
+			task.AssemblyCode = "" // only needed for the key
+			b.results[key] = task
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read baseline: %w", err)
+	}
+	return b, nil
+}
+
+// Len returns the number of results the baseline can reuse.
+func (b *Baseline) Len() int {
+	return len(b.results)
+}
+
+// Match returns the baseline's result for a method with the same class,
+// selector and assembly hash as task, or nil if it has none. Methods are
+// matched like DiffRuns matches them, so results survive a method moving to
+// another category or address. syms are the symbols of the task's image.
+func (b *Baseline) Match(task *Task, syms *ImageSymbols) *Task {
+	key := baselineKey(task, syms)
+	if key == "" {
+		return nil
+	}
+	return b.results[key]
+}
+
+// Filter returns the tasks the baseline has no result for. symbols holds the
+// symbols of the tasks' images, keyed by image.
+func (b *Baseline) Filter(tasks []*Task, symbols map[string]*ImageSymbols) []*Task {
+	var changed []*Task
+	for _, task := range tasks {
+		if b.Match(task, symbols[task.Image]) == nil {
+			changed = append(changed, task)
+		}
+	}
+	return changed
+}
+
+// ApplyBaseline completes every pending task of store that the baseline has
+// a result for with a copy of that result, so only new and changed methods
+// are left for the workers. It returns the number of tasks completed.
+func ApplyBaseline(ctx context.Context, store *TaskStore, b *Baseline) (int, error) {
+	symbols, err := store.AllImageSymbols(ctx)
+	if err != nil {
+		return 0, err
+	}
+	reuse := make(map[int64]*Task)
+	err = store.ForEachTask(ctx, false, func(task *Task) error {
+		if task.Status != StatusPending {
+			return nil
+		}
+		if result := b.Match(task, symbols[task.Image]); result != nil {
+			reuse[task.ID] = result
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := store.ReuseResults(ctx, reuse); err != nil {
+		return 0, err
+	}
+	return len(reuse), nil
+}
+
+// baselineKey identifies a method and its code, or is "" for a task without
+// assembly.
+func baselineKey(task *Task, syms *ImageSymbols) string {
+	hash := AssemblyHash(task.AssemblyCode, syms)
+	if hash == "" {
+		return ""
+	}
+	key := task.SymbolName
+	if sym, ok := ParseSymbol(task.SymbolName); ok {
+		key = diffKey(&ExportRecord{Class: sym.Class, Selector: sym.Selector, ClassMethod: sym.ClassMethod})
+	}
+	return key + " " + hash
+}
@@ -0,0 +1,101 @@
+package decompile
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestApplyBaseline(t *testing.T) {
+	ctx := context.Background()
+	const start = "0x1a2b3c000:  adrp x8, 0x1f5c23000\n0x1a2b3c004:  ldr x1, [x8, #0x5c8]\n0x1a2b3c008:  b _objc_msgSend"
+	const stop = "0x1a2b3c100:  strb wzr, [x0, #0x10]\n0x1a2b3c104:  ret"
+
+	path := filepath.Join(t.TempDir(), "17.0.db")
+	old, err := NewTaskStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = old.AddTasks(ctx, []*Task{
+		{ClassName: "CMCaptureController", SymbolName: "-[CMCaptureController(Capture) startCapture]", AssemblyCode: start},
+		{ClassName: "CMCaptureController", SymbolName: "-[CMCaptureController stopCapture]", AssemblyCode: stop},
+		{ClassName: "CMCaptureController", SymbolName: "-[CMCaptureController reset]", AssemblyCode: "ret"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tasks, err := old.GetAllTasks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, task := range tasks {
+		if strings.Contains(task.SymbolName, "reset") {
+			continue // never decompiled, so nothing to reuse
+		}
+		err := old.UpdateTaskSuccess(ctx, task.ID, "source of "+task.SymbolName, ResultInfo{
+			Model: "gpt-4o", PromptVersion: "v3", Summary: "summary", Validation: "valid",
+			Fidelity: &Fidelity{Score: 0.5, Missing: []string{"@selector(x)"}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	old.Close()
+
+	baseline, err := LoadBaseline(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if baseline.Len() != 2 {
+		t.Fatalf("baseline has %d results, want 2", baseline.Len())
+	}
+
+	store := setupTestDB(t)
+	defer store.Close()
+	moved := strings.NewReplacer("0x1a2b3c", "0x1b000", "0x1f5c23000", "0x1f6000000", "#0x5c8", "#0x010").Replace(start)
+	err = store.AddTasks(ctx, []*Task{
+		// Moved out of its category and relocated, but the same code.
+		{ClassName: "CMCaptureController", SymbolName: "-[CMCaptureController startCapture]", AssemblyCode: moved},
+		{ClassName: "CMCaptureController", SymbolName: "-[CMCaptureController stopCapture]", AssemblyCode: strings.Replace(stop, "#0x10", "#0x18", 1)},
+		{ClassName: "CMCaptureController", SymbolName: "-[CMCaptureController reset]", AssemblyCode: "ret"},
+		{ClassName: "CMCaptureController", SymbolName: "-[CMCaptureController pause]", AssemblyCode: start},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending, _ := store.GetAllTasks(ctx)
+	if got := len(baseline.Filter(pending, nil)); got != 3 {
+		t.Errorf("Filter left %d tasks, want 3", got)
+	}
+
+	reused, err := ApplyBaseline(ctx, store, baseline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reused != 1 {
+		t.Errorf("reused %d results, want 1", reused)
+	}
+	all, err := store.GetAllTasks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, task := range all {
+		isStart := task.SymbolName == "-[CMCaptureController startCapture]"
+		if (task.Status == StatusCompleted) != isStart {
+			t.Errorf("%s is %s", task.SymbolName, task.Status)
+		}
+		if !isStart {
+			continue
+		}
+		if task.DecompiledSource.String != "source of -[CMCaptureController(Capture) startCapture]" || task.Model.String != "gpt-4o" ||
+			task.PromptVersion.String != "v3" || task.Summary.String != "summary" || task.Validation.String != "valid" ||
+			task.Fidelity.Float64 != 0.5 || !strings.Contains(task.FidelityIssues.String, "@selector(x)") {
+			t.Errorf("reused result not copied: %+v", task)
+		}
+	}
+
+	if _, err := LoadBaseline(ctx, filepath.Join(t.TempDir(), "missing.db")); err == nil {
+		t.Error("LoadBaseline of a missing database succeeded")
+	}
+}
@@ -0,0 +1,162 @@
+package decompile
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of a CircuitBreaker.
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"
+	BreakerOpen     BreakerState = "open"
+	BreakerHalfOpen BreakerState = "half_open"
+)
+
+// TransportError reports that the provider could not be reached at all, as
+// opposed to answering with something unusable. Only transport errors count
+// towards opening the circuit breaker.
+type TransportError struct {
+	Err error
+}
+
+func (e *TransportError) Error() string { return e.Err.Error() }
+
+func (e *TransportError) Unwrap() error { return e.Err }
+
+// CircuitBreaker pauses the whole worker pool while the AI endpoint is down.
+// After threshold consecutive transport errors it opens and workers stop
+// claiming tasks. Once the cooldown has passed a single worker is let through
+// as a probe; its outcome either closes the breaker or re-opens it for another
+// cooldown. A nil *CircuitBreaker never opens.
+type CircuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+	changed  chan struct{}
+}
+
+// NewCircuitBreaker creates a closed breaker.
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		state:     BreakerClosed,
+		changed:   make(chan struct{}),
+	}
+}
+
+// State returns the current state of the breaker.
+func (b *CircuitBreaker) State() BreakerState {
+	if b == nil {
+		return BreakerClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Wait blocks until the caller may claim work. It reports probe=true when the
+// caller is the single worker allowed through a half-open breaker; that worker
+// must then call RecordSuccess, RecordFailure or CancelProbe.
+func (b *CircuitBreaker) Wait(ctx context.Context) (probe bool, err error) {
+	if b == nil {
+		return false, nil
+	}
+	for {
+		b.mu.Lock()
+		var wait <-chan time.Time
+		switch b.state {
+		case BreakerClosed:
+			b.mu.Unlock()
+			return false, nil
+		case BreakerOpen:
+			remaining := time.Until(b.openedAt.Add(b.cooldown))
+			if remaining <= 0 {
+				b.setState(BreakerHalfOpen)
+				b.probing = true
+				b.mu.Unlock()
+				return true, nil
+			}
+			wait = time.After(remaining)
+		case BreakerHalfOpen:
+			if !b.probing {
+				b.probing = true
+				b.mu.Unlock()
+				return true, nil
+			}
+		}
+		changed := b.changed
+		b.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-wait:
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+}
+
+// RecordSuccess notes that the provider answered. It resets the failure count
+// and closes the breaker if it was probing.
+func (b *CircuitBreaker) RecordSuccess() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.probing = false
+	if b.state != BreakerClosed {
+		log.Printf("Circuit breaker: endpoint recovered, resuming workers")
+		b.setState(BreakerClosed)
+	}
+}
+
+// RecordFailure notes a transport error. It opens the breaker once the
+// threshold is reached, or immediately if a probe failed.
+func (b *CircuitBreaker) RecordFailure() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.probing = false
+	if b.state == BreakerHalfOpen || (b.state == BreakerClosed && b.failures >= b.threshold) {
+		log.Printf("Circuit breaker: opening after %d consecutive transport errors, next probe in %s", b.failures, b.cooldown)
+		b.openedAt = time.Now()
+		b.setState(BreakerOpen)
+	}
+}
+
+// CancelProbe gives up a probe slot without a verdict, for example when the
+// probing worker found no tasks to send. Another worker may then probe.
+func (b *CircuitBreaker) CancelProbe() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerHalfOpen && b.probing {
+		b.probing = false
+		close(b.changed)
+		b.changed = make(chan struct{})
+	}
+}
+
+// setState switches state and wakes every waiting worker. b.mu must be held.
+func (b *CircuitBreaker) setState(state BreakerState) {
+	b.state = state
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
@@ -0,0 +1,56 @@
+package decompile
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker_OpensAndProbes(t *testing.T) {
+	b := NewCircuitBreaker(2, 10*time.Millisecond)
+
+	b.RecordFailure()
+	if got := b.State(); got != BreakerClosed {
+		t.Fatalf("expected breaker to stay closed below threshold, got %s", got)
+	}
+	b.RecordFailure()
+	if got := b.State(); got != BreakerOpen {
+		t.Fatalf("expected breaker to open at threshold, got %s", got)
+	}
+
+	probe, err := b.Wait(context.Background())
+	if err != nil {
+		t.Fatalf("wait failed: %v", err)
+	}
+	if !probe {
+		t.Fatal("expected the first worker after cooldown to be the probe")
+	}
+
+	// While the probe is outstanding nobody else gets through.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := b.Wait(ctx); err == nil {
+		t.Fatal("expected second worker to block while probing")
+	}
+
+	b.RecordSuccess()
+	if got := b.State(); got != BreakerClosed {
+		t.Fatalf("expected successful probe to close breaker, got %s", got)
+	}
+	if probe, err := b.Wait(context.Background()); err != nil || probe {
+		t.Fatalf("expected closed breaker to admit workers freely, got probe=%v err=%v", probe, err)
+	}
+}
+
+func TestCircuitBreaker_FailedProbeReopens(t *testing.T) {
+	b := NewCircuitBreaker(1, time.Millisecond)
+	b.RecordFailure()
+
+	if probe, _ := b.Wait(context.Background()); !probe {
+		t.Fatal("expected probe after cooldown")
+	}
+	b.RecordFailure()
+	if got := b.State(); got != BreakerOpen {
+		t.Fatalf("expected failed probe to re-open breaker, got %s", got)
+	}
+}
@@ -0,0 +1,148 @@
+package decompile
+
+import (
+	"sort"
+	"strings"
+)
+
+// CallEdge is a static call from one method to another, by symbol name and
+// image, so same-named classes in two images are told apart.
+type CallEdge struct {
+	Caller      string
+	Callee      string
+	CallerImage string
+	CalleeImage string
+}
+
+// CalleeSummary is what a caller's prompt is told about a callee that has
+// already been decompiled.
+type CalleeSummary struct {
+	SymbolName string `json:"symbol_name"`
+	Signature  string `json:"signature"`
+	Summary    string `json:"summary,omitempty"`
+}
+
+// methodKey identifies an Objective-C method implementation independently of
+// the category it was declared in.
+type methodKey struct {
+	class       string
+	selector    string
+	classMethod bool
+}
+
+// BuildCallGraph finds the calls between the given tasks using the same
+// static pass as the prompt annotations. Message sends are resolved when the
+// receiver is self, a class object or super; sends to an unknown receiver are
+// linked to a method of the caller's own class with that selector or, failing
+// that, to the only task implementing it. Direct calls are linked by address
+// or function name. A symbol defined in several images resolves to the one
+// in the caller's image. Recursive calls are dropped. symbols is keyed by
+// image path; it and classes may be missing entries.
+func BuildCallGraph(tasks []*Task, symbols map[string]*ImageSymbols, classes []*ClassInfo) []CallEdge {
+	classInfo := indexClasses(classes)
+	methods := make(map[methodKey][]*Task)
+	implementers := make(map[string][]*Task) // instance selector -> tasks
+	functions := make(map[string][]*Task)
+	addresses := make(map[uint64][]*Task)
+	for _, task := range tasks {
+		if task.Address != 0 {
+			addresses[task.Address] = append(addresses[task.Address], task)
+		}
+		sym, ok := ParseSymbol(task.SymbolName)
+		if !ok {
+			name := strings.TrimPrefix(task.SymbolName, "_")
+			functions[name] = append(functions[name], task)
+			continue
+		}
+		key := methodKey{sym.Class, sym.Selector, sym.ClassMethod}
+		methods[key] = append(methods[key], task)
+		if !sym.ClassMethod {
+			implementers[sym.Selector] = append(implementers[sym.Selector], task)
+		}
+	}
+
+	seen := make(map[CallEdge]bool)
+	var edges []CallEdge
+	for _, task := range tasks {
+		sym, isMethod := ParseSymbol(task.SymbolName)
+		class := classInfo.lookup(taskClass(task))
+		analysis := AnalyzeAssembly(task.AssemblyCode, symbols[task.Image], class, sym.ClassMethod)
+		for _, call := range analysis.Calls {
+			var callee *Task
+			switch {
+			case call.TargetAddress != 0 && len(addresses[call.TargetAddress]) > 0:
+				callee = inImage(addresses[call.TargetAddress], task.Image)
+			case !call.IsMessageSend():
+				callee = inImage(functions[call.Function], task.Image)
+			case call.Selector == "":
+			case call.Super:
+				if class != nil {
+					callee = inImage(methods[methodKey{class.Superclass, call.Selector, sym.ClassMethod}], task.Image)
+				}
+			case call.Receiver != "":
+				callee = inImage(methods[methodKey{call.Receiver, call.Selector, call.ClassMessage}], task.Image)
+			default:
+				if isMethod {
+					callee = inImage(methods[methodKey{sym.Class, call.Selector, false}], task.Image)
+				}
+				if callee == nil {
+					callee = inImage(implementers[call.Selector], task.Image)
+				}
+			}
+
+			if callee == nil || callee == task {
+				continue
+			}
+			edge := CallEdge{Caller: task.SymbolName, Callee: callee.SymbolName, CallerImage: task.Image, CalleeImage: callee.Image}
+			if seen[edge] {
+				continue
+			}
+			seen[edge] = true
+			edges = append(edges, edge)
+		}
+	}
+
+	sort.Slice(edges, func(i, j int) bool {
+		a, b := edges[i], edges[j]
+		if a.Caller != b.Caller {
+			return a.Caller < b.Caller
+		}
+		if a.CallerImage != b.CallerImage {
+			return a.CallerImage < b.CallerImage
+		}
+		if a.Callee != b.Callee {
+			return a.Callee < b.Callee
+		}
+		return a.CalleeImage < b.CalleeImage
+	})
+	return edges
+}
+
+// inImage picks the callee among the tasks defining a symbol: the only one
+// in the caller's image or, if the image has none, the only one anywhere.
+// Anything else is ambiguous and yields nil.
+func inImage(tasks []*Task, image string) *Task {
+	var match *Task
+	for _, task := range tasks {
+		if task.Image == image {
+			if match != nil {
+				return nil
+			}
+			match = task
+		}
+	}
+	if match == nil && len(tasks) == 1 {
+		match = tasks[0]
+	}
+	return match
+}
+
+// signatureOf returns the declaration a decompiled method or function starts
+// with, i.e. everything before its opening brace on a single line.
+func signatureOf(source string) string {
+	head, _, found := strings.Cut(stripComments(source), "{")
+	if !found {
+		return ""
+	}
+	return strings.Join(strings.Fields(head), " ")
+}
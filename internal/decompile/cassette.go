@@ -0,0 +1,211 @@
+package decompile
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Cassette modes accepted by NewCassette.
+const (
+	// CassetteRecord forwards requests to the network and saves every
+	// request/response pair.
+	CassetteRecord = "record"
+	// CassetteReplay serves saved responses without touching the network.
+	CassetteReplay = "replay"
+)
+
+// cassetteHeaders are the response headers worth keeping; the rest describe
+// the connection rather than the answer.
+var cassetteHeaders = []string{
+	"Content-Type",
+	"Retry-After",
+	"X-Ratelimit-Remaining-Requests",
+	"X-Ratelimit-Remaining-Tokens",
+	"X-Ratelimit-Reset-Requests",
+	"X-Ratelimit-Reset-Tokens",
+}
+
+// Cassette is an http.RoundTripper that records chat completions to a
+// directory or replays them from it. Exchanges are keyed by a hash of the
+// canonicalized request body, so the endpoint URL doesn't matter on replay.
+// Identical requests sent several times are recorded in order and replayed in
+// the same order, the last one repeating.
+type Cassette struct {
+	dir  string
+	mode string
+	next http.RoundTripper
+
+	mu   sync.Mutex
+	seen map[string]int
+}
+
+// cassetteEntry is one recorded exchange as stored on disk.
+type cassetteEntry struct {
+	Request json.RawMessage     `json:"request"`
+	Status  int                 `json:"status"`
+	Header  map[string][]string `json:"header,omitempty"`
+	Body    string              `json:"body"`
+}
+
+// NewCassette opens a cassette directory, creating it when recording.
+func NewCassette(dir, mode string) (*Cassette, error) {
+	switch mode {
+	case CassetteRecord:
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create cassette directory: %w", err)
+		}
+	case CassetteReplay:
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("cassette directory %s not found", dir)
+		}
+	default:
+		return nil, fmt.Errorf("unknown cassette mode %q", mode)
+	}
+	return &Cassette{dir: dir, mode: mode, next: http.DefaultTransport, seen: make(map[string]int)}, nil
+}
+
+// RoundTrip implements http.RoundTripper.
+func (c *Cassette) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, fmt.Errorf("failed to read request body: %w", err)
+		}
+		req.Body.Close()
+	}
+	canonical, key := requestKey(body)
+
+	c.mu.Lock()
+	n := c.seen[key]
+	c.seen[key]++
+	c.mu.Unlock()
+
+	if c.mode == CassetteReplay {
+		return c.replay(req, key, n)
+	}
+
+	forwarded := req.Clone(req.Context())
+	forwarded.Body = io.NopCloser(bytes.NewReader(body))
+	forwarded.ContentLength = int64(len(body))
+	resp, err := c.next.RoundTrip(forwarded)
+	if err != nil {
+		return nil, err
+	}
+	entry := cassetteEntry{Request: canonical, Status: resp.StatusCode, Header: make(map[string][]string)}
+	for _, h := range cassetteHeaders {
+		if v := resp.Header.Values(h); len(v) > 0 {
+			entry.Header[h] = v
+		}
+	}
+	// The exchange is saved once the caller has read the whole body, so
+	// streamed responses still reach the caller as they arrive.
+	path := c.path(key, n)
+	resp.Body = &recordingBody{ReadCloser: resp.Body, done: func(data []byte) error {
+		entry.Body = string(data)
+		out, err := json.MarshalIndent(entry, "", "  ")
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(path, out, 0644)
+	}}
+	return resp, nil
+}
+
+// replay serves the nth recording of a request, or the last one if it was
+// sent fewer times when recording. A request that was never recorded gets a
+// 404 naming its key.
+func (c *Cassette) replay(req *http.Request, key string, n int) (*http.Response, error) {
+	var data []byte
+	var err error
+	for ; n >= 0; n-- {
+		if data, err = os.ReadFile(c.path(key, n)); !errors.Is(err, os.ErrNotExist) {
+			break
+		}
+	}
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to read cassette: %w", err)
+		}
+		msg := fmt.Sprintf("no recorded response for request %s in %s", key, c.dir)
+		return &http.Response{
+			StatusCode: http.StatusNotFound,
+			Status:     "404 Not Found",
+			Header:     http.Header{"Content-Type": {"text/plain"}},
+			Body:       io.NopCloser(bytes.NewReader([]byte(msg))),
+			Request:    req,
+		}, nil
+	}
+	var entry cassetteEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, fmt.Errorf("failed to parse cassette %s: %w", c.path(key, n), err)
+	}
+	return &http.Response{
+		StatusCode:    entry.Status,
+		Status:        fmt.Sprintf("%d %s", entry.Status, http.StatusText(entry.Status)),
+		Header:        http.Header(entry.Header),
+		Body:          io.NopCloser(bytes.NewReader([]byte(entry.Body))),
+		ContentLength: int64(len(entry.Body)),
+		Request:       req,
+	}, nil
+}
+
+func (c *Cassette) path(key string, n int) string {
+	return filepath.Join(c.dir, fmt.Sprintf("%s-%d.json", key, n))
+}
+
+// requestKey canonicalizes a JSON request body, so field order and
+// whitespace don't matter, and returns it with its hash.
+func requestKey(body []byte) (json.RawMessage, string) {
+	canonical := body
+	var v any
+	if err := json.Unmarshal(body, &v); err == nil {
+		// Maps are marshalled with sorted keys.
+		if out, err := json.Marshal(v); err == nil {
+			canonical = out
+		}
+	}
+	sum := sha256.Sum256(canonical)
+	if !json.Valid(canonical) {
+		canonical, _ = json.Marshal(string(body))
+	}
+	return canonical, hex.EncodeToString(sum[:8])
+}
+
+// recordingBody copies a response body as it is read and hands the copy to
+// done once the body has been read to the end. Closing the body reads
+// whatever the caller left, such as the newline after a JSON document.
+type recordingBody struct {
+	io.ReadCloser
+	buf  bytes.Buffer
+	done func([]byte) error
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	if err == io.EOF && b.done != nil {
+		if err := b.done(b.buf.Bytes()); err != nil {
+			log.Printf("Failed to save cassette: %v", err)
+		}
+		b.done = nil
+	}
+	return n, err
+}
+
+func (b *recordingBody) Close() error {
+	if b.done != nil {
+		io.Copy(io.Discard, b)
+	}
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,74 @@
+package decompile
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCassette_RecordAndReplay(t *testing.T) {
+	dir := t.TempDir()
+	source := "- (void)foo {\n}"
+	run := func(url string, cassette *Cassette) []*Task {
+		t.Helper()
+		store := setupTestDB(t)
+		defer store.Close()
+		ctx := context.Background()
+		if err := store.AddTasks(ctx, []*Task{{ClassName: "A", SymbolName: "-[A foo]", AssemblyCode: "ret"}}); err != nil {
+			t.Fatalf("failed to add tasks: %v", err)
+		}
+		DecompileWorker(ctx, 0, store, WorkerConfig{
+			LiteLLMURL: url,
+			Models:     ModelChain{"test-model"},
+			BatchSize:  10,
+			MaxRetries: 1,
+			Transport:  cassette,
+		})
+		tasks, err := store.GetAllCompletedTasks()
+		if err != nil {
+			t.Fatalf("get completed tasks failed: %v", err)
+		}
+		return tasks
+	}
+
+	fake := &fakeLiteLLM{replies: []string{
+		resultsJSON(t, DecompiledResult{SymbolName: "-[A foo]", DecompiledSource: source, Success: true}),
+	}}
+	server := httptest.NewServer(fake)
+	recorder, err := NewCassette(dir, CassetteRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tasks := run(server.URL, recorder); len(tasks) != 1 {
+		t.Fatalf("recording run completed %d tasks, want 1", len(tasks))
+	}
+	server.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) != 1 {
+		t.Fatalf("expected one recorded exchange, got %v", files)
+	}
+
+	// The server is gone; only the cassette can answer.
+	player, err := NewCassette(dir, CassetteReplay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tasks := run(server.URL, player)
+	if len(tasks) != 1 || tasks[0].DecompiledSource.String != source {
+		t.Fatalf("replay did not reproduce the recorded result: %+v", tasks)
+	}
+
+	// A request that was never recorded is answered with its key.
+	if err := os.Remove(files[0]); err != nil {
+		t.Fatal(err)
+	}
+	player, _ = NewCassette(dir, CassetteReplay)
+	_, _, err = callChat(context.Background(), player, server.URL, "test-model", []ChatMessage{{Role: "user", Content: "hi"}}, nil)
+	if err == nil || !strings.Contains(err.Error(), "no recorded response") {
+		t.Errorf("got %v, want a missing recording error", err)
+	}
+}
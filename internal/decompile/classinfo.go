@@ -0,0 +1,393 @@
+package decompile
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ClassInfo is the Objective-C runtime metadata scanned for a class.
+type ClassInfo struct {
+	Name       string         `json:"name"`
+	Image      string         `json:"image,omitempty"`
+	Superclass string         `json:"superclass,omitempty"`
+	Protocols  []string       `json:"protocols,omitempty"`
+	Ivars      []IvarInfo     `json:"ivars,omitempty"`
+	Properties []PropertyInfo `json:"properties,omitempty"`
+	Methods    []MethodInfo   `json:"methods,omitempty"`
+}
+
+// classKey identifies a class by image and name, since two images may each
+// define a class of the same name.
+type classKey struct {
+	image string
+	name  string
+}
+
+// taskClass returns the key of the class a task's method belongs to.
+func taskClass(task *Task) classKey {
+	return classKey{task.Image, classOf(task)}
+}
+
+// classIndex looks up class metadata by image and name.
+type classIndex struct {
+	byKey  map[classKey]*ClassInfo
+	byName map[string][]*ClassInfo
+}
+
+func indexClasses(classes []*ClassInfo) classIndex {
+	idx := classIndex{byKey: make(map[classKey]*ClassInfo, len(classes)), byName: make(map[string][]*ClassInfo)}
+	for _, c := range classes {
+		idx.byKey[classKey{c.Image, c.Name}] = c
+		idx.byName[c.Name] = append(idx.byName[c.Name], c)
+	}
+	return idx
+}
+
+// lookup returns the metadata of a class, or nil if there is none. A class
+// of another image is used when it is the only one of that name, as for a
+// category extending a class of another image.
+func (idx classIndex) lookup(key classKey) *ClassInfo {
+	if c := idx.byKey[key]; c != nil {
+		return c
+	}
+	if named := idx.byName[key.name]; len(named) == 1 {
+		return named[0]
+	}
+	return nil
+}
+
+// IvarInfo describes an instance variable and where it lives in the object.
+type IvarInfo struct {
+	Name   string `json:"name"`
+	Offset uint64 `json:"offset"`
+	Type   string `json:"type"` // type encoding, e.g. @"AVCaptureSession"
+}
+
+// PropertyInfo describes a declared property by its runtime attribute string,
+// e.g. T@"AVCaptureSession",&,N,V_session.
+type PropertyInfo struct {
+	Name       string `json:"name"`
+	Attributes string `json:"attributes"`
+}
+
+// MethodInfo describes a method and its type encoding, e.g. v24@0:8d16.
+type MethodInfo struct {
+	Selector    string `json:"selector"`
+	Types       string `json:"types"`
+	ClassMethod bool   `json:"class_method,omitempty"`
+}
+
+// IvarAt returns the instance variable at the given offset, if any.
+func (c *ClassInfo) IvarAt(offset uint64) (IvarInfo, bool) {
+	for _, ivar := range c.Ivars {
+		if ivar.Offset == offset {
+			return ivar, true
+		}
+	}
+	return IvarInfo{}, false
+}
+
+// Context renders the class as an annotated @interface for prompts. Ivars
+// list their offsets so loads relative to self can be mapped to names.
+func (c *ClassInfo) Context() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "@interface %s", c.Name)
+	if c.Superclass != "" {
+		fmt.Fprintf(&b, " : %s", c.Superclass)
+	}
+	if len(c.Protocols) > 0 {
+		fmt.Fprintf(&b, " <%s>", strings.Join(c.Protocols, ", "))
+	}
+	b.WriteString(" {\n")
+
+	ivars := append([]IvarInfo(nil), c.Ivars...)
+	sort.Slice(ivars, func(i, j int) bool { return ivars[i].Offset < ivars[j].Offset })
+	for _, ivar := range ivars {
+		fmt.Fprintf(&b, "    %s; // offset 0x%x\n", declare(DecodeType(ivar.Type), ivar.Name), ivar.Offset)
+	}
+	b.WriteString("}\n")
+
+	for _, prop := range c.Properties {
+		b.WriteString(PropertyDeclaration(prop) + "\n")
+	}
+	for _, m := range c.Methods {
+		b.WriteString(MethodDeclaration(m) + ";\n")
+	}
+	b.WriteString("@end")
+	return b.String()
+}
+
+// PropertyDeclaration turns a property's runtime attributes into an
+// @property line, e.g. "@property (nonatomic, strong) AVCaptureSession *session; // ivar _session".
+func PropertyDeclaration(p PropertyInfo) string {
+	var typ, ivar string
+	var attrs []string
+	atomic, ownership := true, ""
+	for _, attr := range splitPropertyAttributes(p.Attributes) {
+		if attr == "" {
+			continue
+		}
+		switch attr[0] {
+		case 'T':
+			typ = DecodeType(attr[1:])
+		case 'V':
+			ivar = attr[1:]
+		case 'R':
+			attrs = append(attrs, "readonly")
+		case 'C':
+			ownership = "copy"
+		case '&':
+			ownership = "strong"
+		case 'W':
+			ownership = "weak"
+		case 'N':
+			atomic = false
+		case 'G':
+			attrs = append(attrs, "getter="+attr[1:])
+		case 'S':
+			attrs = append(attrs, "setter="+attr[1:])
+		}
+	}
+	if typ == "" {
+		typ = "id"
+	}
+	if ownership == "" && strings.HasSuffix(typ, "*") {
+		ownership = "assign"
+	}
+	var all []string
+	if !atomic {
+		all = append(all, "nonatomic")
+	}
+	if ownership != "" {
+		all = append(all, ownership)
+	}
+	all = append(all, attrs...)
+
+	decl := "@property "
+	if len(all) > 0 {
+		decl += "(" + strings.Join(all, ", ") + ") "
+	}
+	decl += declare(typ, p.Name) + ";"
+	if ivar != "" && ivar != "_"+p.Name {
+		decl += " // ivar " + ivar
+	}
+	return decl
+}
+
+// splitPropertyAttributes splits an attribute string on commas that are not
+// inside the quoted class name of the type.
+func splitPropertyAttributes(s string) []string {
+	var parts []string
+	inQuote := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			inQuote = !inQuote
+		case ',':
+			if !inQuote {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// MethodDeclaration renders a method's selector and type encoding as an
+// Objective-C declaration without the trailing semicolon, e.g.
+// "- (void)setZoom:(double)arg1 animated:(BOOL)arg2".
+func MethodDeclaration(m MethodInfo) string {
+	prefix := "-"
+	if m.ClassMethod {
+		prefix = "+"
+	}
+	types := decodeMethodTypes(m.Types)
+	ret := "id"
+	if len(types) > 0 {
+		ret = types[0]
+	}
+	// types[1] and types[2] are self and _cmd.
+	var args []string
+	if len(types) > 3 {
+		args = types[3:]
+	}
+
+	parts := strings.Split(m.Selector, ":")
+	if len(parts) == 1 {
+		return fmt.Sprintf("%s (%s)%s", prefix, ret, m.Selector)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s (%s)", prefix, ret)
+	for i, part := range parts[:len(parts)-1] {
+		argType := "id"
+		if i < len(args) {
+			argType = args[i]
+		}
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		fmt.Fprintf(&b, "%s:(%s)arg%d", part, argType, i+1)
+	}
+	return b.String()
+}
+
+// decodeMethodTypes decodes a method type encoding into the return type
+// followed by the argument types, dropping the stack offsets.
+func decodeMethodTypes(enc string) []string {
+	var types []string
+	for len(enc) > 0 {
+		typ, rest := decodeOne(enc)
+		if rest == enc {
+			break
+		}
+		types = append(types, typ)
+		enc = strings.TrimLeft(rest, "-0123456789")
+	}
+	return types
+}
+
+// DecodeType converts an Objective-C type encoding, such as @"NSString" or
+// ^{CGRect={CGPoint=dd}{CGSize=dd}}, into a C type name.
+func DecodeType(enc string) string {
+	typ, _ := decodeOne(enc)
+	return typ
+}
+
+// decodeOne decodes the first type in enc and returns the rest of the string.
+func decodeOne(enc string) (string, string) {
+	if enc == "" {
+		return "void", ""
+	}
+	simple := map[byte]string{
+		'c': "char", 'i': "int", 's': "short", 'l': "long", 'q': "long long",
+		'C': "unsigned char", 'I': "unsigned int", 'S': "unsigned short",
+		'L': "unsigned long", 'Q': "unsigned long long", 'f': "float", 'd': "double",
+		'D': "long double", 'B': "BOOL", 'v': "void", '*': "char *", '#': "Class",
+		':': "SEL", '?': "void *", 't': "__int128", 'T': "unsigned __int128",
+	}
+	c := enc[0]
+	if name, ok := simple[c]; ok {
+		return name, enc[1:]
+	}
+	switch c {
+	case 'r':
+		typ, rest := decodeOne(enc[1:])
+		return "const " + typ, rest
+	case 'n', 'N', 'o', 'O', 'R', 'V', 'A', 'j':
+		// in/inout/out/bycopy/byref/oneway/atomic/complex qualifiers.
+		return decodeOne(enc[1:])
+	case '@':
+		rest := enc[1:]
+		if strings.HasPrefix(rest, "?") {
+			rest = rest[1:]
+			if strings.HasPrefix(rest, "<") {
+				if end := strings.IndexByte(rest, '>'); end >= 0 {
+					rest = rest[end+1:]
+				}
+			}
+			return "id /* block */", rest
+		}
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				return "id", ""
+			}
+			name := rest[1 : end+1]
+			rest = rest[end+2:]
+			if strings.HasPrefix(name, "<") {
+				return "id" + name, rest
+			}
+			if i := strings.IndexByte(name, '<'); i >= 0 {
+				return name[:i] + " " + name[i:] + " *", rest
+			}
+			return name + " *", rest
+		}
+		return "id", rest
+	case '^':
+		typ, rest := decodeOne(enc[1:])
+		if strings.HasSuffix(typ, "*") {
+			return typ + "*", rest
+		}
+		return typ + " *", rest
+	case 'b':
+		n := strings.IndexFunc(enc[1:], func(r rune) bool { return r < '0' || r > '9' })
+		if n < 0 {
+			n = len(enc) - 1
+		}
+		return "unsigned int /* :" + enc[1:1+n] + " */", enc[1+n:]
+	case '[':
+		n := strings.IndexFunc(enc[1:], func(r rune) bool { return r < '0' || r > '9' })
+		if n < 0 {
+			return "void *", ""
+		}
+		count := enc[1 : 1+n]
+		typ, rest := decodeOne(enc[1+n:])
+		rest = strings.TrimPrefix(rest, "]")
+		return typ + " [" + count + "]", rest
+	case '{', '(':
+		closer := byte('}')
+		kind := "struct"
+		if c == '(' {
+			closer, kind = ')', "union"
+		}
+		end := matchingClose(enc, c, closer)
+		body := enc[1:end]
+		name := body
+		if eq := strings.IndexByte(body, '='); eq >= 0 {
+			name = body[:eq]
+		}
+		rest := ""
+		if end < len(enc) {
+			rest = enc[end+1:]
+		}
+		if name == "" || name == "?" {
+			return kind + " { /* anonymous */ }", rest
+		}
+		// Common CoreGraphics and Foundation structs are typedef'd.
+		if strings.HasPrefix(name, "CG") || strings.HasPrefix(name, "NS") || strings.HasPrefix(name, "_NS") || strings.HasPrefix(name, "CM") {
+			return strings.TrimPrefix(name, "_"), rest
+		}
+		return kind + " " + name, rest
+	}
+	return "void /* " + strconv.Quote(enc[:1]) + " */", enc[1:]
+}
+
+// matchingClose returns the index of the bracket closing the one at enc[0],
+// or len(enc) if it is unbalanced.
+func matchingClose(enc string, open, close byte) int {
+	depth := 0
+	inQuote := false
+	for i := 0; i < len(enc); i++ {
+		switch enc[i] {
+		case '"':
+			inQuote = !inQuote
+		case open:
+			if !inQuote {
+				depth++
+			}
+		case close:
+			if !inQuote {
+				depth--
+				if depth == 0 {
+					return i
+				}
+			}
+		}
+	}
+	return len(enc)
+}
+
+// declare combines a type and a name into a declaration, keeping the pointer
+// star next to the name and placing array sizes after it.
+func declare(typ, name string) string {
+	if i := strings.Index(typ, " ["); i >= 0 && strings.HasSuffix(typ, "]") {
+		return declare(typ[:i], name) + typ[i+1:]
+	}
+	if strings.HasSuffix(typ, "*") {
+		return typ + name
+	}
+	return typ + " " + name
+}
@@ -0,0 +1,105 @@
+package decompile
+
+import "testing"
+
+func TestDecodeType(t *testing.T) {
+	for _, tt := range []struct {
+		enc, want string
+	}{
+		{"", "void"},
+		{"B", "BOOL"},
+		{"r*", "const char *"},
+		{"@", "id"},
+		{`@"NSString"`, "NSString *"},
+		{`@"<NSCopying>"`, "id<NSCopying>"},
+		{`@"CALayer<CAMediaTiming>"`, "CALayer <CAMediaTiming> *"},
+		{"@?", "id /* block */"},
+		{"@?<v@?@>", "id /* block */"},
+		{"^v", "void *"},
+		{"^^v", "void **"},
+		{"^{CGRect={CGPoint=dd}{CGSize=dd}}", "CGRect *"},
+		{"{_NSRange=QQ}", "NSRange"},
+		{"{opaque=ii}", "struct opaque"},
+		{"{?=ii}", "struct { /* anonymous */ }"},
+		{"(?=iq)", "union { /* anonymous */ }"},
+		{"b4", "unsigned int /* :4 */"},
+		{"[16C]", "unsigned char [16]"},
+		{"x", `void /* "x" */`},
+	} {
+		if got := DecodeType(tt.enc); got != tt.want {
+			t.Errorf("DecodeType(%q) = %q, want %q", tt.enc, got, tt.want)
+		}
+	}
+}
+
+func TestPropertyDeclaration(t *testing.T) {
+	for _, tt := range []struct {
+		name, attrs, want string
+	}{
+		{"session", `T@"AVCaptureSession",&,N,V_session`, "@property (nonatomic, strong) AVCaptureSession *session;"},
+		{"title", `T@"NSString",C,R,N,V_title`, "@property (nonatomic, copy, readonly) NSString *title;"},
+		{"delegate", `T@"<AVDelegate>",W,V_delegate`, "@property (weak) id<AVDelegate> delegate;"},
+		{"owner", `T@"Owner",V_owner`, "@property (assign) Owner *owner;"},
+		{"zoom", `Td,N,GcurrentZoom,SsetCurrentZoom:,V_zoomFactor`, "@property (nonatomic, getter=currentZoom, setter=setCurrentZoom:) double zoom; // ivar _zoomFactor"},
+		// The commas of the type's quoted class name don't split attributes.
+		{"value", `T@"NSObject<A,B>",&,N`, "@property (nonatomic, strong) NSObject <A,B> *value;"},
+		{"flags", "Tb3,V_flags", "@property unsigned int /* :3 */ flags;"},
+		{"x", "R", "@property (readonly) id x;"},
+	} {
+		if got := PropertyDeclaration(PropertyInfo{Name: tt.name, Attributes: tt.attrs}); got != tt.want {
+			t.Errorf("PropertyDeclaration(%s, %q) = %q, want %q", tt.name, tt.attrs, got, tt.want)
+		}
+	}
+}
+
+func TestMethodDeclaration(t *testing.T) {
+	for _, tt := range []struct {
+		method MethodInfo
+		want   string
+	}{
+		{MethodInfo{Selector: "setZoom:animated:", Types: "v24@0:8d16B24"}, "- (void)setZoom:(double)arg1 animated:(BOOL)arg2"},
+		{MethodInfo{Selector: "session", Types: `@"AVCaptureSession"16@0:8`}, "- (AVCaptureSession *)session"},
+		{MethodInfo{Selector: "sharedInstance", Types: "@16@0:8", ClassMethod: true}, "+ (id)sharedInstance"},
+		{MethodInfo{Selector: "frame", Types: "{CGRect={CGPoint=dd}{CGSize=dd}}16@0:8"}, "- (CGRect)frame"},
+		{MethodInfo{Selector: "performWithCompletion:", Types: "v24@0:8@?16"}, "- (void)performWithCompletion:(id /* block */)arg1"},
+		// Without an encoding everything is an object.
+		{MethodInfo{Selector: "run:with:"}, "- (id)run:(id)arg1 with:(id)arg2"},
+	} {
+		if got := MethodDeclaration(tt.method); got != tt.want {
+			t.Errorf("MethodDeclaration(%+v) = %q, want %q", tt.method, got, tt.want)
+		}
+	}
+}
+
+func TestClassInfo_Context(t *testing.T) {
+	class := &ClassInfo{
+		Name:       "Camera",
+		Superclass: "NSObject",
+		Protocols:  []string{"A", "B"},
+		Ivars: []IvarInfo{
+			{Name: "_zoom", Offset: 0x10, Type: "d"},
+			{Name: "_title", Offset: 0x8, Type: `@"NSString"`},
+			{Name: "_buf", Offset: 0x18, Type: "[4i]"},
+		},
+		Properties: []PropertyInfo{{Name: "title", Attributes: `T@"NSString",C,N,V_title`}},
+		Methods: []MethodInfo{
+			{Selector: "start", Types: "v16@0:8"},
+			{Selector: "shared", Types: "@16@0:8", ClassMethod: true},
+		},
+	}
+	want := `@interface Camera : NSObject <A, B> {
+    NSString *_title; // offset 0x8
+    double _zoom; // offset 0x10
+    int _buf[4]; // offset 0x18
+}
+@property (nonatomic, copy) NSString *title;
+- (void)start;
++ (id)shared;
+@end`
+	if got := class.Context(); got != want {
+		t.Errorf("Context() =\n%s\nwant\n%s", got, want)
+	}
+	if ivar, ok := class.IvarAt(0x10); !ok || ivar.Name != "_zoom" {
+		t.Errorf("IvarAt(0x10) = %+v, %v; want _zoom", ivar, ok)
+	}
+}
@@ -0,0 +1,179 @@
+package decompile
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Price is what a model charges, in US dollars per million tokens.
+type Price struct {
+	Prompt     float64 `json:"prompt"`
+	Completion float64 `json:"completion"`
+}
+
+// PriceTable maps model names to prices. A key ending in "*" matches every
+// model with that prefix, e.g. "ollama/*"; the longest matching key wins.
+type PriceTable map[string]Price
+
+// DefaultPrices returns the built-in price table. Local models are free;
+// hosted models have to be priced with --prices.
+func DefaultPrices() PriceTable {
+	return PriceTable{
+		"ollama/*":      {},
+		"ollama_chat/*": {},
+	}
+}
+
+// LoadPriceTable reads a JSON object of model prices, e.g.
+// {"gpt-4o": {"prompt": 2.5, "completion": 10}}, on top of the built-in
+// table. An empty path returns the built-in table.
+func LoadPriceTable(path string) (PriceTable, error) {
+	prices := DefaultPrices()
+	if path == "" {
+		return prices, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read price table: %w", err)
+	}
+	var custom PriceTable
+	if err := json.Unmarshal(data, &custom); err != nil {
+		return nil, fmt.Errorf("failed to parse price table %s: %w", path, err)
+	}
+	for model, price := range custom {
+		prices[model] = price
+	}
+	return prices, nil
+}
+
+// Lookup returns the price of a model.
+func (t PriceTable) Lookup(model string) (Price, bool) {
+	if price, ok := t[model]; ok {
+		return price, true
+	}
+	best, found := "", false
+	for key := range t {
+		prefix, wildcard := strings.CutSuffix(key, "*")
+		if wildcard && strings.HasPrefix(model, prefix) && len(prefix) >= len(best) {
+			best, found = prefix, true
+		}
+	}
+	return t[best+"*"], found
+}
+
+// Cost returns the price of the given usage in US dollars. It reports false
+// for models missing from the table, which are counted as free.
+func (t PriceTable) Cost(model string, u Usage) (float64, bool) {
+	price, ok := t.Lookup(model)
+	if !ok {
+		return 0, false
+	}
+	return (float64(u.PromptTokens)*price.Prompt + float64(u.CompletionTokens)*price.Completion) / 1e6, true
+}
+
+// Budget caps what a run may spend. Workers stop claiming batches once it is
+// exhausted; requests already sent are finished and recorded. A nil *Budget
+// is unlimited.
+type Budget struct {
+	limit float64
+
+	mu    sync.Mutex
+	spent float64
+}
+
+// NewBudget creates a budget of limit US dollars. A limit of zero or less
+// returns nil, i.e. no budget.
+func NewBudget(limit float64) *Budget {
+	if limit <= 0 {
+		return nil
+	}
+	return &Budget{limit: limit}
+}
+
+// Spend records the cost of a model call.
+func (b *Budget) Spend(cost float64) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.spent += cost
+}
+
+// Exhausted reports whether the run has spent its budget.
+func (b *Budget) Exhausted() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.spent >= b.limit
+}
+
+// Spent returns what the run has spent so far.
+func (b *Budget) Spent() float64 {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.spent
+}
+
+// TaskUsage is the share of a model call attributed to one task.
+type TaskUsage struct {
+	TaskID int64
+	Usage
+	Cost float64
+}
+
+// splitUsage attributes the usage of a call made for several tasks to each of
+// them in proportion to the size of its assembly.
+func splitUsage(tasks []*Task, u Usage, cost float64) []TaskUsage {
+	weights := make([]int, len(tasks))
+	total := 0
+	for i, task := range tasks {
+		weights[i] = max(len(task.AssemblyCode), 1)
+		total += weights[i]
+	}
+	shares := make([]TaskUsage, len(tasks))
+	prompt, completion := u.PromptTokens, u.CompletionTokens
+	for i, task := range tasks {
+		share := TaskUsage{TaskID: task.ID, Usage: Usage{Estimated: u.Estimated}}
+		if i == len(tasks)-1 {
+			// The last task gets the rounding remainder.
+			share.PromptTokens, share.CompletionTokens = prompt, completion
+		} else {
+			share.PromptTokens = u.PromptTokens * weights[i] / total
+			share.CompletionTokens = u.CompletionTokens * weights[i] / total
+		}
+		prompt -= share.PromptTokens
+		completion -= share.CompletionTokens
+		share.Cost = cost * float64(weights[i]) / float64(total)
+		shares[i] = share
+	}
+	return shares
+}
+
+// recordUsage prices a model call, charges it to the budget and stores each
+// task's share of it.
+func (w *worker) recordUsage(tasks []*Task, model string, u Usage) {
+	cost, priced := w.cfg.Prices.Cost(model, u)
+	if !priced && w.cfg.Prices != nil && !w.unpriced[model] {
+		w.unpriced[model] = true
+		log.Printf("Worker %d: no price for %s; counting it as free", w.id, model)
+	}
+	w.cfg.Budget.Spend(cost)
+	if len(tasks) == 0 {
+		return
+	}
+	// Usage is recorded even if the run is being cancelled.
+	if err := w.store.RecordUsage(context.Background(), w.cfg.RunID, model, splitUsage(tasks, u, cost)); err != nil {
+		log.Printf("Worker %d: failed to record token usage: %v", w.id, err)
+	}
+}
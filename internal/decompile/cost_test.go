@@ -0,0 +1,94 @@
+package decompile
+
+import (
+	"context"
+	"math"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPriceTable_Lookup(t *testing.T) {
+	prices := PriceTable{
+		"gpt-4o":       {Prompt: 2.5, Completion: 10},
+		"ollama/*":     {},
+		"ollama/big-*": {Prompt: 1},
+		"openrouter/*": {Prompt: 3, Completion: 15},
+	}
+	tests := []struct {
+		model string
+		want  Price
+		found bool
+	}{
+		{"gpt-4o", Price{Prompt: 2.5, Completion: 10}, true},
+		{"gpt-4o-mini", Price{}, false},
+		{"ollama/codellama", Price{}, true},
+		{"ollama/big-model", Price{Prompt: 1}, true},
+		{"openrouter/anthropic/claude", Price{Prompt: 3, Completion: 15}, true},
+	}
+	for _, tt := range tests {
+		got, found := prices.Lookup(tt.model)
+		if got != tt.want || found != tt.found {
+			t.Errorf("Lookup(%q) = %v, %v, want %v, %v", tt.model, got, found, tt.want, tt.found)
+		}
+	}
+
+	cost, _ := prices.Cost("gpt-4o", Usage{PromptTokens: 1000, CompletionTokens: 100})
+	if math.Abs(cost-0.0035) > 1e-9 {
+		t.Errorf("got cost %v, want 0.0035", cost)
+	}
+}
+
+func TestDecompileWorker_RecordsUsageAndStopsAtBudget(t *testing.T) {
+	store := setupTestDB(t)
+	defer store.Close()
+
+	ctx := context.Background()
+	err := store.AddTasks(ctx, []*Task{
+		{ClassName: "A", SymbolName: "-[A foo]", AssemblyCode: "ret"},
+		{ClassName: "B", SymbolName: "-[B bar]", AssemblyCode: "ret"},
+	})
+	if err != nil {
+		t.Fatalf("failed to add tasks: %v", err)
+	}
+
+	fake := &fakeLiteLLM{
+		replies: []string{
+			resultsJSON(t, DecompiledResult{SymbolName: "-[A foo]", DecompiledSource: "- (void)foo {\n}", Success: true}),
+			resultsJSON(t, DecompiledResult{SymbolName: "-[B bar]", DecompiledSource: "- (void)bar {\n}", Success: true}),
+		},
+		usage: &Usage{PromptTokens: 1000, CompletionTokens: 500},
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	runID, err := store.StartRun(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	budget := NewBudget(1)
+	DecompileWorker(ctx, 0, store, WorkerConfig{
+		LiteLLMURL: server.URL,
+		Models:     ModelChain{"test-model"},
+		BatchSize:  1,
+		MaxRetries: 1,
+		Prices:     PriceTable{"test-model": {Prompt: 1000, Completion: 2000}},
+		Budget:     budget,
+		RunID:      runID,
+	})
+
+	if len(fake.requests) != 1 {
+		t.Fatalf("expected the worker to stop after the first batch spent the budget, got %d requests", len(fake.requests))
+	}
+	if got := budget.Spent(); math.Abs(got-2) > 1e-9 {
+		t.Errorf("got $%v spent, want $2", got)
+	}
+
+	report, err := store.CostReport(ctx, CostByClass)
+	if err != nil {
+		t.Fatalf("cost report failed: %v", err)
+	}
+	want := []CostRow{{Key: "A", Tasks: 1, PromptTokens: 1000, CompletionTokens: 500, Cost: 2}}
+	if len(report) != 1 || report[0] != want[0] {
+		t.Errorf("got report %+v, want %+v", report, want)
+	}
+}
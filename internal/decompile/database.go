@@ -3,7 +3,10 @@ package decompile
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"os"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -21,16 +24,43 @@ const (
 
 // Task represents a single decompilation task.
 type Task struct {
-	ID               int64
-	ClassName        string
-	SymbolName       string
+	ID         int64
+	ClassName  string
+	SymbolName string
+	// Image is the path of the binary image the method was scanned from.
+	Image string
+	// Address is the method's address in the image, or 0 if unknown. It is
+	// used to resolve direct calls when building the call graph.
+	Address uint64
+	// Unit groups tasks that are decompiled together as one @implementation
+	// in whole-class mode. It is empty for tasks decompiled method by method.
+	Unit             string
 	AssemblyCode     string
 	Status           TaskStatus
 	Retries          int
+	ModelTier        int
+	Model            sql.NullString
+	PromptVersion    sql.NullString
 	DecompiledSource sql.NullString
-	ErrorMessage     sql.NullString
-	CreatedAt        time.Time
-	UpdatedAt        time.Time
+	// Summary is the model's one-line description of what the method does,
+	// shown to the prompts of its callers.
+	Summary sql.NullString
+	// Validation is the outcome of the syntax check: valid, repaired or
+	// invalid. It is NULL when validation was disabled.
+	Validation       sql.NullString
+	ValidationErrors sql.NullString
+	// Fidelity is the share of the assembly's selectors, functions and
+	// strings the source agrees on, from 0 to 1.
+	Fidelity sql.NullFloat64
+	// FidelityIssues is the JSON-encoded Fidelity of a result with
+	// mismatches, NULL if it had none.
+	FidelityIssues sql.NullString
+	// Disagreements is a JSON list of the selectors ensemble models did not
+	// agree on. It is only set for tasks decompiled in ensemble mode.
+	Disagreements sql.NullString
+	ErrorMessage  sql.NullString
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
 }
 
 // TaskStore manages database operations for decompilation tasks.
@@ -47,6 +77,10 @@ func NewTaskStore(dataSourceName string) (*TaskStore, error) {
 	if err := db.Ping(); err != nil {
 		return nil, fmt.Errorf("failed to connect to database: %w", err)
 	}
+	// SQLite allows a single writer. Funnelling every worker through one
+	// connection serializes their transactions instead of failing them with
+	// "database is locked" when the pool is busy.
+	db.SetMaxOpenConns(1)
 
 	store := &TaskStore{db: db}
 	if err := store.initSchema(); err != nil {
@@ -56,9 +90,36 @@ func NewTaskStore(dataSourceName string) (*TaskStore, error) {
 	return store, nil
 }
 
-// initSchema creates the necessary database table if it doesn't exist.
-func (s *TaskStore) initSchema() error {
-	query := `
+// OpenTaskStore opens an existing database read-only, for commands that
+// only read a run. Unlike NewTaskStore it fails if the file is missing and
+// never migrates it: tables and columns the database predates are stood in
+// for by temporary tables and views that live on the connection.
+func OpenTaskStore(path string) (*TaskStore, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	uri := strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23").Replace(path)
+	db, err := sql.Open("sqlite3", "file:"+uri+"?mode=ro")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	// The temporary schema exists only on the connection that created it.
+	db.SetMaxOpenConns(1)
+
+	store := &TaskStore{db: db}
+	if err := store.shimSchema(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to read schema of %s: %w", path, err)
+	}
+	return store, nil
+}
+
+// schema holds the statements that create the database tables if they don't exist.
+var schema = []string{`
     CREATE TABLE IF NOT EXISTS decompilation_tasks (
         id INTEGER PRIMARY KEY AUTOINCREMENT,
         class_name TEXT NOT NULL,
@@ -70,10 +131,340 @@ func (s *TaskStore) initSchema() error {
         error_message TEXT,
         created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
         updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-        UNIQUE(class_name, symbol_name)
-    );`
-	_, err := s.db.Exec(query)
-	return err
+        image TEXT NOT NULL DEFAULT '',
+        UNIQUE(class_name, symbol_name, image)
+    );`, `
+    CREATE TABLE IF NOT EXISTS ensemble_candidates (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        task_id INTEGER NOT NULL REFERENCES decompilation_tasks(id),
+        model TEXT NOT NULL,
+        decompiled_source TEXT NOT NULL,
+        selected INTEGER NOT NULL DEFAULT 0,
+        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    );`, `
+    CREATE INDEX IF NOT EXISTS idx_ensemble_candidates_task ON ensemble_candidates(task_id);`, `
+    CREATE TABLE IF NOT EXISTS image_symbols (
+        image TEXT NOT NULL,
+        kind TEXT NOT NULL,
+        address INTEGER NOT NULL,
+        value TEXT NOT NULL,
+        PRIMARY KEY (image, kind, address)
+    );`, `
+    CREATE TABLE IF NOT EXISTS classes (
+        name TEXT NOT NULL,
+        image TEXT NOT NULL DEFAULT '',
+        metadata TEXT NOT NULL,
+        PRIMARY KEY (image, name)
+    );`, `
+    CREATE TABLE IF NOT EXISTS protocols (
+        name TEXT NOT NULL,
+        image TEXT NOT NULL DEFAULT '',
+        metadata TEXT NOT NULL,
+        PRIMARY KEY (image, name)
+    );`, `
+    CREATE TABLE IF NOT EXISTS call_edges (
+        caller_id INTEGER NOT NULL REFERENCES decompilation_tasks(id),
+        callee_id INTEGER NOT NULL REFERENCES decompilation_tasks(id),
+        PRIMARY KEY (caller_id, callee_id)
+    );`, `
+    CREATE INDEX IF NOT EXISTS idx_call_edges_callee ON call_edges(callee_id);`, `
+    CREATE TABLE IF NOT EXISTS runs (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        budget REAL,
+        started_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    );`, `
+    CREATE TABLE IF NOT EXISTS task_usage (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        task_id INTEGER NOT NULL REFERENCES decompilation_tasks(id),
+        run_id INTEGER NOT NULL DEFAULT 0,
+        model TEXT NOT NULL,
+        prompt_tokens INTEGER NOT NULL,
+        completion_tokens INTEGER NOT NULL,
+        cost REAL NOT NULL,
+        estimated INTEGER NOT NULL DEFAULT 0,
+        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    );`, `
+    CREATE INDEX IF NOT EXISTS idx_task_usage_task ON task_usage(task_id);`,
+}
+
+// blockedSchema keeps decompilation_tasks.blocked, the number of a task's
+// callees outside its unit that are still pending or in flight, up to date
+// whatever changes a status, so the scheduler can pick the least blocked
+// tasks from an index. It is applied after the migrations that add the
+// column.
+var blockedSchema = []string{`
+    CREATE INDEX IF NOT EXISTS idx_tasks_pending ON decompilation_tasks(status, blocked, id);`, `
+    CREATE TRIGGER IF NOT EXISTS tasks_blocked AFTER UPDATE OF status ON decompilation_tasks
+    WHEN (OLD.status IN ('pending', 'in_flight')) != (NEW.status IN ('pending', 'in_flight'))
+    BEGIN
+        UPDATE decompilation_tasks
+        SET blocked = blocked + CASE WHEN NEW.status IN ('pending', 'in_flight') THEN 1 ELSE -1 END
+        WHERE id IN (SELECT caller_id FROM call_edges WHERE callee_id = NEW.id)
+            AND (unit = '' OR unit != NEW.unit);
+    END;`, `
+    CREATE TRIGGER IF NOT EXISTS call_edges_blocked AFTER INSERT ON call_edges
+    BEGIN
+        UPDATE decompilation_tasks SET blocked = blocked + 1
+        WHERE id = NEW.caller_id AND EXISTS (
+            SELECT 1 FROM decompilation_tasks c
+            WHERE c.id = NEW.callee_id AND c.status IN ('pending', 'in_flight')
+                AND (decompilation_tasks.unit = '' OR c.unit != decompilation_tasks.unit));
+    END;`,
+}
+
+// countBlocked fills decompilation_tasks.blocked for databases that predate
+// it.
+const countBlocked = `
+    UPDATE decompilation_tasks SET blocked = (
+        SELECT COUNT(*) FROM call_edges e
+        JOIN decompilation_tasks c ON c.id = e.callee_id
+        WHERE e.caller_id = decompilation_tasks.id AND c.status IN ('pending', 'in_flight')
+            AND (decompilation_tasks.unit = '' OR c.unit != decompilation_tasks.unit))`
+
+// initSchema creates the necessary database tables if they don't exist and
+// brings older databases up to date.
+func (s *TaskStore) initSchema() error {
+	for _, query := range schema {
+		if _, err := s.db.Exec(query); err != nil {
+			return err
+		}
+	}
+	if err := s.migrateSchema(); err != nil {
+		return err
+	}
+	for _, query := range blockedSchema {
+		if _, err := s.db.Exec(query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// columnMigrations lists the columns added to the schema over time. They are
+// applied with ALTER TABLE so databases from earlier runs can be resumed,
+// followed by fill, if set, to compute the column for existing rows.
+var columnMigrations = []struct {
+	table      string
+	column     string
+	definition string
+	fill       string
+}{
+	{"decompilation_tasks", "model_tier", "INTEGER NOT NULL DEFAULT 0", ""},
+	{"decompilation_tasks", "model", "TEXT", ""},
+	{"decompilation_tasks", "disagreements", "TEXT", ""},
+	{"decompilation_tasks", "prompt_version", "TEXT", ""},
+	{"ensemble_candidates", "prompt_version", "TEXT", ""},
+	{"decompilation_tasks", "image", "TEXT NOT NULL DEFAULT ''", ""},
+	{"decompilation_tasks", "address", "INTEGER NOT NULL DEFAULT 0", ""},
+	{"decompilation_tasks", "summary", "TEXT", ""},
+	{"ensemble_candidates", "summary", "TEXT", ""},
+	{"decompilation_tasks", "unit", "TEXT NOT NULL DEFAULT ''", ""},
+	{"decompilation_tasks", "validation", "TEXT", ""},
+	{"decompilation_tasks", "validation_errors", "TEXT", ""},
+	{"decompilation_tasks", "fidelity", "REAL", ""},
+	{"decompilation_tasks", "fidelity_issues", "TEXT", ""},
+	{"decompilation_tasks", "blocked", "INTEGER NOT NULL DEFAULT 0", countBlocked},
+}
+
+// migrateSchema adds any columns from columnMigrations that are missing and
+// widens the keys of older task, class and protocol tables.
+func (s *TaskStore) migrateSchema() error {
+	for _, m := range columnMigrations {
+		exists, err := s.hasColumn(m.table, m.column)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if _, err := s.db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, m.table, m.column, m.definition)); err != nil {
+			return fmt.Errorf("failed to add column %s.%s: %w", m.table, m.column, err)
+		}
+		if m.fill != "" {
+			if _, err := s.db.Exec(m.fill); err != nil {
+				return fmt.Errorf("failed to fill column %s.%s: %w", m.table, m.column, err)
+			}
+		}
+	}
+	if err := s.migrateTaskKey(); err != nil {
+		return err
+	}
+	for _, table := range []string{"classes", "protocols"} {
+		if err := s.migrateNameKey(table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// oldTaskKey is the unique key of task tables created before tasks were
+// told apart by image.
+const oldTaskKey = "UNIQUE(class_name, symbol_name)"
+
+// migrateTaskKey rebuilds a task table keyed by class and symbol alone so
+// the key includes the image, letting same-named classes of two images
+// coexist. SQLite can't alter a constraint, so the table is copied into one
+// created from its own definition with the key replaced.
+func (s *TaskStore) migrateTaskKey() error {
+	definition, err := s.tableDefinition("decompilation_tasks")
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(definition, oldTaskKey) {
+		return nil
+	}
+	definition = strings.Replace(definition, oldTaskKey, "UNIQUE(class_name, symbol_name, image)", 1)
+	definition = strings.Replace(definition, "decompilation_tasks", "decompilation_tasks_new", 1)
+	return s.rebuildTable("decompilation_tasks", definition, `SELECT * FROM decompilation_tasks`)
+}
+
+// oldNameKey is the primary key of class and protocol tables created before
+// they were told apart by image.
+const oldNameKey = "name TEXT PRIMARY KEY"
+
+// migrateNameKey rebuilds a class or protocol table keyed by name alone so
+// the key includes the image, like migrateTaskKey does for tasks. Their
+// columns never changed, so the table is recreated from the current schema.
+func (s *TaskStore) migrateNameKey(table string) error {
+	definition, err := s.tableDefinition(table)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(definition, oldNameKey) {
+		return nil
+	}
+	for _, query := range schema {
+		if strings.Contains(query, "CREATE TABLE IF NOT EXISTS "+table+" (") {
+			definition = strings.Replace(query, "IF NOT EXISTS "+table, table+"_new", 1)
+		}
+	}
+	return s.rebuildTable(table, definition, fmt.Sprintf(`SELECT name, COALESCE(image, ''), metadata FROM %s`, table))
+}
+
+// tableDefinition returns the CREATE TABLE statement of a table.
+func (s *TaskStore) tableDefinition(table string) (string, error) {
+	var definition string
+	err := s.db.QueryRow(`SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?`, table).Scan(&definition)
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect table %s: %w", table, err)
+	}
+	return definition, nil
+}
+
+// rebuildTable replaces table with <table>_new, created by definition and
+// filled by rows. SQLite can't alter a constraint, so keys are changed by
+// copying the table.
+func (s *TaskStore) rebuildTable(table, definition, rows string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	for _, query := range []string{
+		definition,
+		fmt.Sprintf(`INSERT INTO %s_new %s`, table, rows),
+		fmt.Sprintf(`DROP TABLE %s`, table),
+		fmt.Sprintf(`ALTER TABLE %s_new RENAME TO %s`, table, table),
+	} {
+		if _, err := tx.Exec(query); err != nil {
+			return fmt.Errorf("failed to rebuild table %s: %w", table, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// shimSchema lets a read-only database be queried like an up-to-date one.
+// Missing tables are created empty in the temp schema, and tables missing
+// columns are shadowed by a temporary view adding them with their defaults.
+func (s *TaskStore) shimSchema() error {
+	temp := make(map[string]bool)
+	for _, query := range schema {
+		rest, ok := strings.CutPrefix(strings.TrimSpace(query), "CREATE TABLE IF NOT EXISTS ")
+		if !ok {
+			continue // indexes
+		}
+		table := strings.Fields(rest)[0]
+		exists, err := s.hasTable(table)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if table == "decompilation_tasks" {
+			return fmt.Errorf("not a decompile database")
+		}
+		if _, err := s.db.Exec(strings.Replace(query, "CREATE TABLE IF NOT EXISTS", "CREATE TEMP TABLE", 1)); err != nil {
+			return fmt.Errorf("failed to create table %s: %w", table, err)
+		}
+		temp[table] = true
+	}
+
+	missing := make(map[string][]string)
+	for _, m := range columnMigrations {
+		exists, err := s.hasColumn(m.table, m.column)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if temp[m.table] {
+			if _, err := s.db.Exec(fmt.Sprintf(`ALTER TABLE temp.%s ADD COLUMN %s %s`, m.table, m.column, m.definition)); err != nil {
+				return fmt.Errorf("failed to add column %s.%s: %w", m.table, m.column, err)
+			}
+			continue
+		}
+		value := "NULL"
+		if _, def, ok := strings.Cut(m.definition, "DEFAULT "); ok {
+			value = def
+		}
+		missing[m.table] = append(missing[m.table], value+" AS "+m.column)
+	}
+	for _, table := range sortedKeys(missing) {
+		query := fmt.Sprintf(`CREATE TEMP VIEW %s AS SELECT *, %s FROM main.%s`, table, strings.Join(missing[table], ", "), table)
+		if _, err := s.db.Exec(query); err != nil {
+			return fmt.Errorf("failed to extend table %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// hasTable reports whether the main schema has the given table.
+func (s *TaskStore) hasTable(table string) (bool, error) {
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM main.sqlite_master WHERE type = 'table' AND name = ?`, table).Scan(&n)
+	if err != nil {
+		return false, fmt.Errorf("failed to inspect table %s: %w", table, err)
+	}
+	return n > 0, nil
+}
+
+// hasColumn reports whether table already has the given column.
+func (s *TaskStore) hasColumn(table, column string) (bool, error) {
+	rows, err := s.db.Query(fmt.Sprintf(`PRAGMA table_info(%s)`, table))
+	if err != nil {
+		return false, fmt.Errorf("failed to inspect table %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			colType    string
+			notNull    int
+			defaultVal sql.NullString
+			pk         int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultVal, &pk); err != nil {
+			return false, fmt.Errorf("failed to scan table info for %s: %w", table, err)
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
 }
 
 // Close closes the database connection.
@@ -101,8 +492,8 @@ func (s *TaskStore) AddTasks(ctx context.Context, tasks []*Task) error {
 	defer tx.Rollback()
 
 	stmt, err := tx.PrepareContext(ctx, `
-        INSERT OR IGNORE INTO decompilation_tasks (class_name, symbol_name, assembly_code, status)
-        VALUES (?, ?, ?, ?)
+        INSERT OR IGNORE INTO decompilation_tasks (class_name, symbol_name, image, address, unit, assembly_code, status, model_tier)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?)
     `)
 	if err != nil {
 		return fmt.Errorf("failed to prepare statement: %w", err)
@@ -110,7 +501,7 @@ func (s *TaskStore) AddTasks(ctx context.Context, tasks []*Task) error {
 	defer stmt.Close()
 
 	for _, task := range tasks {
-		_, err := stmt.ExecContext(ctx, task.ClassName, task.SymbolName, task.AssemblyCode, string(StatusPending))
+		_, err := stmt.ExecContext(ctx, task.ClassName, task.SymbolName, task.Image, int64(task.Address), task.Unit, task.AssemblyCode, string(StatusPending), task.ModelTier)
 		if err != nil {
 			return fmt.Errorf("failed to execute statement for task %s: %w", task.SymbolName, err)
 		}
@@ -119,8 +510,237 @@ func (s *TaskStore) AddTasks(ctx context.Context, tasks []*Task) error {
 	return tx.Commit()
 }
 
+// AddClasses stores the runtime metadata of scanned classes, replacing any
+// earlier metadata for the same class of the same image.
+func (s *TaskStore) AddClasses(ctx context.Context, classes []*ClassInfo) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `INSERT OR REPLACE INTO classes (name, image, metadata) VALUES (?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, class := range classes {
+		metadata, err := json.Marshal(class)
+		if err != nil {
+			return fmt.Errorf("failed to encode metadata for class %s: %w", class.Name, err)
+		}
+		if _, err := stmt.ExecContext(ctx, class.Name, class.Image, string(metadata)); err != nil {
+			return fmt.Errorf("failed to execute statement for class %s: %w", class.Name, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetClass returns the stored metadata for a class of an image, or nil if
+// the scanner recorded none. A class of another image is returned when it is
+// the only one of that name, as for a category extending a class of another
+// image.
+func (s *TaskStore) GetClass(ctx context.Context, image, name string) (*ClassInfo, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT COALESCE(image, ''), metadata FROM classes WHERE name = ?`, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query class %s: %w", name, err)
+	}
+	defer rows.Close()
+
+	var found []string
+	for rows.Next() {
+		var classImage, metadata string
+		if err := rows.Scan(&classImage, &metadata); err != nil {
+			return nil, fmt.Errorf("failed to scan class %s: %w", name, err)
+		}
+		if classImage == image {
+			found = []string{metadata}
+			break
+		}
+		found = append(found, metadata)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query class %s: %w", name, err)
+	}
+	if len(found) != 1 {
+		return nil, nil
+	}
+	var class ClassInfo
+	if err := json.Unmarshal([]byte(found[0]), &class); err != nil {
+		return nil, fmt.Errorf("failed to decode metadata for class %s: %w", name, err)
+	}
+	return &class, nil
+}
+
+// GetAllClasses returns the stored metadata of every class, sorted by name
+// and image.
+func (s *TaskStore) GetAllClasses(ctx context.Context) ([]*ClassInfo, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT name, metadata FROM classes ORDER BY name, image`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query classes: %w", err)
+	}
+	defer rows.Close()
+
+	var classes []*ClassInfo
+	for rows.Next() {
+		var name, metadata string
+		if err := rows.Scan(&name, &metadata); err != nil {
+			return nil, fmt.Errorf("failed to scan class: %w", err)
+		}
+		var class ClassInfo
+		if err := json.Unmarshal([]byte(metadata), &class); err != nil {
+			return nil, fmt.Errorf("failed to decode metadata for class %s: %w", name, err)
+		}
+		classes = append(classes, &class)
+	}
+	return classes, rows.Err()
+}
+
+// AddProtocols stores the runtime metadata of scanned protocols, replacing
+// any earlier metadata for the same protocol of the same image.
+func (s *TaskStore) AddProtocols(ctx context.Context, protocols []*ProtocolInfo) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `INSERT OR REPLACE INTO protocols (name, image, metadata) VALUES (?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, protocol := range protocols {
+		metadata, err := json.Marshal(protocol)
+		if err != nil {
+			return fmt.Errorf("failed to encode metadata for protocol %s: %w", protocol.Name, err)
+		}
+		if _, err := stmt.ExecContext(ctx, protocol.Name, protocol.Image, string(metadata)); err != nil {
+			return fmt.Errorf("failed to execute statement for protocol %s: %w", protocol.Name, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetAllProtocols returns the stored metadata of every protocol, sorted by
+// name and image.
+func (s *TaskStore) GetAllProtocols(ctx context.Context) ([]*ProtocolInfo, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT name, metadata FROM protocols ORDER BY name, image`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query protocols: %w", err)
+	}
+	defer rows.Close()
+
+	var protocols []*ProtocolInfo
+	for rows.Next() {
+		var name, metadata string
+		if err := rows.Scan(&name, &metadata); err != nil {
+			return nil, fmt.Errorf("failed to scan protocol: %w", err)
+		}
+		var protocol ProtocolInfo
+		if err := json.Unmarshal([]byte(metadata), &protocol); err != nil {
+			return nil, fmt.Errorf("failed to decode metadata for protocol %s: %w", name, err)
+		}
+		protocols = append(protocols, &protocol)
+	}
+	return protocols, rows.Err()
+}
+
+// AddImageSymbols stores the symbol table the annotation pass uses for an image.
+func (s *TaskStore) AddImageSymbols(ctx context.Context, image string, syms *ImageSymbols) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `INSERT OR REPLACE INTO image_symbols (image, kind, address, value) VALUES (?, ?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, kind := range []string{SymbolSelref, SymbolClassref, SymbolCFString, SymbolCString, SymbolFunction} {
+		for addr, value := range syms.byKind(kind) {
+			// SQLite integers are signed; addresses round-trip through int64.
+			if _, err := stmt.ExecContext(ctx, image, kind, int64(addr), value); err != nil {
+				return fmt.Errorf("failed to insert %s symbol %#x: %w", kind, addr, err)
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetImageSymbols loads the symbol table of an image. An image without
+// recorded symbols yields an empty table.
+func (s *TaskStore) GetImageSymbols(ctx context.Context, image string) (*ImageSymbols, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT kind, address, value FROM image_symbols WHERE image = ?`, image)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query symbols for %s: %w", image, err)
+	}
+	defer rows.Close()
+
+	syms := NewImageSymbols()
+	for rows.Next() {
+		var (
+			kind, value string
+			addr        int64
+		)
+		if err := rows.Scan(&kind, &addr, &value); err != nil {
+			return nil, fmt.Errorf("failed to scan symbol row: %w", err)
+		}
+		if m := syms.byKind(kind); m != nil {
+			m[uint64(addr)] = value
+		}
+	}
+	return syms, rows.Err()
+}
+
+// AllImageSymbols loads the symbols of every image, keyed by image.
+func (s *TaskStore) AllImageSymbols(ctx context.Context) (map[string]*ImageSymbols, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT image, kind, address, value FROM image_symbols`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query symbols: %w", err)
+	}
+	defer rows.Close()
+
+	symbols := make(map[string]*ImageSymbols)
+	for rows.Next() {
+		var (
+			image, kind, value string
+			addr               int64
+		)
+		if err := rows.Scan(&image, &kind, &addr, &value); err != nil {
+			return nil, fmt.Errorf("failed to scan symbol row: %w", err)
+		}
+		syms := symbols[image]
+		if syms == nil {
+			syms = NewImageSymbols()
+			symbols[image] = syms
+		}
+		if m := syms.byKind(kind); m != nil {
+			m[uint64(addr)] = value
+		}
+	}
+	return symbols, rows.Err()
+}
+
 // FetchPendingBatch fetches a batch of pending tasks and marks them as "in_flight".
-// This operation is transactional to prevent race conditions.
+// This operation is transactional to prevent race conditions. All tasks in a
+// batch share the same model tier, since a batch is sent to a single model.
+//
+// Tasks whose callees are all decompiled come first, so callers can be shown
+// their callees' summaries. When every pending task still waits on a callee,
+// as happens with call cycles, the least blocked tasks are taken instead.
+// Callees in the caller's own unit don't count, since they are decompiled
+// together; see blockedSchema.
+// A task that belongs to a unit is fetched together with the rest of its
+// unit, regardless of batchSize.
 func (s *TaskStore) FetchPendingBatch(ctx context.Context, batchSize int) ([]*Task, error) {
 	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
 	if err != nil {
@@ -128,12 +748,39 @@ func (s *TaskStore) FetchPendingBatch(ctx context.Context, batchSize int) ([]*Ta
 	}
 	defer tx.Rollback()
 
+	var (
+		headTier, headBlocked int
+		headUnit              string
+	)
+	err = tx.QueryRowContext(ctx, `
+        SELECT model_tier, unit, blocked FROM decompilation_tasks
+        WHERE status = ? ORDER BY blocked, id LIMIT 1`,
+		string(StatusPending),
+	).Scan(&headTier, &headUnit, &headBlocked)
+	if err == sql.ErrNoRows {
+		return []*Task{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query pending tasks: %w", err)
+	}
+
 	query := `
-        SELECT id, class_name, symbol_name, assembly_code, status, retries, created_at, updated_at
+        SELECT id, class_name, symbol_name, image, address, unit, assembly_code, status, retries, model_tier, created_at, updated_at
         FROM decompilation_tasks
-        WHERE status = ?
+        WHERE status = ? AND model_tier = ? AND unit = ?`
+	args := []interface{}{string(StatusPending), headTier, headUnit}
+	limit := batchSize
+	if headUnit == "" {
+		// Only tasks as blocked as the head, read in order from idx_tasks_pending.
+		query += ` AND blocked = ?`
+		args = append(args, headBlocked)
+	} else {
+		limit = -1 // SQLite for no limit
+	}
+	query += `
+        ORDER BY id
         LIMIT ?`
-	rows, err := tx.QueryContext(ctx, query, string(StatusPending), batchSize)
+	rows, err := tx.QueryContext(ctx, query, append(args, limit)...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query pending tasks: %w", err)
 	}
@@ -143,12 +790,14 @@ func (s *TaskStore) FetchPendingBatch(ctx context.Context, batchSize int) ([]*Ta
 	var taskIDs []int64
 	for rows.Next() {
 		var task Task
+		var address int64
 		if err := rows.Scan(
-			&task.ID, &task.ClassName, &task.SymbolName, &task.AssemblyCode,
-			&task.Status, &task.Retries, &task.CreatedAt, &task.UpdatedAt,
+			&task.ID, &task.ClassName, &task.SymbolName, &task.Image, &address, &task.Unit, &task.AssemblyCode,
+			&task.Status, &task.Retries, &task.ModelTier, &task.CreatedAt, &task.UpdatedAt,
 		); err != nil {
 			return nil, fmt.Errorf("failed to scan task row: %w", err)
 		}
+		task.Address = uint64(address)
 		tasks = append(tasks, &task)
 		taskIDs = append(taskIDs, task.ID)
 	}
@@ -161,16 +810,9 @@ func (s *TaskStore) FetchPendingBatch(ctx context.Context, batchSize int) ([]*Ta
 	}
 
 	// Mark the fetched tasks as "in_flight"
-	updateQuery := `UPDATE decompilation_tasks SET status = ?, updated_at = CURRENT_TIMESTAMP WHERE id IN (`
-	for i := range taskIDs {
-		updateQuery += "?"
-		if i < len(taskIDs)-1 {
-			updateQuery += ","
-		}
-	}
-	updateQuery += ")"
+	updateQuery := `UPDATE decompilation_tasks SET status = ?, updated_at = CURRENT_TIMESTAMP WHERE id IN (` + placeholders(len(taskIDs)) + `)`
 
-	args := []interface{}{string(StatusInFlight)}
+	args = []interface{}{string(StatusInFlight)}
 	for _, id := range taskIDs {
 		args = append(args, id)
 	}
@@ -187,19 +829,101 @@ func (s *TaskStore) FetchPendingBatch(ctx context.Context, batchSize int) ([]*Ta
 	return tasks, nil
 }
 
+// ReleaseTasks returns in-flight tasks to the pending queue without touching
+// their retry count. It is used when a batch could not be sent for reasons
+// outside the tasks' control, such as provider backpressure.
+func (s *TaskStore) ReleaseTasks(ctx context.Context, taskIDs []int64) error {
+	if len(taskIDs) == 0 {
+		return nil
+	}
+	query := `UPDATE decompilation_tasks SET status = ?, updated_at = CURRENT_TIMESTAMP
+        WHERE status = ? AND id IN (` + placeholders(len(taskIDs)) + `)`
+	args := []interface{}{string(StatusPending), string(StatusInFlight)}
+	for _, id := range taskIDs {
+		args = append(args, id)
+	}
+	if _, err := s.db.ExecContext(ctx, query, args...); err != nil {
+		return fmt.Errorf("failed to release tasks: %w", err)
+	}
+	return nil
+}
+
+// placeholders returns a comma-separated list of n SQL bind parameters.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+// ResultInfo describes how a successful result was produced.
+type ResultInfo struct {
+	Model         string
+	PromptVersion string
+	Summary       string
+	// Validation is the syntax check outcome, empty when it was not run.
+	Validation       string
+	ValidationErrors string
+	// Fidelity compares the result with the assembly; nil if not checked.
+	Fidelity *Fidelity
+}
+
 // UpdateTaskSuccess updates a task as successfully completed.
-func (s *TaskStore) UpdateTaskSuccess(ctx context.Context, taskID int64, decompiledSource string) error {
+func (s *TaskStore) UpdateTaskSuccess(ctx context.Context, taskID int64, decompiledSource string, info ResultInfo) error {
 	query := `
         UPDATE decompilation_tasks
-        SET status = ?, decompiled_source = ?, updated_at = CURRENT_TIMESTAMP
+        SET status = ?, decompiled_source = ?, model = ?, prompt_version = ?, summary = ?,
+            validation = NULLIF(?, ''), validation_errors = NULLIF(?, ''),
+            fidelity = ?, fidelity_issues = ?, updated_at = CURRENT_TIMESTAMP
         WHERE id = ?`
-	_, err := s.db.ExecContext(ctx, query, string(StatusCompleted), decompiledSource, taskID)
+	var fidelity sql.NullFloat64
+	var fidelityIssues sql.NullString
+	if f := info.Fidelity; f != nil {
+		fidelity = sql.NullFloat64{Float64: f.Score, Valid: true}
+		if len(f.Missing)+len(f.Hallucinated) > 0 {
+			data, err := json.Marshal(f)
+			if err != nil {
+				return fmt.Errorf("failed to encode fidelity issues: %w", err)
+			}
+			fidelityIssues = sql.NullString{String: string(data), Valid: true}
+		}
+	}
+	_, err := s.db.ExecContext(ctx, query, string(StatusCompleted), decompiledSource, info.Model, info.PromptVersion, info.Summary,
+		info.Validation, info.ValidationErrors, fidelity, fidelityIssues, taskID)
 	if err != nil {
 		return fmt.Errorf("failed to update task as successful: %w", err)
 	}
 	return nil
 }
 
+// ReuseResults completes pending tasks with copies of earlier results, keyed
+// by the ID of the task each one is copied to. The source, model, prompt
+// version, summary, validation and fidelity are copied as they were.
+func (s *TaskStore) ReuseResults(ctx context.Context, results map[int64]*Task) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `
+        UPDATE decompilation_tasks
+        SET status = ?, decompiled_source = ?, model = ?, prompt_version = ?, summary = ?,
+            validation = ?, validation_errors = ?, fidelity = ?, fidelity_issues = ?,
+            updated_at = CURRENT_TIMESTAMP
+        WHERE id = ? AND status = ?`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	for id, r := range results {
+		_, err := stmt.ExecContext(ctx, string(StatusCompleted), r.DecompiledSource, r.Model, r.PromptVersion, r.Summary,
+			r.Validation, r.ValidationErrors, r.Fidelity, r.FidelityIssues, id, string(StatusPending))
+		if err != nil {
+			return fmt.Errorf("failed to reuse result of %s: %w", r.SymbolName, err)
+		}
+	}
+	return tx.Commit()
+}
+
 // UpdateTaskFailure updates a task as failed.
 func (s *TaskStore) UpdateTaskFailure(ctx context.Context, taskID int64, errorMessage string, retryCount int) error {
 	query := `
@@ -213,6 +937,235 @@ func (s *TaskStore) UpdateTaskFailure(ctx context.Context, taskID int64, errorMe
 	return nil
 }
 
+// RetryTask puts a task back in the pending queue on its current model tier,
+// recording the retry and the reason for it.
+func (s *TaskStore) RetryTask(ctx context.Context, taskID int64, retryCount int, reason string) error {
+	query := `
+        UPDATE decompilation_tasks
+        SET status = ?, retries = ?, error_message = ?, updated_at = CURRENT_TIMESTAMP
+        WHERE id = ?`
+	_, err := s.db.ExecContext(ctx, query, string(StatusPending), retryCount, reason, taskID)
+	if err != nil {
+		return fmt.Errorf("failed to retry task: %w", err)
+	}
+	return nil
+}
+
+// EscalateTask moves a task to a higher model tier and puts it back in the
+// pending queue. The reason is kept as the task's error message so the history
+// of why it escalated is not lost.
+func (s *TaskStore) EscalateTask(ctx context.Context, taskID int64, tier int, reason string) error {
+	query := `
+        UPDATE decompilation_tasks
+        SET status = ?, model_tier = ?, error_message = ?, updated_at = CURRENT_TIMESTAMP
+        WHERE id = ?`
+	_, err := s.db.ExecContext(ctx, query, string(StatusPending), tier, reason, taskID)
+	if err != nil {
+		return fmt.Errorf("failed to escalate task: %w", err)
+	}
+	return nil
+}
+
+// AddCallEdges records the static call graph. Edges are given by symbol name
+// and image, and ignored when either end has no task.
+func (s *TaskStore) AddCallEdges(ctx context.Context, edges []CallEdge) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `
+        INSERT OR IGNORE INTO call_edges (caller_id, callee_id)
+        SELECT caller.id, callee.id
+        FROM decompilation_tasks caller, decompilation_tasks callee
+        WHERE caller.symbol_name = ? AND caller.image = ? AND callee.symbol_name = ? AND callee.image = ?`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, edge := range edges {
+		if _, err := stmt.ExecContext(ctx, edge.Caller, edge.CallerImage, edge.Callee, edge.CalleeImage); err != nil {
+			return fmt.Errorf("failed to insert call edge %s -> %s: %w", edge.Caller, edge.Callee, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetCalleeSummaries returns, for each of the given tasks, the signature and
+// summary of every callee that has already been decompiled.
+func (s *TaskStore) GetCalleeSummaries(ctx context.Context, taskIDs []int64) (map[int64][]CalleeSummary, error) {
+	summaries := make(map[int64][]CalleeSummary)
+	if len(taskIDs) == 0 {
+		return summaries, nil
+	}
+	query := `
+        SELECT e.caller_id, c.symbol_name, c.decompiled_source, COALESCE(c.summary, '')
+        FROM call_edges e
+        JOIN decompilation_tasks c ON c.id = e.callee_id
+        WHERE c.status = ? AND c.decompiled_source IS NOT NULL AND e.caller_id IN (` + placeholders(len(taskIDs)) + `)
+        ORDER BY e.caller_id, c.symbol_name`
+	args := []interface{}{string(StatusCompleted)}
+	for _, id := range taskIDs {
+		args = append(args, id)
+	}
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query callee summaries: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			callerID int64
+			callee   CalleeSummary
+			source   string
+		)
+		if err := rows.Scan(&callerID, &callee.SymbolName, &source, &callee.Summary); err != nil {
+			return nil, fmt.Errorf("failed to scan callee row: %w", err)
+		}
+		callee.Signature = signatureOf(source)
+		summaries[callerID] = append(summaries[callerID], callee)
+	}
+	return summaries, rows.Err()
+}
+
+// SaveCandidates stores every ensemble candidate for a task, replacing those
+// from earlier attempts, along with the disagreements found between them.
+func (s *TaskStore) SaveCandidates(ctx context.Context, taskID int64, candidates []Candidate, disagreements string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM ensemble_candidates WHERE task_id = ?`, taskID); err != nil {
+		return fmt.Errorf("failed to clear previous candidates: %w", err)
+	}
+	for _, c := range candidates {
+		_, err := tx.ExecContext(ctx, `
+            INSERT INTO ensemble_candidates (task_id, model, prompt_version, decompiled_source, summary, selected)
+            VALUES (?, ?, ?, ?, ?, ?)`, taskID, c.Model, c.PromptVersion, c.DecompiledSource, c.Summary, c.Selected)
+		if err != nil {
+			return fmt.Errorf("failed to insert candidate from %s: %w", c.Model, err)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE decompilation_tasks SET disagreements = ? WHERE id = ?`, disagreements, taskID); err != nil {
+		return fmt.Errorf("failed to store disagreements: %w", err)
+	}
+	return tx.Commit()
+}
+
+// GetCandidates returns the ensemble candidates stored for a task.
+func (s *TaskStore) GetCandidates(ctx context.Context, taskID int64) ([]Candidate, error) {
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT id, task_id, model, COALESCE(prompt_version, ''), decompiled_source, COALESCE(summary, ''), selected
+        FROM ensemble_candidates
+        WHERE task_id = ?
+        ORDER BY id`, taskID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query candidates: %w", err)
+	}
+	defer rows.Close()
+
+	var candidates []Candidate
+	for rows.Next() {
+		var c Candidate
+		if err := rows.Scan(&c.ID, &c.TaskID, &c.Model, &c.PromptVersion, &c.DecompiledSource, &c.Summary, &c.Selected); err != nil {
+			return nil, fmt.Errorf("failed to scan candidate row: %w", err)
+		}
+		candidates = append(candidates, c)
+	}
+	return candidates, rows.Err()
+}
+
+// StartRun records the start of a decompilation run and returns its ID, under
+// which the run's token usage is stored. A budget of zero means none.
+func (s *TaskStore) StartRun(ctx context.Context, budget float64) (int64, error) {
+	res, err := s.db.ExecContext(ctx, `INSERT INTO runs (budget) VALUES (NULLIF(?, 0))`, budget)
+	if err != nil {
+		return 0, fmt.Errorf("failed to start run: %w", err)
+	}
+	return res.LastInsertId()
+}
+
+// RecordUsage stores the tasks' shares of one model call.
+func (s *TaskStore) RecordUsage(ctx context.Context, runID int64, model string, usage []TaskUsage) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, u := range usage {
+		_, err := tx.ExecContext(ctx, `
+            INSERT INTO task_usage (task_id, run_id, model, prompt_tokens, completion_tokens, cost, estimated)
+            VALUES (?, ?, ?, ?, ?, ?, ?)`, u.TaskID, runID, model, u.PromptTokens, u.CompletionTokens, u.Cost, u.Estimated)
+		if err != nil {
+			return fmt.Errorf("failed to record usage of task %d: %w", u.TaskID, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// Cost report groupings accepted by CostReport.
+const (
+	CostByClass = "class"
+	CostByModel = "model"
+	CostByRun   = "run"
+)
+
+// CostRow is one line of a cost report.
+type CostRow struct {
+	// Key is the class, model or run ID the row covers.
+	Key              string
+	Tasks            int64
+	PromptTokens     int64
+	CompletionTokens int64
+	Cost             float64
+	// Estimated is set when some of the usage was estimated rather than
+	// reported by the provider.
+	Estimated bool
+}
+
+// CostReport sums the recorded token usage by class, model or run, most
+// expensive first.
+func (s *TaskStore) CostReport(ctx context.Context, by string) ([]CostRow, error) {
+	var key string
+	switch by {
+	case CostByClass:
+		key = "t.class_name"
+	case CostByModel:
+		key = "u.model"
+	case CostByRun:
+		key = "CAST(u.run_id AS TEXT)"
+	default:
+		return nil, fmt.Errorf("unknown cost grouping %q, want class, model or run", by)
+	}
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT `+key+`, COUNT(DISTINCT u.task_id), SUM(u.prompt_tokens), SUM(u.completion_tokens), SUM(u.cost), MAX(u.estimated)
+        FROM task_usage u
+        JOIN decompilation_tasks t ON t.id = u.task_id
+        GROUP BY 1
+        ORDER BY 5 DESC, 1`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query cost report: %w", err)
+	}
+	defer rows.Close()
+
+	var report []CostRow
+	for rows.Next() {
+		var r CostRow
+		if err := rows.Scan(&r.Key, &r.Tasks, &r.PromptTokens, &r.CompletionTokens, &r.Cost, &r.Estimated); err != nil {
+			return nil, fmt.Errorf("failed to scan cost row: %w", err)
+		}
+		report = append(report, r)
+	}
+	return report, rows.Err()
+}
+
 // GetProgress returns the number of completed tasks and the total number of tasks.
 func (s *TaskStore) GetProgress() (completed int64, total int64, err error) {
 	err = s.db.QueryRow(`SELECT COUNT(*) FROM decompilation_tasks WHERE status = ?`, string(StatusCompleted)).Scan(&completed)
@@ -228,10 +1181,64 @@ func (s *TaskStore) GetProgress() (completed int64, total int64, err error) {
 	return completed, total, nil
 }
 
+// GetAllTasks returns every task whatever its status, with its result or
+// error, ordered by class and symbol.
+func (s *TaskStore) GetAllTasks(ctx context.Context) ([]*Task, error) {
+	var tasks []*Task
+	err := s.ForEachTask(ctx, false, func(task *Task) error {
+		tasks = append(tasks, task)
+		return nil
+	})
+	return tasks, err
+}
+
+// ForEachTask calls fn with each task, ordered by class and symbol, without
+// loading them all into memory. With completedOnly, only tasks with a result
+// are visited. fn must not use the store, whose single connection is busy
+// until the iteration ends; an error from fn stops it.
+func (s *TaskStore) ForEachTask(ctx context.Context, completedOnly bool, fn func(*Task) error) error {
+	query := `
+		SELECT id, class_name, symbol_name, image, address, assembly_code, status, retries, model_tier,
+		       model, prompt_version, decompiled_source, summary, validation, validation_errors,
+		       fidelity, fidelity_issues, error_message, created_at, updated_at
+		FROM decompilation_tasks`
+	var args []any
+	if completedOnly {
+		query += `
+		WHERE status = ? AND decompiled_source IS NOT NULL`
+		args = append(args, string(StatusCompleted))
+	}
+	query += `
+		ORDER BY class_name, symbol_name`
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query tasks: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var task Task
+		var address int64
+		if err := rows.Scan(&task.ID, &task.ClassName, &task.SymbolName, &task.Image, &address, &task.AssemblyCode, &task.Status, &task.Retries, &task.ModelTier,
+			&task.Model, &task.PromptVersion, &task.DecompiledSource, &task.Summary, &task.Validation, &task.ValidationErrors,
+			&task.Fidelity, &task.FidelityIssues, &task.ErrorMessage, &task.CreatedAt, &task.UpdatedAt); err != nil {
+			return fmt.Errorf("failed to scan task row: %w", err)
+		}
+		task.Address = uint64(address)
+		if err := fn(&task); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error during task iteration: %w", err)
+	}
+	return nil
+}
+
 // GetAllCompletedTasks retrieves all successfully completed tasks from the database.
 func (s *TaskStore) GetAllCompletedTasks() ([]*Task, error) {
 	rows, err := s.db.Query(`
-		SELECT id, class_name, symbol_name, decompiled_source
+		SELECT id, class_name, symbol_name, image, address, assembly_code, model, prompt_version, validation, fidelity, decompiled_source
 		FROM decompilation_tasks
 		WHERE status = ? AND decompiled_source IS NOT NULL
 		ORDER BY class_name, symbol_name
@@ -244,9 +1251,11 @@ func (s *TaskStore) GetAllCompletedTasks() ([]*Task, error) {
 	var tasks []*Task
 	for rows.Next() {
 		var task Task
-		if err := rows.Scan(&task.ID, &task.ClassName, &task.SymbolName, &task.DecompiledSource); err != nil {
+		var address int64
+		if err := rows.Scan(&task.ID, &task.ClassName, &task.SymbolName, &task.Image, &address, &task.AssemblyCode, &task.Model, &task.PromptVersion, &task.Validation, &task.Fidelity, &task.DecompiledSource); err != nil {
 			return nil, fmt.Errorf("failed to scan completed task row: %w", err)
 		}
+		task.Address = uint64(address)
 		tasks = append(tasks, &task)
 	}
 
@@ -255,4 +1264,4 @@ func (s *TaskStore) GetAllCompletedTasks() ([]*Task, error) {
 	}
 
 	return tasks, nil
-}
\ No newline at end of file
+}
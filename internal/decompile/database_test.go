@@ -1,8 +1,12 @@
 package decompile
 
 import (
+	"bytes"
 	"context"
+	"database/sql"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 )
@@ -73,4 +77,403 @@ func TestFetchPendingBatch_Transactional(t *testing.T) {
 	if len(seenIDs) != 4 {
 		t.Errorf("expected to fetch 4 unique tasks, but got %d", len(seenIDs))
 	}
-}
\ No newline at end of file
+}
+
+func TestFetchPendingBatch_SingleModelTier(t *testing.T) {
+	store := setupTestDB(t)
+	defer store.Close()
+
+	ctx := context.Background()
+	tasks := []*Task{
+		{ClassName: "Test", SymbolName: "small1", AssemblyCode: "...", ModelTier: 0},
+		{ClassName: "Test", SymbolName: "large", AssemblyCode: "...", ModelTier: 1},
+		{ClassName: "Test", SymbolName: "small2", AssemblyCode: "...", ModelTier: 0},
+	}
+	if err := store.AddTasks(ctx, tasks); err != nil {
+		t.Fatalf("failed to add tasks: %v", err)
+	}
+
+	first, err := store.FetchPendingBatch(ctx, 10)
+	if err != nil {
+		t.Fatalf("fetch pending batch failed: %v", err)
+	}
+	if len(first) != 2 || first[0].ModelTier != 0 || first[1].ModelTier != 0 {
+		t.Fatalf("expected both tier 0 tasks in the first batch, got %d tasks", len(first))
+	}
+
+	// Escalating a task moves it into the next tier's queue.
+	if err := store.EscalateTask(ctx, first[0].ID, 1, "low quality"); err != nil {
+		t.Fatalf("escalate task failed: %v", err)
+	}
+	second, err := store.FetchPendingBatch(ctx, 10)
+	if err != nil {
+		t.Fatalf("fetch pending batch failed: %v", err)
+	}
+	if len(second) != 2 {
+		t.Fatalf("expected escalated task to join the tier 1 batch, got %d tasks", len(second))
+	}
+	for _, task := range second {
+		if task.ModelTier != 1 {
+			t.Errorf("task %s has tier %d, want 1", task.SymbolName, task.ModelTier)
+		}
+	}
+}
+
+func TestFetchPendingBatch_CalleesFirst(t *testing.T) {
+	store := setupTestDB(t)
+	defer store.Close()
+
+	ctx := context.Background()
+	tasks := []*Task{
+		{ClassName: "A", SymbolName: "-[A foo]", AssemblyCode: "..."},
+		{ClassName: "A", SymbolName: "-[A helper:]", AssemblyCode: "..."},
+		{ClassName: "B", SymbolName: "-[B ping]", AssemblyCode: "..."},
+		{ClassName: "B", SymbolName: "-[B pong]", AssemblyCode: "..."},
+	}
+	if err := store.AddTasks(ctx, tasks); err != nil {
+		t.Fatalf("failed to add tasks: %v", err)
+	}
+	edges := []CallEdge{
+		{Caller: "-[A foo]", Callee: "-[A helper:]"},
+		{Caller: "-[B ping]", Callee: "-[B pong]"},
+		{Caller: "-[B pong]", Callee: "-[B ping]"},
+	}
+	if err := store.AddCallEdges(ctx, edges); err != nil {
+		t.Fatalf("failed to add call edges: %v", err)
+	}
+
+	first, err := store.FetchPendingBatch(ctx, 10)
+	if err != nil {
+		t.Fatalf("fetch pending batch failed: %v", err)
+	}
+	if len(first) != 1 || first[0].SymbolName != "-[A helper:]" {
+		t.Fatalf("expected only the leaf in the first batch, got %v", symbolNames(first))
+	}
+	source := "- (void)helper:(id)arg1 {\n    [arg1 retain];\n}"
+	if err := store.UpdateTaskSuccess(ctx, first[0].ID, source, ResultInfo{Summary: "Retains its argument."}); err != nil {
+		t.Fatalf("update task failed: %v", err)
+	}
+
+	second, err := store.FetchPendingBatch(ctx, 10)
+	if err != nil {
+		t.Fatalf("fetch pending batch failed: %v", err)
+	}
+	if len(second) != 1 || second[0].SymbolName != "-[A foo]" {
+		t.Fatalf("expected the caller once its callee is done, got %v", symbolNames(second))
+	}
+	summaries, err := store.GetCalleeSummaries(ctx, []int64{second[0].ID})
+	if err != nil {
+		t.Fatalf("get callee summaries failed: %v", err)
+	}
+	want := CalleeSummary{SymbolName: "-[A helper:]", Signature: "- (void)helper:(id)arg1", Summary: "Retains its argument."}
+	if got := summaries[second[0].ID]; len(got) != 1 || got[0] != want {
+		t.Errorf("callee summaries = %+v, want %+v", got, want)
+	}
+
+	// The cycle never becomes ready; its members are still handed out.
+	third, err := store.FetchPendingBatch(ctx, 10)
+	if err != nil {
+		t.Fatalf("fetch pending batch failed: %v", err)
+	}
+	if len(third) != 2 {
+		t.Fatalf("expected both cycle members, got %v", symbolNames(third))
+	}
+}
+
+func symbolNames(tasks []*Task) []string {
+	names := make([]string, len(tasks))
+	for i, task := range tasks {
+		names[i] = task.SymbolName
+	}
+	return names
+}
+
+func TestFetchPendingBatch_WholeUnit(t *testing.T) {
+	store := setupTestDB(t)
+	defer store.Close()
+
+	ctx := context.Background()
+	tasks := []*Task{
+		{ClassName: "A", SymbolName: "-[A foo]", AssemblyCode: "..."},
+		{ClassName: "A", SymbolName: "-[A helper:]", AssemblyCode: "..."},
+		{ClassName: "A", SymbolName: "-[A bar]", AssemblyCode: "..."},
+		{ClassName: "B", SymbolName: "-[B baz]", AssemblyCode: "..."},
+	}
+	edges := []CallEdge{{Caller: "-[A foo]", Callee: "-[A helper:]"}}
+	AssignUnits(tasks, edges, 5)
+	if err := store.AddTasks(ctx, tasks); err != nil {
+		t.Fatalf("failed to add tasks: %v", err)
+	}
+	if err := store.AddCallEdges(ctx, edges); err != nil {
+		t.Fatalf("failed to add call edges: %v", err)
+	}
+
+	// The unit comes as a whole even though it exceeds the batch size and
+	// contains a caller of a pending callee.
+	first, err := store.FetchPendingBatch(ctx, 2)
+	if err != nil {
+		t.Fatalf("fetch pending batch failed: %v", err)
+	}
+	if len(first) != 3 {
+		t.Fatalf("expected the whole unit A, got %v", symbolNames(first))
+	}
+	for _, task := range first {
+		if task.Unit != "A" {
+			t.Errorf("task %s has unit %q, want A", task.SymbolName, task.Unit)
+		}
+	}
+
+	second, err := store.FetchPendingBatch(ctx, 2)
+	if err != nil {
+		t.Fatalf("fetch pending batch failed: %v", err)
+	}
+	if len(second) != 1 || second[0].Unit != "" {
+		t.Fatalf("expected the lone method of B without a unit, got %v", symbolNames(second))
+	}
+}
+
+func TestOpenTaskStore(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	if _, err := OpenTaskStore(filepath.Join(dir, "typo.db")); err == nil {
+		t.Error("OpenTaskStore opened a missing database")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "typo.db")); !os.IsNotExist(err) {
+		t.Error("OpenTaskStore created the missing database")
+	}
+
+	// A database from before images, summaries and usage were recorded.
+	path := filepath.Join(dir, "old?.db")
+	db, err := sql.Open("sqlite3", "file:"+strings.ReplaceAll(path, "?", "%3f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, query := range []string{oldTaskTable, `INSERT INTO decompilation_tasks (class_name, symbol_name, assembly_code, status, decompiled_source)
+        VALUES ('A', '-[A foo]', 'ret', 'completed', '- (void)foo {}')`} {
+		if _, err := db.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := OpenTaskStore(path)
+	if err != nil {
+		t.Fatalf("OpenTaskStore: %v", err)
+	}
+	tasks, err := store.GetAllTasks(ctx)
+	if err != nil {
+		t.Fatalf("reading an old database: %v", err)
+	}
+	if len(tasks) != 1 || tasks[0].DecompiledSource.String != "- (void)foo {}" || tasks[0].Image != "" || tasks[0].Model.Valid {
+		t.Errorf("got tasks %+v", tasks)
+	}
+	if _, err := store.CostReport(ctx, CostByModel); err != nil {
+		t.Errorf("CostReport without a usage table: %v", err)
+	}
+	if err := store.AddTasks(ctx, []*Task{{ClassName: "B", SymbolName: "-[B bar]", AssemblyCode: "ret"}}); err == nil {
+		t.Error("AddTasks wrote to a read-only store")
+	}
+	store.Close()
+
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Error("OpenTaskStore modified the database")
+	}
+}
+
+// oldTaskTable is the task table of the first databases, keyed by class and
+// symbol alone.
+const oldTaskTable = `
+    CREATE TABLE decompilation_tasks (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        class_name TEXT NOT NULL,
+        symbol_name TEXT NOT NULL,
+        assembly_code TEXT NOT NULL,
+        status TEXT NOT NULL CHECK(status IN ('pending', 'in_flight', 'completed', 'failed')),
+        retries INTEGER DEFAULT 0,
+        decompiled_source TEXT,
+        error_message TEXT,
+        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+        updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+        UNIQUE(class_name, symbol_name)
+    );`
+
+func TestNewTaskStore_MigratesTaskKey(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "old.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, query := range []string{oldTaskTable, `INSERT INTO decompilation_tasks (class_name, symbol_name, assembly_code, status)
+        VALUES ('A', '-[A foo]', 'ret', 'pending'), ('A', '-[A helper]', 'ret', 'pending')`,
+		`CREATE TABLE call_edges (caller_id INTEGER NOT NULL, callee_id INTEGER NOT NULL, PRIMARY KEY (caller_id, callee_id))`,
+		`INSERT INTO call_edges VALUES (1, 2)`} {
+		if _, err := db.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	store, err := NewTaskStore(path)
+	if err != nil {
+		t.Fatalf("NewTaskStore: %v", err)
+	}
+	defer store.Close()
+
+	// The same class in a second image, calling into its own image.
+	err = store.AddTasks(ctx, []*Task{
+		{ClassName: "A", SymbolName: "-[A foo]", Image: "B", AssemblyCode: "ret"},
+		{ClassName: "A", SymbolName: "-[A bar]", Image: "B", AssemblyCode: "ret"},
+		{ClassName: "A", SymbolName: "-[A bar]", AssemblyCode: "ret"},
+	})
+	if err != nil {
+		t.Fatalf("failed to add tasks: %v", err)
+	}
+	tasks, err := store.GetAllTasks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 5 {
+		t.Fatalf("got %d tasks after migrating, want the 2 old tasks and 3 new ones", len(tasks))
+	}
+	if got := blockedCount(t, store, 1); got != 1 {
+		t.Errorf("old caller has %d blocked callees after migrating, want 1", got)
+	}
+	if err := store.AddCallEdges(ctx, []CallEdge{{Caller: "-[A foo]", Callee: "-[A bar]", CallerImage: "B", CalleeImage: "B"}}); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	err = store.db.QueryRow(`
+        SELECT COUNT(*) FROM call_edges e
+        JOIN decompilation_tasks a ON a.id = e.caller_id
+        JOIN decompilation_tasks b ON b.id = e.callee_id
+        WHERE a.image = 'B' OR b.image = 'B'`).Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || blockedCount(t, store, 3) != 1 {
+		t.Errorf("got %d edges into image B, want only foo -> bar within it", n)
+	}
+}
+
+func TestNewTaskStore_MigratesClassKey(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "old.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, query := range []string{oldTaskTable,
+		`CREATE TABLE classes (name TEXT PRIMARY KEY, image TEXT, metadata TEXT NOT NULL)`,
+		`INSERT INTO classes VALUES ('Foo', 'A', '{"name":"Foo","image":"A","superclass":"NSObject"}')`} {
+		if _, err := db.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	store, err := NewTaskStore(path)
+	if err != nil {
+		t.Fatalf("NewTaskStore: %v", err)
+	}
+	defer store.Close()
+
+	// A class of the same name in a second image is kept apart.
+	if err := store.AddClasses(ctx, []*ClassInfo{{Name: "Foo", Image: "B", Superclass: "UIView"}}); err != nil {
+		t.Fatalf("failed to add classes: %v", err)
+	}
+	for image, want := range map[string]string{"A": "NSObject", "B": "UIView"} {
+		class, err := store.GetClass(ctx, image, "Foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if class == nil || class.Superclass != want {
+			t.Errorf("GetClass(%s, Foo) = %+v, want superclass %s", image, class, want)
+		}
+	}
+	// A category in a third image can't tell which Foo it extends.
+	if class, err := store.GetClass(ctx, "C", "Foo"); err != nil || class != nil {
+		t.Errorf("GetClass(C, Foo) = %+v, %v; want nil", class, err)
+	}
+	classes, err := store.GetAllClasses(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(classes) != 2 || classes[0].Image != "A" || classes[1].Image != "B" {
+		t.Errorf("GetAllClasses() = %+v, want Foo of A and of B", classes)
+	}
+}
+
+func blockedCount(t *testing.T, store *TaskStore, id int64) int {
+	t.Helper()
+	var n int
+	if err := store.db.QueryRow(`SELECT blocked FROM decompilation_tasks WHERE id = ?`, id).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestFetchPendingBatch_BlockedCounts(t *testing.T) {
+	store := setupTestDB(t)
+	defer store.Close()
+
+	ctx := context.Background()
+	tasks := []*Task{
+		{ClassName: "A", SymbolName: "-[A foo]", AssemblyCode: "..."},
+		{ClassName: "A", SymbolName: "-[A helper:]", AssemblyCode: "..."},
+		{ClassName: "B", SymbolName: "-[B ping]", Unit: "B", AssemblyCode: "..."},
+		{ClassName: "B", SymbolName: "-[B pong]", Unit: "B", AssemblyCode: "..."},
+	}
+	if err := store.AddTasks(ctx, tasks); err != nil {
+		t.Fatalf("failed to add tasks: %v", err)
+	}
+	edges := []CallEdge{
+		{Caller: "-[A foo]", Callee: "-[A helper:]"},
+		{Caller: "-[A foo]", Callee: "-[B ping]"},
+		// Calls within a unit don't block it.
+		{Caller: "-[B ping]", Callee: "-[B pong]"},
+	}
+	if err := store.AddCallEdges(ctx, edges); err != nil {
+		t.Fatalf("failed to add call edges: %v", err)
+	}
+	if foo, ping := blockedCount(t, store, 1), blockedCount(t, store, 3); foo != 2 || ping != 0 {
+		t.Fatalf("blocked = %d and %d, want 2 for foo and 0 for ping", foo, ping)
+	}
+
+	// Callees block while in flight or released, and stop when they finish,
+	// successfully or not.
+	batch, err := store.FetchPendingBatch(ctx, 1)
+	if err != nil || len(batch) != 1 || batch[0].SymbolName != "-[A helper:]" {
+		t.Fatalf("first batch = %v, %v; want the helper", symbolNames(batch), err)
+	}
+	if err := store.ReleaseTasks(ctx, []int64{batch[0].ID}); err != nil {
+		t.Fatal(err)
+	}
+	if got := blockedCount(t, store, 1); got != 2 {
+		t.Errorf("blocked = %d after releasing a callee, want 2", got)
+	}
+	if err := store.UpdateTaskFailure(ctx, batch[0].ID, "no", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UpdateTaskSuccess(ctx, 3, "- (void)ping {}", ResultInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := blockedCount(t, store, 1); got != 0 {
+		t.Errorf("blocked = %d after the callees finished, want 0", got)
+	}
+	if err := store.RetryTask(ctx, batch[0].ID, 2, "again"); err != nil {
+		t.Fatal(err)
+	}
+	if got := blockedCount(t, store, 1); got != 1 {
+		t.Errorf("blocked = %d after retrying a callee, want 1", got)
+	}
+}
@@ -0,0 +1,383 @@
+package decompile
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"html"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// projectDBName is the database decompile-project creates in its working
+// directory by default.
+const projectDBName = "decompile.db"
+
+// DiffContext is the number of unchanged lines shown around each hunk of a
+// source diff.
+const DiffContext = 3
+
+// LoadRun reads the methods of a decompilation run from a SQLite database, a
+// directory holding the decompile.db of a project, or a JSON or JSON Lines
+// file written by export.
+func LoadRun(ctx context.Context, path string) ([]*ExportRecord, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open run: %w", err)
+	}
+	if fi.IsDir() {
+		path = filepath.Join(path, projectDBName)
+		if _, err := os.Stat(path); err != nil {
+			return nil, fmt.Errorf("failed to open run: %w", err)
+		}
+	}
+
+	var records []*ExportRecord
+	add := func(r *ExportRecord) error {
+		records = append(records, r)
+		return nil
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case "." + ExportJSONL, "." + ExportJSON:
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open run: %w", err)
+		}
+		defer f.Close()
+		if err := ReadExport(f, add); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return records, nil
+	}
+
+	store, err := OpenTaskStore(path)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+	symbols, err := store.AllImageSymbols(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = store.ForEachTask(ctx, false, func(task *Task) error {
+		return add(NewExportRecord(task, symbols[task.Image]))
+	})
+	return records, err
+}
+
+// MethodChange is a method that was added, removed or changed between two
+// runs. Old is nil for added methods and New for removed ones.
+type MethodChange struct {
+	// Key is the method's class and selector, e.g. "-[CMCaptureController
+	// startCapture]", or the symbol of a function.
+	Key string
+	Old *ExportRecord
+	New *ExportRecord
+	// Diff is the unified diff of the decompiled sources of a changed
+	// method, empty if they are identical.
+	Diff string
+}
+
+// RunDiff compares the methods of two runs, typically of two builds of the
+// same firmware.
+type RunDiff struct {
+	Old     string
+	New     string
+	Added   []*MethodChange
+	Removed []*MethodChange
+	Changed []*MethodChange
+	// Unchanged counts the methods whose assembly hashes are equal.
+	Unchanged int
+}
+
+// DiffRuns matches the methods of two runs by image, class and selector, so
+// methods moved to another category or address still pair up. A pair whose
+// assembly hashes are equal is unchanged whatever its sources; any other pair
+// is changed and its sources are diffed.
+func DiffRuns(oldName string, old []*ExportRecord, newName string, new []*ExportRecord) *RunDiff {
+	d := &RunDiff{Old: oldName, New: newName}
+	olds, news := methodsByKey(old), methodsByKey(new)
+	for _, id := range sortedIDs(olds) {
+		o, key := olds[id], id.key
+		n, ok := news[id]
+		switch {
+		case !ok:
+			d.Removed = append(d.Removed, &MethodChange{Key: key, Old: o})
+		case o.AssemblyHash != "" && o.AssemblyHash == n.AssemblyHash:
+			d.Unchanged++
+		case o.AssemblyHash == "" && n.AssemblyHash == "" && o.Source == n.Source:
+			d.Unchanged++
+		default:
+			d.Changed = append(d.Changed, &MethodChange{
+				Key: key, Old: o, New: n,
+				Diff: UnifiedDiff(o.Source, n.Source, oldName+"/"+key, newName+"/"+key, DiffContext),
+			})
+		}
+	}
+	for _, id := range sortedIDs(news) {
+		if _, ok := olds[id]; !ok {
+			d.Added = append(d.Added, &MethodChange{Key: id.key, New: news[id]})
+		}
+	}
+	return d
+}
+
+// diffID identifies a method across runs: its image group and diffKey.
+type diffID struct {
+	group string
+	key   string
+}
+
+// methodsByKey indexes records by image group and diffKey. Every record of
+// a key claimed more than once, by the same selector in two categories, is
+// indexed by its full symbol instead, so the pairing doesn't depend on the
+// order of the records.
+func methodsByKey(records []*ExportRecord) map[diffID]*ExportRecord {
+	claims := make(map[diffID]int, len(records))
+	for _, r := range records {
+		claims[diffID{ImageGroup(r.Image), diffKey(r)}]++
+	}
+	m := make(map[diffID]*ExportRecord, len(records))
+	for _, r := range records {
+		id := diffID{ImageGroup(r.Image), diffKey(r)}
+		if claims[id] > 1 {
+			id.key = r.Symbol
+		}
+		m[id] = r
+	}
+	return m
+}
+
+// sortedIDs returns the keys of m sorted by method, then image group.
+func sortedIDs(m map[diffID]*ExportRecord) []diffID {
+	ids := make([]diffID, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if ids[i].key != ids[j].key {
+			return ids[i].key < ids[j].key
+		}
+		return ids[i].group < ids[j].group
+	})
+	return ids
+}
+
+func diffKey(r *ExportRecord) string {
+	if r.Selector == "" {
+		return r.Symbol
+	}
+	kind := "-"
+	if r.ClassMethod {
+		kind = "+"
+	}
+	return kind + "[" + r.Class + " " + r.Selector + "]"
+}
+
+// WriteText writes the diff as plain text: a summary, the added and removed
+// methods, and the source diff of each changed method.
+func (d *RunDiff) WriteText(w io.Writer) error {
+	b := bufio.NewWriter(w)
+	fmt.Fprintf(b, "--- %s\n+++ %s\n", d.Old, d.New)
+	fmt.Fprintf(b, "%d changed, %d added, %d removed, %d unchanged\n", len(d.Changed), len(d.Added), len(d.Removed), d.Unchanged)
+	if len(d.Added) > 0 {
+		b.WriteString("\nAdded:\n")
+		for _, m := range d.Added {
+			fmt.Fprintf(b, "  %s\t%s\n", m.Key, ImageGroup(m.New.Image))
+		}
+	}
+	if len(d.Removed) > 0 {
+		b.WriteString("\nRemoved:\n")
+		for _, m := range d.Removed {
+			fmt.Fprintf(b, "  %s\t%s\n", m.Key, ImageGroup(m.Old.Image))
+		}
+	}
+	for _, m := range d.Changed {
+		fmt.Fprintf(b, "\nChanged: %s\n", m.Key)
+		if m.Diff != "" {
+			b.WriteString(m.Diff)
+		} else {
+			fmt.Fprintf(b, "  %s\n", m.Note())
+		}
+	}
+	return b.Flush()
+}
+
+// Note explains a changed method whose source diff is empty.
+func (m *MethodChange) Note() string {
+	switch {
+	case m.Old.Source == "" && m.New.Source == "":
+		return "assembly changed; not decompiled in either run"
+	case m.Old.Source == "":
+		return "assembly changed; not decompiled in the old run"
+	case m.New.Source == "":
+		return "assembly changed; not decompiled in the new run"
+	}
+	return "assembly changed; decompiled source is identical"
+}
+
+// RenderHTMLDiff renders a diff as a static page, index.html, with the
+// stylesheet of the HTML report.
+func RenderHTMLDiff(title string, d *RunDiff) ([]OutputFile, error) {
+	style, err := reportFiles.ReadFile("report/style.css")
+	if err != nil {
+		return nil, err
+	}
+	data := struct {
+		Title string
+		*RunDiff
+	}{title, d}
+	var b bytes.Buffer
+	if err := reportTemplates.ExecuteTemplate(&b, "diff.html.tmpl", data); err != nil {
+		return nil, fmt.Errorf("failed to render index.html: %w", err)
+	}
+	return []OutputFile{{Path: "index.html", Content: b.Bytes()}, {Path: "style.css", Content: style}}, nil
+}
+
+// highlightDiff escapes a unified diff and marks up its file header, hunk
+// header, added and removed lines.
+func highlightDiff(diff string) template.HTML {
+	var b strings.Builder
+	for i, line := range strings.Split(strings.TrimSuffix(diff, "\n"), "\n") {
+		class := ""
+		switch {
+		case i < 2:
+			class = "fh"
+		case strings.HasPrefix(line, "@@"):
+			class = "hunk"
+		case strings.HasPrefix(line, "+"):
+			class = "ins"
+		case strings.HasPrefix(line, "-"):
+			class = "del"
+		}
+		fmt.Fprintf(&b, `<span class="dl %s">%s</span>`, class, html.EscapeString(line))
+	}
+	return template.HTML(b.String())
+}
+
+// diffLine is a line of an edit script: ' ' kept, '-' deleted or '+' inserted.
+type diffLine struct {
+	op   byte
+	text string
+}
+
+// UnifiedDiff returns the unified diff of two texts with context lines of
+// context around each hunk, or "" if they are equal.
+func UnifiedDiff(a, b, fromName, toName string, context int) string {
+	if a == b {
+		return ""
+	}
+	script := diffLines(splitLines(a), splitLines(b))
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromName, toName)
+	// Lines of a and b before each entry of the script.
+	aPos, bPos := make([]int, len(script)+1), make([]int, len(script)+1)
+	for i, l := range script {
+		aPos[i+1], bPos[i+1] = aPos[i], bPos[i]
+		if l.op != '+' {
+			aPos[i+1]++
+		}
+		if l.op != '-' {
+			bPos[i+1]++
+		}
+	}
+	for i := 0; i < len(script); {
+		for i < len(script) && script[i].op == ' ' {
+			i++
+		}
+		if i == len(script) {
+			break
+		}
+		// Extend the hunk over changes separated by at most 2*context lines.
+		start, end := max(0, i-context), i+1
+		for j := i + 1; j < len(script); j++ {
+			if script[j].op != ' ' {
+				end = j + 1
+			} else if j-end >= 2*context {
+				break
+			}
+		}
+		end = min(len(script), end+context)
+
+		aStart, aLen := aPos[start], aPos[end]-aPos[start]
+		bStart, bLen := bPos[start], bPos[end]-bPos[start]
+		if aLen > 0 {
+			aStart++
+		}
+		if bLen > 0 {
+			bStart++
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", aStart, aLen, bStart, bLen)
+		for _, l := range script[start:end] {
+			out.WriteByte(l.op)
+			out.WriteString(l.text)
+			out.WriteByte('\n')
+		}
+		i = end
+	}
+	return out.String()
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// diffLines returns a shortest edit script turning a into b, from the longest
+// common subsequence of their lines. Methods are short, so the quadratic
+// table is only built for the lines between the common prefix and suffix.
+func diffLines(a, b []string) []diffLine {
+	var script []diffLine
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		script = append(script, diffLine{' ', a[prefix]})
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	ma, mb := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+
+	// lcs[i][j] is the length of the LCS of ma[i:] and mb[j:].
+	lcs := make([][]int, len(ma)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(mb)+1)
+	}
+	for i := len(ma) - 1; i >= 0; i-- {
+		for j := len(mb) - 1; j >= 0; j-- {
+			if ma[i] == mb[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(ma) || j < len(mb) {
+		switch {
+		case i < len(ma) && j < len(mb) && ma[i] == mb[j]:
+			script = append(script, diffLine{' ', ma[i]})
+			i++
+			j++
+		case j == len(mb) || (i < len(ma) && lcs[i+1][j] >= lcs[i][j+1]):
+			script = append(script, diffLine{'-', ma[i]})
+			i++
+		default:
+			script = append(script, diffLine{'+', mb[j]})
+			j++
+		}
+	}
+	for _, line := range a[len(a)-suffix:] {
+		script = append(script, diffLine{' ', line})
+	}
+	return script
+}
@@ -0,0 +1,165 @@
+package decompile
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	a := "- (void)startCapture {\n    [self.session startRunning];\n    self.running = YES;\n}\n"
+	b := "- (void)startCapture {\n    if (self.running) return;\n    [self.session startRunning];\n    self.running = YES;\n}\n"
+	want := `--- old
++++ new
+@@ -1,4 +1,5 @@
+ - (void)startCapture {
++    if (self.running) return;
+     [self.session startRunning];
+     self.running = YES;
+ }
+`
+	if got := UnifiedDiff(a, b, "old", "new", 3); got != want {
+		t.Errorf("UnifiedDiff() =\n%s\nwant\n%s", got, want)
+	}
+	if got := UnifiedDiff(a, a, "old", "new", 3); got != "" {
+		t.Errorf("UnifiedDiff of equal texts = %q, want empty", got)
+	}
+
+	// Changes far apart get their own hunks.
+	var lines []string
+	for i := 1; i <= 20; i++ {
+		lines = append(lines, strings.Repeat("x", i))
+	}
+	old := strings.Join(lines, "\n")
+	lines[1], lines[17] = "two", "eighteen"
+	got := UnifiedDiff(old, strings.Join(lines, "\n"), "a", "b", 2)
+	if !strings.Contains(got, "@@ -1,4 +1,4 @@\n x\n-xx\n+two\n") || !strings.Contains(got, "@@ -16,5 +16,5 @@\n") {
+		t.Errorf("expected two hunks, got:\n%s", got)
+	}
+
+	// Everything removed.
+	if got := UnifiedDiff("a\nb", "", "a", "b", 3); !strings.Contains(got, "@@ -1,2 +0,0 @@\n-a\n-b\n") {
+		t.Errorf("diff against empty text:\n%s", got)
+	}
+}
+
+func TestDiffRuns(t *testing.T) {
+	rec := func(symbol, hash, source string) *ExportRecord {
+		r := NewExportRecord(&Task{SymbolName: symbol, Status: StatusCompleted}, nil)
+		r.AssemblyHash, r.Source = hash, source
+		return r
+	}
+	old := []*ExportRecord{
+		rec("-[CMCaptureController startCapture]", "aaa", "- (void)startCapture {\n    [self.session startRunning];\n}"),
+		rec("-[CMCaptureController stopCapture]", "bbb", "- (void)stopCapture {\n}"),
+		rec("+[CMCaptureController(Debug) shared]", "ccc", "+ (id)shared {\n}"),
+		rec("-[CMCaptureController setZoom:]", "ddd", "- (void)setZoom:(double)zoom {\n}"),
+		rec("-[CMCaptureController reset]", "eee", ""),
+	}
+	new := []*ExportRecord{
+		rec("-[CMCaptureController startCapture]", "a2", "- (void)startCapture {\n    [self.session startRunning];\n    self.running = YES;\n}"),
+		// Moved out of a category with the same code: unchanged.
+		rec("+[CMCaptureController shared]", "ccc", "+ (instancetype)shared {\n}"),
+		rec("-[CMCaptureController setZoom:]", "ddd", "- (void)setZoom:(double)zoom {\n}"),
+		rec("-[CMCaptureController reset]", "e2", ""),
+		rec("-[CMCaptureController pause]", "fff", "- (void)pause {\n}"),
+	}
+	d := DiffRuns("17.0", old, "17.1", new)
+
+	if d.Unchanged != 2 {
+		t.Errorf("Unchanged = %d, want 2", d.Unchanged)
+	}
+	if len(d.Added) != 1 || d.Added[0].Key != "-[CMCaptureController pause]" {
+		t.Errorf("Added = %v, want pause", d.Added)
+	}
+	if len(d.Removed) != 1 || d.Removed[0].Key != "-[CMCaptureController stopCapture]" {
+		t.Errorf("Removed = %v, want stopCapture", d.Removed)
+	}
+	if len(d.Changed) != 2 || d.Changed[0].Key != "-[CMCaptureController reset]" || d.Changed[1].Key != "-[CMCaptureController startCapture]" {
+		t.Fatalf("Changed = %v, want reset and startCapture", d.Changed)
+	}
+	if d.Changed[0].Diff != "" || d.Changed[0].Note() != "assembly changed; not decompiled in either run" {
+		t.Errorf("reset: diff %q, note %q", d.Changed[0].Diff, d.Changed[0].Note())
+	}
+	if !strings.Contains(d.Changed[1].Diff, "+++ 17.1/-[CMCaptureController startCapture]\n") || !strings.Contains(d.Changed[1].Diff, "+    self.running = YES;\n") {
+		t.Errorf("startCapture diff:\n%s", d.Changed[1].Diff)
+	}
+
+	var text bytes.Buffer
+	if err := d.WriteText(&text); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"2 changed, 1 added, 1 removed, 2 unchanged\n", "Added:\n  -[CMCaptureController pause]", "Removed:\n  -[CMCaptureController stopCapture]", "Changed: -[CMCaptureController startCapture]\n---"} {
+		if !strings.Contains(text.String(), want) {
+			t.Errorf("text output is missing %q:\n%s", want, text.String())
+		}
+	}
+
+	files, err := RenderHTMLDiff("17.0 → 17.1", d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := string(files[0].Content)
+	if files[0].Path != "index.html" || !strings.Contains(page, `<span class="dl ins">+    self.running = YES;</span>`) || !strings.Contains(page, "not decompiled in either run") {
+		t.Errorf("unexpected diff page:\n%s", page)
+	}
+}
+
+func TestDiffRuns_Collisions(t *testing.T) {
+	rec := func(image, symbol, hash string) *ExportRecord {
+		r := NewExportRecord(&Task{SymbolName: symbol, Image: image, Status: StatusCompleted}, nil)
+		r.AssemblyHash = hash
+		return r
+	}
+	const kit, lib = "/System/Library/Frameworks/Kit.framework/Kit", "/usr/lib/libother.dylib"
+	old := []*ExportRecord{
+		rec(kit, "-[A foo]", "aaa"),
+		rec(lib, "-[A foo]", "bbb"),
+		rec(kit, "-[A(One) bar]", "ccc"),
+		rec(kit, "-[A(Two) bar]", "ddd"),
+	}
+	// The same methods in another order: every one must pair up with itself,
+	// whichever record of a colliding key comes first.
+	new := []*ExportRecord{old[3], old[2], old[1], old[0]}
+	d := DiffRuns("17.0", old, "17.1", new)
+	if d.Unchanged != 4 || len(d.Changed)+len(d.Added)+len(d.Removed) != 0 {
+		t.Errorf("got %d unchanged, changed %v, added %v, removed %v; want 4 unchanged", d.Unchanged, d.Changed, d.Added, d.Removed)
+	}
+
+	new = []*ExportRecord{rec(kit, "-[A foo]", "aaa"), rec(lib, "-[A foo]", "b2")}
+	d = DiffRuns("17.0", old[:2], "17.1", new)
+	if d.Unchanged != 1 || len(d.Changed) != 1 || d.Changed[0].New.Image != lib {
+		t.Errorf("got %d unchanged, changed %v; want -[A foo] of libother changed", d.Unchanged, d.Changed)
+	}
+}
+
+func TestLoadRunExport(t *testing.T) {
+	dir := t.TempDir()
+	for _, format := range []string{ExportJSONL, ExportJSON} {
+		var b bytes.Buffer
+		w, _ := NewExportWriter(&b, format)
+		for _, sym := range []string{"-[A a]", "-[A b]"} {
+			if err := w.Write(NewExportRecord(&Task{SymbolName: sym, Address: 0x1000, AssemblyCode: "ret"}, nil)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		w.Close()
+		path := filepath.Join(dir, "run."+format)
+		if err := os.WriteFile(path, b.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		records, err := LoadRun(context.Background(), path)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if len(records) != 2 || records[1].Selector != "b" || records[1].Address != 0x1000 || records[1].AssemblyHash != AssemblyHash("ret", nil) {
+			t.Errorf("%s: got %+v", format, records)
+		}
+	}
+	if _, err := LoadRun(context.Background(), dir); err == nil {
+		t.Error("LoadRun of a directory without decompile.db succeeded")
+	}
+}
@@ -0,0 +1,354 @@
+package decompile
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"strings"
+)
+
+// Ensemble strategies decide which candidate is kept for a method.
+const (
+	// EnsembleSyntax prefers candidates that pass the structural syntax check.
+	EnsembleSyntax = "syntax"
+	// EnsembleConsensus prefers the candidate whose called selectors agree
+	// most with the other candidates.
+	EnsembleConsensus = "consensus"
+	// EnsembleJudge asks a judge model to pick, falling back to consensus.
+	EnsembleJudge = "judge"
+)
+
+// EnsembleConfig describes ensemble mode, in which the same batch is sent to
+// several models and one of their outputs is kept per method.
+type EnsembleConfig struct {
+	Models     []string
+	Strategy   string
+	JudgeModel string
+	// Classes limits ensemble mode to these classes. Empty means all classes.
+	Classes map[string]bool
+}
+
+// Candidate is one model's output for a task decompiled in ensemble mode.
+type Candidate struct {
+	ID               int64
+	TaskID           int64
+	Model            string
+	PromptVersion    string
+	DecompiledSource string
+	Summary          string
+	Selected         bool
+	// Validation and ValidationErrors are the syntax check's verdict on
+	// the source. They are recorded for the kept candidate only.
+	Validation       string
+	ValidationErrors string
+	// errorMessage is the model's reason for failing the method.
+	errorMessage string
+}
+
+// Disagreement is a selector that only some of the ensemble models call.
+type Disagreement struct {
+	Selector string   `json:"selector"`
+	Models   []string `json:"models"`
+}
+
+// ParseEnsembleConfig builds an ensemble configuration from comma-separated
+// flag values. It returns nil when no ensemble models are given.
+func ParseEnsembleConfig(models, strategy, judgeModel, classes string) (*EnsembleConfig, error) {
+	names := splitList(models)
+	if len(names) == 0 {
+		return nil, nil
+	}
+	if len(names) < 2 {
+		return nil, fmt.Errorf("ensemble mode needs at least two models, got %q", models)
+	}
+	switch strategy {
+	case EnsembleSyntax, EnsembleConsensus:
+	case EnsembleJudge:
+		if judgeModel == "" {
+			return nil, fmt.Errorf("the %q ensemble strategy requires a judge model", EnsembleJudge)
+		}
+	default:
+		return nil, fmt.Errorf("unknown ensemble strategy %q", strategy)
+	}
+
+	cfg := &EnsembleConfig{
+		Models:     names,
+		Strategy:   strategy,
+		JudgeModel: judgeModel,
+		Classes:    make(map[string]bool),
+	}
+	for _, class := range splitList(classes) {
+		cfg.Classes[class] = true
+	}
+	return cfg, nil
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// partition separates the tasks that should be decompiled in ensemble mode
+// from the rest. A nil config sends everything down the regular path.
+func (e *EnsembleConfig) partition(tasks []*Task) (ensemble, regular []*Task) {
+	if e == nil {
+		return nil, tasks
+	}
+	for _, task := range tasks {
+		if e.includes(task) {
+			ensemble = append(ensemble, task)
+		} else {
+			regular = append(regular, task)
+		}
+	}
+	return ensemble, regular
+}
+
+// includes reports whether a task is decompiled in ensemble mode.
+func (e *EnsembleConfig) includes(task *Task) bool {
+	return e != nil && (len(e.Classes) == 0 || e.Classes[task.ClassName])
+}
+
+// processEnsemble sends the batch to every ensemble model, stores all their
+// candidates and keeps one per method. Each model's output is syntax checked
+// and repaired like a regular batch, and the kept candidate goes through the
+// same quality and fidelity checks.
+func (w *worker) processEnsemble(ctx context.Context, tasks []*Task) {
+	cfg := w.cfg.Ensemble
+	log.Printf("Worker %d: processing ensemble batch of %d tasks with %s", w.id, len(tasks), strings.Join(cfg.Models, ", "))
+
+	candidates := make(map[string][]Candidate)
+	// failures holds a failed result per method, reported when no model
+	// produced a candidate for it.
+	failures := make(map[string]Candidate)
+	var lastErr error
+	requeued := false
+	for _, model := range cfg.Models {
+		messages, promptVersion, err := w.renderPrompt(ctx, model, tasks)
+		if err != nil {
+			log.Printf("Worker %d: failed to format prompt for %s: %v", w.id, model, err)
+			lastErr = err
+			continue
+		}
+		content, err := w.send(ctx, tasks, model, messages)
+		var results []DecompiledResult
+		if err == nil {
+			results, err = decodeResults(content)
+		}
+		if err == nil {
+			results, err = w.verify(ctx, tasks, model, messages, content, results)
+		}
+		if errors.Is(err, errRequeue) {
+			// The candidates already paid for are kept; only the methods
+			// without one go back to the queue.
+			log.Printf("Worker %d: ensemble model %s refused the batch, keeping the candidates so far", w.id, model)
+			requeued = true
+			break
+		}
+		if err != nil {
+			log.Printf("Worker %d: ensemble model %s failed: %v", w.id, model, err)
+			lastErr = err
+			continue
+		}
+		for _, result := range results {
+			c := Candidate{
+				Model:            model,
+				PromptVersion:    promptVersion,
+				DecompiledSource: result.DecompiledSource,
+				Summary:          result.Summary,
+				Validation:       result.Validation,
+				ValidationErrors: result.ValidationErrors,
+				errorMessage:     result.ErrorMessage,
+			}
+			if result.Success && strings.TrimSpace(result.DecompiledSource) != "" {
+				candidates[result.SymbolName] = append(candidates[result.SymbolName], c)
+			} else {
+				failures[result.SymbolName] = c
+			}
+		}
+	}
+
+	if requeued && ctx.Err() != nil {
+		w.requeue(tasks)
+		return
+	}
+	for _, task := range tasks {
+		cands := candidates[task.SymbolName]
+		if len(cands) == 0 {
+			if requeued {
+				w.requeue([]*Task{task})
+				continue
+			}
+			if f, ok := failures[task.SymbolName]; ok {
+				w.handleResult(ctx, task, f.Model, f.PromptVersion, DecompiledResult{SymbolName: task.SymbolName, ErrorMessage: f.errorMessage})
+				continue
+			}
+			if lastErr == nil {
+				lastErr = fmt.Errorf("no ensemble model produced a result")
+			}
+			w.failBatch(ctx, []*Task{task}, "ensemble", lastErr)
+			continue
+		}
+
+		chosen, judgeVersion := w.chooseCandidate(ctx, task, cands)
+		cands[chosen].Selected = true
+
+		disagreements, err := json.Marshal(findDisagreements(cands))
+		if err != nil {
+			log.Printf("Worker %d: failed to encode disagreements for %s: %v", w.id, task.SymbolName, err)
+		}
+		if err := w.store.SaveCandidates(ctx, task.ID, cands, string(disagreements)); err != nil {
+			log.Printf("Worker %d: failed to store candidates for task %d: %v", w.id, task.ID, err)
+		}
+		c := cands[chosen]
+		// The judge's prompt shaped the result too, so its version is kept.
+		w.handleResult(ctx, task, c.Model, joinVersions(c.PromptVersion, judgeVersion), DecompiledResult{
+			SymbolName:       task.SymbolName,
+			DecompiledSource: c.DecompiledSource,
+			Summary:          c.Summary,
+			Success:          true,
+			Validation:       c.Validation,
+			ValidationErrors: c.ValidationErrors,
+		})
+	}
+}
+
+// chooseCandidate returns the index of the candidate to keep and, when a
+// judge picked it, the version of the judge prompt.
+func (w *worker) chooseCandidate(ctx context.Context, task *Task, cands []Candidate) (int, string) {
+	if len(cands) == 1 {
+		return 0, ""
+	}
+	switch w.cfg.Ensemble.Strategy {
+	case EnsembleSyntax:
+		return pickBySyntax(cands), ""
+	case EnsembleJudge:
+		choice, version, err := w.judge(ctx, task, cands)
+		if err == nil {
+			return choice, version
+		}
+		log.Printf("Worker %d: judge failed for %s, falling back to consensus: %v", w.id, task.SymbolName, err)
+	}
+	return pickByConsensus(cands), ""
+}
+
+// pickBySyntax keeps the first candidate, in model order, with the fewest
+// structural syntax issues, using the quality heuristic to break ties.
+func pickBySyntax(cands []Candidate) int {
+	best, bestScore := 0, math.Inf(-1)
+	for i, c := range cands {
+		score := qualityScore(c.DecompiledSource) - float64(len(CheckDelimiters(c.DecompiledSource)))
+		if score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
+
+// pickByConsensus keeps the candidate whose called selectors overlap most
+// with those of the other candidates. Syntactically clean candidates get a
+// small bonus so they win ties.
+func pickByConsensus(cands []Candidate) int {
+	selectors := make([][]string, len(cands))
+	for i, c := range cands {
+		selectors[i] = MessageSends(c.DecompiledSource)
+	}
+	best, bestScore := 0, math.Inf(-1)
+	for i, c := range cands {
+		score := 0.0
+		for j := range cands {
+			if i != j {
+				score += jaccard(selectors[i], selectors[j])
+			}
+		}
+		if len(CheckDelimiters(c.DecompiledSource)) == 0 {
+			score += 0.1
+		}
+		if score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
+
+// judge asks the judge model which candidate best matches the assembly, and
+// returns its choice with the version of the judge prompt.
+func (w *worker) judge(ctx context.Context, task *Task, cands []Candidate) (int, string, error) {
+	set, err := w.cfg.Prompts.ForModel(w.cfg.Ensemble.JudgeModel)
+	if err != nil {
+		return 0, "", err
+	}
+	sources := make([]string, len(cands))
+	for i, c := range cands {
+		sources[i] = c.DecompiledSource
+	}
+	prompt, err := set.RenderJudge(task, sources)
+	if err != nil {
+		return 0, "", err
+	}
+
+	content, err := w.send(ctx, []*Task{task}, w.cfg.Ensemble.JudgeModel, []ChatMessage{prompt})
+	if err != nil {
+		return 0, "", err
+	}
+
+	var verdict struct {
+		Choice int    `json:"choice"`
+		Reason string `json:"reason"`
+	}
+	start, end := strings.Index(content, "{"), strings.LastIndex(content, "}")
+	if start < 0 || end < start {
+		return 0, "", fmt.Errorf("judge reply contains no JSON object: %q", content)
+	}
+	if err := json.Unmarshal([]byte(content[start:end+1]), &verdict); err != nil {
+		return 0, "", fmt.Errorf("failed to parse judge reply: %w", err)
+	}
+	if verdict.Choice < 0 || verdict.Choice >= len(cands) {
+		return 0, "", fmt.Errorf("judge chose candidate %d of %d", verdict.Choice, len(cands))
+	}
+	log.Printf("Worker %d: judge picked %s for %s: %s", w.id, cands[verdict.Choice].Model, task.SymbolName, verdict.Reason)
+	return verdict.Choice, set.Version, nil
+}
+
+// joinVersions merges two prompt versions of the form "a+b", keeping each
+// part once.
+func joinVersions(a, b string) string {
+	if a == "" {
+		return b
+	}
+	parts := strings.Split(a, "+")
+	for _, v := range strings.Split(b, "+") {
+		if v != "" && !slices.Contains(parts, v) {
+			parts = append(parts, v)
+		}
+	}
+	return strings.Join(parts, "+")
+}
+
+// findDisagreements lists the selectors called by some candidates but not all
+// of them, together with the models whose output calls them.
+func findDisagreements(cands []Candidate) []Disagreement {
+	callers := make(map[string][]string)
+	for _, c := range cands {
+		for _, sel := range MessageSends(c.DecompiledSource) {
+			callers[sel] = append(callers[sel], c.Model)
+		}
+	}
+	disagreements := []Disagreement{}
+	for _, sel := range sortedKeys(callers) {
+		if models := callers[sel]; len(models) < len(cands) {
+			disagreements = append(disagreements, Disagreement{Selector: sel, Models: models})
+		}
+	}
+	return disagreements
+}
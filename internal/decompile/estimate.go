@@ -0,0 +1,265 @@
+package decompile
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"time"
+)
+
+const (
+	// completionRatio is the expected size of decompiled source relative to
+	// the assembly it comes from, in tokens.
+	completionRatio = 0.5
+	// completionOverhead is the expected per-method cost of the JSON wrapper
+	// and summary around the source, in tokens.
+	completionOverhead = 40
+	// judgeCompletion is the expected size of a judge's verdict, in tokens.
+	judgeCompletion = 60
+	// requestOverhead is the expected latency of a request before the first
+	// output token.
+	requestOverhead = 2 * time.Second
+)
+
+// EstimateConfig holds the run settings a dry run is estimated for.
+type EstimateConfig struct {
+	Models      ModelChain
+	BatchSize   int
+	Concurrency int
+	Ensemble    *EnsembleConfig
+	Prompts     *PromptLibrary
+	Prices      PriceTable
+	// RequestsPerMinute and TokensPerMinute are the rate limits, 0 if none.
+	RequestsPerMinute int
+	TokensPerMinute   int
+	// OutputTokensPerSecond is the assumed generation speed of the models.
+	OutputTokensPerSecond float64
+}
+
+// ModelEstimate is the expected usage of one model.
+type ModelEstimate struct {
+	Model            string
+	Requests         int
+	Methods          int
+	PromptTokens     int
+	CompletionTokens int
+	Cost             float64
+	// Priced is false if the model is missing from the price table.
+	Priced bool
+}
+
+// Estimate is the expected cost and duration of decompiling a set of tasks.
+type Estimate struct {
+	Tasks            int
+	Requests         int
+	PromptTokens     int
+	CompletionTokens int
+	Cost             float64
+	// Duration is the expected wall-clock time at the configured concurrency
+	// and rate limits.
+	Duration time.Duration
+	// Models breaks the totals down by model, most expensive first.
+	Models []ModelEstimate
+}
+
+// estimatedRequest is one model call a run is expected to make.
+type estimatedRequest struct {
+	model      string
+	methods    int
+	prompt     int
+	completion int
+}
+
+// EstimateRun predicts the requests, tokens, cost and time it takes to
+// decompile tasks on the first attempt, batched the way the worker pool would
+// batch them and with the prompts it would render. Repairs, retries and
+// escalations are not included. Nothing is sent and nothing is stored.
+func EstimateRun(tasks []*Task, edges []CallEdge, classes []*ClassInfo, symbols map[string]*ImageSymbols, cfg EstimateConfig) (*Estimate, error) {
+	if cfg.BatchSize < 1 {
+		cfg.BatchSize = 1
+	}
+	classInfo := indexClasses(classes)
+	calls := make(map[string][]string)
+	for _, edge := range edges {
+		calls[edge.Caller] = append(calls[edge.Caller], edge.Callee)
+	}
+	var requests []estimatedRequest
+	for _, batch := range estimateBatches(tasks, cfg.BatchSize) {
+		model := cfg.Models.Model(batch[0].ModelTier)
+		if batch[0].Unit != "" {
+			r, err := estimateRequest(batch, model, calls, classInfo, symbols, cfg.Prompts)
+			if err != nil {
+				return nil, err
+			}
+			requests = append(requests, r)
+			continue
+		}
+		ensembleTasks, regularTasks := cfg.Ensemble.partition(batch)
+		if len(regularTasks) > 0 {
+			r, err := estimateRequest(regularTasks, model, calls, classInfo, symbols, cfg.Prompts)
+			if err != nil {
+				return nil, err
+			}
+			requests = append(requests, r)
+		}
+		if len(ensembleTasks) == 0 {
+			continue
+		}
+		var candidates int
+		for _, m := range cfg.Ensemble.Models {
+			r, err := estimateRequest(ensembleTasks, m, calls, classInfo, symbols, cfg.Prompts)
+			if err != nil {
+				return nil, err
+			}
+			requests = append(requests, r)
+			candidates += r.completion
+		}
+		if cfg.Ensemble.Strategy == EnsembleJudge {
+			// One judge call per method, showing its assembly and every candidate.
+			for _, task := range ensembleTasks {
+				requests = append(requests, estimatedRequest{
+					model:      cfg.Ensemble.JudgeModel,
+					methods:    1,
+					prompt:     countTokens(task.AssemblyCode) + candidates/len(ensembleTasks),
+					completion: judgeCompletion,
+				})
+			}
+		}
+	}
+	return summarizeEstimate(len(tasks), requests, cfg), nil
+}
+
+// estimateBatches groups tasks the way FetchPendingBatch hands them out: each
+// unit whole, other tasks in batches of one model tier.
+func estimateBatches(tasks []*Task, batchSize int) [][]*Task {
+	units := make(map[string][]*Task)
+	tiers := make(map[int][]*Task)
+	var unitOrder []string
+	for _, task := range tasks {
+		if task.Unit == "" {
+			tiers[task.ModelTier] = append(tiers[task.ModelTier], task)
+			continue
+		}
+		if _, ok := units[task.Unit]; !ok {
+			unitOrder = append(unitOrder, task.Unit)
+		}
+		units[task.Unit] = append(units[task.Unit], task)
+	}
+
+	var batches [][]*Task
+	for _, unit := range unitOrder {
+		batches = append(batches, units[unit])
+	}
+	for _, tier := range slices.Sorted(maps.Keys(tiers)) {
+		pending := tiers[tier]
+		for len(pending) > 0 {
+			n := min(batchSize, len(pending))
+			batches = append(batches, pending[:n])
+			pending = pending[n:]
+		}
+	}
+	return batches
+}
+
+// estimateRequest renders the prompt for a batch and guesses the size of the
+// answer from the size of the assembly.
+func estimateRequest(tasks []*Task, model string, calls map[string][]string, classes classIndex, symbols map[string]*ImageSymbols, prompts *PromptLibrary) (estimatedRequest, error) {
+	set, err := prompts.ForModel(model)
+	if err != nil {
+		return estimatedRequest{}, err
+	}
+
+	callees := make(map[int64][]CalleeSummary)
+	var batchClasses []*ClassInfo
+	seen := make(map[classKey]bool)
+	annotated := make([]*Task, len(tasks))
+	completion := 0
+	for i, task := range tasks {
+		key := taskClass(task)
+		class := classes.lookup(key)
+		if !seen[key] && class != nil {
+			batchClasses = append(batchClasses, class)
+		}
+		seen[key] = true
+
+		sym, _ := ParseSymbol(task.SymbolName)
+		copied := *task
+		// Tasks have no IDs before they are stored; callees are keyed by position.
+		copied.ID = int64(i + 1)
+		copied.AssemblyCode = AnalyzeAssembly(task.AssemblyCode, symbols[task.Image], class, sym.ClassMethod).Annotated()
+		annotated[i] = &copied
+
+		for _, callee := range calls[task.SymbolName] {
+			// The callee's signature and summary are unknown until it is
+			// decompiled; its symbol name stands in for both.
+			callees[copied.ID] = append(callees[copied.ID], CalleeSummary{SymbolName: callee, Signature: callee, Summary: callee})
+		}
+		completion += int(float64(countTokens(task.AssemblyCode))*completionRatio) + completionOverhead
+	}
+
+	var messages []ChatMessage
+	if unit := tasks[0].Unit; unit != "" {
+		messages, err = set.RenderUnit(unit, annotated, batchClasses, callees)
+	} else {
+		messages, err = set.Render(annotated, batchClasses, callees)
+	}
+	if err != nil {
+		return estimatedRequest{}, fmt.Errorf("failed to render prompt for %s: %w", model, err)
+	}
+	return estimatedRequest{
+		model:      model,
+		methods:    len(tasks),
+		prompt:     countTokens(messagesText(messages)),
+		completion: completion,
+	}, nil
+}
+
+// summarizeEstimate totals the requests by model and works out how long they
+// take with the configured concurrency and rate limits.
+func summarizeEstimate(tasks int, requests []estimatedRequest, cfg EstimateConfig) *Estimate {
+	est := &Estimate{Tasks: tasks, Requests: len(requests)}
+	byModel := make(map[string]int)
+	var busy time.Duration
+	var longest time.Duration
+	tps := cfg.OutputTokensPerSecond
+	if tps <= 0 {
+		tps = 1
+	}
+	for _, r := range requests {
+		i, ok := byModel[r.model]
+		if !ok {
+			i = len(est.Models)
+			byModel[r.model] = i
+			_, priced := cfg.Prices.Lookup(r.model)
+			est.Models = append(est.Models, ModelEstimate{Model: r.model, Priced: priced})
+		}
+		m := &est.Models[i]
+		m.Requests++
+		m.Methods += r.methods
+		m.PromptTokens += r.prompt
+		m.CompletionTokens += r.completion
+		cost, _ := cfg.Prices.Cost(r.model, Usage{PromptTokens: r.prompt, CompletionTokens: r.completion})
+		m.Cost += cost
+
+		est.PromptTokens += r.prompt
+		est.CompletionTokens += r.completion
+		est.Cost += cost
+
+		d := requestOverhead + time.Duration(float64(r.completion)/tps*float64(time.Second))
+		busy += d
+		longest = max(longest, d)
+	}
+
+	workers := max(cfg.Concurrency, 1)
+	est.Duration = max(busy/time.Duration(workers), longest)
+	if cfg.RequestsPerMinute > 0 {
+		est.Duration = max(est.Duration, time.Duration(float64(len(requests))/float64(cfg.RequestsPerMinute)*float64(time.Minute)))
+	}
+	if cfg.TokensPerMinute > 0 {
+		tokens := est.PromptTokens + est.CompletionTokens
+		est.Duration = max(est.Duration, time.Duration(float64(tokens)/float64(cfg.TokensPerMinute)*float64(time.Minute)))
+	}
+	sort.SliceStable(est.Models, func(i, j int) bool { return est.Models[i].Cost > est.Models[j].Cost })
+	return est
+}
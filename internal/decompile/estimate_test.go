@@ -0,0 +1,45 @@
+package decompile
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestEstimateRun(t *testing.T) {
+	tasks := []*Task{
+		{ClassName: "A", SymbolName: "-[A foo]", AssemblyCode: strings.Repeat("0x1000:  nop\n", 40)},
+		{ClassName: "A", SymbolName: "-[A bar]", AssemblyCode: "0x2000:  ret"},
+		{ClassName: "B", SymbolName: "-[B baz]", AssemblyCode: "0x3000:  ret"},
+		{ClassName: "C", SymbolName: "-[C one]", AssemblyCode: "0x4000:  ret", Unit: "C", ModelTier: 1},
+		{ClassName: "C", SymbolName: "-[C two]", AssemblyCode: "0x5000:  ret", Unit: "C", ModelTier: 1},
+	}
+	est, err := EstimateRun(tasks, []CallEdge{{Caller: "-[A foo]", Callee: "-[A bar]"}}, nil, nil, EstimateConfig{
+		Models:                ModelChain{"small", "large"},
+		BatchSize:             2,
+		Concurrency:           2,
+		Prices:                PriceTable{"large": {Prompt: 1, Completion: 1}},
+		OutputTokensPerSecond: 10,
+	})
+	if err != nil {
+		t.Fatalf("EstimateRun failed: %v", err)
+	}
+
+	// The unit goes out whole; the other three methods take two batches.
+	if est.Tasks != 5 || est.Requests != 3 {
+		t.Errorf("got %d tasks in %d requests, want 5 in 3", est.Tasks, est.Requests)
+	}
+	if len(est.Models) != 2 || est.Models[0].Model != "large" || est.Models[0].Requests != 1 || est.Models[1].Requests != 2 {
+		t.Fatalf("unexpected per-model breakdown: %+v", est.Models)
+	}
+	if est.Models[1].Priced || !est.Models[0].Priced {
+		t.Errorf("only the large model has a price: %+v", est.Models)
+	}
+	large := est.Models[0]
+	if want := float64(large.PromptTokens+large.CompletionTokens) / 1e6; math.Abs(est.Cost-want) > 1e-12 {
+		t.Errorf("got cost %v, want %v", est.Cost, want)
+	}
+	if est.Duration < requestOverhead*3/2 {
+		t.Errorf("three requests on two workers estimated at only %s", est.Duration)
+	}
+}
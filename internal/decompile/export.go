@@ -0,0 +1,253 @@
+package decompile
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Export formats.
+const (
+	// ExportJSONL writes one JSON record per line.
+	ExportJSONL = "jsonl"
+	// ExportJSON writes a single JSON array of records.
+	ExportJSON = "json"
+)
+
+// ExportRecord is the machine-readable form of a task written by export.
+type ExportRecord struct {
+	ID          int64   `json:"id"`
+	Class       string  `json:"class"`
+	Symbol      string  `json:"symbol"`
+	Category    string  `json:"category,omitempty"`
+	Selector    string  `json:"selector,omitempty"`
+	ClassMethod bool    `json:"class_method,omitempty"`
+	Image       string  `json:"image,omitempty"`
+	Address     Address `json:"address"`
+	// AssemblyHash identifies the method's code independently of where the
+	// image was loaded; see AssemblyHash.
+	AssemblyHash  string     `json:"assembly_hash"`
+	Status        TaskStatus `json:"status"`
+	Model         string     `json:"model,omitempty"`
+	PromptVersion string     `json:"prompt_version,omitempty"`
+	Source        string     `json:"source,omitempty"`
+	Summary       string     `json:"summary,omitempty"`
+	Validation    string     `json:"validation,omitempty"`
+	Fidelity      *float64   `json:"fidelity,omitempty"`
+	Error         string     `json:"error,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// NewExportRecord converts a task to its export record. syms are the symbols
+// of the task's image, used to hash its assembly; see AssemblyHash.
+func NewExportRecord(task *Task, syms *ImageSymbols) *ExportRecord {
+	r := &ExportRecord{
+		ID:            task.ID,
+		Class:         classOf(task),
+		Symbol:        task.SymbolName,
+		Image:         task.Image,
+		Address:       Address(task.Address),
+		AssemblyHash:  AssemblyHash(task.AssemblyCode, syms),
+		Status:        task.Status,
+		Model:         task.Model.String,
+		PromptVersion: task.PromptVersion.String,
+		Source:        task.DecompiledSource.String,
+		Summary:       task.Summary.String,
+		Validation:    task.Validation.String,
+		Error:         task.ErrorMessage.String,
+		CreatedAt:     task.CreatedAt,
+		UpdatedAt:     task.UpdatedAt,
+	}
+	if sym, ok := ParseSymbol(task.SymbolName); ok {
+		r.Category, r.Selector, r.ClassMethod = sym.Category, sym.Selector, sym.ClassMethod
+	}
+	if task.Fidelity.Valid {
+		f := task.Fidelity.Float64
+		r.Fidelity = &f
+	}
+	return r
+}
+
+// ExportWriter streams records to a writer in one of the export formats, so
+// an export never has to be held in memory.
+type ExportWriter struct {
+	w      io.Writer
+	format string
+	n      int
+}
+
+// NewExportWriter returns a writer of ExportJSONL or ExportJSON records.
+func NewExportWriter(w io.Writer, format string) (*ExportWriter, error) {
+	switch format {
+	case ExportJSONL, ExportJSON:
+		return &ExportWriter{w: w, format: format}, nil
+	}
+	return nil, fmt.Errorf("unknown export format %q (want %s or %s)", format, ExportJSONL, ExportJSON)
+}
+
+// Write writes one record.
+func (e *ExportWriter) Write(r *ExportRecord) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", r.Symbol, err)
+	}
+	if e.format == ExportJSON {
+		sep := ",\n"
+		if e.n == 0 {
+			sep = "[\n"
+		}
+		if _, err := io.WriteString(e.w, sep); err != nil {
+			return err
+		}
+	}
+	e.n++
+	if e.format == ExportJSONL {
+		data = append(data, '\n')
+	}
+	_, err = e.w.Write(data)
+	return err
+}
+
+// Count returns the number of records written.
+func (e *ExportWriter) Count() int {
+	return e.n
+}
+
+// Close ends the export. It does not close the underlying writer.
+func (e *ExportWriter) Close() error {
+	if e.format != ExportJSON {
+		return nil
+	}
+	end := "\n]\n"
+	if e.n == 0 {
+		end = "[]\n"
+	}
+	_, err := io.WriteString(e.w, end)
+	return err
+}
+
+// ReadExport calls fn with each record of an export in either format, one
+// at a time.
+func ReadExport(r io.Reader, fn func(*ExportRecord) error) error {
+	br := bufio.NewReader(r)
+	array := false
+	for {
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+			array = c == '['
+			br.UnreadByte()
+			break
+		}
+	}
+
+	dec := json.NewDecoder(br)
+	if array {
+		if _, err := dec.Token(); err != nil {
+			return fmt.Errorf("failed to read export: %w", err)
+		}
+	}
+	for !array || dec.More() {
+		var rec ExportRecord
+		if err := dec.Decode(&rec); err == io.EOF && !array {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read export record: %w", err)
+		}
+		if err := fn(&rec); err != nil {
+			return err
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return fmt.Errorf("failed to read export: %w", err)
+	}
+	return nil
+}
+
+// hexLiteral matches the hex numbers of a disassembly listing.
+var hexLiteral = regexp.MustCompile(`0x[0-9a-fA-F]+`)
+
+// AssemblyHash returns a SHA-256 of a method's assembly listing that survives
+// the method moving: instruction addresses and comments are dropped, and
+// what is loaded through a page address is replaced by what it resolves to
+// in syms, the symbols of the method's image, such as @selector(start) or
+// @"capture.started". Page addresses, offsets syms can't resolve and other
+// literals large enough to be addresses become placeholders. Two methods
+// with the same hash compile to the same code modulo relocation. syms may be
+// nil. The hash is "" for an empty listing.
+func AssemblyHash(asm string, syms *ImageSymbols) string {
+	if strings.TrimSpace(asm) == "" {
+		return ""
+	}
+	if syms == nil {
+		syms = NewImageSymbols()
+	}
+	// The annotation pass resolves page-relative loads and addresses the
+	// same way for prompts; its notes name the targets.
+	a := AnalyzeAssembly(asm, syms, nil, false)
+	h := sha256.New()
+	pages := make(map[string]bool) // registers holding an adrp page
+	for i, line := range a.Lines {
+		mnemonic, operands := splitInstruction(line)
+		if mnemonic == "" {
+			continue
+		}
+		ops := splitOperands(operands)
+		target := "<pageoff>"
+		if note := a.notes[i]; note != "" {
+			target = note
+		}
+		switch mnemonic {
+		case "adrp":
+			if len(ops) == 2 {
+				ops[1] = "<page>"
+			}
+		case "adr":
+			if len(ops) == 2 {
+				ops[1] = strings.Replace(target, "<pageoff>", "<page>", 1)
+			}
+		case "add":
+			if len(ops) == 3 && pages[regName(ops[1])] {
+				ops[2] = target
+			}
+		case "ldr", "ldur", "ldrb", "ldrh", "ldrsb", "ldrsh", "ldrsw", "str", "stur", "strb", "strh":
+			if len(ops) >= 2 {
+				if base, _, ok := parseMemOperand(ops[1]); ok && pages[base] {
+					ops[1] = "[" + base + ", " + target + "]"
+				}
+			}
+		case "b", "bl":
+			if len(ops) == 1 {
+				if addr, ok := parseImmediate(ops[0]); ok && syms.Functions[addr] != "" {
+					ops[0] = syms.Functions[addr]
+				}
+			}
+		}
+		for i, op := range ops {
+			ops[i] = hexLiteral.ReplaceAllStringFunc(op, func(lit string) string {
+				if v, ok := parseImmediate(lit); ok && v < 0x4000 {
+					return lit
+				}
+				return "<addr>"
+			})
+		}
+		// A register stays a page until something else is written to it.
+		if len(ops) > 0 && !strings.HasPrefix(mnemonic, "st") {
+			dst := regName(ops[0])
+			pages[dst] = mnemonic == "adrp"
+		}
+		fmt.Fprintf(h, "%s %s\n", mnemonic, strings.Join(ops, ", "))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
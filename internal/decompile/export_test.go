@@ -0,0 +1,164 @@
+package decompile
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestAssemblyHash(t *testing.T) {
+	const asm = `0x1a2b3c000:  stp x29, x30, [sp, #-0x10]!
+0x1a2b3c004:  adrp x8, 0x1f5c23000
+0x1a2b3c008:  ldr x1, [x8, #0x5c8] ; @selector(startRunning)
+0x1a2b3c00c:  adrp x2, 0x1e0000000
+0x1a2b3c010:  add x2, x2, #0x1a0
+0x1a2b3c014:  ldr x0, [x0, #0x18]
+0x1a2b3c018:  bl _objc_msgSend
+0x1a2b3c01c:  b 0x1a2b3c100`
+	// The same code, loaded elsewhere and with its data laid out differently.
+	const moved = `0x1b0000200:  stp x29, x30, [sp, #-0x10]!
+0x1b0000204:  adrp x8, 0x1f6000000
+0x1b0000208:  ldr x1, [x8, #0x010]
+0x1b000020c:  adrp x2, 0x1e0004000
+0x1b0000210:  add x2, x2, #0x3f8 ; @"capture.started"
+0x1b0000214:  ldr x0, [x0, #0x18]
+0x1b0000218:  bl _objc_msgSend
+0x1b000021c:  b 0x1b0000300`
+
+	h := AssemblyHash(asm, nil)
+	if len(h) != 64 {
+		t.Fatalf("AssemblyHash() = %q, want a SHA-256 hex digest", h)
+	}
+	if got := AssemblyHash(moved, nil); got != h {
+		t.Errorf("hash of relocated method = %s, want %s", got, h)
+	}
+	// The ivar offset is part of the code, not a relocation.
+	if got := AssemblyHash(strings.Replace(asm, "[x0, #0x18]", "[x0, #0x20]", 1), nil); got == h {
+		t.Error("changing an ivar offset did not change the hash")
+	}
+	if got := AssemblyHash(strings.Replace(asm, "bl _objc_msgSend", "bl _objc_retain", 1), nil); got == h {
+		t.Error("changing a call did not change the hash")
+	}
+	if got := AssemblyHash(" \n", nil); got != "" {
+		t.Errorf("AssemblyHash of empty listing = %q, want empty", got)
+	}
+}
+
+func TestAssemblyHash_ResolvedTargets(t *testing.T) {
+	const asm = `adrp x8, 0x1f5c23000
+ldr x1, [x8, #0x5c8]
+adrp x2, 0x1e0000000
+add x2, x2, #0x1a0
+bl _objc_msgSend`
+	syms := NewImageSymbols()
+	syms.Selrefs[0x1f5c235c8] = "start"
+	syms.Selrefs[0x1f5c235d0] = "stop"
+	syms.CFStrings[0x1e00001a0] = "a"
+	syms.CFStrings[0x1e00001b0] = "b"
+
+	h := AssemblyHash(asm, syms)
+	if got := AssemblyHash(strings.Replace(asm, "#0x5c8", "#0x5d0", 1), syms); got == h {
+		t.Error("loading another selector did not change the hash")
+	}
+	if got := AssemblyHash(strings.Replace(asm, "#0x1a0", "#0x1b0", 1), syms); got == h {
+		t.Error("loading another string did not change the hash")
+	}
+
+	// The same selector and string at other addresses in another build.
+	moved := NewImageSymbols()
+	moved.Selrefs[0x1f6000010] = "start"
+	moved.CFStrings[0x1e00043f8] = "a"
+	relocated := strings.NewReplacer("0x1f5c23000", "0x1f6000000", "#0x5c8", "#0x10", "0x1e0000000", "0x1e0004000", "#0x1a0", "#0x3f8").Replace(asm)
+	if got := AssemblyHash(relocated, moved); got != h {
+		t.Errorf("hash of relocated method = %s, want %s", got, h)
+	}
+}
+
+func TestExport(t *testing.T) {
+	store := setupTestDB(t)
+	defer store.Close()
+	ctx := context.Background()
+
+	tasks := []*Task{
+		{ClassName: "CMCaptureController", SymbolName: "-[CMCaptureController startCapture]", Image: "/S/L/F/CMCapture.framework/CMCapture", Address: 0x1a2b3c000, AssemblyCode: "0x1a2b3c000:  ret"},
+		{ClassName: "CMCaptureController", SymbolName: "+[CMCaptureController(Debug) shared]", AssemblyCode: "ret"},
+		{ClassName: "CMCaptureController", SymbolName: "-[CMCaptureController stopCapture]", AssemblyCode: "ret"},
+	}
+	if err := store.AddTasks(ctx, tasks); err != nil {
+		t.Fatalf("failed to add tasks: %v", err)
+	}
+	all, err := store.GetAllTasks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, task := range all {
+		if strings.Contains(task.SymbolName, "stopCapture") {
+			continue
+		}
+		err := store.UpdateTaskSuccess(ctx, task.ID, "- (void)x {}", ResultInfo{Model: "ollama/codellama", PromptVersion: "v2", Validation: "valid", Fidelity: &Fidelity{Score: 0.75}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	export := func(format string, completedOnly bool) []byte {
+		var b bytes.Buffer
+		w, err := NewExportWriter(&b, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store.ForEachTask(ctx, completedOnly, func(task *Task) error {
+			return w.Write(NewExportRecord(task, nil))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return b.Bytes()
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(export(ExportJSONL, true)), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d JSONL records, want 2 completed:\n%s", len(lines), strings.Join(lines, "\n"))
+	}
+	var first, second ExportRecord
+	if err := json.Unmarshal([]byte(lines[0]), &first); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &second); err != nil {
+		t.Fatal(err)
+	}
+	if first.Symbol != "+[CMCaptureController(Debug) shared]" || first.Category != "Debug" || !first.ClassMethod || first.Selector != "shared" {
+		t.Errorf("first record = %+v, want the Debug category's class method", first)
+	}
+	if second.Address != 0x1a2b3c000 || second.Image == "" || second.Model != "ollama/codellama" || second.PromptVersion != "v2" ||
+		second.Validation != "valid" || second.Fidelity == nil || *second.Fidelity != 0.75 || second.Status != StatusCompleted ||
+		second.AssemblyHash != AssemblyHash("ret", nil) || second.CreatedAt.IsZero() {
+		t.Errorf("second record = %+v", second)
+	}
+	if !strings.Contains(lines[1], `"address":"0x1a2b3c000"`) {
+		t.Errorf("address not written as hex: %s", lines[1])
+	}
+
+	var records []ExportRecord
+	if err := json.Unmarshal(export(ExportJSON, false), &records); err != nil {
+		t.Fatalf("JSON export is not an array: %v", err)
+	}
+	if len(records) != 3 || records[2].Status != StatusPending || records[2].Source != "" {
+		t.Errorf("got %d records with --all, want 3 ending with the pending stopCapture: %+v", len(records), records)
+	}
+
+	var b bytes.Buffer
+	w, _ := NewExportWriter(&b, ExportJSON)
+	w.Close()
+	if b.String() != "[]\n" {
+		t.Errorf("empty JSON export = %q, want []", b.String())
+	}
+	if _, err := NewExportWriter(&b, "csv"); err == nil {
+		t.Error("NewExportWriter accepted an unknown format")
+	}
+}
@@ -0,0 +1,256 @@
+package decompile
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Fidelity compares the selectors, C functions and string literals a method's
+// assembly references with those its decompiled source references.
+type Fidelity struct {
+	// Score is the share of references the two sides agree on, from 0 to 1.
+	Score float64 `json:"score"`
+	// Missing lists references in the assembly the source leaves out.
+	Missing []string `json:"missing,omitempty"`
+	// Hallucinated lists references in the source the assembly never makes.
+	Hallucinated []string `json:"hallucinated,omitempty"`
+}
+
+// String summarizes the mismatches, e.g.
+// "missing @selector(stop), hallucinated NSLog()".
+func (f Fidelity) String() string {
+	var parts []string
+	if len(f.Missing) > 0 {
+		parts = append(parts, "missing "+strings.Join(f.Missing, ", "))
+	}
+	if len(f.Hallucinated) > 0 {
+		parts = append(parts, "hallucinated "+strings.Join(f.Hallucinated, ", "))
+	}
+	if len(parts) == 0 {
+		return "no mismatches"
+	}
+	return strings.Join(parts, "; ")
+}
+
+// runtimeCalls maps Objective-C runtime entry points the compiler emits to
+// the selectors they stand for. Entry points mapped to nothing are ARC and
+// runtime bookkeeping without a counterpart in source.
+var runtimeCalls = map[string][]string{
+	"objc_alloc":                              {"alloc"},
+	"objc_alloc_init":                         {"alloc", "init"},
+	"objc_allocWithZone":                      {"allocWithZone:"},
+	"objc_opt_new":                            {"new"},
+	"objc_opt_class":                          {"class"},
+	"objc_opt_self":                           {"self"},
+	"objc_opt_isKindOfClass":                  {"isKindOfClass:"},
+	"objc_opt_respondsToSelector":             {"respondsToSelector:"},
+	"objc_retain":                             nil,
+	"objc_release":                            nil,
+	"objc_autorelease":                        nil,
+	"objc_autoreleaseReturnValue":             nil,
+	"objc_retainAutorelease":                  nil,
+	"objc_retainAutoreleaseReturnValue":       nil,
+	"objc_retainAutoreleasedReturnValue":      nil,
+	"objc_unsafeClaimAutoreleasedReturnValue": nil,
+	"objc_claimAutoreleasedReturnValue":       nil,
+	"objc_retainBlock":                        nil,
+	"objc_storeStrong":                        nil,
+	"objc_storeWeak":                          nil,
+	"objc_loadWeak":                           nil,
+	"objc_loadWeakRetained":                   nil,
+	"objc_initWeak":                           nil,
+	"objc_destroyWeak":                        nil,
+	"objc_copyWeak":                           nil,
+	"objc_moveWeak":                           nil,
+	"objc_getProperty":                        nil,
+	"objc_setProperty":                        nil,
+	"objc_setProperty_nonatomic":              nil,
+	"objc_setProperty_nonatomic_copy":         nil,
+	"objc_setProperty_atomic":                 nil,
+	"objc_copyStruct":                         nil,
+	"objc_autoreleasePoolPush":                nil,
+	"objc_autoreleasePoolPop":                 nil,
+	"objc_enumerationMutation":                nil,
+	"objc_sync_enter":                         nil,
+	"objc_sync_exit":                          nil,
+	"objc_exception_throw":                    nil,
+	"objc_begin_catch":                        nil,
+	"objc_end_catch":                          nil,
+	"__stack_chk_fail":                        nil,
+	"_Block_object_assign":                    nil,
+	"_Block_object_dispose":                   nil,
+	"_Block_copy":                             nil,
+	"_Block_release":                          nil,
+	"__objc_personality_v0":                   nil,
+	"_Unwind_Resume":                          nil,
+}
+
+// inlineFunctions are functions and macros that usually leave no call in
+// the assembly, so the source using them is not a hallucination.
+var inlineFunctions = map[string]bool{
+	"CGRectMake": true, "CGPointMake": true, "CGSizeMake": true, "CGVectorMake": true,
+	"NSMakeRange": true, "NSMakeRect": true, "NSMakePoint": true, "NSMakeSize": true,
+	"UIEdgeInsetsMake": true, "NSDirectionalEdgeInsetsMake": true,
+	"MIN": true, "MAX": true, "ABS": true, "NSLocalizedString": true,
+	"dispatch_get_main_queue": true, "NSParameterAssert": true, "NSAssert": true,
+	"__builtin_expect": true, "likely": true, "unlikely": true,
+}
+
+// notFunctions are keywords and type names that can precede a parenthesis
+// without being a call.
+var notFunctions = map[string]bool{
+	"if": true, "for": true, "while": true, "switch": true, "return": true,
+	"sizeof": true, "typeof": true, "__typeof__": true, "__typeof": true, "alignof": true,
+	"defined": true, "catch": true, "void": true, "int": true, "char": true,
+	"float": true, "double": true, "long": true, "short": true, "unsigned": true,
+	"signed": true, "BOOL": true, "id": true, "const": true,
+	"instancetype": true, "__attribute__": true, "__block": true, "__weak": true,
+	"__strong": true, "static": true,
+}
+
+var (
+	functionCallPattern  = regexp.MustCompile(`([A-Za-z_][A-Za-z0-9_]*)\s*\(`)
+	stringLiteralPattern = regexp.MustCompile(`"((?:[^"\\\n]|\\.)*)"`)
+	propertyPattern      = regexp.MustCompile(`\.\s*([A-Za-z_][A-Za-z0-9_]*)`)
+)
+
+// CheckFidelity compares the references found by the static pass over a
+// method's assembly with those in its decompiled source. Calls the pass could
+// not resolve, message sends with an unknown selector or branches to unknown
+// addresses, excuse as many unexplained selectors or functions in the source,
+// and addresses it could not resolve as many unexplained strings. ok is false
+// when the pass found no references at all, as without the image's symbols,
+// leaving nothing to score the source against.
+func CheckFidelity(analysis *AsmAnalysis, source string) (f Fidelity, ok bool) {
+	asm := make(map[string]bool)
+	unresolved := make(map[string]int) // reference prefix -> unresolved calls
+	for _, call := range analysis.Calls {
+		switch {
+		case call.IsMessageSend() && call.Selector == "":
+			unresolved["@selector("]++
+		case call.IsMessageSend():
+			asm[selectorRef(call.Selector)] = true
+		case call.Function == "":
+			unresolved["function"]++
+		default:
+			sels, isRuntime := runtimeCalls[call.Function]
+			if strings.HasPrefix(call.Function, "objc_msgSend") || strings.HasPrefix(call.Function, "swift_") {
+				isRuntime = true
+			}
+			for _, sel := range sels {
+				asm[selectorRef(sel)] = true
+			}
+			if !isRuntime {
+				asm[functionRef(call.Function)] = true
+			}
+		}
+	}
+	for _, s := range analysis.Strings {
+		asm[strconv.Quote(s.Value)] = true
+	}
+	if len(asm) == 0 {
+		return Fidelity{}, false
+	}
+	unresolved["string"] = analysis.unresolvedAddresses
+
+	src := sourceReferences(source)
+	clean := stripCommentsAndStrings(source)
+
+	matched := 0
+	for _, ref := range sortedKeys(asm) {
+		switch {
+		case src[ref]:
+			matched++
+		case strings.HasPrefix(ref, "@selector(") && propertyAccess(clean, strings.TrimSuffix(strings.TrimPrefix(ref, "@selector("), ")")):
+			matched++
+		default:
+			f.Missing = append(f.Missing, ref)
+		}
+	}
+
+	extra := make(map[string][]string)
+	for _, ref := range sortedKeys(src) {
+		switch {
+		case asm[ref]:
+		case strings.HasPrefix(ref, "@selector("):
+			extra["@selector("] = append(extra["@selector("], ref)
+		case strings.HasSuffix(ref, "()"):
+			if !inlineFunctions[strings.TrimSuffix(ref, "()")] {
+				extra["function"] = append(extra["function"], ref)
+			}
+		default:
+			extra["string"] = append(extra["string"], ref)
+		}
+	}
+	unexplained := 0
+	for _, kind := range []string{"@selector(", "function", "string"} {
+		refs := extra[kind]
+		if len(refs) <= unresolved[kind] {
+			// Each of them may be a call the static pass couldn't resolve.
+			continue
+		}
+		f.Hallucinated = append(f.Hallucinated, refs...)
+		unexplained += len(refs) - unresolved[kind]
+	}
+
+	total := matched + len(f.Missing) + unexplained
+	f.Score = 1
+	if total > 0 {
+		f.Score = float64(matched) / float64(total)
+	}
+	return f, true
+}
+
+// sourceReferences collects the selectors sent, functions called and string
+// literals used in decompiled source, formatted like CheckFidelity reports them.
+func sourceReferences(source string) map[string]bool {
+	refs := make(map[string]bool)
+	for _, sel := range MessageSends(source) {
+		refs[selectorRef(sel)] = true
+	}
+
+	clean := stripCommentsAndStrings(source)
+	for _, m := range functionCallPattern.FindAllStringSubmatchIndex(clean, -1) {
+		name := clean[m[2]:m[3]]
+		if notFunctions[name] || (m[2] > 0 && (clean[m[2]-1] == '@' || clean[m[2]-1] == '.')) {
+			continue
+		}
+		refs[functionRef(name)] = true
+	}
+
+	for _, m := range stringLiteralPattern.FindAllStringSubmatch(stripComments(source), -1) {
+		value, err := strconv.Unquote(`"` + m[1] + `"`)
+		if err != nil {
+			value = m[1]
+		}
+		refs[strconv.Quote(value)] = true
+	}
+	return refs
+}
+
+// propertyAccess reports whether source uses dot syntax for the property a
+// getter or setter selector belongs to, e.g. ".session" for "session" or
+// "setSession:".
+func propertyAccess(source, selector string) bool {
+	name := selector
+	if strings.HasPrefix(selector, "set") && strings.HasSuffix(selector, ":") && strings.Count(selector, ":") == 1 && len(selector) > 4 {
+		name = strings.ToLower(selector[3:4]) + selector[4:len(selector)-1]
+	} else if strings.Contains(selector, ":") {
+		return false
+	}
+	for _, m := range propertyPattern.FindAllStringSubmatch(source, -1) {
+		if m[1] == name {
+			return true
+		}
+	}
+	return false
+}
+
+func selectorRef(sel string) string {
+	return "@selector(" + sel + ")"
+}
+
+func functionRef(name string) string {
+	return name + "()"
+}
@@ -0,0 +1,119 @@
+package decompile
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCheckFidelity(t *testing.T) {
+	syms := NewImageSymbols()
+	syms.Selrefs[0x2008] = "startRunning"
+	syms.Selrefs[0x2010] = "session"
+	syms.CFStrings[0x3000] = "capture.started"
+
+	asm := `adrp x8, 0x2000
+ldr x1, [x8, #0x10]
+bl _objc_msgSend
+bl _objc_retainAutoreleasedReturnValue
+adrp x8, 0x2000
+ldr x1, [x8, #0x8]
+bl _objc_msgSend
+adrp x2, 0x3000
+add x2, x2, #0x0
+bl _NSLog
+bl _objc_msgSend`
+	analysis := AnalyzeAssembly(asm, syms, nil, false)
+
+	faithful := `- (void)startCapture {
+    [self.session startRunning];
+    NSLog(@"capture.started");
+    [self notifyObservers]; // the unresolved send
+}`
+	if f, ok := CheckFidelity(analysis, faithful); !ok || f.Score != 1 || len(f.Missing)+len(f.Hallucinated) != 0 {
+		t.Errorf("faithful source: got %+v, want a perfect score", f)
+	}
+
+	unfaithful := `- (void)startCapture {
+    [self.session stopRunning];
+    [self resetZoom];
+    dispatch_async(queue, block);
+}`
+	f, _ := CheckFidelity(analysis, unfaithful)
+	wantMissing := []string{`"capture.started"`, "@selector(startRunning)", "NSLog()"}
+	if !reflect.DeepEqual(f.Missing, wantMissing) {
+		t.Errorf("missing = %v, want %v", f.Missing, wantMissing)
+	}
+	wantHallucinated := []string{"@selector(resetZoom)", "@selector(stopRunning)", "dispatch_async()"}
+	if !reflect.DeepEqual(f.Hallucinated, wantHallucinated) {
+		t.Errorf("hallucinated = %v, want %v", f.Hallucinated, wantHallucinated)
+	}
+	// One match (session) against three missing and two unexplained extras.
+	if want := 1.0 / 6; f.Score != want {
+		t.Errorf("score = %v, want %v", f.Score, want)
+	}
+}
+
+func TestCheckFidelity_LocalBranch(t *testing.T) {
+	syms := NewImageSymbols()
+	syms.Selrefs[0x2008] = "startRunning"
+	syms.Functions[0x5000] = "_CFRelease"
+
+	asm := `0x1000:  cbz x0, loc_110
+0x1004:  b loc_110
+0x1008:  b 0x1010
+0x100c:  ret
+0x1010:  adrp x8, 0x2000
+0x1014:  ldr x1, [x8, #0x8]
+loc_110:
+0x1018:  bl _objc_msgSend
+0x101c:  b 0x5000`
+	analysis := AnalyzeAssembly(asm, syms, nil, false)
+	for _, call := range analysis.Calls {
+		if call.Function == "loc_110" || call.TargetAddress == 0x1010 {
+			t.Errorf("local branch recorded as a call: %+v", call)
+		}
+	}
+	if n := len(analysis.Calls); n != 2 {
+		t.Errorf("got %d calls, want the send and the tail call to _CFRelease: %+v", n, analysis.Calls)
+	}
+
+	source := `- (void)startCapture {
+    if (self) {
+        [self startRunning];
+    }
+    CFRelease(self);
+}`
+	if f, ok := CheckFidelity(analysis, source); !ok || f.Score != 1 || len(f.Missing)+len(f.Hallucinated) != 0 {
+		t.Errorf("got %+v, want a perfect score", f)
+	}
+}
+
+func TestCheckFidelity_Unscored(t *testing.T) {
+	// Without the image's symbols the pass resolves nothing.
+	asm := `adrp x8, 0x2000
+ldr x1, [x8, #0x8]
+bl _objc_msgSend`
+	if f, ok := CheckFidelity(AnalyzeAssembly(asm, NewImageSymbols(), nil, false), "- (void)a {\n    [self start];\n}"); ok {
+		t.Errorf("got %+v, want no score", f)
+	}
+}
+
+func TestCheckFidelity_UnresolvedString(t *testing.T) {
+	syms := NewImageSymbols()
+	syms.Selrefs[0x2008] = "log:"
+
+	asm := `adrp x8, 0x2000
+ldr x1, [x8, #0x8]
+adrp x2, 0x3000
+add x2, x2, #0x10
+bl _objc_msgSend`
+	analysis := AnalyzeAssembly(asm, syms, nil, false)
+	// The string may be the one at the address the symbols don't name.
+	if f, ok := CheckFidelity(analysis, "- (void)a {\n    [self log:@\"done\"];\n}"); !ok || f.Score != 1 {
+		t.Errorf("got %+v, want a perfect score", f)
+	}
+	f, _ := CheckFidelity(analysis, "- (void)a {\n    [self log:@\"done\"];\n    [self log:@\"again\"];\n}")
+	if f.Score == 1 {
+		t.Errorf("got %+v, want the second string to count against the score", f)
+	}
+}
@@ -0,0 +1,384 @@
+package decompile
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultGitBranch is the branch CommitOutput commits to unless told
+// otherwise. The branch belongs to the tool: each commit's tree is exactly the
+// assembled output.
+const DefaultGitBranch = "decompiled"
+
+// GitCommit describes a commit of the assembled output.
+type GitCommit struct {
+	// Branch is committed to, DefaultGitBranch if empty.
+	Branch string
+	// Author is "Name <email>", used as author and committer.
+	Author  string
+	Time    time.Time
+	Message string
+}
+
+// CommitOutput commits files as the whole tree of a commit on a branch of the
+// git repository at repo, creating a bare repository if repo doesn't exist or
+// is empty. It writes loose objects and the branch ref itself, so no git
+// binary is needed, and never touches a working tree or index: committing to
+// the branch checked out in a non-bare repository is refused. If the tree is
+// the same as that of the branch's last commit, nothing is committed and that
+// commit is returned with committed false.
+func CommitOutput(repo string, files []OutputFile, c GitCommit) (id string, committed bool, err error) {
+	if c.Branch == "" {
+		c.Branch = DefaultGitBranch
+	}
+	ref := "refs/heads/" + c.Branch
+	if !validBranch(c.Branch) {
+		return "", false, fmt.Errorf("invalid branch name %q", c.Branch)
+	}
+	r, err := openGitRepo(repo, ref)
+	if err != nil {
+		return "", false, err
+	}
+	if !r.bare {
+		if head, _ := os.ReadFile(filepath.Join(r.dir, "HEAD")); strings.TrimSpace(string(head)) == "ref: "+ref {
+			return "", false, fmt.Errorf("branch %s is checked out in %s; commit to another branch or check out another one", c.Branch, repo)
+		}
+	}
+
+	root := &gitTree{}
+	for _, f := range files {
+		if err := checkOutputPath(f.Path); err != nil {
+			return "", false, err
+		}
+		blob, err := r.writeObject("blob", f.Content)
+		if err != nil {
+			return "", false, err
+		}
+		root.add(strings.Split(f.Path, "/"), blob)
+	}
+	tree, err := r.writeTree(root)
+	if err != nil {
+		return "", false, err
+	}
+
+	parent, err := r.readRef(ref)
+	if err != nil {
+		return "", false, err
+	}
+	if parent != "" && r.commitTree(parent) == tree {
+		return parent, false, nil
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "tree %s\n", tree)
+	if parent != "" {
+		fmt.Fprintf(&b, "parent %s\n", parent)
+	}
+	sig := fmt.Sprintf("%s %d %s", c.Author, c.Time.Unix(), c.Time.Format("-0700"))
+	fmt.Fprintf(&b, "author %s\ncommitter %s\n\n%s", sig, sig, c.Message)
+	if !strings.HasSuffix(c.Message, "\n") {
+		b.WriteByte('\n')
+	}
+	id, err = r.writeObject("commit", []byte(b.String()))
+	if err != nil {
+		return "", false, err
+	}
+	if err := writeFileAtomic(filepath.Join(r.dir, filepath.FromSlash(ref)), []byte(id+"\n")); err != nil {
+		return "", false, fmt.Errorf("failed to update %s: %w", ref, err)
+	}
+	return id, true, nil
+}
+
+// validBranch checks a branch name against the main rules of
+// git check-ref-format.
+func validBranch(name string) bool {
+	if name == "" || strings.HasPrefix(name, "-") || strings.Contains(name, "..") || strings.Contains(name, "@{") ||
+		strings.ContainsAny(name, " ~^:?*[\\\x7f") {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || strings.HasPrefix(part, ".") || strings.HasSuffix(part, ".lock") {
+			return false
+		}
+	}
+	for _, c := range name {
+		if c < ' ' {
+			return false
+		}
+	}
+	return !strings.HasSuffix(name, ".")
+}
+
+// gitRepo is the git directory of a repository: <repo>/.git, or the
+// repository itself if it is bare.
+type gitRepo struct {
+	dir  string
+	bare bool
+}
+
+// openGitRepo finds the git directory of repo, initializing a bare
+// repository whose HEAD is ref if repo doesn't exist or is empty.
+func openGitRepo(repo, ref string) (*gitRepo, error) {
+	if fi, err := os.Stat(filepath.Join(repo, ".git")); err == nil {
+		if !fi.IsDir() {
+			return nil, fmt.Errorf("%s is a linked worktree or submodule, which is not supported; use the main repository", repo)
+		}
+		return &gitRepo{dir: filepath.Join(repo, ".git")}, nil
+	}
+	if _, err := os.Stat(filepath.Join(repo, "objects")); err == nil {
+		if _, err := os.Stat(filepath.Join(repo, "HEAD")); err == nil {
+			return &gitRepo{dir: repo, bare: true}, nil
+		}
+	}
+	if entries, err := os.ReadDir(repo); !errors.Is(err, os.ErrNotExist) && (err != nil || len(entries) > 0) {
+		return nil, fmt.Errorf("%s is not a git repository", repo)
+	}
+
+	r := &gitRepo{dir: repo, bare: true}
+	for _, dir := range []string{"objects", "refs/heads", "refs/tags"} {
+		if err := os.MkdirAll(filepath.Join(repo, filepath.FromSlash(dir)), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create git repository: %w", err)
+		}
+	}
+	init := map[string]string{
+		"HEAD":   "ref: " + ref + "\n",
+		"config": "[core]\n\trepositoryformatversion = 0\n\tfilemode = true\n\tbare = true\n",
+	}
+	for name, content := range init {
+		if err := writeFileAtomic(filepath.Join(repo, name), []byte(content)); err != nil {
+			return nil, fmt.Errorf("failed to create git repository: %w", err)
+		}
+	}
+	return r, nil
+}
+
+// readRef returns the commit a ref points to, or "" if it doesn't exist.
+func (r *gitRepo) readRef(ref string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(r.dir, filepath.FromSlash(ref)))
+	if err == nil {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("failed to read %s: %w", ref, err)
+	}
+	// git gc moves refs to packed-refs.
+	packed, err := os.ReadFile(filepath.Join(r.dir, "packed-refs"))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("failed to read packed refs: %w", err)
+	}
+	for _, line := range strings.Split(string(packed), "\n") {
+		if id, name, ok := strings.Cut(line, " "); ok && name == ref {
+			return id, nil
+		}
+	}
+	return "", nil
+}
+
+// commitTree returns the tree of a commit, or "" if the commit can't be read,
+// as when git gc has moved it to a pack.
+func (r *gitRepo) commitTree(id string) string {
+	kind, data, err := r.readObject(id)
+	if err != nil || kind != "commit" {
+		return ""
+	}
+	tree, _, _ := strings.Cut(string(data), "\n")
+	return strings.TrimPrefix(tree, "tree ")
+}
+
+func (r *gitRepo) objectPath(id string) string {
+	return filepath.Join(r.dir, "objects", id[:2], id[2:])
+}
+
+// writeObject stores a loose object and returns its id.
+func (r *gitRepo) writeObject(kind string, data []byte) (string, error) {
+	header := fmt.Sprintf("%s %d\x00", kind, len(data))
+	h := sha1.New()
+	io.WriteString(h, header)
+	h.Write(data)
+	id := hex.EncodeToString(h.Sum(nil))
+
+	path := r.objectPath(id)
+	if _, err := os.Stat(path); err == nil {
+		return id, nil
+	}
+	var b bytes.Buffer
+	zw := zlib.NewWriter(&b)
+	io.WriteString(zw, header)
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		return "", fmt.Errorf("failed to compress %s %s: %w", kind, id, err)
+	}
+	if err := writeFileAtomic(path, b.Bytes()); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// readObject reads a loose object.
+func (r *gitRepo) readObject(id string) (kind string, data []byte, err error) {
+	if len(id) != 40 {
+		return "", nil, fmt.Errorf("invalid object id %q", id)
+	}
+	f, err := os.Open(r.objectPath(id))
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+	zr, err := zlib.NewReader(f)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read object %s: %w", id, err)
+	}
+	raw, err := io.ReadAll(zr)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read object %s: %w", id, err)
+	}
+	header, data, ok := bytes.Cut(raw, []byte{0})
+	if !ok {
+		return "", nil, fmt.Errorf("object %s has no header", id)
+	}
+	kind, _, _ = strings.Cut(string(header), " ")
+	return kind, data, nil
+}
+
+// gitTree is a directory of the commit being built.
+type gitTree struct {
+	blobs map[string]string
+	dirs  map[string]*gitTree
+}
+
+func (t *gitTree) add(path []string, blob string) {
+	if len(path) == 1 {
+		if t.blobs == nil {
+			t.blobs = make(map[string]string)
+		}
+		t.blobs[path[0]] = blob
+		return
+	}
+	if t.dirs == nil {
+		t.dirs = make(map[string]*gitTree)
+	}
+	sub, ok := t.dirs[path[0]]
+	if !ok {
+		sub = &gitTree{}
+		t.dirs[path[0]] = sub
+	}
+	sub.add(path[1:], blob)
+}
+
+// writeTree stores a tree and its subtrees and returns the tree's id.
+func (r *gitRepo) writeTree(t *gitTree) (string, error) {
+	type entry struct {
+		mode, name, id string
+	}
+	var entries []entry
+	for _, name := range slices.Sorted(maps.Keys(t.dirs)) {
+		id, err := r.writeTree(t.dirs[name])
+		if err != nil {
+			return "", err
+		}
+		entries = append(entries, entry{"40000", name, id})
+	}
+	for name, id := range t.blobs {
+		entries = append(entries, entry{"100644", name, id})
+	}
+	// git orders a directory as if its name ended in a slash.
+	key := func(e entry) string {
+		if e.mode == "40000" {
+			return e.name + "/"
+		}
+		return e.name
+	}
+	sort.Slice(entries, func(i, j int) bool { return key(entries[i]) < key(entries[j]) })
+
+	var b bytes.Buffer
+	for _, e := range entries {
+		id, err := hex.DecodeString(e.id)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "%s %s\x00", e.mode, e.name)
+		b.Write(id)
+	}
+	return r.writeObject("tree", b.Bytes())
+}
+
+// CommitStats tallies the tasks of a run for the message of its commit.
+type CommitStats struct {
+	reportCounts
+	models  map[string]int
+	prompts map[string]int
+}
+
+// Add counts a task.
+func (s *CommitStats) Add(task *Task) {
+	s.add(task)
+	if task.Status != StatusCompleted {
+		return
+	}
+	if s.models == nil {
+		s.models, s.prompts = make(map[string]int), make(map[string]int)
+	}
+	if task.Model.Valid {
+		s.models[task.Model.String]++
+	}
+	if task.PromptVersion.Valid {
+		s.prompts[task.PromptVersion.String]++
+	}
+}
+
+// Message returns a commit message naming the build, the models and prompt
+// versions that produced the results, and the task counts. build and runID
+// may be empty and 0.
+func (s *CommitStats) Message(build string, runID int64) string {
+	var b strings.Builder
+	switch {
+	case build != "":
+		fmt.Fprintf(&b, "Decompile %s", build)
+	case runID != 0:
+		fmt.Fprintf(&b, "Decompile run %d", runID)
+	default:
+		b.WriteString("Decompile")
+	}
+	fmt.Fprintf(&b, ": %d of %d methods\n\n", s.Completed, s.Total)
+	if build != "" {
+		fmt.Fprintf(&b, "Build: %s\n", build)
+	}
+	if runID != 0 {
+		fmt.Fprintf(&b, "Run: %d\n", runID)
+	}
+	fmt.Fprintf(&b, "Models: %s\n", countList(s.models))
+	fmt.Fprintf(&b, "Prompt versions: %s\n", countList(s.prompts))
+	fmt.Fprintf(&b, "Methods: %d completed, %d failed, %d pending\n", s.Completed, s.Failed, s.Pending)
+	if s.Fidelity.Valid {
+		fmt.Fprintf(&b, "Mean fidelity: %.0f%%\n", s.Fidelity.Float64*100)
+	}
+	return b.String()
+}
+
+// countList formats counts as "a (3), b (1)", most frequent first.
+func countList(counts map[string]int) string {
+	if len(counts) == 0 {
+		return "none"
+	}
+	keys := sortedKeys(counts)
+	sort.SliceStable(keys, func(i, j int) bool { return counts[keys[i]] > counts[keys[j]] })
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%s (%d)", k, counts[k])
+	}
+	return strings.Join(parts, ", ")
+}
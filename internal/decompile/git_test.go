@@ -0,0 +1,107 @@
+package decompile
+
+import (
+	"database/sql"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommitOutput(t *testing.T) {
+	repo := filepath.Join(t.TempDir(), "CMCapture.git")
+	files := []OutputFile{
+		{Path: "CMCapture/CMCaptureController.m", Content: []byte("@implementation CMCaptureController\n@end\n")},
+		{Path: "CMCapture/CMCaptureController.h", Content: []byte("@interface CMCaptureController\n@end\n")},
+		{Path: "CMCapture.h", Content: []byte("#import <CMCapture/CMCaptureController.h>\n")},
+	}
+	commit := GitCommit{Author: "Test <test@example.com>", Time: time.Unix(1700000000, 0).UTC(), Message: "Decompile 21A5248v"}
+
+	first, committed, err := CommitOutput(repo, files, commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !committed || len(first) != 40 {
+		t.Fatalf("CommitOutput() = %q, %v, want a new commit", first, committed)
+	}
+	r := &gitRepo{dir: repo, bare: true}
+	if head, _ := r.readRef("refs/heads/" + DefaultGitBranch); head != first {
+		t.Errorf("branch points at %q, want %s", head, first)
+	}
+	kind, data, err := r.readObject(first)
+	if err != nil || kind != "commit" {
+		t.Fatalf("readObject(commit) = %q, %v", kind, err)
+	}
+	if want := "author Test <test@example.com> 1700000000 +0000\n"; !strings.Contains(string(data), want) || strings.Contains(string(data), "parent") {
+		t.Errorf("unexpected first commit:\n%s", data)
+	}
+
+	// The same tree is not committed again.
+	if again, committed, err := CommitOutput(repo, files, commit); err != nil || committed || again != first {
+		t.Errorf("recommitting the same files = %q, %v, %v; want %s unchanged", again, committed, err, first)
+	}
+
+	files[0].Content = []byte("@implementation CMCaptureController\n- (void)startCapture {\n}\n@end\n")
+	second, committed, err := CommitOutput(repo, files[:2], commit)
+	if err != nil || !committed {
+		t.Fatalf("second commit: %v", err)
+	}
+	if _, data, _ := r.readObject(second); !strings.Contains(string(data), "parent "+first+"\n") {
+		t.Errorf("second commit has no parent %s:\n%s", first, data)
+	}
+
+	if _, _, err := CommitOutput(repo, files, GitCommit{Branch: "bad..name"}); err == nil {
+		t.Error("CommitOutput accepted an invalid branch name")
+	}
+	notRepo := t.TempDir()
+	os.WriteFile(filepath.Join(notRepo, "README"), nil, 0o644)
+	if _, _, err := CommitOutput(notRepo, files, commit); err == nil {
+		t.Error("CommitOutput wrote into a directory that isn't a repository")
+	}
+
+	// Let git itself check the objects when it is installed.
+	if _, err := exec.LookPath("git"); err != nil {
+		return
+	}
+	if out, err := exec.Command("git", "--git-dir", repo, "fsck", "--strict").CombinedOutput(); err != nil {
+		t.Errorf("git fsck: %v\n%s", err, out)
+	}
+	out, err := exec.Command("git", "--git-dir", repo, "log", "-p", "--format=%s", DefaultGitBranch).CombinedOutput()
+	if err != nil {
+		t.Fatalf("git log: %v\n%s", err, out)
+	}
+	for _, want := range []string{"+- (void)startCapture {", "deleted file mode 100644", "CMCapture/CMCaptureController.h"} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("git log -p is missing %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestCommitStats(t *testing.T) {
+	var s CommitStats
+	for _, task := range []*Task{
+		{Status: StatusCompleted, Model: sql.NullString{String: "gpt-4o", Valid: true}, PromptVersion: sql.NullString{String: "v3", Valid: true}, Fidelity: sql.NullFloat64{Float64: 1, Valid: true}},
+		{Status: StatusCompleted, Model: sql.NullString{String: "gpt-4o", Valid: true}, PromptVersion: sql.NullString{String: "v3", Valid: true}, Fidelity: sql.NullFloat64{Float64: 0.5, Valid: true}},
+		{Status: StatusCompleted, Model: sql.NullString{String: "ollama/codellama", Valid: true}, PromptVersion: sql.NullString{String: "v3", Valid: true}},
+		{Status: StatusFailed},
+	} {
+		s.Add(task)
+	}
+	want := `Decompile 21A5248v: 3 of 4 methods
+
+Build: 21A5248v
+Run: 7
+Models: gpt-4o (2), ollama/codellama (1)
+Prompt versions: v3 (3)
+Methods: 3 completed, 1 failed, 0 pending
+Mean fidelity: 75%
+`
+	if got := s.Message("21A5248v", 7); got != want {
+		t.Errorf("Message() =\n%s\nwant\n%s", got, want)
+	}
+	if got := s.Message("", 0); !strings.HasPrefix(got, "Decompile: 3 of 4 methods\n\nModels:") {
+		t.Errorf("Message without build or run =\n%s", got)
+	}
+}
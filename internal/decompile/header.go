@@ -0,0 +1,329 @@
+package decompile
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ProtocolInfo is the Objective-C runtime metadata scanned for a protocol.
+type ProtocolInfo struct {
+	Name  string `json:"name"`
+	Image string `json:"image,omitempty"`
+	// Protocols are the protocols this one adopts.
+	Protocols       []string       `json:"protocols,omitempty"`
+	Properties      []PropertyInfo `json:"properties,omitempty"`
+	Methods         []MethodInfo   `json:"methods,omitempty"`
+	OptionalMethods []MethodInfo   `json:"optional_methods,omitempty"`
+}
+
+// HeaderName returns the file name of the header generated for a class.
+func HeaderName(class string) string {
+	return class + ".h"
+}
+
+// ProtocolHeaderName returns the file name of the header generated for a
+// protocol. The suffix keeps it apart from a class of the same name, such as
+// NSObject.
+func ProtocolHeaderName(protocol string) string {
+	return protocol + "-Protocol.h"
+}
+
+// objectTypePattern matches the class or protocol names in type encodings,
+// e.g. @"AVCaptureSession" or @"<AVCaptureVideoDataOutputSampleBufferDelegate>".
+var objectTypePattern = regexp.MustCompile(`@"([^"]+)"`)
+
+// headerSet knows which headers are generated and for which image, so
+// headers can import each other.
+type headerSet struct {
+	layout Layout
+	// classes and protocols map names to the image they were scanned from.
+	classes   map[string]string
+	protocols map[string]string
+}
+
+func newHeaderSet(classes []*ClassInfo, protocols []*ProtocolInfo, layout Layout) *headerSet {
+	set := &headerSet{
+		layout:    layout,
+		classes:   make(map[string]string, len(classes)),
+		protocols: make(map[string]string, len(protocols)),
+	}
+	for _, c := range classes {
+		set.classes[c.Name] = c.Image
+	}
+	for _, p := range protocols {
+		set.protocols[p.Name] = p.Image
+	}
+	return set
+}
+
+// headerImports tracks what a header refers to so it can import the headers
+// generated alongside it and forward-declare everything else.
+type headerImports struct {
+	set       *headerSet
+	self      string
+	image     string
+	imports   []string
+	imported  map[string]bool
+	refs      map[string]bool
+	protoRefs map[string]bool
+}
+
+func (set *headerSet) imports(self, image string) *headerImports {
+	return &headerImports{
+		set:       set,
+		self:      self,
+		image:     image,
+		imported:  make(map[string]bool),
+		refs:      make(map[string]bool),
+		protoRefs: make(map[string]bool),
+	}
+}
+
+// inherit imports what a declaration needs in full: its superclass and the
+// protocols it adopts, if their headers are generated.
+func (h *headerImports) inherit(superclass string, protocols []string) {
+	if image, ok := h.set.classes[superclass]; ok && superclass != "" {
+		h.imports = append(h.imports, h.set.layout.include(h.image, image, HeaderName(superclass)))
+		h.imported[HeaderName(superclass)] = true
+	}
+	for _, p := range protocols {
+		if image, ok := h.set.protocols[p]; ok && !h.imported[ProtocolHeaderName(p)] {
+			h.imports = append(h.imports, h.set.layout.include(h.image, image, ProtocolHeaderName(p)))
+			h.imported[ProtocolHeaderName(p)] = true
+		}
+	}
+}
+
+// reference records the object types a type encoding mentions.
+func (h *headerImports) reference(enc string) {
+	for _, m := range objectTypePattern.FindAllStringSubmatch(enc, -1) {
+		name := m[1]
+		if i := strings.IndexByte(name, '<'); i >= 0 {
+			for _, p := range strings.Split(strings.Trim(name[i:], "<>"), ",") {
+				h.protoRefs[strings.TrimSpace(p)] = true
+			}
+			name = name[:i]
+		}
+		if name != "" && name != h.self {
+			h.refs[name] = true
+		}
+	}
+}
+
+// write emits the #import lines and forward declarations.
+func (h *headerImports) write(b *bytes.Buffer) {
+	b.WriteString("#import <Foundation/Foundation.h>\n")
+	for _, include := range h.imports {
+		fmt.Fprintf(b, "#import %s\n", include)
+	}
+
+	var classes, protocols []string
+	for name := range h.refs {
+		if !h.imported[HeaderName(name)] {
+			classes = append(classes, name)
+		}
+	}
+	for name := range h.protoRefs {
+		if !h.imported[ProtocolHeaderName(name)] && name != h.self {
+			protocols = append(protocols, name)
+		}
+	}
+	sort.Strings(classes)
+	sort.Strings(protocols)
+	if len(classes) > 0 || len(protocols) > 0 {
+		b.WriteByte('\n')
+	}
+	if len(classes) > 0 {
+		fmt.Fprintf(b, "@class %s;\n", strings.Join(classes, ", "))
+	}
+	if len(protocols) > 0 {
+		fmt.Fprintf(b, "@protocol %s;\n", strings.Join(protocols, ", "))
+	}
+}
+
+// RenderHeaders builds a header per class and per protocol from their runtime
+// metadata. Headers import each other for superclasses and adopted protocols
+// that have headers of their own and forward-declare the other types they
+// mention, so together they read as an SDK for the scanned images. With
+// LayoutFramework each image also gets an umbrella header importing all of
+// its headers, unless a class of the same name takes its place.
+func RenderHeaders(classes []*ClassInfo, protocols []*ProtocolInfo, layout Layout) []OutputFile {
+	set := newHeaderSet(classes, protocols, layout)
+	umbrellas := make(map[string][]string)
+	var out []OutputFile
+	add := func(image, name string, content []byte) {
+		out = append(out, OutputFile{Path: layout.headerPath(image, name), Content: content})
+		if group := layout.group(image); layout == LayoutFramework && group != "" {
+			umbrellas[group] = append(umbrellas[group], name)
+		}
+	}
+	for _, c := range classes {
+		add(c.Image, HeaderName(c.Name), c.header(set))
+	}
+	for _, p := range protocols {
+		add(p.Image, ProtocolHeaderName(p.Name), p.header(set))
+	}
+
+	paths := make(map[string]bool, len(out))
+	for _, f := range out {
+		paths[f.Path] = true
+	}
+	for _, group := range sortedKeys(umbrellas) {
+		path := group + "/Headers/" + HeaderName(group)
+		if paths[path] {
+			continue
+		}
+		names := umbrellas[group]
+		sort.Strings(names)
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "// Umbrella header for %s\n\n#import <Foundation/Foundation.h>\n\n", group)
+		for _, name := range names {
+			fmt.Fprintf(&b, "#import <%s/%s>\n", group, name)
+		}
+		out = append(out, OutputFile{Path: path, Content: b.Bytes()})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Path < out[j].Path })
+	return out
+}
+
+// header renders the class as an @interface with its ivars, properties and
+// the methods that aren't property accessors.
+func (c *ClassInfo) header(set *headerSet) []byte {
+	imports := set.imports(c.Name, c.Image)
+	imports.inherit(c.Superclass, c.Protocols)
+	ivars := append([]IvarInfo(nil), c.Ivars...)
+	sort.Slice(ivars, func(i, j int) bool { return ivars[i].Offset < ivars[j].Offset })
+	for _, ivar := range ivars {
+		imports.reference(ivar.Type)
+	}
+	for _, prop := range c.Properties {
+		imports.reference(prop.Attributes)
+	}
+	methods := withoutAccessors(c.Methods, c.Properties)
+	for _, m := range methods {
+		imports.reference(m.Types)
+	}
+
+	var b bytes.Buffer
+	writeHeaderComment(&b, c.Image)
+	imports.write(&b)
+
+	fmt.Fprintf(&b, "\n@interface %s", c.Name)
+	if c.Superclass != "" {
+		fmt.Fprintf(&b, " : %s", c.Superclass)
+	}
+	if len(c.Protocols) > 0 {
+		fmt.Fprintf(&b, " <%s>", strings.Join(c.Protocols, ", "))
+	}
+	if len(ivars) > 0 {
+		b.WriteString(" {\n")
+		for _, ivar := range ivars {
+			fmt.Fprintf(&b, "    %s; // offset 0x%x\n", declare(DecodeType(ivar.Type), ivar.Name), ivar.Offset)
+		}
+		b.WriteString("}")
+	}
+	b.WriteByte('\n')
+	writeDeclarations(&b, c.Properties, methods)
+	b.WriteString("\n@end\n")
+	return b.Bytes()
+}
+
+// header renders the protocol as a @protocol with its required and optional
+// methods.
+func (p *ProtocolInfo) header(set *headerSet) []byte {
+	imports := set.imports(p.Name, p.Image)
+	imports.inherit("", p.Protocols)
+	for _, prop := range p.Properties {
+		imports.reference(prop.Attributes)
+	}
+	for _, m := range append(append([]MethodInfo(nil), p.Methods...), p.OptionalMethods...) {
+		imports.reference(m.Types)
+	}
+
+	var b bytes.Buffer
+	writeHeaderComment(&b, p.Image)
+	imports.write(&b)
+
+	fmt.Fprintf(&b, "\n@protocol %s", p.Name)
+	if len(p.Protocols) > 0 {
+		fmt.Fprintf(&b, " <%s>", strings.Join(p.Protocols, ", "))
+	}
+	b.WriteByte('\n')
+	writeDeclarations(&b, p.Properties, withoutAccessors(p.Methods, p.Properties))
+	if optional := withoutAccessors(p.OptionalMethods, p.Properties); len(optional) > 0 {
+		b.WriteString("\n@optional\n")
+		writeDeclarations(&b, nil, optional)
+	}
+	b.WriteString("\n@end\n")
+	return b.Bytes()
+}
+
+func writeHeaderComment(b *bytes.Buffer, image string) {
+	if image != "" {
+		fmt.Fprintf(b, "// Generated from the runtime metadata of %s\n\n", image)
+	}
+}
+
+// writeDeclarations writes properties, then class methods, then instance
+// methods, each group sorted, with a blank line before each group.
+func writeDeclarations(b *bytes.Buffer, props []PropertyInfo, methods []MethodInfo) {
+	if len(props) > 0 {
+		b.WriteByte('\n')
+		sorted := append([]PropertyInfo(nil), props...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+		for _, prop := range sorted {
+			b.WriteString(PropertyDeclaration(prop) + "\n")
+		}
+	}
+	for _, classMethods := range []bool{true, false} {
+		var group []MethodInfo
+		for _, m := range methods {
+			if m.ClassMethod == classMethods {
+				group = append(group, m)
+			}
+		}
+		if len(group) == 0 {
+			continue
+		}
+		sort.Slice(group, func(i, j int) bool { return group[i].Selector < group[j].Selector })
+		b.WriteByte('\n')
+		for _, m := range group {
+			b.WriteString(MethodDeclaration(m) + ";\n")
+		}
+	}
+}
+
+// withoutAccessors drops the instance methods that are the getters and
+// setters of the given properties; the @property lines declare them.
+func withoutAccessors(methods []MethodInfo, props []PropertyInfo) []MethodInfo {
+	accessors := make(map[string]bool)
+	for _, prop := range props {
+		getter := prop.Name
+		setter := "set" + strings.ToUpper(prop.Name[:min(1, len(prop.Name))]) + prop.Name[min(1, len(prop.Name)):] + ":"
+		for _, attr := range splitPropertyAttributes(prop.Attributes) {
+			switch {
+			case strings.HasPrefix(attr, "G"):
+				getter = attr[1:]
+			case strings.HasPrefix(attr, "S"):
+				setter = attr[1:]
+			case attr == "R":
+				setter = ""
+			}
+		}
+		accessors[getter] = true
+		if setter != "" {
+			accessors[setter] = true
+		}
+	}
+	var out []MethodInfo
+	for _, m := range methods {
+		if !m.ClassMethod && accessors[m.Selector] {
+			continue
+		}
+		out = append(out, m)
+	}
+	return out
+}
@@ -0,0 +1,97 @@
+package decompile
+
+import "testing"
+
+func TestRenderHeaders(t *testing.T) {
+	classes := []*ClassInfo{
+		{
+			Name:       "CMCaptureController",
+			Image:      "/CMCapture",
+			Superclass: "CMBase",
+			Protocols:  []string{"CMObserver", "NSCopying"},
+			Ivars: []IvarInfo{
+				{Name: "_zoomFactor", Offset: 0x20, Type: "d"},
+				{Name: "_session", Offset: 0x18, Type: `@"AVCaptureSession"`},
+				{Name: "_delegate", Offset: 0x10, Type: `@"<CMCaptureDelegate>"`},
+			},
+			Properties: []PropertyInfo{
+				{Name: "session", Attributes: `T@"AVCaptureSession",&,N,V_session`},
+				{Name: "running", Attributes: "TB,R,N,GisRunning,V_running"},
+			},
+			Methods: []MethodInfo{
+				{Selector: "setZoom:", Types: "v24@0:8d16"},
+				{Selector: "session", Types: "@16@0:8"},
+				{Selector: "setSession:", Types: "v24@0:8@16"},
+				{Selector: "isRunning", Types: "B16@0:8"},
+				{Selector: "sharedController", Types: "@16@0:8", ClassMethod: true},
+			},
+		},
+		{Name: "CMBase", Superclass: "NSObject"},
+	}
+	protocols := []*ProtocolInfo{{
+		Name:            "CMObserver",
+		Protocols:       []string{"NSObject"},
+		Methods:         []MethodInfo{{Selector: "controllerDidStart:", Types: `v24@0:8@"CMCaptureController"16`}},
+		OptionalMethods: []MethodInfo{{Selector: "controllerDidStop", Types: "v16@0:8"}},
+	}}
+
+	want := map[string]string{
+		"CMBase.h": `#import <Foundation/Foundation.h>
+
+@interface CMBase : NSObject
+
+@end
+`,
+		"CMCaptureController.h": `// Generated from the runtime metadata of /CMCapture
+
+#import <Foundation/Foundation.h>
+#import "CMBase.h"
+#import "CMObserver-Protocol.h"
+
+@class AVCaptureSession;
+@protocol CMCaptureDelegate;
+
+@interface CMCaptureController : CMBase <CMObserver, NSCopying> {
+    id<CMCaptureDelegate> _delegate; // offset 0x10
+    AVCaptureSession *_session; // offset 0x18
+    double _zoomFactor; // offset 0x20
+}
+
+@property (nonatomic, readonly, getter=isRunning) BOOL running;
+@property (nonatomic, strong) AVCaptureSession *session;
+
++ (id)sharedController;
+
+- (void)setZoom:(double)arg1;
+
+@end
+`,
+		"CMObserver-Protocol.h": `#import <Foundation/Foundation.h>
+
+@class CMCaptureController;
+
+@protocol CMObserver <NSObject>
+
+- (void)controllerDidStart:(CMCaptureController *)arg1;
+
+@optional
+
+- (void)controllerDidStop;
+
+@end
+`,
+	}
+
+	files := RenderHeaders(classes, protocols, LayoutFlat)
+	if len(files) != len(want) {
+		t.Fatalf("got %d headers, want %d", len(files), len(want))
+	}
+	for i, f := range files {
+		if i > 0 && files[i-1].Path >= f.Path {
+			t.Errorf("headers are not sorted: %s before %s", files[i-1].Path, f.Path)
+		}
+		if string(f.Content) != want[f.Path] {
+			t.Errorf("%s:\n%s\nwant:\n%s", f.Path, f.Content, want[f.Path])
+		}
+	}
+}
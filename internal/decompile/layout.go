@@ -0,0 +1,88 @@
+package decompile
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Layout decides where generated files go in the output directory.
+type Layout string
+
+// Output layouts accepted by ParseLayout.
+const (
+	// LayoutFlat puts every file in the output directory itself.
+	LayoutFlat Layout = "flat"
+	// LayoutImage puts the files of each image in <Image>/.
+	LayoutImage Layout = "image"
+	// LayoutFramework lays each image out like an Xcode framework target:
+	// <Image>/Headers/ with an umbrella header <Image>.h, and <Image>/Sources/.
+	LayoutFramework Layout = "framework"
+)
+
+// ParseLayout parses the name of an output layout.
+func ParseLayout(s string) (Layout, error) {
+	switch l := Layout(s); l {
+	case LayoutFlat, LayoutImage, LayoutFramework:
+		return l, nil
+	}
+	return "", fmt.Errorf("unknown output layout %q, want \"flat\", \"image\" or \"framework\"", s)
+}
+
+// ImageGroup returns the directory name the files of an image are grouped
+// under: the framework name for images inside a .framework bundle, e.g.
+// CMCapture for .../CMCapture.framework/CMCapture, and the file name without
+// .dylib otherwise. It returns "" for an unknown image.
+func ImageGroup(image string) string {
+	if image == "" {
+		return ""
+	}
+	parts := strings.Split(image, "/")
+	for i := len(parts) - 1; i >= 0; i-- {
+		if name, ok := strings.CutSuffix(parts[i], ".framework"); ok && name != "" {
+			return name
+		}
+	}
+	return strings.TrimSuffix(path.Base(image), ".dylib")
+}
+
+// group returns the directory of an image's files, "" if they go in the
+// output directory itself.
+func (l Layout) group(image string) string {
+	if l != LayoutImage && l != LayoutFramework {
+		return ""
+	}
+	return ImageGroup(image)
+}
+
+// sourcePath returns where a .m file of the given image goes.
+func (l Layout) sourcePath(image, name string) string {
+	return l.path(image, "Sources", name)
+}
+
+// headerPath returns where a header of the given image goes.
+func (l Layout) headerPath(image, name string) string {
+	return l.path(image, "Headers", name)
+}
+
+func (l Layout) path(image, kind, name string) string {
+	group := l.group(image)
+	switch {
+	case group == "":
+		return name
+	case l == LayoutFramework:
+		return group + "/" + kind + "/" + name
+	}
+	return group + "/" + name
+}
+
+// include returns the argument of the #import with which a file of image
+// from includes the header name of image to: a quoted name within an image,
+// and <Image/Header.h> across images, as for frameworks in an SDK.
+func (l Layout) include(from, to, name string) string {
+	group := l.group(to)
+	if group == "" || group == l.group(from) {
+		return fmt.Sprintf("%q", name)
+	}
+	return "<" + group + "/" + name + ">"
+}
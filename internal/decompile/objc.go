@@ -0,0 +1,396 @@
+package decompile
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// stripCommentsAndStrings blanks out comments and the contents of string and
+// character literals so structural scans don't trip over brackets inside
+// them. Offsets and line breaks are preserved.
+func stripCommentsAndStrings(source string) string {
+	out := []byte(source)
+	for i := 0; i < len(out); i++ {
+		switch {
+		case out[i] == '/' && i+1 < len(out) && out[i+1] == '/':
+			for ; i < len(out) && out[i] != '\n'; i++ {
+				out[i] = ' '
+			}
+		case out[i] == '/' && i+1 < len(out) && out[i+1] == '*':
+			end := strings.Index(string(out[i+2:]), "*/")
+			stop := len(out)
+			if end >= 0 {
+				stop = i + 2 + end + 2
+			}
+			for ; i < stop; i++ {
+				if out[i] != '\n' {
+					out[i] = ' '
+				}
+			}
+			i--
+		case out[i] == '"' || out[i] == '\'':
+			quote := out[i]
+			for i++; i < len(out) && out[i] != quote && out[i] != '\n'; i++ {
+				if out[i] == '\\' && i+1 < len(out) {
+					out[i] = ' '
+					i++
+				}
+				out[i] = ' '
+			}
+		}
+	}
+	return string(out)
+}
+
+// Symbol is a parsed Objective-C method symbol such as
+// "-[CMCaptureController(Zoom) setZoom:animated:]".
+type Symbol struct {
+	ClassMethod bool
+	Class       string
+	Category    string
+	Selector    string
+}
+
+// ParseSymbol parses an Objective-C method symbol. It reports false for
+// anything else, such as C functions.
+func ParseSymbol(name string) (Symbol, bool) {
+	if len(name) < 4 || (name[0] != '-' && name[0] != '+') || name[1] != '[' || !strings.HasSuffix(name, "]") {
+		return Symbol{}, false
+	}
+	body := name[2 : len(name)-1]
+	space := strings.IndexByte(body, ' ')
+	if space <= 0 || space == len(body)-1 {
+		return Symbol{}, false
+	}
+	sym := Symbol{ClassMethod: name[0] == '+', Class: body[:space], Selector: body[space+1:]}
+	if open := strings.IndexByte(sym.Class, '('); open >= 0 && strings.HasSuffix(sym.Class, ")") {
+		sym.Category = sym.Class[open+1 : len(sym.Class)-1]
+		sym.Class = sym.Class[:open]
+	}
+	return sym, true
+}
+
+// classOf returns the Objective-C class a task's method belongs to, falling
+// back to the task's class name when the symbol is not a method.
+func classOf(task *Task) string {
+	if sym, ok := ParseSymbol(task.SymbolName); ok {
+		return sym.Class
+	}
+	return task.ClassName
+}
+
+// ImplMethod is a method definition found in an @implementation block.
+type ImplMethod struct {
+	ClassMethod bool
+	Selector    string
+	// Source is the method from its declaration to its closing brace.
+	Source string
+}
+
+// SplitImplementation extracts the method definitions from Objective-C
+// source holding one or more @implementation blocks. Methods are recognized
+// as top-level lines starting with '-' or '+' followed by a braced body;
+// C functions, ivar blocks and everything else are skipped.
+func SplitImplementation(source string) []ImplMethod {
+	clean := stripCommentsAndStrings(source)
+	var methods []ImplMethod
+	depth := 0
+	lineStart := true
+	for i := 0; i < len(clean); i++ {
+		c := clean[i]
+		switch {
+		case c == '\n':
+			lineStart = true
+			continue
+		case c == ' ' || c == '\t':
+			continue
+		case depth == 0 && lineStart && (c == '-' || c == '+'):
+			open := strings.IndexAny(clean[i:], "{;")
+			if open < 0 || clean[i+open] != '{' {
+				break // a declaration without a body
+			}
+			open += i
+			end := matchingClose(clean[open:], '{', '}') + open
+			if end >= len(clean) {
+				end = len(clean) - 1
+			}
+			methods = append(methods, ImplMethod{
+				ClassMethod: c == '+',
+				Selector:    declarationSelector(clean[i+1 : open]),
+				Source:      source[i : end+1],
+			})
+			i = end
+			lineStart = false
+			continue
+		case c == '{':
+			depth++
+		case c == '}':
+			depth--
+		}
+		lineStart = false
+	}
+	return methods
+}
+
+// declarationSelector returns the selector of a method declaration without
+// its leading '-' or '+', e.g. "(void)setZoom:(double)z animated:(BOOL)a".
+func declarationSelector(decl string) string {
+	// Drop the return and parameter types.
+	var b strings.Builder
+	depth := 0
+	for i := 0; i < len(decl); i++ {
+		switch decl[i] {
+		case '(':
+			depth++
+			b.WriteByte(' ')
+		case ')':
+			depth--
+		default:
+			if depth == 0 {
+				b.WriteByte(decl[i])
+			}
+		}
+	}
+	fields := strings.Fields(strings.ReplaceAll(b.String(), ":", ": "))
+	if len(fields) == 0 {
+		return ""
+	}
+	if !strings.HasSuffix(fields[0], ":") {
+		return fields[0]
+	}
+	var sel strings.Builder
+	for _, f := range fields {
+		if strings.HasSuffix(f, ":") {
+			sel.WriteString(f)
+		}
+	}
+	return sel.String()
+}
+
+// SyntaxIssue is a structural problem found by CheckDelimiters.
+type SyntaxIssue struct {
+	Line    int
+	Message string
+}
+
+func (i SyntaxIssue) String() string {
+	return fmt.Sprintf("line %d: %s", i.Line, i.Message)
+}
+
+// CheckDelimiters verifies that parentheses, brackets and braces in an
+// Objective-C snippet are balanced and properly nested, and that string
+// literals are terminated. It is a cheap structural check, not a parser.
+func CheckDelimiters(source string) []SyntaxIssue {
+	var issues []SyntaxIssue
+
+	// Unterminated literals are detected line by line, ignoring comments.
+	for n, line := range strings.Split(stripComments(source), "\n") {
+		if unterminatedLiteral(line) {
+			issues = append(issues, SyntaxIssue{Line: n + 1, Message: "unterminated string or character literal"})
+		}
+	}
+
+	pairs := map[byte]byte{')': '(', ']': '[', '}': '{'}
+	type open struct {
+		ch   byte
+		line int
+	}
+	var stack []open
+	line := 1
+	clean := stripCommentsAndStrings(source)
+	for i := 0; i < len(clean); i++ {
+		c := clean[i]
+		switch c {
+		case '\n':
+			line++
+		case '(', '[', '{':
+			stack = append(stack, open{c, line})
+		case ')', ']', '}':
+			if len(stack) == 0 {
+				issues = append(issues, SyntaxIssue{Line: line, Message: fmt.Sprintf("unexpected '%c'", c)})
+				continue
+			}
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if top.ch != pairs[c] {
+				issues = append(issues, SyntaxIssue{Line: line, Message: fmt.Sprintf("'%c' closes '%c' opened on line %d", c, top.ch, top.line)})
+			}
+		}
+	}
+	for _, o := range stack {
+		issues = append(issues, SyntaxIssue{Line: o.line, Message: fmt.Sprintf("unclosed '%c'", o.ch)})
+	}
+	return issues
+}
+
+// stripComments removes comments but leaves literals intact.
+func stripComments(source string) string {
+	var b strings.Builder
+	inString := byte(0)
+	for i := 0; i < len(source); i++ {
+		c := source[i]
+		switch {
+		case inString != 0:
+			b.WriteByte(c)
+			if c == '\\' && i+1 < len(source) {
+				i++
+				b.WriteByte(source[i])
+			} else if c == inString || c == '\n' {
+				inString = 0
+			}
+		case c == '"' || c == '\'':
+			inString = c
+			b.WriteByte(c)
+		case c == '/' && i+1 < len(source) && source[i+1] == '/':
+			for i < len(source) && source[i] != '\n' {
+				i++
+			}
+			i--
+		case c == '/' && i+1 < len(source) && source[i+1] == '*':
+			end := strings.Index(source[i+2:], "*/")
+			if end < 0 {
+				i = len(source)
+				continue
+			}
+			b.WriteString(strings.Repeat("\n", strings.Count(source[i:i+2+end], "\n")))
+			i += 2 + end + 1
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// unterminatedLiteral reports whether a comment-free line leaves a string or
+// character literal open.
+func unterminatedLiteral(line string) bool {
+	inString := byte(0)
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case inString != 0 && c == '\\':
+			i++
+		case inString != 0 && c == inString:
+			inString = 0
+		case inString == 0 && (c == '"' || c == '\''):
+			inString = c
+		}
+	}
+	return inString != 0
+}
+
+// MessageSends returns the distinct selectors of the Objective-C message sends
+// in source, such as "setZoom:" or "objectForKey:inDomain:", sorted.
+func MessageSends(source string) []string {
+	clean := stripCommentsAndStrings(source)
+	seen := make(map[string]bool)
+	for i := 0; i < len(clean); i++ {
+		// Skip non-brackets and @[...] array literals.
+		if clean[i] != '[' || (i > 0 && clean[i-1] == '@') {
+			continue
+		}
+		if sel := selectorAt(clean, i); sel != "" {
+			seen[sel] = true
+		}
+	}
+	return sortedKeys(seen)
+}
+
+// selectorAt extracts the selector of the message send whose opening bracket
+// is at start, or "" if the brackets enclose something else, like an array
+// subscript or literal.
+func selectorAt(s string, start int) string {
+	depth := 0
+	var top strings.Builder // text at nesting depth 1, nested groups replaced by a marker
+	for i := start; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '[', '(', '{':
+			depth++
+			if depth == 2 {
+				top.WriteString(" _ ")
+			}
+			continue
+		case ']', ')', '}':
+			depth--
+			if depth == 0 {
+				return parseSelector(top.String())
+			}
+			continue
+		}
+		if depth == 1 {
+			top.WriteByte(c)
+		}
+	}
+	return ""
+}
+
+// parseSelector turns the top-level text of "[receiver keyword: arg ...]" into
+// a selector. The receiver is skipped; a unary message is a single identifier
+// following it.
+func parseSelector(body string) string {
+	fields := strings.Fields(strings.ReplaceAll(body, ":", ": "))
+	if len(fields) < 2 {
+		return ""
+	}
+	rest := fields[1:]
+	if !strings.HasSuffix(rest[0], ":") {
+		if len(rest) == 1 && isIdentifier(rest[0]) {
+			return rest[0]
+		}
+		return ""
+	}
+	var sel strings.Builder
+	for _, f := range rest {
+		// Bare colons come from ternaries inside arguments, not from keywords.
+		if name, ok := strings.CutSuffix(f, ":"); ok && isIdentifier(name) {
+			sel.WriteString(f)
+		}
+	}
+	return sel.String()
+}
+
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		if r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (i > 0 && r >= '0' && r <= '9') {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// jaccard returns the Jaccard similarity of two string sets. Two empty sets
+// are considered identical.
+func jaccard(a, b []string) float64 {
+	if len(a) == 0 && len(b) == 0 {
+		return 1
+	}
+	set := make(map[string]int)
+	for _, s := range a {
+		set[s] |= 1
+	}
+	for _, s := range b {
+		set[s] |= 2
+	}
+	both := 0
+	for _, v := range set {
+		if v == 3 {
+			both++
+		}
+	}
+	return float64(both) / float64(len(set))
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,88 @@
+package decompile
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMessageSends(t *testing.T) {
+	source := `- (void)startCapture {
+    // [self ignoredInComment];
+    NSString *key = @"[notASend]";
+    [[NSNotificationCenter defaultCenter] postNotificationName:key object:self];
+    [self.session setZoom:(_enabled ? 1.0 : 2.0) animated:YES];
+    NSArray *items = @[a, b];
+    id first = items[0];
+}`
+	want := []string{"defaultCenter", "postNotificationName:object:", "setZoom:animated:"}
+	if got := MessageSends(source); !reflect.DeepEqual(got, want) {
+		t.Errorf("MessageSends() = %v, want %v", got, want)
+	}
+}
+
+func TestCheckDelimiters(t *testing.T) {
+	valid := `- (void)foo {
+    if ([self bar:@"}"]) { /* ) */ return; }
+}`
+	if issues := CheckDelimiters(valid); len(issues) != 0 {
+		t.Errorf("expected no issues, got %v", issues)
+	}
+
+	invalid := "- (void)foo {\n    [self bar:(1];\n"
+	issues := CheckDelimiters(invalid)
+	if len(issues) == 0 {
+		t.Fatal("expected issues for unbalanced source")
+	}
+	if issues[0].Line != 2 {
+		t.Errorf("expected first issue on line 2, got %v", issues[0])
+	}
+}
+
+func TestSplitImplementation(t *testing.T) {
+	source := `#import "CMCaptureController.h"
+
+@implementation CMCaptureController {
+    BOOL _flag;
+}
+
++ (instancetype)sharedController {
+    return nil;
+}
+
+// Not a method: - (void)commented {}
+- (void)setZoom:(double)zoom animated:(BOOL)animated {
+    if (animated) { NSLog(@"}"); }
+}
+
+static void helper(void) {
+    int x = -1;
+}
+
+- (void)stopCapture;
+- (void)startCapture
+{
+    [self setZoom:1.0 animated:NO];
+}
+@end`
+	got := SplitImplementation(source)
+	want := []struct {
+		classMethod bool
+		selector    string
+		suffix      string
+	}{
+		{true, "sharedController", "return nil;\n}"},
+		{false, "setZoom:animated:", "NSLog(@\"}\"); }\n}"},
+		{false, "startCapture", "animated:NO];\n}"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("SplitImplementation() found %d methods, want %d: %+v", len(got), len(want), got)
+	}
+	for i, w := range want {
+		if got[i].ClassMethod != w.classMethod || got[i].Selector != w.selector {
+			t.Errorf("method %d = %v %q, want %v %q", i, got[i].ClassMethod, got[i].Selector, w.classMethod, w.selector)
+		}
+		if len(got[i].Source) < len(w.suffix) || got[i].Source[len(got[i].Source)-len(w.suffix):] != w.suffix {
+			t.Errorf("method %d source = %q, want suffix %q", i, got[i].Source, w.suffix)
+		}
+	}
+}
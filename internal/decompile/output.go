@@ -0,0 +1,344 @@
+package decompile
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ManifestName is the file in the output directory that lists the files the
+// last assembly generated.
+const ManifestName = ".odin-manifest.json"
+
+// OutputFile is a generated file and its content. Path is relative to the
+// output directory and uses forward slashes.
+type OutputFile struct {
+	Path    string
+	Content []byte
+}
+
+// OutputStats counts what WriteOutput did.
+type OutputStats struct {
+	Written   int
+	Unchanged int
+	Removed   int
+}
+
+// manifest maps each generated file to the SHA-256 of its content.
+type manifest struct {
+	Files map[string]string `json:"files"`
+}
+
+// sourceFile collects the definitions that go into one generated .m file.
+type sourceFile struct {
+	class    string
+	category string
+	// info is the runtime metadata of the class, nil if it has none.
+	info *ClassInfo
+	// include is the argument of the file's #import of its class header, ""
+	// if the class has none.
+	include   string
+	functions []definition
+	// methods maps methodID to its definition; the first one wins.
+	methods map[string]definition
+}
+
+// definition is the source of a function or method and the task it came from.
+type definition struct {
+	task   *Task
+	source string
+	// classMethod tells the static pass that x0 is the class, not self.
+	classMethod bool
+	// line is where the definition starts in the rendered file, from 1.
+	line int
+}
+
+// RenderSources builds a .m file per class from completed tasks: <Class>.m
+// for the class itself and <Class>+<Category>.m for each category, placed by
+// layout under the image the task was scanned from. Methods are wrapped in
+// @implementation ... @end, class methods before instance methods, each
+// sorted by selector, and each method appears once. Tasks that aren't
+// Objective-C methods, such as C functions, go before the @implementation of
+// the file for their class. Files of classes with runtime metadata in classes
+// #import the header RenderHeaders generates for them.
+//
+// Each file with methods from known addresses gets a <File>.m.map source map
+// locating them in their image, built from the calls and literals of the
+// assembly with the symbols of its image, which may be missing.
+func RenderSources(tasks []*Task, classes []*ClassInfo, symbols map[string]*ImageSymbols, layout Layout) []OutputFile {
+	classInfo := indexClasses(classes)
+	files := make(map[string]*sourceFile)
+	for _, task := range tasks {
+		if !task.DecompiledSource.Valid {
+			continue // Skip tasks with no decompiled source
+		}
+		sym, isMethod := ParseSymbol(task.SymbolName)
+		if !isMethod {
+			sym = Symbol{Class: task.ClassName}
+		}
+		info := classInfo.lookup(classKey{task.Image, sym.Class})
+		image := task.Image
+		if image == "" && info != nil {
+			image = info.Image
+		}
+		name := sym.Class + ".m"
+		if sym.Category != "" {
+			name = sym.Class + "+" + sym.Category + ".m"
+		}
+		path := layout.sourcePath(image, name)
+		f, ok := files[path]
+		if !ok {
+			f = &sourceFile{class: sym.Class, category: sym.Category, info: info, methods: make(map[string]definition)}
+			if info != nil {
+				f.include = layout.include(image, info.Image, HeaderName(sym.Class))
+			}
+			files[path] = f
+		}
+
+		source := strings.TrimSpace(task.DecompiledSource.String)
+		if !isMethod {
+			f.functions = append(f.functions, definition{task: task, source: source})
+			continue
+		}
+		id := methodID(sym.ClassMethod, sym.Selector)
+		if _, dup := f.methods[id]; !dup {
+			f.methods[id] = definition{task: task, source: methodSource(source, sym), classMethod: sym.ClassMethod}
+		}
+	}
+
+	out := make([]OutputFile, 0, len(files))
+	for _, path := range sortedKeys(files) {
+		f := files[path]
+		content, defs := f.render()
+		out = append(out, OutputFile{Path: path, Content: content})
+		if m := f.sourceMap(path, defs, symbols, f.info); m != nil {
+			out = append(out, *m)
+		}
+	}
+	return out
+}
+
+// sourceMap builds the .m.map of a rendered file, or returns nil if none of
+// its definitions can be located in their image.
+func (f *sourceFile) sourceMap(path string, defs []definition, symbols map[string]*ImageSymbols, class *ClassInfo) *OutputFile {
+	m := SourceMap{Version: SourceMapVersion, File: path[strings.LastIndex(path, "/")+1:]}
+	located := false
+	for _, def := range defs {
+		var analysis *AsmAnalysis
+		if def.task.AssemblyCode != "" {
+			analysis = AnalyzeAssembly(def.task.AssemblyCode, symbols[def.task.Image], class, def.classMethod)
+		}
+		fn := mapFunction(def.task, def.source, def.line, analysis)
+		located = located || fn.Address != 0
+		m.Functions = append(m.Functions, fn)
+	}
+	if !located {
+		return nil
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil // the map only holds strings and numbers
+	}
+	return &OutputFile{Path: path + SourceMapExt, Content: append(data, '\n')}
+}
+
+// render lays out the file's import, functions and @implementation block and
+// returns the definitions in the order they appear, with their lines.
+func (f *sourceFile) render() ([]byte, []definition) {
+	var b bytes.Buffer
+	var placed []definition
+	place := func(def definition) {
+		def.line = bytes.Count(b.Bytes(), []byte("\n")) + 1
+		placed = append(placed, def)
+		b.WriteString(def.source)
+	}
+	if f.include != "" {
+		fmt.Fprintf(&b, "#import %s\n\n", f.include)
+	}
+	for _, fn := range f.functions {
+		place(fn)
+		b.WriteString("\n\n")
+	}
+	if len(f.methods) == 0 {
+		return b.Bytes(), placed
+	}
+
+	if f.category != "" {
+		fmt.Fprintf(&b, "@implementation %s (%s)\n", f.class, f.category)
+	} else {
+		fmt.Fprintf(&b, "@implementation %s\n", f.class)
+	}
+	for _, section := range []struct {
+		prefix string
+		title  string
+	}{{"+", "Class Methods"}, {"-", "Instance Methods"}} {
+		var ids []string
+		for id := range f.methods {
+			if strings.HasPrefix(id, section.prefix) {
+				ids = append(ids, id)
+			}
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		sort.Strings(ids)
+		fmt.Fprintf(&b, "\n#pragma mark - %s\n", section.title)
+		for _, id := range ids {
+			b.WriteByte('\n')
+			place(f.methods[id])
+			b.WriteByte('\n')
+		}
+	}
+	b.WriteString("\n@end\n")
+	return b.Bytes(), placed
+}
+
+// methodSource returns the definition of a method from a model's output. If
+// the model wrapped it in an @implementation block, the method is extracted.
+func methodSource(source string, sym Symbol) string {
+	if !strings.Contains(source, "@implementation") {
+		return source
+	}
+	for _, m := range SplitImplementation(source) {
+		if m.ClassMethod == sym.ClassMethod && m.Selector == sym.Selector {
+			return strings.TrimSpace(m.Source)
+		}
+	}
+	return source
+}
+
+// WriteOutput brings the output directory in line with files. Each file is
+// written to a temporary file and renamed into place, so readers never see a
+// partial file, and is left alone if its content hasn't changed. Files listed
+// in the manifest of the previous assembly but absent from files are removed;
+// anything else in the directory is never touched.
+func WriteOutput(dir string, files []OutputFile) (OutputStats, error) {
+	var stats OutputStats
+	previous, err := readManifest(dir)
+	if err != nil {
+		return stats, err
+	}
+
+	current := manifest{Files: make(map[string]string, len(files))}
+	for _, f := range files {
+		if err := checkOutputPath(f.Path); err != nil {
+			return stats, err
+		}
+		sum := sha256.Sum256(f.Content)
+		hash := hex.EncodeToString(sum[:])
+		current.Files[f.Path] = hash
+
+		path := filepath.Join(dir, filepath.FromSlash(f.Path))
+		if existing, err := os.ReadFile(path); err == nil && sha256.Sum256(existing) == sum {
+			stats.Unchanged++
+			continue
+		}
+		if err := writeFileAtomic(path, f.Content); err != nil {
+			return stats, err
+		}
+		stats.Written++
+	}
+
+	var stale []string
+	for path := range previous.Files {
+		if _, ok := current.Files[path]; !ok {
+			stale = append(stale, path)
+		}
+	}
+	sort.Strings(stale)
+	for _, path := range stale {
+		if checkOutputPath(path) != nil {
+			continue // a tampered manifest must not delete files outside dir
+		}
+		full := filepath.Join(dir, filepath.FromSlash(path))
+		if err := os.Remove(full); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return stats, fmt.Errorf("failed to remove stale file %s: %w", full, err)
+		}
+		stats.Removed++
+		removeEmptyParents(dir, filepath.Dir(full))
+	}
+
+	data, err := json.MarshalIndent(current, "", "  ")
+	if err != nil {
+		return stats, fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	if err := writeFileAtomic(filepath.Join(dir, ManifestName), append(data, '\n')); err != nil {
+		return stats, err
+	}
+	return stats, nil
+}
+
+// readManifest loads the manifest of the previous assembly, if any.
+func readManifest(dir string) (manifest, error) {
+	var m manifest
+	data, err := os.ReadFile(filepath.Join(dir, ManifestName))
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return m, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("failed to parse manifest %s: %w", filepath.Join(dir, ManifestName), err)
+	}
+	return m, nil
+}
+
+// checkOutputPath rejects paths that would escape the output directory.
+func checkOutputPath(path string) error {
+	clean := filepath.Clean(filepath.FromSlash(path))
+	if path == "" || filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("invalid output path %q", path)
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames
+// it over path.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", path, err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file for %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name()) // a no-op once renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("failed to set permissions of %s: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to move %s into place: %w", path, err)
+	}
+	return nil
+}
+
+// removeEmptyParents removes dir and its parents up to, but not including,
+// root while they are empty.
+func removeEmptyParents(root, dir string) {
+	root = filepath.Clean(root)
+	for dir = filepath.Clean(dir); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package decompile
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteOutput_Idempotent(t *testing.T) {
+	dir := t.TempDir()
+	task := func(class, symbol, source string) *Task {
+		return &Task{ClassName: class, SymbolName: symbol, DecompiledSource: sql.NullString{String: source, Valid: true}}
+	}
+	tasks := []*Task{
+		task("A", "-[A bar]", "- (void)bar {\n}"),
+		task("A", "-[A foo]", "- (void)foo {\n}"),
+		task("B", "-[B baz]", "- (void)baz {\n}"),
+	}
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("mine"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := WriteOutput(dir, RenderSources(tasks, nil, nil, LayoutFlat))
+	if err != nil {
+		t.Fatalf("first write failed: %v", err)
+	}
+	if stats != (OutputStats{Written: 2}) {
+		t.Errorf("first write: got %+v", stats)
+	}
+	first, _ := os.ReadFile(filepath.Join(dir, "A.m"))
+
+	// Running again must not append or rewrite anything.
+	stats, err = WriteOutput(dir, RenderSources(tasks, nil, nil, LayoutFlat))
+	if err != nil {
+		t.Fatalf("second write failed: %v", err)
+	}
+	if stats != (OutputStats{Unchanged: 2}) {
+		t.Errorf("second write: got %+v", stats)
+	}
+	if again, _ := os.ReadFile(filepath.Join(dir, "A.m")); string(again) != string(first) {
+		t.Errorf("A.m changed on an identical run:\n%s", again)
+	}
+
+	// B lost its results: its file goes, files we didn't write stay.
+	tasks[0].DecompiledSource.String = "- (void)bar {\n    return;\n}"
+	stats, err = WriteOutput(dir, RenderSources(tasks[:2], nil, nil, LayoutFlat))
+	if err != nil {
+		t.Fatalf("third write failed: %v", err)
+	}
+	if stats != (OutputStats{Written: 1, Removed: 1}) {
+		t.Errorf("third write: got %+v", stats)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "B.m")); !os.IsNotExist(err) {
+		t.Errorf("stale B.m was not removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "notes.txt")); err != nil {
+		t.Errorf("unrelated file was touched: %v", err)
+	}
+	leftovers, _ := filepath.Glob(filepath.Join(dir, ".*.tmp-*"))
+	if len(leftovers) > 0 {
+		t.Errorf("temporary files left behind: %v", leftovers)
+	}
+}
+
+func TestRenderSources(t *testing.T) {
+	task := func(class, symbol, source string) *Task {
+		return &Task{ClassName: class, SymbolName: symbol, DecompiledSource: sql.NullString{String: source, Valid: true}}
+	}
+	files := RenderSources([]*Task{
+		task("A", "-[A zoom]", "- (void)zoom {\n}"),
+		task("A", "+[A shared]", "+ (id)shared {\n    return nil;\n}"),
+		task("A", "-[A apply]", "@implementation A\n- (void)apply {\n}\n@end"),
+		task("A", "_helper", "static void helper(void) {\n}"),
+		task("A", "-[A(Debug) dump]", "- (void)dump {\n}"),
+		task("Other", "-[A zoom]", "- (void)zoom {\n    // duplicate\n}"),
+	}, []*ClassInfo{{Name: "A"}}, nil, LayoutFlat)
+
+	want := map[string]string{
+		"A.m": `#import "A.h"
+
+static void helper(void) {
+}
+
+@implementation A
+
+#pragma mark - Class Methods
+
++ (id)shared {
+    return nil;
+}
+
+#pragma mark - Instance Methods
+
+- (void)apply {
+}
+
+- (void)zoom {
+}
+
+@end
+`,
+		"A+Debug.m": `#import "A.h"
+
+@implementation A (Debug)
+
+#pragma mark - Instance Methods
+
+- (void)dump {
+}
+
+@end
+`,
+	}
+	if len(files) != len(want) {
+		t.Fatalf("got %d files, want %d", len(files), len(want))
+	}
+	for _, f := range files {
+		if string(f.Content) != want[f.Path] {
+			t.Errorf("%s:\n%s\nwant:\n%s", f.Path, f.Content, want[f.Path])
+		}
+	}
+}
+
+func TestRenderLayout(t *testing.T) {
+	const kit = "/System/Library/Frameworks/Kit.framework/Versions/A/Kit"
+	const lib = "/usr/lib/libbase.dylib"
+	if got := ImageGroup(kit); got != "Kit" {
+		t.Errorf("ImageGroup(%q) = %q, want Kit", kit, got)
+	}
+	if got := ImageGroup(lib); got != "libbase" {
+		t.Errorf("ImageGroup(%q) = %q, want libbase", lib, got)
+	}
+
+	classes := []*ClassInfo{
+		{Name: "Base", Image: lib, Superclass: "NSObject"},
+		{Name: "View", Image: kit, Superclass: "Base"},
+		{Name: "Window", Image: kit, Superclass: "View"},
+	}
+	tasks := []*Task{
+		{ClassName: "View", SymbolName: "-[View draw]", Image: kit, DecompiledSource: sql.NullString{String: "- (void)draw {\n}", Valid: true}},
+		// A category in another image goes with that image.
+		{ClassName: "View", SymbolName: "-[View(Debug) dump]", Image: lib, DecompiledSource: sql.NullString{String: "- (void)dump {\n}", Valid: true}},
+	}
+
+	for _, tt := range []struct {
+		layout Layout
+		want   map[string]string // path: first line
+	}{
+		{LayoutImage, map[string]string{
+			"Kit/View.m":           `#import "View.h"`,
+			"libbase/View+Debug.m": `#import <Kit/View.h>`,
+			"Kit/View.h":           "#import <libbase/Base.h>",
+			"Kit/Window.h":         `#import "View.h"`,
+			"libbase/Base.h":       "",
+		}},
+		{LayoutFramework, map[string]string{
+			"Kit/Sources/View.m":           `#import "View.h"`,
+			"libbase/Sources/View+Debug.m": `#import <Kit/View.h>`,
+			"Kit/Headers/View.h":           "#import <libbase/Base.h>",
+			"Kit/Headers/Window.h":         `#import "View.h"`,
+			"libbase/Headers/Base.h":       "",
+			"Kit/Headers/Kit.h":            "#import <Kit/View.h>\n#import <Kit/Window.h>",
+			"libbase/Headers/libbase.h":    "#import <libbase/Base.h>",
+		}},
+	} {
+		files := append(RenderSources(tasks, classes, nil, tt.layout), RenderHeaders(classes, nil, tt.layout)...)
+		if len(files) != len(tt.want) {
+			var paths []string
+			for _, f := range files {
+				paths = append(paths, f.Path)
+			}
+			t.Errorf("%s: got files %q", tt.layout, paths)
+			continue
+		}
+		for _, f := range files {
+			want, ok := tt.want[f.Path]
+			if !ok {
+				t.Errorf("%s: unexpected file %s", tt.layout, f.Path)
+			} else if !strings.Contains(string(f.Content), want) {
+				t.Errorf("%s: %s does not contain %q:\n%s", tt.layout, f.Path, want, f.Content)
+			}
+		}
+	}
+}
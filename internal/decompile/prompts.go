@@ -0,0 +1,378 @@
+package decompile
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// defaultPrompts holds the built-in templates. A prompt directory passed with
+// --prompt-dir overrides them file by file.
+//
+//go:embed prompts/*.tmpl prompts/examples.json
+var defaultPrompts embed.FS
+
+const (
+	systemTemplateFile = "system.tmpl"
+	userTemplateFile   = "user.tmpl"
+	classTemplateFile  = "class.tmpl"
+	repairTemplateFile = "repair.tmpl"
+	judgeTemplateFile  = "judge.tmpl"
+	examplesFile       = "examples.json"
+)
+
+// versionPattern matches the version header each template starts with:
+// {{- /* version: odin-default-1 */ -}}
+var versionPattern = regexp.MustCompile(`/\*\s*version:\s*(\S+)\s*\*/`)
+
+// ChatMessage is a single message in a chat completion request.
+type ChatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// PromptMethod is the view of a task that user templates render. Callees
+// lists the methods it calls that have already been decompiled.
+type PromptMethod struct {
+	SymbolName   string          `json:"symbol_name"`
+	AssemblyCode string          `json:"assembly_code"`
+	Callees      []CalleeSummary `json:"callees,omitempty"`
+}
+
+// PromptClass is the runtime metadata of a class with methods in the batch.
+// Context is the class rendered as an annotated @interface.
+type PromptClass struct {
+	Name    string
+	Context string
+}
+
+// PromptRepair is a result that failed the syntax check, as shown to the
+// repair template.
+type PromptRepair struct {
+	SymbolName       string   `json:"symbol_name"`
+	DecompiledSource string   `json:"decompiled_source"`
+	Errors           []string `json:"errors"`
+}
+
+// PromptCandidate is an ensemble model's output shown to the judge template.
+// The judge answers with its Number.
+type PromptCandidate struct {
+	Number           int
+	DecompiledSource string
+}
+
+// PromptData is the value templates are executed with. Unit is set when the
+// methods are decompiled together as a whole class, which uses the class
+// template instead of the user template. Repairs is only set for the repair
+// template, and Candidates for the judge template.
+type PromptData struct {
+	Unit       string
+	Methods    []PromptMethod
+	Classes    []PromptClass
+	Repairs    []PromptRepair
+	Candidates []PromptCandidate
+}
+
+// PromptExample is a few-shot example. Each one is sent ahead of the real
+// request as a user turn rendered with the user template, followed by an
+// assistant turn holding the expected JSON answer.
+type PromptExample struct {
+	SymbolName       string `json:"symbol_name"`
+	AssemblyCode     string `json:"assembly_code"`
+	DecompiledSource string `json:"decompiled_source"`
+	Summary          string `json:"summary"`
+}
+
+// PromptSet is a loaded set of system, user, class, repair and judge
+// templates with its few-shot examples.
+type PromptSet struct {
+	// Version identifies the templates and is recorded with every result.
+	Version  string
+	system   *template.Template
+	user     *template.Template
+	class    *template.Template
+	repair   *template.Template
+	judge    *template.Template
+	examples []PromptExample
+}
+
+// PromptLibrary resolves the prompt set for each model. Templates are looked
+// up in <dir>/<model>/, then <dir>/, then the built-in defaults, one file at a
+// time, so an override directory only needs the files it changes. Slashes in
+// model names are replaced with underscores for the directory name.
+type PromptLibrary struct {
+	dir string
+
+	mu   sync.Mutex
+	sets map[string]*PromptSet
+}
+
+// LoadPromptLibrary creates a library rooted at dir, which may be empty to use
+// only the built-in templates. The root set is loaded eagerly so template
+// errors surface before any worker starts.
+func LoadPromptLibrary(dir string) (*PromptLibrary, error) {
+	l := &PromptLibrary{dir: dir, sets: make(map[string]*PromptSet)}
+	if _, err := l.ForModel(""); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+var (
+	builtinLibrary     *PromptLibrary
+	builtinLibraryOnce sync.Once
+)
+
+// ForModel returns the prompt set for a model. A nil library serves the
+// built-in templates.
+func (l *PromptLibrary) ForModel(model string) (*PromptSet, error) {
+	if l == nil {
+		builtinLibraryOnce.Do(func() {
+			builtinLibrary = &PromptLibrary{sets: make(map[string]*PromptSet)}
+		})
+		l = builtinLibrary
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if set, ok := l.sets[model]; ok {
+		return set, nil
+	}
+
+	set, err := l.load(model)
+	if err != nil {
+		return nil, err
+	}
+	l.sets[model] = set
+	return set, nil
+}
+
+// load reads and parses the prompt set for a model.
+func (l *PromptLibrary) load(model string) (*PromptSet, error) {
+	set := &PromptSet{}
+	var versions []string
+
+	for _, name := range []string{systemTemplateFile, userTemplateFile, classTemplateFile, repairTemplateFile, judgeTemplateFile} {
+		text, origin, err := l.readFile(model, name)
+		if err != nil {
+			return nil, err
+		}
+		tmpl, err := template.New(name).Funcs(promptFuncs).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse prompt template %s: %w", origin, err)
+		}
+		m := versionPattern.FindStringSubmatch(text)
+		if m == nil {
+			return nil, fmt.Errorf("prompt template %s has no version header", origin)
+		}
+		if !slices.Contains(versions, m[1]) {
+			versions = append(versions, m[1])
+		}
+		switch name {
+		case systemTemplateFile:
+			set.system = tmpl
+		case userTemplateFile:
+			set.user = tmpl
+		case classTemplateFile:
+			set.class = tmpl
+		case repairTemplateFile:
+			set.repair = tmpl
+		default:
+			set.judge = tmpl
+		}
+	}
+
+	text, origin, err := l.readFile(model, examplesFile)
+	if err != nil {
+		return nil, err
+	}
+	examples, err := parseExamples(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse prompt examples %s: %w", origin, err)
+	}
+	set.examples = examples.Examples
+	if !slices.Contains(versions, examples.Version) {
+		versions = append(versions, examples.Version)
+	}
+	set.Version = strings.Join(versions, "+")
+	return set, nil
+}
+
+// promptExamples is the content of examples.json.
+type promptExamples struct {
+	Version  string          `json:"version"`
+	Examples []PromptExample `json:"examples"`
+}
+
+// parseExamples parses examples.json. A bare array of examples, as written
+// before the file had a version, is versioned by a hash of its content, so
+// editing it still changes the prompt version.
+func parseExamples(text string) (*promptExamples, error) {
+	var examples promptExamples
+	if strings.HasPrefix(strings.TrimSpace(text), "[") {
+		if err := json.Unmarshal([]byte(text), &examples.Examples); err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256([]byte(text))
+		examples.Version = "examples-" + hex.EncodeToString(sum[:4])
+		return &examples, nil
+	}
+	if err := json.Unmarshal([]byte(text), &examples); err != nil {
+		return nil, err
+	}
+	if examples.Version == "" {
+		return nil, errors.New("no version")
+	}
+	return &examples, nil
+}
+
+// readFile finds the most specific copy of a prompt file and returns its
+// contents and where it came from.
+func (l *PromptLibrary) readFile(model, name string) (string, string, error) {
+	if l.dir != "" {
+		var candidates []string
+		if model != "" {
+			candidates = append(candidates, filepath.Join(l.dir, strings.ReplaceAll(model, "/", "_"), name))
+		}
+		candidates = append(candidates, filepath.Join(l.dir, name))
+		for _, path := range candidates {
+			data, err := os.ReadFile(path)
+			if err == nil {
+				return string(data), path, nil
+			}
+			if !errors.Is(err, fs.ErrNotExist) {
+				return "", "", fmt.Errorf("failed to read prompt file: %w", err)
+			}
+		}
+	}
+	data, err := defaultPrompts.ReadFile("prompts/" + name)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read built-in prompt file %s: %w", name, err)
+	}
+	return string(data), "built-in " + name, nil
+}
+
+var promptFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		data, err := json.MarshalIndent(v, "", "  ")
+		return string(data), err
+	},
+}
+
+// Render builds the chat messages for a batch: the system prompt, one
+// user/assistant exchange per few-shot example and finally the batch itself,
+// together with the metadata of the classes it touches. callees maps task IDs
+// to their decompiled callees and may be nil.
+func (p *PromptSet) Render(tasks []*Task, classes []*ClassInfo, callees map[int64][]CalleeSummary) ([]ChatMessage, error) {
+	data := promptData(tasks, classes, callees)
+	system, err := execute(p.system, data)
+	if err != nil {
+		return nil, err
+	}
+	messages := []ChatMessage{{Role: "system", Content: system}}
+
+	for _, ex := range p.examples {
+		user, err := execute(p.user, PromptData{Methods: []PromptMethod{{SymbolName: ex.SymbolName, AssemblyCode: ex.AssemblyCode}}})
+		if err != nil {
+			return nil, err
+		}
+		answer, err := json.MarshalIndent([]DecompiledResult{{SymbolName: ex.SymbolName, DecompiledSource: ex.DecompiledSource, Summary: ex.Summary, Success: true}}, "", "  ")
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal example answer: %w", err)
+		}
+		messages = append(messages,
+			ChatMessage{Role: "user", Content: user},
+			ChatMessage{Role: "assistant", Content: string(answer)},
+		)
+	}
+
+	user, err := execute(p.user, data)
+	if err != nil {
+		return nil, err
+	}
+	return append(messages, ChatMessage{Role: "user", Content: user}), nil
+}
+
+// RenderUnit builds the chat messages for decompiling a unit as a whole
+// class. The few-shot examples answer per-method prompts, so they are left
+// out.
+func (p *PromptSet) RenderUnit(unit string, tasks []*Task, classes []*ClassInfo, callees map[int64][]CalleeSummary) ([]ChatMessage, error) {
+	data := promptData(tasks, classes, callees)
+	// Units are named "image:Class", and clusters of a large class "Class#n";
+	// the model only needs the class.
+	data.Unit, _, _ = strings.Cut(unit[strings.LastIndex(unit, ":")+1:], "#")
+	system, err := execute(p.system, data)
+	if err != nil {
+		return nil, err
+	}
+	user, err := execute(p.class, data)
+	if err != nil {
+		return nil, err
+	}
+	return []ChatMessage{{Role: "system", Content: system}, {Role: "user", Content: user}}, nil
+}
+
+// RenderRepair builds the user message asking the model to fix results that
+// failed the syntax check. It is sent after the model's previous answer.
+func (p *PromptSet) RenderRepair(repairs []PromptRepair) (ChatMessage, error) {
+	content, err := execute(p.repair, PromptData{Repairs: repairs})
+	if err != nil {
+		return ChatMessage{}, err
+	}
+	return ChatMessage{Role: "user", Content: content}, nil
+}
+
+// RenderJudge builds the message asking a judge model which ensemble
+// candidate for a task best matches its assembly. Candidates are numbered
+// from 0 in the order given.
+func (p *PromptSet) RenderJudge(task *Task, sources []string) (ChatMessage, error) {
+	data := promptData([]*Task{task}, nil, nil)
+	for i, source := range sources {
+		data.Candidates = append(data.Candidates, PromptCandidate{Number: i, DecompiledSource: source})
+	}
+	content, err := execute(p.judge, data)
+	if err != nil {
+		return ChatMessage{}, err
+	}
+	return ChatMessage{Role: "user", Content: content}, nil
+}
+
+func promptData(tasks []*Task, classes []*ClassInfo, callees map[int64][]CalleeSummary) PromptData {
+	data := PromptData{Methods: make([]PromptMethod, len(tasks))}
+	for i, task := range tasks {
+		data.Methods[i] = PromptMethod{SymbolName: task.SymbolName, AssemblyCode: task.AssemblyCode, Callees: callees[task.ID]}
+	}
+	for _, class := range classes {
+		data.Classes = append(data.Classes, PromptClass{Name: class.Name, Context: class.Context()})
+	}
+	return data
+}
+
+func execute(tmpl *template.Template, data any) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to render prompt template %s: %w", tmpl.Name(), err)
+	}
+	return buf.String(), nil
+}
+
+// messagesText concatenates the content of all messages, for token estimates.
+func messagesText(messages []ChatMessage) string {
+	var b strings.Builder
+	for _, m := range messages {
+		b.WriteString(m.Content)
+	}
+	return b.String()
+}
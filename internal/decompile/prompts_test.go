@@ -0,0 +1,159 @@
+package decompile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPromptLibrary_Overrides(t *testing.T) {
+	dir := t.TempDir()
+	modelDir := filepath.Join(dir, "ollama_codellama")
+	if err := os.MkdirAll(modelDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	userTmpl := "{{- /* version: codellama-2 */ -}}\n{{ range .Methods }}{{ .SymbolName }}\n{{ end }}"
+	if err := os.WriteFile(filepath.Join(modelDir, userTemplateFile), []byte(userTmpl), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(modelDir, examplesFile), []byte(`{"version": "codellama-2", "examples": []}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	lib, err := LoadPromptLibrary(dir)
+	if err != nil {
+		t.Fatalf("failed to load prompt library: %v", err)
+	}
+
+	defaults, err := lib.ForModel("gpt-4o-mini")
+	if err != nil {
+		t.Fatalf("failed to load default prompts: %v", err)
+	}
+	if defaults.Version != "odin-default-6" {
+		t.Errorf("default version = %q, want odin-default-6", defaults.Version)
+	}
+
+	set, err := lib.ForModel("ollama/codellama")
+	if err != nil {
+		t.Fatalf("failed to load model prompts: %v", err)
+	}
+	if set.Version != "odin-default-6+codellama-2" {
+		t.Errorf("model version = %q, want odin-default-6+codellama-2", set.Version)
+	}
+
+	messages, err := set.Render([]*Task{{SymbolName: "-[A foo]"}, {SymbolName: "-[A bar]"}}, nil, nil)
+	if err != nil {
+		t.Fatalf("render failed: %v", err)
+	}
+	if len(messages) != 2 || messages[0].Role != "system" {
+		t.Fatalf("expected system and user messages without examples, got %+v", messages)
+	}
+	if got := strings.TrimSpace(messages[1].Content); got != "-[A foo]\n-[A bar]" {
+		t.Errorf("user message = %q", got)
+	}
+}
+
+func TestPromptLibrary_ExamplesVersion(t *testing.T) {
+	dir := t.TempDir()
+	lib, err := LoadPromptLibrary(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaults, err := lib.ForModel("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Examples without a version are versioned by their content.
+	var versions []string
+	for i, examples := range []string{"[]", `[{"symbol_name": "-[A foo]"}]`} {
+		modelDir := filepath.Join(dir, fmt.Sprintf("model%d", i))
+		if err := os.MkdirAll(modelDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(modelDir, examplesFile), []byte(examples), 0644); err != nil {
+			t.Fatal(err)
+		}
+		set, err := lib.ForModel(fmt.Sprintf("model%d", i))
+		if err != nil {
+			t.Fatalf("failed to load %s: %v", examples, err)
+		}
+		if !strings.HasPrefix(set.Version, defaults.Version+"+examples-") {
+			t.Errorf("version with examples %s = %q, want the default version and a hash", examples, set.Version)
+		}
+		versions = append(versions, set.Version)
+	}
+	if versions[0] == versions[1] {
+		t.Errorf("changing the examples kept version %q", versions[0])
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, examplesFile), []byte(`{"examples": []}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadPromptLibrary(dir); err == nil {
+		t.Error("examples without a version were accepted")
+	}
+}
+
+func TestPromptSet_RenderUnit(t *testing.T) {
+	set, err := (*PromptLibrary)(nil).ForModel("")
+	if err != nil {
+		t.Fatalf("failed to load built-in prompts: %v", err)
+	}
+	tasks := []*Task{{SymbolName: "-[A foo]"}, {SymbolName: "-[A bar]"}}
+	messages, err := set.RenderUnit("A#2", tasks, nil, nil)
+	if err != nil {
+		t.Fatalf("render failed: %v", err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("expected system and user messages without examples, got %d messages", len(messages))
+	}
+	if !strings.Contains(messages[0].Content, `"implementation"`) {
+		t.Errorf("system message lacks the whole-class output contract: %q", messages[0].Content)
+	}
+	if !strings.Contains(messages[1].Content, "methods of A as one @implementation") {
+		t.Errorf("user message = %q", messages[1].Content)
+	}
+}
+
+func TestPromptSet_RenderJudge(t *testing.T) {
+	set, err := (*PromptLibrary)(nil).ForModel("")
+	if err != nil {
+		t.Fatalf("failed to load built-in prompts: %v", err)
+	}
+	task := &Task{SymbolName: "-[A foo]", AssemblyCode: "bl _objc_msgSend$bar"}
+	msg, err := set.RenderJudge(task, []string{"- (void)foo { [self bar]; }", "- (void)foo { [self baz]; }"})
+	if err != nil {
+		t.Fatalf("render failed: %v", err)
+	}
+	for _, want := range []string{`{"choice": <candidate number>`, "Symbol: -[A foo]", "bl _objc_msgSend$bar", "Candidate 0:\n- (void)foo { [self bar]; }", "Candidate 1:\n- (void)foo { [self baz]; }"} {
+		if !strings.Contains(msg.Content, want) {
+			t.Errorf("judge prompt lacks %q:\n%s", want, msg.Content)
+		}
+	}
+
+	// The judge prompt is overridden like the others and versioned with them.
+	dir := t.TempDir()
+	judgeTmpl := "{{- /* version: judge-2 */ -}}\n{{ range .Candidates }}{{ .Number }}: {{ .DecompiledSource }}\n{{ end }}"
+	if err := os.WriteFile(filepath.Join(dir, judgeTemplateFile), []byte(judgeTmpl), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lib, err := LoadPromptLibrary(dir)
+	if err != nil {
+		t.Fatalf("failed to load prompt library: %v", err)
+	}
+	if set, err = lib.ForModel("judge-model"); err != nil {
+		t.Fatal(err)
+	}
+	if set.Version != "odin-default-6+judge-2" {
+		t.Errorf("version = %q, want odin-default-6+judge-2", set.Version)
+	}
+	if msg, _ = set.RenderJudge(task, []string{"a", "b"}); msg.Content != "0: a\n1: b\n" {
+		t.Errorf("overridden judge prompt = %q", msg.Content)
+	}
+	if got := joinVersions("odin-default-6+codellama-2", set.Version); got != "odin-default-6+codellama-2+judge-2" {
+		t.Errorf("joinVersions = %q", got)
+	}
+}
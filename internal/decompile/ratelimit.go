@@ -0,0 +1,245 @@
+package decompile
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultBackoff is how long workers pause after a 429/503 response that
+// carries no usable Retry-After or x-ratelimit-reset-* header.
+const defaultBackoff = 10 * time.Second
+
+// RateLimitConfig describes the client-side limits applied to AI requests.
+// A zero value for any field disables that particular limit.
+type RateLimitConfig struct {
+	RequestsPerMinute int
+	TokensPerMinute   int
+	MaxInFlight       int
+}
+
+// RateLimiter shapes the traffic of all workers sharing a provider endpoint.
+// It combines a requests-per-minute and a tokens-per-minute bucket with a cap
+// on concurrent requests, and can be paused globally when the provider signals
+// backpressure. A nil *RateLimiter imposes no limits.
+type RateLimiter struct {
+	cfg      RateLimitConfig
+	inFlight chan struct{}
+
+	mu          sync.Mutex
+	requests    float64
+	tokens      float64
+	last        time.Time
+	pausedUntil time.Time
+}
+
+// BackpressureError reports a 429 or 503 response from the provider. The batch
+// that triggered it should go back to the queue instead of being counted as a
+// failed attempt.
+type BackpressureError struct {
+	StatusCode int
+	RetryAfter time.Duration
+	Body       string
+}
+
+func (e *BackpressureError) Error() string {
+	return fmt.Sprintf("provider applied backpressure (status %d, retry after %s): %s", e.StatusCode, e.RetryAfter, e.Body)
+}
+
+// NewRateLimiter creates a limiter for the given configuration. Both buckets
+// start full so the first minute of traffic is not artificially delayed.
+func NewRateLimiter(cfg RateLimitConfig) *RateLimiter {
+	l := &RateLimiter{
+		cfg:      cfg,
+		requests: float64(cfg.RequestsPerMinute),
+		tokens:   float64(cfg.TokensPerMinute),
+		last:     time.Now(),
+	}
+	if cfg.MaxInFlight > 0 {
+		l.inFlight = make(chan struct{}, cfg.MaxInFlight)
+	}
+	return l
+}
+
+// Acquire blocks until a request estimated at the given number of tokens may
+// be sent. The returned function must be called once the request finishes to
+// free its in-flight slot.
+func (l *RateLimiter) Acquire(ctx context.Context, estimatedTokens int) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	if l.inFlight != nil {
+		select {
+		case l.inFlight <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			if l.inFlight != nil {
+				<-l.inFlight
+			}
+		})
+	}
+
+	for {
+		wait := l.reserve(estimatedTokens)
+		if wait <= 0 {
+			return release, nil
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			release()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// reserve consumes capacity for one request if it is available and returns
+// zero, or returns how long the caller should wait before trying again.
+func (l *RateLimiter) reserve(estimatedTokens int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.refill(now)
+
+	if now.Before(l.pausedUntil) {
+		return l.pausedUntil.Sub(now)
+	}
+
+	if l.cfg.RequestsPerMinute > 0 && l.requests < 1 {
+		return perMinuteWait(1-l.requests, l.cfg.RequestsPerMinute)
+	}
+
+	// A single request larger than the whole budget would never fit, so it
+	// only has to wait for a full bucket.
+	need := float64(estimatedTokens)
+	if l.cfg.TokensPerMinute > 0 {
+		if need > float64(l.cfg.TokensPerMinute) {
+			need = float64(l.cfg.TokensPerMinute)
+		}
+		if l.tokens < need {
+			return perMinuteWait(need-l.tokens, l.cfg.TokensPerMinute)
+		}
+	}
+
+	if l.cfg.RequestsPerMinute > 0 {
+		l.requests--
+	}
+	if l.cfg.TokensPerMinute > 0 {
+		l.tokens -= need
+	}
+	return 0
+}
+
+// refill tops up both buckets for the time elapsed since the last call.
+func (l *RateLimiter) refill(now time.Time) {
+	elapsed := now.Sub(l.last).Minutes()
+	l.last = now
+	if l.cfg.RequestsPerMinute > 0 {
+		l.requests = min(l.requests+elapsed*float64(l.cfg.RequestsPerMinute), float64(l.cfg.RequestsPerMinute))
+	}
+	if l.cfg.TokensPerMinute > 0 {
+		l.tokens = min(l.tokens+elapsed*float64(l.cfg.TokensPerMinute), float64(l.cfg.TokensPerMinute))
+	}
+}
+
+func perMinuteWait(missing float64, perMinute int) time.Duration {
+	return time.Duration(missing / float64(perMinute) * float64(time.Minute))
+}
+
+// Pause stops all workers from sending requests for at least d.
+func (l *RateLimiter) Pause(d time.Duration) {
+	if l == nil || d <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if until := time.Now().Add(d); until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+}
+
+// Observe inspects the x-ratelimit-* headers of a provider response and pauses
+// the limiter when the provider reports an exhausted request or token budget.
+func (l *RateLimiter) Observe(h http.Header) {
+	if l == nil {
+		return
+	}
+	for _, kind := range []string{"requests", "tokens"} {
+		remaining, err := strconv.Atoi(h.Get("x-ratelimit-remaining-" + kind))
+		if err != nil || remaining > 0 {
+			continue
+		}
+		if reset, ok := parseResetDuration(h.Get("x-ratelimit-reset-" + kind)); ok {
+			l.Pause(reset)
+		}
+	}
+}
+
+// retryAfter extracts the delay requested by a 429/503 response, falling back
+// to the x-ratelimit-reset-* headers and finally to defaultBackoff.
+func retryAfter(h http.Header) time.Duration {
+	if ms, err := strconv.Atoi(h.Get("retry-after-ms")); err == nil && ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	if v := h.Get("Retry-After"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+			return time.Duration(secs) * time.Second
+		}
+		if at, err := http.ParseTime(v); err == nil {
+			if d := time.Until(at); d > 0 {
+				return d
+			}
+		}
+	}
+	var longest time.Duration
+	for _, kind := range []string{"requests", "tokens"} {
+		if d, ok := parseResetDuration(h.Get("x-ratelimit-reset-" + kind)); ok && d > longest {
+			longest = d
+		}
+	}
+	if longest > 0 {
+		return longest
+	}
+	return defaultBackoff
+}
+
+// parseResetDuration accepts both Go-style durations ("6m0s", "20ms"), as sent
+// by OpenAI-compatible proxies, and plain seconds ("1", "0.5").
+func parseResetDuration(v string) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
+	if d, err := time.ParseDuration(v); err == nil {
+		return d, true
+	}
+	if secs, err := strconv.ParseFloat(v, 64); err == nil {
+		return time.Duration(secs * float64(time.Second)), true
+	}
+	return 0, false
+}
+
+// estimateTokens gives a rough token count for a prompt, assuming about four
+// characters per token and a completion of similar size to the prompt.
+func estimateTokens(prompt string) int {
+	return countTokens(prompt) * 2
+}
+
+// countTokens gives a rough token count for a text at about four characters
+// per token.
+func countTokens(text string) int {
+	return len(text)/4 + 1
+}
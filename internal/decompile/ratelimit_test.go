@@ -0,0 +1,73 @@
+package decompile
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetryAfter(t *testing.T) {
+	cases := []struct {
+		name   string
+		header http.Header
+		want   time.Duration
+	}{
+		{"seconds", http.Header{"Retry-After": {"7"}}, 7 * time.Second},
+		{"milliseconds", http.Header{"Retry-After-Ms": {"250"}}, 250 * time.Millisecond},
+		{"reset header", http.Header{"X-Ratelimit-Reset-Requests": {"1m30s"}}, 90 * time.Second},
+		{"reset seconds", http.Header{"X-Ratelimit-Reset-Tokens": {"2.5"}}, 2500 * time.Millisecond},
+		{"missing", http.Header{}, defaultBackoff},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := retryAfter(tc.header); got != tc.want {
+				t.Errorf("retryAfter() = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRateLimiter_RequestsPerMinute(t *testing.T) {
+	l := NewRateLimiter(RateLimitConfig{RequestsPerMinute: 2})
+
+	for i := 0; i < 2; i++ {
+		if wait := l.reserve(0); wait != 0 {
+			t.Fatalf("request %d: expected immediate reservation, got wait %s", i, wait)
+		}
+	}
+	if wait := l.reserve(0); wait <= 0 {
+		t.Fatalf("expected third request to wait, got %s", wait)
+	}
+}
+
+func TestRateLimiter_ObservePauses(t *testing.T) {
+	l := NewRateLimiter(RateLimitConfig{})
+	l.Observe(http.Header{
+		"X-Ratelimit-Remaining-Tokens": {"0"},
+		"X-Ratelimit-Reset-Tokens":     {"30s"},
+	})
+	if wait := l.reserve(10); wait < 29*time.Second {
+		t.Fatalf("expected limiter to be paused for ~30s, got %s", wait)
+	}
+}
+
+func TestRateLimiter_MaxInFlight(t *testing.T) {
+	l := NewRateLimiter(RateLimitConfig{MaxInFlight: 1})
+
+	release, err := l.Acquire(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("first acquire failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := l.Acquire(ctx, 0); err == nil {
+		t.Fatal("expected second acquire to block until the context expired")
+	}
+
+	release()
+	if _, err := l.Acquire(context.Background(), 0); err != nil {
+		t.Fatalf("acquire after release failed: %v", err)
+	}
+}
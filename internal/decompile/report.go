@@ -0,0 +1,364 @@
+package decompile
+
+import (
+	"bytes"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"html"
+	"html/template"
+	"sort"
+	"strings"
+)
+
+//go:embed report/*.tmpl report/style.css
+var reportFiles embed.FS
+
+var reportTemplates = template.Must(template.New("report").Funcs(template.FuncMap{
+	"statusBadge":   statusBadge,
+	"fidelityBadge": fidelityBadge,
+	"imageName":     ImageGroup,
+	"highlightDiff": highlightDiff,
+	"shortHash":     shortHash,
+}).ParseFS(reportFiles, "report/*.tmpl"))
+
+// reportClass is a class page of the HTML report.
+type reportClass struct {
+	Title   string
+	Name    string
+	Image   string
+	Page    string
+	Methods []*reportMethod
+	reportCounts
+}
+
+// reportMethod is a method, or function, on a class page.
+type reportMethod struct {
+	Task   *Task
+	Page   string
+	Anchor string
+	// Issues describes the fidelity mismatches of the result, if any.
+	Issues   string
+	Assembly template.HTML
+	Source   template.HTML
+}
+
+// reportCounts tallies the outcome of a set of tasks.
+type reportCounts struct {
+	Total     int
+	Completed int
+	Failed    int
+	Pending   int
+	// Fidelity is the mean fidelity of the results that were checked.
+	Fidelity sql.NullFloat64
+
+	fidelitySum float64
+	checked     int
+}
+
+func (c *reportCounts) add(task *Task) {
+	c.Total++
+	switch task.Status {
+	case StatusCompleted:
+		c.Completed++
+	case StatusFailed:
+		c.Failed++
+	default:
+		c.Pending++
+	}
+	if task.Fidelity.Valid {
+		c.fidelitySum += task.Fidelity.Float64
+		c.checked++
+		c.Fidelity = sql.NullFloat64{Float64: c.fidelitySum / float64(c.checked), Valid: true}
+	}
+}
+
+// RenderHTMLReport builds a self-contained static site for the tasks of a
+// run: an index of classes with their progress and a list of the methods that
+// failed or were never decompiled, and a page per class showing each method's
+// annotated assembly next to its highlighted source with its status,
+// fidelity and validation. symbols and classes annotate the assembly and may
+// be empty.
+func RenderHTMLReport(title string, tasks []*Task, classes []*ClassInfo, symbols map[string]*ImageSymbols) ([]OutputFile, error) {
+	classInfo := indexClasses(classes)
+
+	pages := make(map[classKey]*reportClass)
+	pageFiles := make(map[string]bool)
+	var index struct {
+		Title      string
+		Classes    []*reportClass
+		Unfinished []*reportMethod
+		reportCounts
+	}
+	index.Title = title
+	for _, task := range tasks {
+		key := taskClass(task)
+		page, ok := pages[key]
+		if !ok {
+			// A class of the same name in another image gets a page named
+			// after its image too.
+			file := pageName(key.name)
+			if pageFiles[file] {
+				file = pageName(ImageGroup(key.image) + "." + key.name)
+			}
+			pageFiles[file] = true
+			page = &reportClass{Title: title, Name: key.name, Image: task.Image, Page: "classes/" + file + ".html"}
+			pages[key] = page
+			index.Classes = append(index.Classes, page)
+		}
+
+		sym, isMethod := ParseSymbol(task.SymbolName)
+		m := &reportMethod{Task: task, Page: page.Page, Anchor: methodAnchor(sym, isMethod, task.SymbolName)}
+		asm := task.AssemblyCode
+		if asm != "" {
+			asm = AnalyzeAssembly(asm, symbols[task.Image], classInfo.lookup(key), isMethod && sym.ClassMethod).Annotated()
+		}
+		m.Assembly = highlightAssembly(asm)
+		m.Source = highlightObjC(task.DecompiledSource.String)
+		if task.FidelityIssues.Valid {
+			var f Fidelity
+			if json.Unmarshal([]byte(task.FidelityIssues.String), &f) == nil {
+				m.Issues = f.String()
+			}
+		}
+		page.Methods = append(page.Methods, m)
+		page.add(task)
+		index.add(task)
+		if task.Status != StatusCompleted {
+			index.Unfinished = append(index.Unfinished, m)
+		}
+	}
+	sort.Slice(index.Classes, func(i, j int) bool {
+		a, b := index.Classes[i], index.Classes[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Image < b.Image
+	})
+	for _, page := range index.Classes {
+		sort.SliceStable(page.Methods, func(i, j int) bool { return page.Methods[i].Task.SymbolName < page.Methods[j].Task.SymbolName })
+	}
+	sort.SliceStable(index.Unfinished, func(i, j int) bool {
+		a, b := index.Unfinished[i].Task, index.Unfinished[j].Task
+		return classOf(a) < classOf(b) || (classOf(a) == classOf(b) && a.SymbolName < b.SymbolName)
+	})
+
+	style, err := reportFiles.ReadFile("report/style.css")
+	if err != nil {
+		return nil, err
+	}
+	files := []OutputFile{{Path: "style.css", Content: style}}
+	render := func(path, tmpl string, data any) error {
+		var b bytes.Buffer
+		if err := reportTemplates.ExecuteTemplate(&b, tmpl, data); err != nil {
+			return fmt.Errorf("failed to render %s: %w", path, err)
+		}
+		files = append(files, OutputFile{Path: path, Content: b.Bytes()})
+		return nil
+	}
+	if err := render("index.html", "index.html.tmpl", index); err != nil {
+		return nil, err
+	}
+	for _, page := range index.Classes {
+		if err := render(page.Page, "class.html.tmpl", page); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// pageName makes a class name safe to use as a file name.
+func pageName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' || r == '+' || r == '.' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// methodAnchor returns the id of a method's section on its class page, e.g.
+// "i-setZoom:" or "c-Debug-shared" for +[A(Debug) shared].
+func methodAnchor(sym Symbol, isMethod bool, symbol string) string {
+	if !isMethod {
+		return "f-" + pageName(symbol)
+	}
+	kind := "i-"
+	if sym.ClassMethod {
+		kind = "c-"
+	}
+	if sym.Category != "" {
+		kind += pageName(sym.Category) + "-"
+	}
+	return kind + sym.Selector
+}
+
+func statusBadge(status TaskStatus) template.HTML {
+	s := html.EscapeString(string(status))
+	return template.HTML(`<span class="badge ` + s + `">` + s + `</span>`)
+}
+
+func fidelityBadge(score float64) template.HTML {
+	class := "poor"
+	switch {
+	case score >= 0.8:
+		class = "good"
+	case score >= 0.5:
+		class = "fair"
+	}
+	return template.HTML(fmt.Sprintf(`<span class="badge %s">%.0f%% fidelity</span>`, class, score*100))
+}
+
+// shortHash abbreviates an assembly hash like git abbreviates commits.
+func shortHash(h string) string {
+	if len(h) > 12 {
+		return h[:12]
+	}
+	return h
+}
+
+// objcKeywords are highlighted as keywords in decompiled source.
+var objcKeywords = map[string]bool{
+	"if": true, "else": true, "for": true, "while": true, "do": true, "switch": true,
+	"case": true, "default": true, "break": true, "continue": true, "return": true,
+	"goto": true, "sizeof": true, "typedef": true, "struct": true, "union": true,
+	"enum": true, "static": true, "const": true, "extern": true, "inline": true,
+	"void": true, "char": true, "short": true, "int": true, "long": true, "float": true,
+	"double": true, "signed": true, "unsigned": true, "id": true, "BOOL": true,
+	"SEL": true, "Class": true, "instancetype": true, "self": true, "super": true,
+	"nil": true, "Nil": true, "NULL": true, "YES": true, "NO": true, "true": true,
+	"false": true, "__block": true, "__weak": true, "__strong": true,
+	"__unsafe_unretained": true,
+}
+
+// highlightObjC escapes Objective-C source and wraps comments, literals,
+// keywords, @-directives, preprocessor lines and type names in spans.
+func highlightObjC(src string) template.HTML {
+	var b strings.Builder
+	span := func(class, text string) {
+		fmt.Fprintf(&b, `<span class="%s">%s</span>`, class, html.EscapeString(text))
+	}
+	lineStart := true
+	for i := 0; i < len(src); {
+		c := src[i]
+		rest := src[i:]
+		n := 0 // length of the token at i, 0 for a plain character
+		switch {
+		case lineStart && c == '#', strings.HasPrefix(rest, "//"):
+			n = strings.IndexByte(rest, '\n')
+			if n < 0 {
+				n = len(rest)
+			}
+			class := "c"
+			if c == '#' {
+				class = "p"
+			}
+			span(class, rest[:n])
+		case strings.HasPrefix(rest, "/*"):
+			n = len(rest)
+			if end := strings.Index(rest[2:], "*/"); end >= 0 {
+				n = end + 4
+			}
+			span("c", rest[:n])
+		case c == '"' || c == '\'' || strings.HasPrefix(rest, `@"`):
+			quote := rest[0]
+			n = 1
+			if c == '@' {
+				quote, n = '"', 2
+			}
+			for n < len(rest) && rest[n] != quote && rest[n] != '\n' {
+				if rest[n] == '\\' {
+					n++
+				}
+				n++
+			}
+			n = min(n+1, len(rest))
+			span("s", rest[:n])
+		case c == '@' && len(rest) > 1 && isIdentStart(rest[1]):
+			n = 1 + identLength(rest[1:])
+			span("k", rest[:n])
+		case c >= '0' && c <= '9':
+			n = 1
+			for n < len(rest) && (isIdentChar(rest[n]) || rest[n] == '.') {
+				n++
+			}
+			span("n", rest[:n])
+		case isIdentStart(c):
+			n = identLength(rest)
+			word := rest[:n]
+			switch {
+			case objcKeywords[word]:
+				span("k", word)
+			case word[0] >= 'A' && word[0] <= 'Z' && (i == 0 || src[i-1] != '.'):
+				span("t", word)
+			default:
+				b.WriteString(html.EscapeString(word))
+			}
+		}
+		if n > 0 {
+			i += n
+			lineStart = false
+			continue
+		}
+		b.WriteString(html.EscapeString(string(c)))
+		if c == '\n' {
+			lineStart = true
+		} else if c != ' ' && c != '\t' {
+			lineStart = false
+		}
+		i++
+	}
+	return template.HTML(b.String())
+}
+
+// highlightAssembly escapes a disassembly listing and marks up the address,
+// mnemonic and comment of each line.
+func highlightAssembly(asm string) template.HTML {
+	var b strings.Builder
+	for i, line := range strings.Split(asm, "\n") {
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		code, comment := line, ""
+		if j := strings.IndexByte(line, ';'); j >= 0 {
+			code, comment = line[:j], line[j:]
+		}
+		if _, ok := instructionAddress(code); ok {
+			j := strings.IndexByte(code, ':') + 1
+			fmt.Fprintf(&b, `<span class="a">%s</span>`, html.EscapeString(code[:j]))
+			code = code[j:]
+		}
+		mnemonic := strings.TrimLeft(code, " \t")
+		b.WriteString(code[:len(code)-len(mnemonic)])
+		operands := ""
+		if j := strings.IndexAny(mnemonic, " \t"); j >= 0 {
+			mnemonic, operands = mnemonic[:j], mnemonic[j:]
+		}
+		if mnemonic != "" {
+			fmt.Fprintf(&b, `<span class="k">%s</span>`, html.EscapeString(mnemonic))
+		}
+		b.WriteString(html.EscapeString(operands))
+		if comment != "" {
+			fmt.Fprintf(&b, `<span class="c">%s</span>`, html.EscapeString(comment))
+		}
+	}
+	return template.HTML(b.String())
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || c >= '0' && c <= '9'
+}
+
+// identLength returns the length of the identifier s starts with.
+func identLength(s string) int {
+	n := 0
+	for n < len(s) && isIdentChar(s[n]) {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,70 @@
+package decompile
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+)
+
+func TestRenderHTMLReport(t *testing.T) {
+	tasks := []*Task{
+		{
+			ClassName:        "A",
+			SymbolName:       "-[A compare:]",
+			Status:           StatusCompleted,
+			AssemblyCode:     "0x1000:  cmp x0, x1\n0x1004:  ret",
+			DecompiledSource: sql.NullString{Valid: true, String: "- (BOOL)compare:(id)other {\n    // a < b\n    return [self size] < @\"<b>\".length;\n}"},
+			Fidelity:         sql.NullFloat64{Valid: true, Float64: 0.5},
+			FidelityIssues:   sql.NullString{Valid: true, String: `{"score":0.5,"missing":["@selector(size)"]}`},
+		},
+		{ClassName: "A", SymbolName: "+[A(Debug) dump]", Status: StatusFailed, ErrorMessage: sql.NullString{Valid: true, String: "Max retries exceeded: <timeout>"}},
+		{ClassName: "B", SymbolName: "-[B run]", Status: StatusPending},
+		// Another image's B gets a page of its own.
+		{ClassName: "B", SymbolName: "-[B stop]", Image: "/usr/lib/libother.dylib", Status: StatusPending},
+	}
+	files, err := RenderHTMLReport("Run", tasks, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pages := make(map[string]string)
+	for _, f := range files {
+		pages[f.Path] = string(f.Content)
+	}
+	for _, path := range []string{"index.html", "style.css", "classes/A.html", "classes/B.html", "classes/libother.B.html"} {
+		if _, ok := pages[path]; !ok {
+			t.Errorf("missing %s", path)
+		}
+	}
+
+	index := pages["index.html"]
+	for _, want := range []string{
+		`<a href="classes/A.html#c-Debug-dump">`,
+		"Max retries exceeded: &lt;timeout&gt;",
+		`<a href="classes/B.html#i-run">`,
+		`<span class="badge pending">2 pending</span>`,
+	} {
+		if !strings.Contains(index, want) {
+			t.Errorf("index.html lacks %q", want)
+		}
+	}
+
+	class := pages["classes/A.html"]
+	for _, want := range []string{
+		`id="i-compare:"`,
+		`<span class="a">0x1000:</span>  <span class="k">cmp</span> x0, x1`,
+		`<span class="c">// a &lt; b</span>`,
+		`<span class="k">return</span> [<span class="k">self</span> size] &lt; <span class="s">@&#34;&lt;b&gt;&#34;</span>.length;`,
+		`<span class="badge fair">50% fidelity</span>`,
+		"Fidelity: missing @selector(size)",
+	} {
+		if !strings.Contains(class, want) {
+			t.Errorf("classes/A.html lacks %q", want)
+		}
+	}
+	if strings.Contains(pages["classes/B.html"], "stop") {
+		t.Error("classes/B.html lists the other image's B")
+	}
+	if strings.Contains(class, "<b>") {
+		t.Error("source was not escaped")
+	}
+}
@@ -0,0 +1,143 @@
+package decompile
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ModelChain is an ordered list of models, from cheapest to strongest. A task
+// starts at the tier chosen by RouteTasks and moves up one tier each time its
+// current model fails or produces a result below the quality threshold.
+type ModelChain []string
+
+// ParseModelChain parses a chain such as "ollama/codellama -> gpt-4o-mini -> claude".
+// A single model name yields a chain of length one.
+func ParseModelChain(s string) (ModelChain, error) {
+	var chain ModelChain
+	for _, part := range strings.Split(s, "->") {
+		name := strings.TrimSpace(part)
+		if name == "" {
+			return nil, fmt.Errorf("invalid model chain %q: empty model name", s)
+		}
+		chain = append(chain, name)
+	}
+	return chain, nil
+}
+
+// Model returns the model for a tier, clamping out-of-range tiers to the
+// nearest end of the chain.
+func (c ModelChain) Model(tier int) string {
+	if tier < 0 {
+		tier = 0
+	}
+	if tier >= len(c) {
+		tier = len(c) - 1
+	}
+	return c[tier]
+}
+
+// CanEscalate reports whether there is a stronger model above tier.
+func (c ModelChain) CanEscalate(tier int) bool {
+	return tier+1 < len(c)
+}
+
+// ParseRouteThresholds parses a comma-separated, ascending list of complexity
+// thresholds such as "40,200".
+func ParseRouteThresholds(s string) ([]int, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var thresholds []int
+	for _, part := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("invalid route threshold %q: %w", part, err)
+		}
+		thresholds = append(thresholds, n)
+	}
+	if !sort.IntsAreSorted(thresholds) {
+		return nil, fmt.Errorf("route thresholds must be ascending: %s", s)
+	}
+	return thresholds, nil
+}
+
+// RouteTasks assigns each task its starting tier. A task whose complexity
+// reaches thresholds[i] starts at tier i+1, so with thresholds 40,200 small
+// methods go to the first model, medium ones to the second and large ones to
+// the third. Tiers are capped at the end of the chain.
+func RouteTasks(tasks []*Task, chain ModelChain, thresholds []int) {
+	for _, task := range tasks {
+		score := AssemblyComplexity(task.AssemblyCode)
+		tier := sort.Search(len(thresholds), func(i int) bool { return thresholds[i] > score })
+		task.ModelTier = min(tier, len(chain)-1)
+	}
+}
+
+// AssemblyComplexity is a cheap size and complexity heuristic for a method's
+// disassembly. Every instruction counts once, with extra weight for calls and
+// conditional branches since they are where weak models tend to go wrong.
+func AssemblyComplexity(asm string) int {
+	score := 0
+	for _, line := range strings.Split(asm, "\n") {
+		mnemonic, _ := splitInstruction(line)
+		if mnemonic == "" {
+			continue
+		}
+		score++
+		switch {
+		case mnemonic == "bl" || mnemonic == "blr" || mnemonic == "blraa" || mnemonic == "blraaz":
+			score += 3
+		case strings.HasPrefix(mnemonic, "b.") || mnemonic == "cbz" || mnemonic == "cbnz" ||
+			mnemonic == "tbz" || mnemonic == "tbnz":
+			score += 2
+		}
+	}
+	return score
+}
+
+// splitInstruction extracts the mnemonic and operand text from a line of
+// disassembly, skipping an optional leading address and trailing comment.
+// Labels, directives and blank lines yield an empty mnemonic.
+func splitInstruction(line string) (mnemonic, operands string) {
+	if i := strings.Index(line, ";"); i >= 0 {
+		line = line[:i]
+	}
+	if i := strings.Index(line, "//"); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) > 0 && (strings.HasPrefix(fields[0], "0x") || strings.HasSuffix(fields[0], ":")) {
+		if strings.HasSuffix(fields[0], ":") && !strings.HasPrefix(fields[0], "0x") {
+			return "", "" // label
+		}
+		fields = fields[1:]
+	}
+	if len(fields) == 0 || strings.HasPrefix(fields[0], ".") {
+		return "", ""
+	}
+	mnemonic = strings.ToLower(fields[0])
+	operands = strings.TrimSpace(strings.Join(fields[1:], " "))
+	return mnemonic, operands
+}
+
+// qualityScore rates a decompiled method between 0 and 1. It only catches
+// obviously unusable output: empty bodies, refusals and placeholder code.
+func qualityScore(source string) float64 {
+	trimmed := strings.TrimSpace(source)
+	if trimmed == "" {
+		return 0
+	}
+	score := 1.0
+	if !strings.Contains(trimmed, "{") || !strings.Contains(trimmed, "}") {
+		score -= 0.5
+	}
+	lower := strings.ToLower(trimmed)
+	for _, marker := range []string{"todo", "unable to decompile", "cannot decompile", "// ...", "/* ... */"} {
+		if strings.Contains(lower, marker) {
+			score -= 0.3
+		}
+	}
+	return max(score, 0)
+}
@@ -0,0 +1,258 @@
+package decompile
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SourceMapVersion is the version of the .m.map format written by
+// RenderSources.
+const SourceMapVersion = 1
+
+// SourceMapExt is appended to the name of a generated .m file to name its
+// source map.
+const SourceMapExt = ".map"
+
+// Address is an address in a binary image. It is written to JSON as a hex
+// string, since addresses don't fit in the integers JSON readers support.
+type Address uint64
+
+func (a Address) String() string {
+	return fmt.Sprintf("%#x", uint64(a))
+}
+
+// MarshalJSON implements json.Marshaler.
+func (a Address) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (a *Address) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := strconv.ParseUint(s, 0, 64)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %w", s, err)
+	}
+	*a = Address(v)
+	return nil
+}
+
+// SourceMap maps the lines of a generated .m file back to the binary. It is
+// written next to the file as <File>.m.map.
+type SourceMap struct {
+	Version   int           `json:"version"`
+	File      string        `json:"file"`
+	Functions []FunctionMap `json:"functions"`
+}
+
+// FunctionMap locates one decompiled method or function in the .m file and
+// in its image.
+type FunctionMap struct {
+	Symbol    string `json:"symbol"`
+	Image     string `json:"image,omitempty"`
+	StartLine int    `json:"start_line"`
+	EndLine   int    `json:"end_line"`
+	// Address is the start of the function, 0 if unknown. EndAddress is the
+	// address after its last instruction, 0 if the listing has none.
+	Address    Address   `json:"address"`
+	EndAddress Address   `json:"end_address,omitempty"`
+	Lines      []LineMap `json:"lines,omitempty"`
+}
+
+// LineMap lists the instructions a source line was matched to.
+type LineMap struct {
+	Line      int       `json:"line"`
+	Addresses []Address `json:"addresses"`
+}
+
+// LoadSourceMap reads a .m.map file.
+func LoadSourceMap(path string) (*SourceMap, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read source map: %w", err)
+	}
+	var m SourceMap
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse source map %s: %w", path, err)
+	}
+	if m.Version != SourceMapVersion {
+		return nil, fmt.Errorf("source map %s has version %d, want %d", path, m.Version, SourceMapVersion)
+	}
+	return &m, nil
+}
+
+// Line returns the function a line of the .m file belongs to and the
+// instructions matched to the line, if any.
+func (m *SourceMap) Line(line int) (*FunctionMap, []Address, bool) {
+	for i := range m.Functions {
+		fn := &m.Functions[i]
+		if line < fn.StartLine || line > fn.EndLine {
+			continue
+		}
+		for _, l := range fn.Lines {
+			if l.Line == line {
+				return fn, l.Addresses, true
+			}
+		}
+		return fn, nil, true
+	}
+	return nil, nil, false
+}
+
+// Address returns the function containing an address and the line of the
+// .m file closest to it: the line of the instruction itself if it was
+// matched, else that of the nearest matched instruction before it, else the
+// first line of the function.
+func (m *SourceMap) Address(addr Address) (*FunctionMap, int, bool) {
+	for i := range m.Functions {
+		fn := &m.Functions[i]
+		if fn.Address == 0 || addr < fn.Address || (fn.EndAddress != 0 && addr >= fn.EndAddress) || (fn.EndAddress == 0 && addr != fn.Address) {
+			continue
+		}
+		line, best := fn.StartLine, Address(0)
+		for _, l := range fn.Lines {
+			for _, a := range l.Addresses {
+				if a <= addr && a >= best {
+					line, best = l.Line, a
+				}
+			}
+		}
+		return fn, line, true
+	}
+	return nil, 0, false
+}
+
+// mapFunction matches the calls and string literals of a decompiled
+// definition to those the static pass found in its assembly. The nth use of
+// a selector, function or string in the source is matched to its nth
+// occurrence in the listing, and further uses to the last one. startLine is
+// the line of the .m file the source starts on.
+func mapFunction(task *Task, source string, startLine int, analysis *AsmAnalysis) FunctionMap {
+	fn := FunctionMap{
+		Symbol:    task.SymbolName,
+		Image:     task.Image,
+		StartLine: startLine,
+		EndLine:   startLine + strings.Count(source, "\n"),
+		Address:   Address(task.Address),
+	}
+	if analysis == nil {
+		return fn
+	}
+
+	var last uint64
+	for i := range analysis.Lines {
+		if addr, ok := analysis.Addresses[i]; ok {
+			if fn.Address == 0 {
+				fn.Address = Address(addr)
+			}
+			last = max(last, addr)
+		}
+	}
+	if last != 0 {
+		fn.EndAddress = Address(last + 4) // ARM64 instructions are 4 bytes
+	}
+
+	// Addresses of each reference in the listing, in order.
+	asm := make(map[string][]Address)
+	add := func(ref string, line int) {
+		if addr, ok := analysis.Addresses[line]; ok {
+			asm[ref] = append(asm[ref], Address(addr))
+		}
+	}
+	for _, call := range analysis.Calls {
+		switch {
+		case call.IsMessageSend() && call.Selector != "":
+			add(selectorRef(call.Selector), call.Line)
+		case call.Function != "":
+			add(functionRef(call.Function), call.Line)
+			for _, sel := range runtimeCalls[call.Function] {
+				add(selectorRef(sel), call.Line)
+			}
+		}
+	}
+	for _, s := range analysis.Strings {
+		add(strconv.Quote(s.Value), s.Line)
+	}
+
+	lines := make(map[int][]Address)
+	used := make(map[string]int)
+	match := func(ref string, line int) {
+		addrs := asm[ref]
+		if len(addrs) == 0 {
+			return
+		}
+		n := min(used[ref], len(addrs)-1)
+		used[ref]++
+		lines[startLine+line] = append(lines[startLine+line], addrs[n])
+	}
+	for _, ref := range sourceReferenceLines(source) {
+		match(ref.ref, ref.line)
+	}
+	// Dot syntax sends the getter or setter of a property.
+	sent := maps.Clone(used)
+	for i, text := range strings.Split(stripCommentsAndStrings(source), "\n") {
+		for _, ref := range sortedKeys(asm) {
+			if sent[ref] == 0 && strings.HasPrefix(ref, "@selector(") &&
+				propertyAccess(text, strings.TrimSuffix(strings.TrimPrefix(ref, "@selector("), ")")) {
+				match(ref, i)
+			}
+		}
+	}
+
+	for _, line := range slices.Sorted(maps.Keys(lines)) {
+		addrs := lines[line]
+		slices.Sort(addrs)
+		fn.Lines = append(fn.Lines, LineMap{Line: line, Addresses: slices.Compact(addrs)})
+	}
+	return fn
+}
+
+// sourceReference is a selector, function or string literal used in source,
+// keyed like CheckFidelity keys them, and the line it is on, counted from 0.
+type sourceReference struct {
+	ref  string
+	line int
+}
+
+// sourceReferenceLines finds each use of the references sourceReferences
+// collects, in order of their lines.
+func sourceReferenceLines(source string) []sourceReference {
+	var refs []sourceReference
+	clean := stripCommentsAndStrings(source)
+	for i := 0; i < len(clean); i++ {
+		if clean[i] != '[' || (i > 0 && clean[i-1] == '@') {
+			continue
+		}
+		if sel := selectorAt(clean, i); sel != "" {
+			refs = append(refs, sourceReference{selectorRef(sel), strings.Count(clean[:i], "\n")})
+		}
+	}
+	for _, m := range functionCallPattern.FindAllStringSubmatchIndex(clean, -1) {
+		name := clean[m[2]:m[3]]
+		if notFunctions[name] || (m[2] > 0 && (clean[m[2]-1] == '@' || clean[m[2]-1] == '.')) {
+			continue
+		}
+		refs = append(refs, sourceReference{functionRef(name), strings.Count(clean[:m[2]], "\n")})
+	}
+	// stripComments keeps every newline, so lines still line up.
+	uncommented := stripComments(source)
+	for _, m := range stringLiteralPattern.FindAllStringSubmatchIndex(uncommented, -1) {
+		raw := uncommented[m[2]:m[3]]
+		value, err := strconv.Unquote(`"` + raw + `"`)
+		if err != nil {
+			value = raw
+		}
+		refs = append(refs, sourceReference{strconv.Quote(value), strings.Count(uncommented[:m[0]], "\n")})
+	}
+	sort.SliceStable(refs, func(i, j int) bool { return refs[i].line < refs[j].line })
+	return refs
+}
@@ -0,0 +1,87 @@
+package decompile
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSourceMap(t *testing.T) {
+	syms := NewImageSymbols()
+	syms.Selrefs[0x2008] = "startRunning"
+	syms.Selrefs[0x2010] = "session"
+	syms.CFStrings[0x3000] = "capture.started"
+
+	task := &Task{
+		ClassName:  "A",
+		SymbolName: "-[A startCapture]",
+		Image:      "/A",
+		Address:    0x1000,
+		AssemblyCode: `0x1000:  adrp x8, 0x2000
+0x1004:  ldr x1, [x8, #0x10]
+0x1008:  bl _objc_msgSend
+0x100c:  adrp x8, 0x2000
+0x1010:  ldr x1, [x8, #0x8]
+0x1014:  bl _objc_msgSend
+0x1018:  adrp x2, 0x3000
+0x101c:  add x2, x2, #0x0
+0x1020:  bl _NSLog
+0x1024:  ret`,
+		DecompiledSource: sql.NullString{Valid: true, String: `- (void)startCapture {
+    // Start the session.
+    [self.session startRunning];
+    NSLog(@"capture.started");
+}`},
+	}
+	files := RenderSources([]*Task{task}, nil, map[string]*ImageSymbols{"/A": syms}, LayoutFlat)
+	if len(files) != 2 || files[1].Path != "A.m.map" {
+		t.Fatalf("got %d files, want A.m and A.m.map", len(files))
+	}
+
+	dir := t.TempDir()
+	if _, err := WriteOutput(dir, files); err != nil {
+		t.Fatal(err)
+	}
+	m, err := LoadSourceMap(filepath.Join(dir, "A.m.map"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := FunctionMap{
+		Symbol:     "-[A startCapture]",
+		Image:      "/A",
+		StartLine:  5,
+		EndLine:    9,
+		Address:    0x1000,
+		EndAddress: 0x1028,
+		Lines: []LineMap{
+			{Line: 7, Addresses: []Address{0x1008, 0x1014}},
+			{Line: 8, Addresses: []Address{0x101c, 0x1020}},
+		},
+	}
+	if m.File != "A.m" || len(m.Functions) != 1 || !reflect.DeepEqual(m.Functions[0], want) {
+		t.Fatalf("got map %+v, want %+v", m, want)
+	}
+
+	source, _ := os.ReadFile(filepath.Join(dir, "A.m"))
+	if line := strings.Split(string(source), "\n")[6]; line != "    [self.session startRunning];" {
+		t.Errorf("line 7 of A.m is %q", line)
+	}
+
+	if fn, addrs, ok := m.Line(8); !ok || fn.Symbol != want.Symbol || !reflect.DeepEqual(addrs, []Address{0x101c, 0x1020}) {
+		t.Errorf("Line(8) = %v, %v, %v", fn, addrs, ok)
+	}
+	if _, _, ok := m.Line(2); ok {
+		t.Error("Line(2) is outside any method but was found")
+	}
+	for addr, wantLine := range map[Address]int{0x1000: 5, 0x1010: 7, 0x1020: 8, 0x1024: 8} {
+		if _, line, ok := m.Address(addr); !ok || line != wantLine {
+			t.Errorf("Address(%v) = line %d, %v, want %d", addr, line, ok, wantLine)
+		}
+	}
+	if _, _, ok := m.Address(0x1028); ok {
+		t.Error("Address(0x1028) is past the method but was found")
+	}
+}
@@ -0,0 +1,311 @@
+package decompile
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultStreamIdleTimeout is used when WorkerConfig.StreamIdleTimeout is zero.
+const DefaultStreamIdleTimeout = 60 * time.Second
+
+// errStreamStalled is the cancellation cause of a stream that went quiet.
+var errStreamStalled = errors.New("stream stalled")
+
+// streamChunk is one server-sent event of a streamed chat completion.
+type streamChunk struct {
+	Choices []struct {
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+	} `json:"choices"`
+	Usage *Usage `json:"usage"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// callChatStream is callChat with "stream": true. Each piece of content is
+// passed to onDelta, which may be nil, as it arrives and the whole content is
+// returned at the end with the usage from the final chunk. There is no overall deadline; instead the request is
+// aborted with a *TransportError once idle passes without any data. Providers
+// that ignore the stream flag and answer with a plain completion are handled
+// as if the content had arrived in one piece.
+func callChatStream(ctx context.Context, transport http.RoundTripper, apiURL, model string, messages []ChatMessage, limiter *RateLimiter, idle time.Duration, onDelta func(string)) (string, Usage, error) {
+	if idle <= 0 {
+		idle = DefaultStreamIdleTimeout
+	}
+	if onDelta == nil {
+		onDelta = func(string) {}
+	}
+
+	jsonData, err := json.Marshal(AIRequest{
+		Model:         model,
+		Messages:      messages,
+		Stream:        true,
+		StreamOptions: &StreamOptions{IncludeUsage: true},
+	})
+	if err != nil {
+		return "", Usage{}, fmt.Errorf("failed to marshal request payload: %w", err)
+	}
+
+	streamCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	stall := time.AfterFunc(idle, func() { cancel(errStreamStalled) })
+	defer stall.Stop()
+
+	// failed classifies an error that interrupted the request or the stream.
+	failed := func(err error) error {
+		switch {
+		case ctx.Err() != nil:
+			return fmt.Errorf("request to LiteLLM cancelled: %w", ctx.Err())
+		case errors.Is(context.Cause(streamCtx), errStreamStalled):
+			return &TransportError{Err: fmt.Errorf("%w: no data from LiteLLM for %s", errStreamStalled, idle)}
+		}
+		return &TransportError{Err: fmt.Errorf("failed to read from LiteLLM: %w", err)}
+	}
+
+	req, err := http.NewRequestWithContext(streamCtx, "POST", apiURL, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return "", Usage{}, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "text/event-stream")
+
+	client := &http.Client{Transport: transport}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", Usage{}, failed(err)
+	}
+	defer resp.Body.Close()
+
+	limiter.Observe(resp.Header)
+	if err := responseError(resp); err != nil {
+		return "", Usage{}, err
+	}
+
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/event-stream" {
+		var aiResponse AIResponse
+		if err := json.NewDecoder(resp.Body).Decode(&aiResponse); err != nil {
+			if streamCtx.Err() != nil {
+				return "", Usage{}, failed(err)
+			}
+			return "", Usage{}, fmt.Errorf("failed to decode AI response: %w", err)
+		}
+		if len(aiResponse.Choices) == 0 {
+			return "", Usage{}, fmt.Errorf("no choices returned from AI")
+		}
+		content := aiResponse.Choices[0].Message.Content
+		onDelta(content)
+		return content, responseUsage(aiResponse.Usage, messages, content), nil
+	}
+
+	var content strings.Builder
+	var usage *Usage
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		stall.Reset(idle)
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue // comments, event names and keep-alives
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			return content.String(), responseUsage(usage, messages, content.String()), nil
+		}
+		var chunk streamChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return "", Usage{}, fmt.Errorf("failed to decode stream chunk: %w", err)
+		}
+		if chunk.Usage != nil {
+			usage = chunk.Usage
+		}
+		if chunk.Error != nil {
+			return "", Usage{}, fmt.Errorf("LiteLLM stream failed: %s", chunk.Error.Message)
+		}
+		if len(chunk.Choices) > 0 && chunk.Choices[0].Delta.Content != "" {
+			content.WriteString(chunk.Choices[0].Delta.Content)
+			onDelta(chunk.Choices[0].Delta.Content)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", Usage{}, failed(err)
+	}
+	if streamCtx.Err() != nil {
+		return "", Usage{}, failed(streamCtx.Err())
+	}
+	// Some providers close the stream without the [DONE] marker.
+	return content.String(), responseUsage(usage, messages, content.String()), nil
+}
+
+// resultScanner picks the elements of a JSON array of results out of a
+// stream of text and decodes each one as soon as its closing brace arrives.
+// Anything before the opening bracket, such as a Markdown fence, is skipped.
+type resultScanner struct {
+	emit func(DecompiledResult)
+
+	started  bool
+	done     bool
+	depth    int
+	inString bool
+	escaped  bool
+	object   []byte
+	// bad counts elements that were not valid results.
+	bad int
+}
+
+func newResultScanner(emit func(DecompiledResult)) *resultScanner {
+	return &resultScanner{emit: emit}
+}
+
+// Write feeds the next piece of the reply to the scanner.
+func (s *resultScanner) Write(text string) {
+	for i := 0; i < len(text) && !s.done; i++ {
+		c := text[i]
+		if !s.started {
+			s.started = c == '['
+			continue
+		}
+		if s.depth > 0 {
+			s.object = append(s.object, c)
+		}
+		if s.inString {
+			switch {
+			case s.escaped:
+				s.escaped = false
+			case c == '\\':
+				s.escaped = true
+			case c == '"':
+				s.inString = false
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			s.inString = true
+		case '{', '[':
+			if s.depth == 0 {
+				s.object = append(s.object[:0], c)
+			}
+			s.depth++
+		case '}', ']':
+			if s.depth == 0 {
+				// The end of the array; ignore whatever follows.
+				s.done = true
+				continue
+			}
+			s.depth--
+			if s.depth == 0 {
+				var result DecompiledResult
+				if err := json.Unmarshal(s.object, &result); err != nil || result.SymbolName == "" {
+					s.bad++
+				} else {
+					s.emit(result)
+				}
+				s.object = s.object[:0]
+			}
+		}
+	}
+}
+
+// processStream is processBatch for streamed replies. Results are stored as
+// they arrive, so an interrupted or cancelled stream loses only the methods
+// that were still being written. Those go back to the queue if the run is
+// shutting down and are failed like any other batch otherwise.
+func (w *worker) processStream(ctx context.Context, tasks []*Task, model, promptVersion string, messages []ChatMessage) {
+	taskMap := make(map[string]*Task, len(tasks))
+	for _, task := range tasks {
+		taskMap[task.SymbolName] = task
+	}
+	// Results are stored even if the run is cancelled mid-stream.
+	persist := context.WithoutCancel(ctx)
+	handled := make(map[string]bool, len(tasks))
+	var repairTasks []*Task
+	var repairResults []DecompiledResult
+
+	accept := func(result DecompiledResult) {
+		task, ok := taskMap[result.SymbolName]
+		if !ok || handled[result.SymbolName] {
+			log.Printf("Worker %d: received result for unknown symbol: %s", w.id, result.SymbolName)
+			return
+		}
+		handled[result.SymbolName] = true
+		if v := w.cfg.Validator; v != nil && result.Success && !w.check(persist, v, &result, ValidationValid) {
+			// Repairs need the whole reply, so they wait for the end of the stream.
+			repairTasks = append(repairTasks, task)
+			repairResults = append(repairResults, result)
+			return
+		}
+		w.handleResult(persist, task, model, promptVersion, result)
+	}
+
+	scanner := newResultScanner(accept)
+	content, err := w.sendStream(ctx, tasks, model, messages, scanner.Write)
+	if scanner.bad > 0 {
+		log.Printf("Worker %d: skipped %d malformed results in the stream", w.id, scanner.bad)
+	}
+	if errors.Is(err, errRequeue) {
+		w.requeue(tasks)
+		return
+	}
+	if err == nil && len(handled) < len(tasks) {
+		// The scanner is lenient; let the strict decoder explain a reply
+		// that didn't cover the batch.
+		var results []DecompiledResult
+		if results, err = decodeResults(content); err == nil {
+			for _, result := range results {
+				if !handled[result.SymbolName] {
+					accept(result)
+				}
+			}
+		}
+	}
+
+	if err != nil {
+		// A broken reply can't anchor a repair round.
+		for _, task := range repairTasks {
+			handled[task.SymbolName] = false
+		}
+		repairTasks = nil
+	}
+	var rest []*Task
+	for _, task := range tasks {
+		if !handled[task.SymbolName] {
+			rest = append(rest, task)
+		}
+	}
+	if err != nil && len(rest) > 0 {
+		if ctx.Err() != nil {
+			log.Printf("Worker %d: stream cancelled after %d of %d methods; releasing the rest", w.id, len(tasks)-len(rest), len(tasks))
+			_ = w.store.ReleaseTasks(persist, taskIDs(rest))
+		} else {
+			log.Printf("Worker %d: AI call failed: %v. Marking %d unfinished tasks as failed.", w.id, err, len(rest))
+			w.failBatch(ctx, rest, model, err)
+		}
+	}
+
+	if len(repairTasks) == 0 {
+		return
+	}
+	if ctx.Err() != nil {
+		_ = w.store.ReleaseTasks(persist, taskIDs(repairTasks))
+		return
+	}
+	results, err := w.verify(ctx, repairTasks, model, messages, content, repairResults)
+	if errors.Is(err, errRequeue) {
+		w.requeue(repairTasks)
+		return
+	}
+	for i, task := range repairTasks {
+		w.handleResult(ctx, task, model, promptVersion, results[i])
+	}
+}
@@ -0,0 +1,95 @@
+package decompile
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResultScanner(t *testing.T) {
+	reply := "```json\n" + `[{"symbol_name": "-[A foo]", "decompiled_source": "- (void)foo { NSLog(@\"}\\\"]\"); }", "success": true},` +
+		`{"bogus": [1, {"x": 2}]}, {"symbol_name": "-[A bar]", "success": false, "error_message": "no"}]` + "\n```"
+
+	// Feed the reply a few bytes at a time so objects and strings straddle pieces.
+	var got []string
+	s := newResultScanner(func(r DecompiledResult) { got = append(got, r.SymbolName) })
+	for i := 0; i < len(reply); i += 3 {
+		s.Write(reply[i:min(i+3, len(reply))])
+	}
+
+	if want := []string{"-[A foo]", "-[A bar]"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got results %q, want %q", got, want)
+	}
+	if s.bad != 1 {
+		t.Errorf("got %d malformed elements, want 1", s.bad)
+	}
+}
+
+func TestDecompileWorker_StreamStoresEachMethod(t *testing.T) {
+	store := setupTestDB(t)
+	defer store.Close()
+
+	ctx := context.Background()
+	err := store.AddTasks(ctx, []*Task{
+		{ClassName: "A", SymbolName: "-[A foo]", AssemblyCode: "ret"},
+		{ClassName: "A", SymbolName: "-[A bar]", AssemblyCode: "ret"},
+	})
+	if err != nil {
+		t.Fatalf("failed to add tasks: %v", err)
+	}
+
+	first := resultsJSON(t, DecompiledResult{SymbolName: "-[A foo]", DecompiledSource: "- (void)foo {\n}", Success: true})
+	first = strings.TrimSuffix(first, "]") + ","
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req AIRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !req.Stream {
+			http.Error(w, "expected a streamed request", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < len(first); i += 8 {
+			chunk, _ := json.Marshal(first[i:min(i+8, len(first))])
+			fmt.Fprintf(w, "data: {\"choices\":[{\"delta\":{\"content\":%s}}]}\n\n", chunk)
+		}
+		w.(http.Flusher).Flush()
+		// Stall in the middle of the second method.
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	start := time.Now()
+	DecompileWorker(ctx, 0, store, WorkerConfig{
+		LiteLLMURL:        server.URL,
+		Models:            ModelChain{"test-model"},
+		BatchSize:         10,
+		MaxRetries:        1,
+		Stream:            true,
+		StreamIdleTimeout: 100 * time.Millisecond,
+	})
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("stalled stream took %s to abort", elapsed)
+	}
+
+	tasks, err := store.GetAllCompletedTasks()
+	if err != nil {
+		t.Fatalf("get completed tasks failed: %v", err)
+	}
+	if len(tasks) != 1 || tasks[0].SymbolName != "-[A foo]" {
+		t.Fatalf("expected only the method that finished streaming to complete, got %d tasks", len(tasks))
+	}
+
+	var status, message string
+	row := store.db.QueryRow(`SELECT status, error_message FROM decompilation_tasks WHERE symbol_name = ?`, "-[A bar]")
+	if err := row.Scan(&status, &message); err != nil {
+		t.Fatal(err)
+	}
+	if status != string(StatusFailed) || !strings.Contains(message, "stream stalled") {
+		t.Errorf("got status %q with %q, want the unfinished method failed by the stall", status, message)
+	}
+}
@@ -0,0 +1,229 @@
+package decompile
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+)
+
+// UnitResult is the answer to a whole-class prompt.
+type UnitResult struct {
+	// Implementation holds one or more @implementation blocks with every
+	// method of the unit.
+	Implementation string `json:"implementation"`
+	// Summaries maps symbol names to one-line method summaries.
+	Summaries    map[string]string `json:"summaries"`
+	Success      bool              `json:"success"`
+	ErrorMessage string            `json:"error_message"`
+}
+
+// AssignUnits groups tasks for whole-class decompilation. A class, or class
+// category, with at most maxMethods methods becomes a single unit. Larger
+// ones are split into clusters of methods connected by calls, packed into
+// units of at most maxMethods. Methods that end up alone are left to the
+// regular per-method path. The tasks of a unit are moved to the highest model
+// tier any of them was routed to, since a unit is sent to a single model.
+// Same-named classes of different images are separate units, named after
+// their image, e.g. "/usr/lib/libfoo.dylib:Foo(Debug)#2".
+func AssignUnits(tasks []*Task, edges []CallEdge, maxMethods int) {
+	if maxMethods < 2 {
+		return
+	}
+	groups := make(map[string][]*Task)
+	for _, task := range tasks {
+		sym, ok := ParseSymbol(task.SymbolName)
+		if !ok {
+			continue
+		}
+		key := sym.Class
+		if sym.Category != "" {
+			key += "(" + sym.Category + ")"
+		}
+		if task.Image != "" {
+			key = task.Image + ":" + key
+		}
+		groups[key] = append(groups[key], task)
+	}
+
+	neighbours := make(map[symbolKey][]symbolKey)
+	for _, edge := range edges {
+		caller, callee := symbolKey{edge.CallerImage, edge.Caller}, symbolKey{edge.CalleeImage, edge.Callee}
+		neighbours[caller] = append(neighbours[caller], callee)
+		neighbours[callee] = append(neighbours[callee], caller)
+	}
+
+	for _, key := range sortedKeys(groups) {
+		group := groups[key]
+		if len(group) <= maxMethods {
+			setUnit(group, key)
+			continue
+		}
+		for i, members := range packClusters(callClusters(group, neighbours), maxMethods) {
+			setUnit(members, fmt.Sprintf("%s#%d", key, i+1))
+		}
+	}
+}
+
+// symbolKey identifies a task by image and symbol name.
+type symbolKey struct {
+	image  string
+	symbol string
+}
+
+// callClusters splits a class's tasks into the connected components of the
+// call graph restricted to that class, largest first.
+func callClusters(group []*Task, neighbours map[symbolKey][]symbolKey) [][]*Task {
+	bySymbol := make(map[symbolKey]*Task, len(group))
+	for _, task := range group {
+		bySymbol[symbolKey{task.Image, task.SymbolName}] = task
+	}
+	seen := make(map[symbolKey]bool)
+	var clusters [][]*Task
+	for _, task := range group {
+		key := symbolKey{task.Image, task.SymbolName}
+		if seen[key] {
+			continue
+		}
+		var cluster []*Task
+		queue := []symbolKey{key}
+		seen[key] = true
+		for len(queue) > 0 {
+			cur := queue[0]
+			queue = queue[1:]
+			cluster = append(cluster, bySymbol[cur])
+			for _, next := range neighbours[cur] {
+				if bySymbol[next] != nil && !seen[next] {
+					seen[next] = true
+					queue = append(queue, next)
+				}
+			}
+		}
+		clusters = append(clusters, cluster)
+	}
+	sort.SliceStable(clusters, func(i, j int) bool { return len(clusters[i]) > len(clusters[j]) })
+	return clusters
+}
+
+// packClusters fills units of at most maxMethods tasks with whole clusters
+// where they fit, first-fit in decreasing size. Clusters larger than a unit
+// are cut into unit-sized pieces.
+func packClusters(clusters [][]*Task, maxMethods int) [][]*Task {
+	var units [][]*Task
+	for _, cluster := range clusters {
+		for len(cluster) > maxMethods {
+			units = append(units, append([]*Task(nil), cluster[:maxMethods]...))
+			cluster = cluster[maxMethods:]
+		}
+		placed := false
+		for i := range units {
+			if len(units[i])+len(cluster) <= maxMethods {
+				units[i] = append(units[i], cluster...)
+				placed = true
+				break
+			}
+		}
+		if !placed {
+			units = append(units, append([]*Task(nil), cluster...))
+		}
+	}
+	return units
+}
+
+// setUnit puts the tasks in one unit on a common model tier. A lone task is
+// left without a unit.
+func setUnit(tasks []*Task, unit string) {
+	if len(tasks) < 2 {
+		return
+	}
+	tier := 0
+	for _, task := range tasks {
+		if task.ModelTier > tier {
+			tier = task.ModelTier
+		}
+	}
+	for _, task := range tasks {
+		task.Unit = unit
+		task.ModelTier = tier
+	}
+}
+
+// processUnit decompiles a unit as one @implementation and stores each method
+// it contains as the result of its own task.
+func (w *worker) processUnit(ctx context.Context, tasks []*Task) {
+	model := w.cfg.Models.Model(tasks[0].ModelTier)
+	log.Printf("Worker %d: processing unit %s (%d methods) with %s", w.id, tasks[0].Unit, len(tasks), model)
+
+	messages, promptVersion, err := w.renderPrompt(ctx, model, tasks)
+	if err != nil {
+		log.Printf("Worker %d: failed to format prompt: %v", w.id, err)
+		for _, task := range tasks {
+			_ = w.store.UpdateTaskFailure(ctx, task.ID, "Failed to format prompt", task.Retries+1)
+		}
+		return
+	}
+
+	content, err := w.send(ctx, tasks, model, messages)
+	var results []DecompiledResult
+	if err == nil {
+		results, err = splitUnitResult(content, tasks)
+	}
+	if err == nil {
+		results, err = w.verify(ctx, tasks, model, messages, content, results)
+	}
+	if errors.Is(err, errRequeue) {
+		w.requeue(tasks)
+		return
+	}
+	if err != nil {
+		log.Printf("Worker %d: AI call failed: %v. Marking unit as failed.", w.id, err)
+		w.failBatch(ctx, tasks, model, err)
+		return
+	}
+	for i, task := range tasks {
+		w.handleResult(ctx, task, model, promptVersion, results[i])
+	}
+}
+
+// splitUnitResult parses the answer to a whole-class prompt and returns a
+// result for each task, in order. Methods are matched by selector and kind,
+// so the class or category name the model chose doesn't matter.
+func splitUnitResult(content string, tasks []*Task) ([]DecompiledResult, error) {
+	var unit UnitResult
+	if err := json.Unmarshal([]byte(content), &unit); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal nested JSON from AI content: %w", err)
+	}
+
+	methods := make(map[string]string)
+	for _, m := range SplitImplementation(unit.Implementation) {
+		methods[methodID(m.ClassMethod, m.Selector)] = m.Source
+	}
+
+	results := make([]DecompiledResult, len(tasks))
+	for i, task := range tasks {
+		result := DecompiledResult{SymbolName: task.SymbolName, Summary: unit.Summaries[task.SymbolName]}
+		sym, _ := ParseSymbol(task.SymbolName)
+		source, found := methods[methodID(sym.ClassMethod, sym.Selector)]
+		switch {
+		case !unit.Success:
+			result.ErrorMessage = unit.ErrorMessage
+		case !found:
+			result.ErrorMessage = "method missing from the returned @implementation"
+		default:
+			result.DecompiledSource = source
+			result.Success = true
+		}
+		results[i] = result
+	}
+	return results, nil
+}
+
+// methodID identifies a method within a class as "-sel" or "+sel".
+func methodID(classMethod bool, selector string) string {
+	if classMethod {
+		return "+" + selector
+	}
+	return "-" + selector
+}
@@ -0,0 +1,124 @@
+package decompile
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestAssignUnits_SameClassInTwoImages(t *testing.T) {
+	tasks := []*Task{
+		{SymbolName: "-[Foo a]", Image: "A"},
+		{SymbolName: "-[Foo b]", Image: "A"},
+		{SymbolName: "-[Foo a]", Image: "B"},
+		{SymbolName: "-[Foo b]", Image: "B"},
+	}
+	AssignUnits(tasks, nil, 4)
+	if tasks[0].Unit != "A:Foo" || tasks[1].Unit != "A:Foo" || tasks[2].Unit != "B:Foo" || tasks[3].Unit != "B:Foo" {
+		t.Errorf("units = %q, %q, %q, %q; want one unit per image", tasks[0].Unit, tasks[1].Unit, tasks[2].Unit, tasks[3].Unit)
+	}
+}
+
+func TestAssignUnits_SplitsLargeClasses(t *testing.T) {
+	tasks := []*Task{
+		{SymbolName: "-[Foo a]"},
+		{SymbolName: "-[Foo b]"},
+		{SymbolName: "-[Foo c]"},
+		{SymbolName: "-[Foo d]", ModelTier: 2},
+		{SymbolName: "-[Foo e]"},
+		{SymbolName: "-[Foo(Debug) dump]"},
+		{SymbolName: "_helper"},
+	}
+	edges := []CallEdge{
+		{Caller: "-[Foo a]", Callee: "-[Foo b]"},
+		{Caller: "-[Foo c]", Callee: "-[Foo b]"},
+		{Caller: "-[Foo d]", Callee: "-[Foo e]"},
+		// Calls into another image's Foo don't join clusters.
+		{Caller: "-[Foo e]", Callee: "-[Foo a]", CalleeImage: "other"},
+	}
+	AssignUnits(tasks, edges, 3)
+
+	want := []struct {
+		unit string
+		tier int
+	}{
+		{"Foo#1", 0}, {"Foo#1", 0}, {"Foo#1", 0},
+		// The cluster is lifted to the tier of its hardest method.
+		{"Foo#2", 2}, {"Foo#2", 2},
+		// Lone methods and functions stay on the per-method path.
+		{"", 0}, {"", 0},
+	}
+	for i, task := range tasks {
+		if task.Unit != want[i].unit || task.ModelTier != want[i].tier {
+			t.Errorf("%s: got unit %q on tier %d, want %q on tier %d", task.SymbolName, task.Unit, task.ModelTier, want[i].unit, want[i].tier)
+		}
+	}
+}
+
+func TestCallClusters(t *testing.T) {
+	a, b, c, d := &Task{SymbolName: "a"}, &Task{SymbolName: "b"}, &Task{SymbolName: "c"}, &Task{SymbolName: "d"}
+	neighbours := map[symbolKey][]symbolKey{
+		{"", "a"}: {{"", "d"}, {"", "x"}},
+		{"", "d"}: {{"", "a"}, {"", "c"}},
+		{"", "c"}: {{"", "d"}},
+	}
+	clusters := callClusters([]*Task{a, b, c, d}, neighbours)
+	if len(clusters) != 2 || len(clusters[0]) != 3 || clusters[1][0] != b {
+		t.Fatalf("got clusters %v, want {a, d, c} then {b}", clusters)
+	}
+}
+
+func TestPackClusters(t *testing.T) {
+	tasks := make([]*Task, 9)
+	for i := range tasks {
+		tasks[i] = &Task{ID: int64(i)}
+	}
+	clusters := [][]*Task{tasks[0:5], tasks[5:7], tasks[7:8], tasks[8:9]}
+	units := packClusters(clusters, 3)
+
+	// The cluster of 5 is cut into 3 and 2; the pair then gets a unit of its
+	// own, and the single tasks fill the first units with room.
+	want := [][]int64{{0, 1, 2}, {3, 4, 7}, {5, 6, 8}}
+	if len(units) != len(want) {
+		t.Fatalf("got %d units, want %d", len(units), len(want))
+	}
+	for i, unit := range units {
+		var ids []int64
+		for _, task := range unit {
+			ids = append(ids, task.ID)
+		}
+		if !reflect.DeepEqual(ids, want[i]) {
+			t.Errorf("unit %d = %v, want %v", i, ids, want[i])
+		}
+	}
+}
+
+func TestSplitUnitResult(t *testing.T) {
+	content, err := json.Marshal(UnitResult{
+		Implementation: "@implementation Foo\n- (void)a {\n}\n@end\n@implementation Foo (Renamed)\n+ (id)shared {\n    return nil;\n}\n@end",
+		Summaries:      map[string]string{"-[Foo a]": "Does a."},
+		Success:        true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tasks := []*Task{{SymbolName: "-[Foo a]"}, {SymbolName: "+[Foo(Debug) shared]"}, {SymbolName: "-[Foo shared]"}}
+	results, err := splitUnitResult(string(content), tasks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := results[0]; !r.Success || r.DecompiledSource != "- (void)a {\n}" || r.Summary != "Does a." {
+		t.Errorf("-[Foo a]: got %+v", r)
+	}
+	if r := results[1]; !r.Success || r.SymbolName != "+[Foo(Debug) shared]" {
+		t.Errorf("+[Foo(Debug) shared]: got %+v, want the class method whatever its category", r)
+	}
+	// Only the class method was returned.
+	if r := results[2]; r.Success || r.ErrorMessage == "" {
+		t.Errorf("-[Foo shared]: got %+v, want it reported missing", r)
+	}
+
+	if _, err := splitUnitResult("not json", tasks); err == nil {
+		t.Error("splitUnitResult of malformed content succeeded")
+	}
+}
@@ -0,0 +1,312 @@
+package decompile
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Validation modes accepted by NewValidator.
+const (
+	// ValidateBuiltin uses the structural checks of CheckDelimiters.
+	ValidateBuiltin = "builtin"
+	// ValidateClang runs clang -fsyntax-only against stub headers.
+	ValidateClang = "clang"
+	// ValidateAuto uses clang when it is on the PATH and the builtin checks
+	// otherwise.
+	ValidateAuto = "auto"
+)
+
+// Validation statuses stored with each result.
+const (
+	// ValidationValid means the first answer passed the syntax check.
+	ValidationValid = "valid"
+	// ValidationRepaired means the answer passed after one or more repair rounds.
+	ValidationRepaired = "repaired"
+	// ValidationInvalid means the answer still had errors when the repair
+	// rounds ran out and was accepted anyway.
+	ValidationInvalid = "invalid"
+)
+
+// Validator syntax-checks decompiled source. A nil *Validator disables
+// validation.
+type Validator struct {
+	// Rounds is the number of repair prompts sent for output that fails the
+	// check.
+	Rounds int
+	// AcceptInvalid keeps output that still fails after the last round,
+	// marked invalid, instead of failing the task.
+	AcceptInvalid bool
+
+	clang   string
+	stubDir string
+}
+
+// stubHeader declares just enough of the Objective-C runtime and Foundation
+// for decompiled methods to reach the parser. Semantic errors about unknown
+// names are filtered out of clang's diagnostics, so it doesn't need to be
+// complete.
+const stubHeader = `typedef signed char BOOL;
+#define YES ((BOOL)1)
+#define NO ((BOOL)0)
+#define nil ((id)0)
+#define NULL ((void *)0)
+typedef unsigned long NSUInteger;
+typedef long NSInteger;
+typedef double CGFloat;
+typedef struct CGPoint { CGFloat x, y; } CGPoint;
+typedef struct CGSize { CGFloat width, height; } CGSize;
+typedef struct CGRect { CGPoint origin; CGSize size; } CGRect;
+@interface NSObject
++ (instancetype)alloc;
++ (instancetype)new;
+- (instancetype)init;
+@end
+@class NSString, NSArray, NSDictionary, NSNumber, NSError;
+@interface OdinCheck : NSObject
+@end
+`
+
+// ignoredDiagnostics are clang errors caused by missing declarations rather
+// than broken syntax.
+var ignoredDiagnostics = []string{
+	"undeclared identifier",
+	"unknown type name",
+	"unknown receiver",
+	"no visible @interface",
+	"implicit declaration",
+	"incomplete",
+	"forward declaration",
+	"not found",
+	"undeclared selector",
+	"has no member",
+	"instance variable",
+	"cannot find interface declaration",
+	"duplicate declaration",
+	"conflicting",
+}
+
+var diagnosticPattern = regexp.MustCompile(`^[^:]+:(\d+):\d+: (?:fatal )?error: (.*)$`)
+
+// NewValidator creates a validator for the given mode. With ValidateClang
+// and ValidateAuto the stub headers are written to a temporary directory
+// that Close removes.
+func NewValidator(mode string, rounds int, acceptInvalid bool) (*Validator, error) {
+	v := &Validator{Rounds: rounds, AcceptInvalid: acceptInvalid}
+	switch mode {
+	case ValidateBuiltin:
+		return v, nil
+	case ValidateClang, ValidateAuto:
+		path, err := exec.LookPath("clang")
+		if err != nil {
+			if mode == ValidateAuto {
+				return v, nil
+			}
+			return nil, fmt.Errorf("clang validation requested but clang was not found: %w", err)
+		}
+		dir, err := os.MkdirTemp("", "odin-validate-*")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create stub header directory: %w", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "odin_stubs.h"), []byte(stubHeader), 0644); err != nil {
+			os.RemoveAll(dir)
+			return nil, fmt.Errorf("failed to write stub header: %w", err)
+		}
+		v.clang, v.stubDir = path, dir
+		return v, nil
+	}
+	return nil, fmt.Errorf("unknown validation mode %q", mode)
+}
+
+// Close removes the stub headers.
+func (v *Validator) Close() error {
+	if v == nil || v.stubDir == "" {
+		return nil
+	}
+	return os.RemoveAll(v.stubDir)
+}
+
+// Check returns the syntax errors found in a decompiled method or function.
+func (v *Validator) Check(ctx context.Context, source string) ([]SyntaxIssue, error) {
+	issues := CheckDelimiters(source)
+	if !strings.Contains(stripCommentsAndStrings(source), "{") {
+		issues = append(issues, SyntaxIssue{Line: 1, Message: "no method or function body"})
+	}
+	if len(issues) > 0 || v.clang == "" {
+		return issues, nil
+	}
+	return v.checkClang(ctx, source)
+}
+
+// checkClang compiles the source inside a stub @implementation and returns
+// clang's syntax errors, with line numbers relative to source.
+func (v *Validator) checkClang(ctx context.Context, source string) ([]SyntaxIssue, error) {
+	const prefix = "#import \"odin_stubs.h\"\n@implementation OdinCheck\n"
+	unit := prefix + source + "\n@end\n"
+	if strings.Contains(source, "@implementation") {
+		unit = "#import \"odin_stubs.h\"\n" + source + "\n"
+	}
+	offset := strings.Count(unit[:strings.Index(unit, source)], "\n")
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, v.clang, "-fsyntax-only", "-x", "objective-c", "-fobjc-arc",
+		"-Wno-everything", "-ferror-limit=20", "-I", v.stubDir, "-")
+	cmd.Stdin = strings.NewReader(unit)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("clang syntax check timed out: %w", ctx.Err())
+	}
+	if _, failed := err.(*exec.ExitError); err != nil && !failed {
+		return nil, fmt.Errorf("failed to run clang: %w", err)
+	}
+
+	var issues []SyntaxIssue
+	for _, line := range strings.Split(stderr.String(), "\n") {
+		m := diagnosticPattern.FindStringSubmatch(line)
+		if m == nil || ignoredDiagnostic(m[2]) {
+			continue
+		}
+		n, _ := strconv.Atoi(m[1])
+		issues = append(issues, SyntaxIssue{Line: n - offset, Message: m[2]})
+	}
+	return issues, nil
+}
+
+func ignoredDiagnostic(message string) bool {
+	for _, s := range ignoredDiagnostics {
+		if strings.Contains(message, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// issuesText renders issues one per line for prompts and the database.
+func issuesText(issues []SyntaxIssue) string {
+	lines := make([]string, len(issues))
+	for i, issue := range issues {
+		lines[i] = issue.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// verify syntax-checks the successful results of a batch and, while repair
+// rounds remain, sends the diagnostics back to the model together with the
+// conversation so far. Results that still fail are either accepted as invalid
+// or turned into failures, depending on the validator. Repairs stop once the
+// run's budget is spent. errRequeue is returned if a repair request was
+// refused.
+func (w *worker) verify(ctx context.Context, tasks []*Task, model string, messages []ChatMessage, reply string, results []DecompiledResult) ([]DecompiledResult, error) {
+	v := w.cfg.Validator
+	if v == nil {
+		return results, nil
+	}
+
+	var failing []int
+	for i := range results {
+		if results[i].Success && !w.check(ctx, v, &results[i], ValidationValid) {
+			failing = append(failing, i)
+		}
+	}
+
+	for round := 1; round <= v.Rounds && len(failing) > 0; round++ {
+		if w.cfg.Budget.Exhausted() {
+			log.Printf("Worker %d: budget exhausted, not repairing %d methods", w.id, len(failing))
+			break
+		}
+		set, err := w.cfg.Prompts.ForModel(model)
+		if err != nil {
+			log.Printf("Worker %d: failed to load repair prompt: %v", w.id, err)
+			break
+		}
+		repairs := make([]PromptRepair, len(failing))
+		for n, i := range failing {
+			repairs[n] = PromptRepair{
+				SymbolName:       results[i].SymbolName,
+				DecompiledSource: results[i].DecompiledSource,
+				Errors:           strings.Split(results[i].ValidationErrors, "\n"),
+			}
+		}
+		repair, err := set.RenderRepair(repairs)
+		if err != nil {
+			log.Printf("Worker %d: failed to format repair prompt: %v", w.id, err)
+			break
+		}
+		messages = append(messages, ChatMessage{Role: "assistant", Content: reply}, repair)
+
+		log.Printf("Worker %d: asking %s to repair %d methods (round %d/%d)", w.id, model, len(failing), round, v.Rounds)
+		reply, err = w.send(ctx, tasks, model, messages)
+		if errors.Is(err, errRequeue) {
+			return nil, err
+		}
+		var repaired []DecompiledResult
+		if err == nil {
+			repaired, err = decodeResults(reply)
+		}
+		if err != nil {
+			log.Printf("Worker %d: repair request failed: %v", w.id, err)
+			break
+		}
+
+		bySymbol := make(map[string]DecompiledResult, len(repaired))
+		for _, r := range repaired {
+			bySymbol[r.SymbolName] = r
+		}
+		var still []int
+		for _, i := range failing {
+			r, ok := bySymbol[results[i].SymbolName]
+			if !ok || !r.Success {
+				still = append(still, i)
+				continue
+			}
+			results[i].DecompiledSource = r.DecompiledSource
+			if r.Summary != "" {
+				results[i].Summary = r.Summary
+			}
+			if !w.check(ctx, v, &results[i], ValidationRepaired) {
+				still = append(still, i)
+			}
+		}
+		failing = still
+	}
+
+	for _, i := range failing {
+		if v.AcceptInvalid {
+			results[i].Validation = ValidationInvalid
+			continue
+		}
+		results[i].Success = false
+		results[i].ErrorMessage = "syntax check failed: " + strings.ReplaceAll(results[i].ValidationErrors, "\n", "; ")
+	}
+	return results, nil
+}
+
+// check validates a result and records the outcome on it. It reports false if
+// the result has syntax errors. If the check itself fails the result is left
+// unvalidated.
+func (w *worker) check(ctx context.Context, v *Validator, result *DecompiledResult, status string) bool {
+	issues, err := v.Check(ctx, result.DecompiledSource)
+	if err != nil {
+		log.Printf("Worker %d: could not validate %s: %v", w.id, result.SymbolName, err)
+		result.Validation, result.ValidationErrors = "", ""
+		return true
+	}
+	result.ValidationErrors = issuesText(issues)
+	if len(issues) > 0 {
+		return false
+	}
+	result.Validation = status
+	return true
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -13,11 +14,25 @@ import (
 
 // AIRequest represents the JSON payload sent to the LiteLLM API.
 type AIRequest struct {
-	Model    string `json:"model"`
-	Messages []struct {
-		Role    string `json:"role"`
-		Content string `json:"content"`
-	} `json:"messages"`
+	Model    string        `json:"model"`
+	Messages []ChatMessage `json:"messages"`
+	Stream   bool          `json:"stream,omitempty"`
+	// StreamOptions asks for token usage at the end of a stream.
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+}
+
+// StreamOptions are the OpenAI-style options for streamed completions.
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// Usage is the number of tokens a model call consumed.
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	// Estimated is set when the provider didn't report usage and the counts
+	// were estimated from the text.
+	Estimated bool `json:"-"`
 }
 
 // AIResponse represents the expected JSON structure from the LiteLLM API.
@@ -27,27 +42,98 @@ type AIResponse struct {
 			Content string `json:"content"`
 		} `json:"message"`
 	} `json:"choices"`
+	Usage *Usage `json:"usage"`
 }
 
 // DecompiledResult represents the inner JSON content within the AI response.
 type DecompiledResult struct {
 	SymbolName       string `json:"symbol_name"`
 	DecompiledSource string `json:"decompiled_source"`
+	Summary          string `json:"summary,omitempty"`
 	Success          bool   `json:"success"`
 	ErrorMessage     string `json:"error_message"`
+
+	// Validation and ValidationErrors are set by the syntax check, not the model.
+	Validation       string `json:"-"`
+	ValidationErrors string `json:"-"`
+}
+
+// WorkerConfig holds the settings shared by every worker in the pool.
+type WorkerConfig struct {
+	LiteLLMURL string
+	// Models is the fallback chain; each batch goes to the model for its tier.
+	Models     ModelChain
+	BatchSize  int
+	MaxRetries int
+	// MinQuality is the quality score below which a successful result is
+	// escalated to the next model instead of being accepted.
+	MinQuality float64
+	// MinFidelity is the fidelity score below which a successful result is
+	// escalated, or retried on the same model once the chain is exhausted.
+	MinFidelity float64
+	// Limiter is shared by all workers so the pool as a whole respects the
+	// provider's limits. It may be nil.
+	Limiter *RateLimiter
+	// Breaker pauses the pool while the endpoint is unreachable. When nil,
+	// transport errors are charged to task retries like any other failure.
+	Breaker *CircuitBreaker
+	// Ensemble, when set, sends matching classes to several models at once.
+	Ensemble *EnsembleConfig
+	// Prompts supplies the templates for each model. When nil the built-in
+	// templates are used.
+	Prompts *PromptLibrary
+	// Validator syntax-checks results and drives repair prompts. When nil
+	// results are stored unchecked.
+	Validator *Validator
+	// Stream requests server-sent events so batch results are stored as each
+	// method's JSON object completes.
+	Stream bool
+	// StreamIdleTimeout aborts a streamed response when no data arrives for
+	// this long. It replaces the fixed timeout of non-streamed requests.
+	StreamIdleTimeout time.Duration
+	// Prices turns token usage into cost. Models without a price, or all
+	// models when nil, are counted as free.
+	Prices PriceTable
+	// Budget stops the pool once the run has spent it. It may be nil.
+	Budget *Budget
+	// RunID is the run that token usage is recorded under.
+	RunID int64
+	// Transport carries the requests to LiteLLM, e.g. a *Cassette. When nil
+	// http.DefaultTransport is used.
+	Transport http.RoundTripper
+}
+
+// errRequeue reports that a request was refused because of backpressure, an
+// unreachable endpoint or shutdown. It says nothing about the tasks, which the
+// caller hands back to the queue with requeue.
+var errRequeue = errors.New("request refused, batch goes back to the queue")
+
+// worker holds the state of a single worker goroutine.
+type worker struct {
+	id    int
+	store *TaskStore
+	cfg   WorkerConfig
+	// symbols caches the annotation symbol table of each image.
+	symbols map[string]*ImageSymbols
+	// classes caches class metadata by image and name; nil entries mark classes
+	// without metadata.
+	classes map[classKey]*ClassInfo
+	// unpriced remembers the models already reported as missing a price.
+	unpriced map[string]bool
 }
 
 // DecompileWorker is the main function for a worker goroutine.
 // It fetches tasks, sends them to the AI for decompilation, and updates the database.
-func DecompileWorker(
-	ctx context.Context,
-	workerID int,
-	store *TaskStore,
-	litellmURL string,
-	model string,
-	batchSize int,
-	maxRetries int,
-) {
+func DecompileWorker(ctx context.Context, workerID int, store *TaskStore, cfg WorkerConfig) {
+	w := &worker{
+		id:       workerID,
+		store:    store,
+		cfg:      cfg,
+		symbols:  make(map[string]*ImageSymbols),
+		classes:  make(map[classKey]*ClassInfo),
+		unpriced: make(map[string]bool),
+	}
+
 	log.Printf("Worker %d started", workerID)
 	defer log.Printf("Worker %d finished", workerID)
 
@@ -57,9 +143,23 @@ func DecompileWorker(
 			log.Printf("Worker %d received shutdown signal", workerID)
 			return
 		default:
-			tasks, err := store.FetchPendingBatch(ctx, batchSize)
+			if cfg.Budget.Exhausted() {
+				log.Printf("Worker %d: budget exhausted ($%.4f spent), stopping", workerID, cfg.Budget.Spent())
+				return
+			}
+			// Don't claim anything while the endpoint is known to be down.
+			probe, err := cfg.Breaker.Wait(ctx)
+			if err != nil {
+				log.Printf("Worker %d received shutdown signal", workerID)
+				return
+			}
+
+			tasks, err := store.FetchPendingBatch(ctx, cfg.BatchSize)
 			if err != nil {
 				log.Printf("Worker %d: error fetching batch: %v", workerID, err)
+				if probe {
+					cfg.Breaker.CancelProbe()
+				}
 				time.Sleep(5 * time.Second) // Wait before retrying
 				continue
 			}
@@ -67,144 +167,459 @@ func DecompileWorker(
 			if len(tasks) == 0 {
 				// No more tasks, worker can exit.
 				log.Printf("Worker %d: no more tasks to process.", workerID)
+				if probe {
+					cfg.Breaker.CancelProbe()
+				}
 				return
 			}
 
-			log.Printf("Worker %d: processing batch of %d tasks", workerID, len(tasks))
-
-			prompt, err := formatPrompt(tasks)
-			if err != nil {
-				log.Printf("Worker %d: failed to format prompt: %v", workerID, err)
-				// Mark all tasks in this batch as failed
-				for _, task := range tasks {
-					_ = store.UpdateTaskFailure(ctx, task.ID, "Failed to format prompt", task.Retries+1)
+			if tasks[0].Unit != "" {
+				// Units are always decompiled by a single model.
+				w.processUnit(ctx, tasks)
+			} else {
+				ensembleTasks, regularTasks := cfg.Ensemble.partition(tasks)
+				if len(regularTasks) > 0 {
+					w.processBatch(ctx, regularTasks)
 				}
-				continue
-			}
-
-			results, err := callLiteLLM(ctx, litellmURL, model, prompt)
-			if err != nil {
-				log.Printf("Worker %d: AI call failed: %v. Marking batch as failed.", workerID, err)
-				for _, task := range tasks {
-					if task.Retries < maxRetries {
-						_ = store.UpdateTaskFailure(ctx, task.ID, err.Error(), task.Retries+1)
-					} else {
-						_ = store.UpdateTaskFailure(ctx, task.ID, "Max retries exceeded", task.Retries)
-					}
+				if len(ensembleTasks) > 0 {
+					w.processEnsemble(ctx, ensembleTasks)
 				}
-				continue
 			}
 
-			// Create a map for quick lookup of tasks by symbol name
-			taskMap := make(map[string]*Task)
-			for _, task := range tasks {
-				taskMap[task.SymbolName] = task
+			// A probe that never reached the endpoint (e.g. the prompt could not
+			// be built) gives its slot to the next worker.
+			if probe {
+				cfg.Breaker.CancelProbe()
 			}
+		}
+	}
+}
 
-			// Process results and update database
-			for _, result := range results {
-				task, ok := taskMap[result.SymbolName]
-				if !ok {
-					log.Printf("Worker %d: received result for unknown symbol: %s", workerID, result.SymbolName)
-					continue
-				}
+// processBatch decompiles a batch with the model for its tier.
+func (w *worker) processBatch(ctx context.Context, tasks []*Task) {
+	model := w.cfg.Models.Model(tasks[0].ModelTier)
+	log.Printf("Worker %d: processing batch of %d tasks with %s", w.id, len(tasks), model)
+
+	messages, promptVersion, err := w.renderPrompt(ctx, model, tasks)
+	if err != nil {
+		log.Printf("Worker %d: failed to format prompt: %v", w.id, err)
+		// Mark all tasks in this batch as failed
+		for _, task := range tasks {
+			_ = w.store.UpdateTaskFailure(ctx, task.ID, "Failed to format prompt", task.Retries+1)
+		}
+		return
+	}
+
+	if w.cfg.Stream {
+		w.processStream(ctx, tasks, model, promptVersion, messages)
+		return
+	}
+
+	content, err := w.send(ctx, tasks, model, messages)
+	var results []DecompiledResult
+	if err == nil {
+		results, err = decodeResults(content)
+	}
+	if err == nil {
+		results, err = w.verify(ctx, tasks, model, messages, content, results)
+	}
+	if errors.Is(err, errRequeue) {
+		w.requeue(tasks)
+		return
+	}
+	if err != nil {
+		log.Printf("Worker %d: AI call failed: %v. Marking batch as failed.", w.id, err)
+		w.failBatch(ctx, tasks, model, err)
+		return
+	}
+
+	// Create a map for quick lookup of tasks by symbol name
+	taskMap := make(map[string]*Task)
+	for _, task := range tasks {
+		taskMap[task.SymbolName] = task
+	}
 
-				if result.Success {
-					err = store.UpdateTaskSuccess(ctx, task.ID, result.DecompiledSource)
-					if err != nil {
-						log.Printf("Worker %d: failed to update task %d as success: %v", workerID, task.ID, err)
-					}
-				} else {
-					log.Printf("Worker %d: AI failed to decompile symbol %s: %s", workerID, result.SymbolName, result.ErrorMessage)
-					err = store.UpdateTaskFailure(ctx, task.ID, result.ErrorMessage, task.Retries) // Not a retryable failure from our side
-					if err != nil {
-						log.Printf("Worker %d: failed to update task %d as failed: %v", workerID, task.ID, err)
-					}
+	// Process results and update database
+	for _, result := range results {
+		task, ok := taskMap[result.SymbolName]
+		if !ok {
+			log.Printf("Worker %d: received result for unknown symbol: %s", w.id, result.SymbolName)
+			continue
+		}
+		w.handleResult(ctx, task, model, promptVersion, result)
+	}
+}
+
+// handleResult stores the model's result for a task, escalating failures and
+// low quality or low fidelity output while a stronger model is available.
+func (w *worker) handleResult(ctx context.Context, task *Task, model, promptVersion string, result DecompiledResult) {
+	if result.Success {
+		if score := qualityScore(result.DecompiledSource); score < w.cfg.MinQuality && w.canEscalate(task) {
+			w.escalate(ctx, task, fmt.Sprintf("%s: low quality output (score %.2f)", model, score))
+			return
+		}
+		fidelity, err := w.fidelity(ctx, task, result.DecompiledSource)
+		if err != nil {
+			log.Printf("Worker %d: could not check fidelity of %s: %v", w.id, task.SymbolName, err)
+		} else if fidelity != nil && fidelity.Score < w.cfg.MinFidelity {
+			reason := fmt.Sprintf("%s: low fidelity output (score %.2f, %s)", model, fidelity.Score, fidelity)
+			if w.canEscalate(task) {
+				w.escalate(ctx, task, reason)
+				return
+			}
+			if task.Retries < w.cfg.MaxRetries {
+				log.Printf("Worker %d: retrying %s (%s)", w.id, task.SymbolName, reason)
+				if err := w.store.RetryTask(ctx, task.ID, task.Retries+1, reason); err != nil {
+					log.Printf("Worker %d: failed to retry task %d: %v", w.id, task.ID, err)
 				}
+				return
 			}
+			log.Printf("Worker %d: accepting %s after %d retries despite %s", w.id, task.SymbolName, task.Retries, reason)
+		}
+		err = w.store.UpdateTaskSuccess(ctx, task.ID, result.DecompiledSource, ResultInfo{
+			Model:            model,
+			PromptVersion:    promptVersion,
+			Summary:          result.Summary,
+			Validation:       result.Validation,
+			ValidationErrors: result.ValidationErrors,
+			Fidelity:         fidelity,
+		})
+		if err != nil {
+			log.Printf("Worker %d: failed to update task %d as success: %v", w.id, task.ID, err)
+		}
+	} else if w.canEscalate(task) {
+		w.escalate(ctx, task, fmt.Sprintf("%s: %s", model, result.ErrorMessage))
+	} else {
+		log.Printf("Worker %d: AI failed to decompile symbol %s: %s", w.id, result.SymbolName, result.ErrorMessage)
+		err := w.store.UpdateTaskFailure(ctx, task.ID, result.ErrorMessage, task.Retries) // Not a retryable failure from our side
+		if err != nil {
+			log.Printf("Worker %d: failed to update task %d as failed: %v", w.id, task.ID, err)
+		}
+	}
+}
+
+// fidelity compares a result with the references in the task's assembly. It
+// returns nil if the assembly has no references to compare with.
+func (w *worker) fidelity(ctx context.Context, task *Task, source string) (*Fidelity, error) {
+	analysis, err := w.analyze(ctx, task)
+	if err != nil {
+		return nil, err
+	}
+	f, ok := CheckFidelity(analysis, source)
+	if !ok {
+		return nil, nil
+	}
+	return &f, nil
+}
+
+// send calls the model through the shared rate limiter and circuit breaker
+// and returns the reply's content. When the provider pushes back or cannot be
+// reached errRequeue is returned. tasks are charged for the tokens used.
+func (w *worker) send(ctx context.Context, tasks []*Task, model string, messages []ChatMessage) (string, error) {
+	return w.sendStream(ctx, tasks, model, messages, nil)
+}
+
+// sendStream is send with the pieces of a streamed reply passed to onDelta as
+// they arrive. Without WorkerConfig.Stream the reply is passed in one piece.
+func (w *worker) sendStream(ctx context.Context, tasks []*Task, model string, messages []ChatMessage, onDelta func(string)) (string, error) {
+	release, err := w.cfg.Limiter.Acquire(ctx, estimateTokens(messagesText(messages)))
+	if err != nil {
+		// Shutting down while waiting for capacity; hand the batch back untouched.
+		return "", errRequeue
+	}
+	var content string
+	var usage Usage
+	if w.cfg.Stream {
+		content, usage, err = callChatStream(ctx, w.cfg.Transport, w.cfg.LiteLLMURL, model, messages, w.cfg.Limiter, w.cfg.StreamIdleTimeout, onDelta)
+	} else if content, usage, err = callChat(ctx, w.cfg.Transport, w.cfg.LiteLLMURL, model, messages, w.cfg.Limiter); err == nil && onDelta != nil {
+		onDelta(content)
+	}
+	release()
+	if err == nil {
+		w.recordUsage(tasks, model, usage)
+	}
+	if err != nil && ctx.Err() != nil {
+		// Shutting down mid-request; the batch goes back untouched.
+		return "", errRequeue
+	}
+
+	var transportErr *TransportError
+	if errors.As(err, &transportErr) && w.cfg.Breaker != nil {
+		// The endpoint is unreachable, which says nothing about these
+		// tasks, so they go back to the queue without using a retry.
+		log.Printf("Worker %d: endpoint unreachable: %v", w.id, err)
+		w.cfg.Breaker.RecordFailure()
+		return "", errRequeue
+	}
+	if ctx.Err() == nil {
+		w.cfg.Breaker.RecordSuccess()
+	}
+
+	var backpressure *BackpressureError
+	if errors.As(err, &backpressure) {
+		log.Printf("Worker %d: provider returned %d, backing off for %s", w.id, backpressure.StatusCode, backpressure.RetryAfter)
+		w.cfg.Limiter.Pause(backpressure.RetryAfter)
+		if w.cfg.Limiter == nil {
+			time.Sleep(backpressure.RetryAfter)
 		}
+		return "", errRequeue
 	}
+	return content, err
 }
 
-// formatPrompt creates the JSON prompt for the AI model from a batch of tasks.
-func formatPrompt(tasks []*Task) (string, error) {
-	var prompt string
-	prompt += "Please decompile the following Objective-C methods. Return a JSON array where each object has 'symbol_name', 'decompiled_source', 'success', and 'error_message' fields.\n\n"
+// renderPrompt builds the messages for a batch using the model's templates and
+// returns them with the template version. Each method is shown with the
+// summaries of its already decompiled callees.
+func (w *worker) renderPrompt(ctx context.Context, model string, tasks []*Task) ([]ChatMessage, string, error) {
+	set, err := w.cfg.Prompts.ForModel(model)
+	if err != nil {
+		return nil, "", err
+	}
+	classes, err := w.batchClasses(ctx, tasks)
+	if err != nil {
+		return nil, "", err
+	}
+	annotated, err := w.annotateTasks(ctx, tasks)
+	if err != nil {
+		return nil, "", err
+	}
+	callees, err := w.store.GetCalleeSummaries(ctx, taskIDs(tasks))
+	if err != nil {
+		return nil, "", err
+	}
+	var messages []ChatMessage
+	if unit := tasks[0].Unit; unit != "" {
+		messages, err = set.RenderUnit(unit, annotated, classes, callees)
+	} else {
+		messages, err = set.Render(annotated, classes, callees)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return messages, set.Version, nil
+}
 
-	type Method struct {
-		SymbolName   string `json:"symbol_name"`
-		AssemblyCode string `json:"assembly_code"`
+// batchClasses loads the runtime metadata of every class with a method in the
+// batch. Classes the scanner recorded nothing for are skipped.
+func (w *worker) batchClasses(ctx context.Context, tasks []*Task) ([]*ClassInfo, error) {
+	var classes []*ClassInfo
+	seen := make(map[classKey]bool)
+	for _, task := range tasks {
+		key := taskClass(task)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		class, err := w.class(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if class != nil {
+			classes = append(classes, class)
+		}
 	}
+	return classes, nil
+}
 
-	methods := make([]Method, len(tasks))
+// annotateTasks returns copies of the tasks whose assembly carries inline
+// comments for resolved selectors, classes, strings and ivars.
+func (w *worker) annotateTasks(ctx context.Context, tasks []*Task) ([]*Task, error) {
+	annotated := make([]*Task, len(tasks))
 	for i, task := range tasks {
-		methods[i] = Method{
-			SymbolName:   task.SymbolName,
-			AssemblyCode: task.AssemblyCode,
+		analysis, err := w.analyze(ctx, task)
+		if err != nil {
+			return nil, err
 		}
+		copied := *task
+		copied.AssemblyCode = analysis.Annotated()
+		annotated[i] = &copied
+	}
+	return annotated, nil
+}
+
+// analyze runs the static pass over a task's assembly.
+func (w *worker) analyze(ctx context.Context, task *Task) (*AsmAnalysis, error) {
+	syms, err := w.imageSymbols(ctx, task.Image)
+	if err != nil {
+		return nil, err
 	}
+	class, err := w.class(ctx, taskClass(task))
+	if err != nil {
+		return nil, err
+	}
+	sym, _ := ParseSymbol(task.SymbolName)
+	return AnalyzeAssembly(task.AssemblyCode, syms, class, sym.ClassMethod), nil
+}
 
-	jsonData, err := json.MarshalIndent(methods, "", "  ")
+// class returns the metadata of a class, loading it on first use. It returns
+// nil for classes the scanner recorded nothing for.
+func (w *worker) class(ctx context.Context, key classKey) (*ClassInfo, error) {
+	if class, ok := w.classes[key]; ok {
+		return class, nil
+	}
+	class, err := w.store.GetClass(ctx, key.image, key.name)
 	if err != nil {
-		return "", fmt.Errorf("failed to marshal tasks to JSON: %w", err)
+		return nil, err
+	}
+	w.classes[key] = class
+	return class, nil
+}
+
+// imageSymbols returns the symbol table of an image, loading it on first use.
+func (w *worker) imageSymbols(ctx context.Context, image string) (*ImageSymbols, error) {
+	if syms, ok := w.symbols[image]; ok {
+		return syms, nil
+	}
+	syms, err := w.store.GetImageSymbols(ctx, image)
+	if err != nil {
+		return nil, err
+	}
+	w.symbols[image] = syms
+	return syms, nil
+}
+
+// failBatch records a failed AI call for every task in the batch, escalating
+// tasks that still have a stronger model available.
+func (w *worker) failBatch(ctx context.Context, tasks []*Task, model string, err error) {
+	for _, task := range tasks {
+		if w.canEscalate(task) {
+			w.escalate(ctx, task, fmt.Sprintf("%s: %v", model, err))
+		} else if task.Retries < w.cfg.MaxRetries {
+			_ = w.store.UpdateTaskFailure(ctx, task.ID, err.Error(), task.Retries+1)
+		} else {
+			_ = w.store.UpdateTaskFailure(ctx, task.ID, "Max retries exceeded", task.Retries)
+		}
+	}
+}
+
+// requeue hands tasks back to the queue without using a retry, after a
+// request for them returned errRequeue. Tasks already finished stay as they are.
+func (w *worker) requeue(tasks []*Task) {
+	if err := w.store.ReleaseTasks(context.Background(), taskIDs(tasks)); err != nil {
+		log.Printf("Worker %d: failed to release batch: %v", w.id, err)
+	}
+}
+
+// canEscalate reports whether a task can move on to a stronger model.
+// Ensemble tasks are sent to every ensemble model whatever their tier, so
+// they are retried or accepted instead.
+func (w *worker) canEscalate(task *Task) bool {
+	return w.cfg.Models.CanEscalate(task.ModelTier) && !w.cfg.Ensemble.includes(task)
+}
+
+// escalate sends a task back to the queue for the next model in the chain.
+func (w *worker) escalate(ctx context.Context, task *Task, reason string) {
+	next := task.ModelTier + 1
+	log.Printf("Worker %d: escalating %s to %s (%s)", w.id, task.SymbolName, w.cfg.Models.Model(next), reason)
+	if err := w.store.EscalateTask(ctx, task.ID, next, reason); err != nil {
+		log.Printf("Worker %d: failed to escalate task %d: %v", w.id, task.ID, err)
 	}
+}
 
-	prompt += string(jsonData)
-	return prompt, nil
+// taskIDs returns the IDs of the given tasks in order.
+func taskIDs(tasks []*Task) []int64 {
+	ids := make([]int64, len(tasks))
+	for i, task := range tasks {
+		ids[i] = task.ID
+	}
+	return ids
 }
 
-// callLiteLLM sends a request to the LiteLLM API and returns the parsed response.
-func callLiteLLM(ctx context.Context, apiURL, model, prompt string) ([]DecompiledResult, error) {
+// decodeResults parses the per-method results of a batch from the model's reply.
+func decodeResults(content string) ([]DecompiledResult, error) {
+	// The actual content is a JSON string within the response, so it needs to be unmarshalled again.
+	var results []DecompiledResult
+	if err := json.Unmarshal([]byte(content), &results); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal nested JSON from AI content: %w", err)
+	}
+
+	return results, nil
+}
+
+// callChat sends a chat completion request and returns the content of the
+// first choice with the tokens it used. The request goes through transport,
+// or http.DefaultTransport if it is nil. Rate limit headers are reported to limiter,
+// 429/503 responses are returned as a *BackpressureError and an unreachable
+// endpoint as a *TransportError.
+func callChat(ctx context.Context, transport http.RoundTripper, apiURL, model string, messages []ChatMessage, limiter *RateLimiter) (string, Usage, error) {
 	requestPayload := AIRequest{
-		Model: model,
-		Messages: []struct {
-			Role    string `json:"role"`
-			Content string `json:"content"`
-		}{
-			{
-				Role:    "user",
-				Content: prompt,
-			},
-		},
+		Model:    model,
+		Messages: messages,
 	}
 
 	jsonData, err := json.Marshal(requestPayload)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal request payload: %w", err)
+		return "", Usage{}, fmt.Errorf("failed to marshal request payload: %w", err)
 	}
 
 	req, err := http.NewRequestWithContext(ctx, "POST", apiURL, bytes.NewBuffer(jsonData))
 	if err != nil {
-		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+		return "", Usage{}, fmt.Errorf("failed to create HTTP request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{Timeout: 5 * time.Minute}
+	client := &http.Client{Transport: transport, Timeout: 5 * time.Minute}
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to send request to LiteLLM: %w", err)
+		if ctx.Err() != nil {
+			return "", Usage{}, fmt.Errorf("request to LiteLLM cancelled: %w", ctx.Err())
+		}
+		return "", Usage{}, &TransportError{Err: fmt.Errorf("failed to send request to LiteLLM: %w", err)}
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("LiteLLM API returned non-200 status: %s, body: %s", resp.Status, string(body))
+	limiter.Observe(resp.Header)
+	if err := responseError(resp); err != nil {
+		return "", Usage{}, err
 	}
 
 	var aiResponse AIResponse
 	if err := json.NewDecoder(resp.Body).Decode(&aiResponse); err != nil {
-		return nil, fmt.Errorf("failed to decode AI response: %w", err)
+		return "", Usage{}, fmt.Errorf("failed to decode AI response: %w", err)
 	}
 
 	if len(aiResponse.Choices) == 0 {
-		return nil, fmt.Errorf("no choices returned from AI")
+		return "", Usage{}, fmt.Errorf("no choices returned from AI")
 	}
 
-	// The actual content is a JSON string within the response, so it needs to be unmarshalled again.
-	var results []DecompiledResult
-	if err := json.Unmarshal([]byte(aiResponse.Choices[0].Message.Content), &results); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal nested JSON from AI content: %w", err)
+	content := aiResponse.Choices[0].Message.Content
+	return content, responseUsage(aiResponse.Usage, messages, content), nil
+}
+
+// responseUsage returns the usage the provider reported or, if it reported
+// none, an estimate from the length of the prompt and the reply.
+func responseUsage(reported *Usage, messages []ChatMessage, content string) Usage {
+	if reported != nil && reported.PromptTokens+reported.CompletionTokens > 0 {
+		return Usage{PromptTokens: reported.PromptTokens, CompletionTokens: reported.CompletionTokens}
 	}
+	return Usage{
+		PromptTokens:     countTokens(messagesText(messages)),
+		CompletionTokens: countTokens(content),
+		Estimated:        true,
+	}
+}
 
-	return results, nil
-}
\ No newline at end of file
+// responseError turns a non-200 response into an error: 429/503 into a
+// *BackpressureError, 502/504 into a *TransportError.
+func responseError(resp *http.Response) error {
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		body, _ := io.ReadAll(resp.Body)
+		return &BackpressureError{
+			StatusCode: resp.StatusCode,
+			RetryAfter: retryAfter(resp.Header),
+			Body:       string(body),
+		}
+	}
+
+	if resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusGatewayTimeout {
+		// The proxy is up but cannot reach the model provider behind it.
+		body, _ := io.ReadAll(resp.Body)
+		return &TransportError{Err: fmt.Errorf("LiteLLM could not reach the provider: %s, body: %s", resp.Status, string(body))}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("LiteLLM API returned non-200 status: %s, body: %s", resp.Status, string(body))
+	}
+	return nil
+}
@@ -0,0 +1,516 @@
+package decompile
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeLiteLLM serves chat completions from a list of canned replies, one per
+// request, and records the requests it received. Each reply reports usage
+// when it is set. The first refuse requests are answered with a 429.
+type fakeLiteLLM struct {
+	mu       sync.Mutex
+	replies  []string
+	usage    *Usage
+	refuse   int
+	requests []AIRequest
+}
+
+func (f *fakeLiteLLM) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req AIRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	f.requests = append(f.requests, req)
+	if f.refuse > 0 {
+		f.refuse--
+		f.mu.Unlock()
+		w.Header().Set("Retry-After-Ms", "1")
+		http.Error(w, "slow down", http.StatusTooManyRequests)
+		return
+	}
+	if len(f.replies) == 0 {
+		f.mu.Unlock()
+		http.Error(w, "no more replies", http.StatusInternalServerError)
+		return
+	}
+	reply := f.replies[0]
+	f.replies = f.replies[1:]
+	f.mu.Unlock()
+
+	var resp AIResponse
+	resp.Choices = make([]struct {
+		Message struct {
+			Content string `json:"content"`
+		} `json:"message"`
+	}, 1)
+	resp.Choices[0].Message.Content = reply
+	resp.Usage = f.usage
+	json.NewEncoder(w).Encode(resp)
+}
+
+func resultsJSON(t *testing.T, results ...DecompiledResult) string {
+	t.Helper()
+	data, err := json.Marshal(results)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestDecompileWorker_RepairsInvalidOutput(t *testing.T) {
+	store := setupTestDB(t)
+	defer store.Close()
+
+	ctx := context.Background()
+	if err := store.AddTasks(ctx, []*Task{{ClassName: "A", SymbolName: "-[A foo]", AssemblyCode: "ret"}}); err != nil {
+		t.Fatalf("failed to add tasks: %v", err)
+	}
+
+	broken := "- (void)foo {\n    [self bar:(1];\n}"
+	fixed := "- (void)foo {\n    [self bar:1];\n}"
+	fake := &fakeLiteLLM{replies: []string{
+		resultsJSON(t, DecompiledResult{SymbolName: "-[A foo]", DecompiledSource: broken, Success: true}),
+		resultsJSON(t, DecompiledResult{SymbolName: "-[A foo]", DecompiledSource: fixed, Summary: "Calls bar:.", Success: true}),
+	}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	validator, err := NewValidator(ValidateBuiltin, 2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	DecompileWorker(ctx, 0, store, WorkerConfig{
+		LiteLLMURL: server.URL,
+		Models:     ModelChain{"test-model"},
+		BatchSize:  10,
+		MaxRetries: 1,
+		Validator:  validator,
+	})
+
+	if len(fake.requests) != 2 {
+		t.Fatalf("expected the answer and one repair round, got %d requests", len(fake.requests))
+	}
+	repair := fake.requests[1].Messages
+	if last := repair[len(repair)-1].Content; !strings.Contains(last, "closes '('") {
+		t.Errorf("repair prompt lacks the diagnostics: %q", last)
+	}
+
+	tasks, err := store.GetAllCompletedTasks()
+	if err != nil {
+		t.Fatalf("get completed tasks failed: %v", err)
+	}
+	if len(tasks) != 1 {
+		t.Fatalf("expected the task to complete, got %d completed tasks", len(tasks))
+	}
+	if tasks[0].DecompiledSource.String != fixed || tasks[0].Validation.String != ValidationRepaired {
+		t.Errorf("got source %q with validation %q, want the repaired source", tasks[0].DecompiledSource.String, tasks[0].Validation.String)
+	}
+}
+
+func TestDecompileWorker_RepairStopsAtBudget(t *testing.T) {
+	store := setupTestDB(t)
+	defer store.Close()
+
+	ctx := context.Background()
+	if err := store.AddTasks(ctx, []*Task{{ClassName: "A", SymbolName: "-[A foo]", AssemblyCode: "ret"}}); err != nil {
+		t.Fatalf("failed to add tasks: %v", err)
+	}
+
+	broken := "- (void)foo {\n    [self bar:(1];\n}"
+	fake := &fakeLiteLLM{
+		replies: []string{resultsJSON(t, DecompiledResult{SymbolName: "-[A foo]", DecompiledSource: broken, Success: true})},
+		usage:   &Usage{PromptTokens: 1000, CompletionTokens: 500},
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	validator, err := NewValidator(ValidateBuiltin, 2, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	DecompileWorker(ctx, 0, store, WorkerConfig{
+		LiteLLMURL: server.URL,
+		Models:     ModelChain{"test-model"},
+		BatchSize:  10,
+		MaxRetries: 1,
+		Validator:  validator,
+		Prices:     PriceTable{"test-model": {Prompt: 1000, Completion: 2000}},
+		Budget:     NewBudget(1),
+	})
+
+	if len(fake.requests) != 1 {
+		t.Fatalf("expected no repair once the budget is spent, got %d requests", len(fake.requests))
+	}
+	tasks, err := store.GetAllCompletedTasks()
+	if err != nil {
+		t.Fatalf("get completed tasks failed: %v", err)
+	}
+	if len(tasks) != 1 || tasks[0].Validation.String != ValidationInvalid {
+		t.Fatalf("expected the task to be accepted as invalid, got %+v", tasks)
+	}
+}
+
+func TestDecompileWorker_EnsembleVerifiesCandidates(t *testing.T) {
+	store := setupTestDB(t)
+	defer store.Close()
+
+	ctx := context.Background()
+	if err := store.AddTasks(ctx, []*Task{{ClassName: "A", SymbolName: "-[A foo]", AssemblyCode: "ret"}}); err != nil {
+		t.Fatalf("failed to add tasks: %v", err)
+	}
+
+	broken := "- (void)foo {\n    [self bar:(1];\n}"
+	fixed := "- (void)foo {\n    [self bar:1];\n}"
+	fake := &fakeLiteLLM{replies: []string{
+		// model-a answers with a syntax error, then repairs it.
+		resultsJSON(t, DecompiledResult{SymbolName: "-[A foo]", DecompiledSource: broken, Success: true}),
+		resultsJSON(t, DecompiledResult{SymbolName: "-[A foo]", DecompiledSource: fixed, Success: true}),
+		// model-b never gets it right.
+		resultsJSON(t, DecompiledResult{SymbolName: "-[A foo]", DecompiledSource: broken, Success: true}),
+		resultsJSON(t, DecompiledResult{SymbolName: "-[A foo]", DecompiledSource: broken, Success: true}),
+	}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	validator, err := NewValidator(ValidateBuiltin, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ensemble, err := ParseEnsembleConfig("model-a,model-b", EnsembleConsensus, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	DecompileWorker(ctx, 0, store, WorkerConfig{
+		LiteLLMURL: server.URL,
+		Models:     ModelChain{"test-model"},
+		BatchSize:  10,
+		MaxRetries: 1,
+		Validator:  validator,
+		Ensemble:   ensemble,
+	})
+
+	if len(fake.requests) != 4 {
+		t.Fatalf("expected an answer and a repair round per model, got %d requests", len(fake.requests))
+	}
+	tasks, err := store.GetAllCompletedTasks()
+	if err != nil {
+		t.Fatalf("get completed tasks failed: %v", err)
+	}
+	if len(tasks) != 1 {
+		t.Fatalf("expected the task to complete, got %d completed tasks", len(tasks))
+	}
+	if got := tasks[0]; got.DecompiledSource.String != fixed || got.Validation.String != ValidationRepaired || got.Model.String != "model-a" {
+		t.Errorf("got source %q from %q with validation %q, want model-a's repaired source",
+			got.DecompiledSource.String, got.Model.String, got.Validation.String)
+	}
+	cands, err := store.GetCandidates(ctx, tasks[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cands) != 1 || !cands[0].Selected {
+		t.Errorf("got candidates %+v, want only model-a's, selected", cands)
+	}
+}
+
+func TestDecompileWorker_EnsembleKeepsCandidatesOnBackpressure(t *testing.T) {
+	store := setupTestDB(t)
+	defer store.Close()
+
+	ctx := context.Background()
+	if err := store.AddTasks(ctx, []*Task{
+		{ClassName: "A", SymbolName: "-[A foo]", AssemblyCode: "ret"},
+		{ClassName: "A", SymbolName: "-[A bar]", AssemblyCode: "ret"},
+	}); err != nil {
+		t.Fatalf("failed to add tasks: %v", err)
+	}
+
+	foo := DecompiledResult{SymbolName: "-[A foo]", DecompiledSource: "- (void)foo {\n}", Success: true}
+	bar := DecompiledResult{SymbolName: "-[A bar]", DecompiledSource: "- (void)bar {\n}", Success: true}
+	var mu sync.Mutex
+	var models []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req AIRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		models = append(models, req.Model)
+		n := len(models)
+		mu.Unlock()
+
+		var reply string
+		switch {
+		case n == 1:
+			// model-a only answers for foo.
+			reply = resultsJSON(t, foo)
+		case n == 2:
+			// model-b pushes back.
+			w.Header().Set("Retry-After-Ms", "1")
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+			return
+		case req.Model == "judge":
+			reply = `{"choice": 1, "reason": "closer"}`
+		default:
+			reply = resultsJSON(t, bar)
+		}
+		var resp AIResponse
+		resp.Choices = make([]struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		}, 1)
+		resp.Choices[0].Message.Content = reply
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer server.Close()
+
+	ensemble, err := ParseEnsembleConfig("model-a,model-b", EnsembleJudge, "judge", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	DecompileWorker(ctx, 0, store, WorkerConfig{
+		LiteLLMURL: server.URL,
+		Models:     ModelChain{"test-model"},
+		BatchSize:  10,
+		MaxRetries: 1,
+		Ensemble:   ensemble,
+		Breaker:    NewCircuitBreaker(3, time.Minute),
+	})
+
+	// foo keeps model-a's candidate; only bar is asked for again, and then judged.
+	if want := []string{"model-a", "model-b", "model-a", "model-b", "judge"}; !reflect.DeepEqual(models, want) {
+		t.Fatalf("requests went to %v, want %v", models, want)
+	}
+	tasks, err := store.GetAllCompletedTasks()
+	if err != nil {
+		t.Fatalf("get completed tasks failed: %v", err)
+	}
+	if len(tasks) != 2 {
+		t.Fatalf("expected both tasks to complete, got %d", len(tasks))
+	}
+	for _, task := range tasks {
+		want := "model-a"
+		if task.SymbolName == "-[A bar]" {
+			want = "model-b"
+		}
+		if task.Model.String != want {
+			t.Errorf("%s kept the candidate of %s, want %s", task.SymbolName, task.Model.String, want)
+		}
+	}
+}
+
+func TestDecompileWorker_EnsembleRetriesInsteadOfEscalating(t *testing.T) {
+	store := setupTestDB(t)
+	defer store.Close()
+
+	ctx := context.Background()
+	syms := NewImageSymbols()
+	syms.Selrefs[0x2008] = "start"
+	if err := store.AddImageSymbols(ctx, "img", syms); err != nil {
+		t.Fatal(err)
+	}
+	asm := "adrp x8, 0x2000\nldr x1, [x8, #0x8]\nbl _objc_msgSend"
+	if err := store.AddTasks(ctx, []*Task{{ClassName: "A", SymbolName: "-[A foo]", Image: "img", AssemblyCode: asm}}); err != nil {
+		t.Fatalf("failed to add tasks: %v", err)
+	}
+
+	// Every candidate sends the wrong message, scoring no fidelity.
+	wrong := resultsJSON(t, DecompiledResult{SymbolName: "-[A foo]", DecompiledSource: "- (void)foo {\n    [self stop];\n}", Success: true})
+	fake := &fakeLiteLLM{replies: []string{wrong, wrong, wrong, wrong}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	ensemble, err := ParseEnsembleConfig("model-a,model-b", EnsembleConsensus, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	DecompileWorker(ctx, 0, store, WorkerConfig{
+		LiteLLMURL:  server.URL,
+		Models:      ModelChain{"small", "big"},
+		BatchSize:   10,
+		MaxRetries:  1,
+		Ensemble:    ensemble,
+		MinFidelity: 0.5,
+	})
+
+	if len(fake.requests) != 4 {
+		t.Fatalf("expected both models to answer twice, got %d requests", len(fake.requests))
+	}
+	tasks, err := store.GetAllTasks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tasks[0]; got.Status != StatusCompleted || got.ModelTier != 0 || got.Retries != 1 {
+		t.Errorf("got status %s on tier %d after %d retries, want it accepted on tier 0 after a retry", got.Status, got.ModelTier, got.Retries)
+	}
+}
+
+func TestDecompileWorker_BackpressureRequeues(t *testing.T) {
+	store := setupTestDB(t)
+	defer store.Close()
+
+	ctx := context.Background()
+	if err := store.AddTasks(ctx, []*Task{{ClassName: "A", SymbolName: "-[A foo]", AssemblyCode: "ret"}}); err != nil {
+		t.Fatalf("failed to add tasks: %v", err)
+	}
+	fake := &fakeLiteLLM{refuse: 1, replies: []string{
+		resultsJSON(t, DecompiledResult{SymbolName: "-[A foo]", DecompiledSource: "- (void)foo {\n}", Success: true}),
+	}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	limiter := NewRateLimiter(RateLimitConfig{})
+	DecompileWorker(ctx, 0, store, WorkerConfig{
+		LiteLLMURL: server.URL,
+		Models:     ModelChain{"test-model"},
+		BatchSize:  10,
+		MaxRetries: 1,
+		Limiter:    limiter,
+	})
+
+	if len(fake.requests) != 2 {
+		t.Fatalf("expected the refused batch to be sent again, got %d requests", len(fake.requests))
+	}
+	if limiter.pausedUntil.IsZero() {
+		t.Error("the 429 did not pause the limiter")
+	}
+	tasks, err := store.GetAllTasks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tasks[0]; got.Status != StatusCompleted || got.Retries != 0 {
+		t.Errorf("got status %s after %d retries, want it completed without using a retry", got.Status, got.Retries)
+	}
+}
+
+func TestDecompileWorker_ShutdownRequeues(t *testing.T) {
+	store := setupTestDB(t)
+	defer store.Close()
+
+	if err := store.AddTasks(context.Background(), []*Task{{ClassName: "A", SymbolName: "-[A foo]", AssemblyCode: "ret"}}); err != nil {
+		t.Fatalf("failed to add tasks: %v", err)
+	}
+	// The worker is stopped while its request is in flight.
+	ctx, cancel := context.WithCancel(context.Background())
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		cancel()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	breaker := NewCircuitBreaker(1, time.Minute)
+	DecompileWorker(ctx, 0, store, WorkerConfig{
+		LiteLLMURL: server.URL,
+		Models:     ModelChain{"test-model", "big-model"},
+		BatchSize:  10,
+		MaxRetries: 1,
+		Breaker:    breaker,
+	})
+
+	if breaker.State() != BreakerClosed {
+		t.Error("the aborted request tripped the breaker")
+	}
+
+	tasks, err := store.GetAllTasks(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tasks[0]; got.Status != StatusPending || got.Retries != 0 || got.ModelTier != 0 {
+		t.Errorf("got status %s on tier %d after %d retries, want it pending and untouched", got.Status, got.ModelTier, got.Retries)
+	}
+}
+
+func TestDecompileWorker_BreakerRequeues(t *testing.T) {
+	store := setupTestDB(t)
+	defer store.Close()
+
+	ctx := context.Background()
+	if err := store.AddTasks(ctx, []*Task{{ClassName: "A", SymbolName: "-[A foo]", AssemblyCode: "ret"}}); err != nil {
+		t.Fatalf("failed to add tasks: %v", err)
+	}
+	fake := &fakeLiteLLM{replies: []string{
+		resultsJSON(t, DecompiledResult{SymbolName: "-[A foo]", DecompiledSource: "- (void)foo {\n}", Success: true}),
+	}}
+	// The proxy can't reach the provider at first.
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls++; calls == 1 {
+			http.Error(w, "upstream down", http.StatusBadGateway)
+			return
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	breaker := NewCircuitBreaker(1, 10*time.Millisecond)
+	DecompileWorker(ctx, 0, store, WorkerConfig{
+		LiteLLMURL: server.URL,
+		Models:     ModelChain{"test-model", "big-model"},
+		BatchSize:  10,
+		MaxRetries: 1,
+		Breaker:    breaker,
+	})
+
+	if calls != 2 {
+		t.Fatalf("expected the batch to be sent again once the breaker let a probe through, got %d requests", calls)
+	}
+	if breaker.State() != BreakerClosed {
+		t.Errorf("breaker is %s after the probe succeeded, want closed", breaker.State())
+	}
+	tasks, err := store.GetAllTasks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tasks[0]; got.Status != StatusCompleted || got.Retries != 0 || got.ModelTier != 0 {
+		t.Errorf("got status %s on tier %d after %d retries, want it completed on tier 0 without using a retry", got.Status, got.ModelTier, got.Retries)
+	}
+}
+
+func TestDecompileWorker_Escalates(t *testing.T) {
+	store := setupTestDB(t)
+	defer store.Close()
+
+	ctx := context.Background()
+	if err := store.AddTasks(ctx, []*Task{{ClassName: "A", SymbolName: "-[A foo]", AssemblyCode: "ret"}}); err != nil {
+		t.Fatalf("failed to add tasks: %v", err)
+	}
+	fake := &fakeLiteLLM{replies: []string{
+		resultsJSON(t, DecompiledResult{SymbolName: "-[A foo]", ErrorMessage: "too hard"}),
+		resultsJSON(t, DecompiledResult{SymbolName: "-[A foo]", DecompiledSource: "- (void)foo {\n}", Success: true}),
+	}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	DecompileWorker(ctx, 0, store, WorkerConfig{
+		LiteLLMURL: server.URL,
+		Models:     ModelChain{"small", "big"},
+		BatchSize:  10,
+		MaxRetries: 1,
+	})
+
+	var models []string
+	for _, req := range fake.requests {
+		models = append(models, req.Model)
+	}
+	if want := []string{"small", "big"}; !reflect.DeepEqual(models, want) {
+		t.Fatalf("requests went to %v, want %v", models, want)
+	}
+	tasks, err := store.GetAllTasks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tasks[0]; got.Status != StatusCompleted || got.ModelTier != 1 || got.Model.String != "big" || got.Retries != 0 {
+		t.Errorf("got status %s from %q on tier %d after %d retries, want it completed by big without using a retry",
+			got.Status, got.Model.String, got.ModelTier, got.Retries)
+	}
+}